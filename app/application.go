@@ -8,6 +8,7 @@ import (
 
 	"github.com/bygui86/go-k8s-probes/commons"
 	generalCfg "github.com/bygui86/go-k8s-probes/config"
+	"github.com/bygui86/go-k8s-probes/database"
 	"github.com/bygui86/go-k8s-probes/logging"
 	"github.com/bygui86/go-k8s-probes/monitoring"
 )
@@ -49,16 +50,72 @@ func New(generalCfg *generalCfg.Config) (*Application, error) {
 		return nil, dbErr
 	}
 
-	prodServer, prodErr := createProducts(dbInterface)
+	// the migrations are loaded once, not at every readiness probe
+	schemaVersions, versionsErr := database.GetSchemaVersions()
+	if versionsErr != nil {
+		return nil, versionsErr
+	}
+
+	dbReplicas, replicasErr := initDbReplicas(generalCfg.GetEnableTracing())
+	if replicasErr != nil {
+		return nil, replicasErr
+	}
+
+	repository, repoErr := initRepository(dbInterface, dbReplicas)
+	if repoErr != nil {
+		return nil, repoErr
+	}
+
+	productsCache := database.NewCachedRepository(repository)
+
+	dbListener := database.NewListener()
+	if dbListener != nil && productsCache != nil {
+		// changes made by the other instances
+		dbListener.Subscribe(database.ProductChangesChannel, productsCache.OnProductChange)
+	}
+
+	prodServer, prodErr := createProducts(repository, productsCache, dbInterface)
 	if prodErr != nil {
 		return nil, prodErr
 	}
 
+	grpcServer := createGrpc(repository, productsCache, prodServer)
+
+	relay, relayErr := createOutboxRelay(repository)
+	if relayErr != nil {
+		return nil, relayErr
+	}
+
+	if monitoringServer != nil {
+		collectors := prodServer.GetCollectors()
+		if relay != nil {
+			collectors = append(collectors, relay.GetCollectors()...)
+		}
+		if productsCache != nil {
+			collectors = append(collectors, productsCache)
+		}
+		if grpcServer != nil {
+			collectors = append(collectors, grpcServer.GetCollectors()...)
+		}
+		regErr := monitoringServer.RegisterCollectors(
+			append(collectors, database.NewStatsCollector(dbInterface))...)
+		if regErr != nil {
+			return nil, regErr
+		}
+	}
+
 	app.monitoringServer = monitoringServer
 	app.jaegerCloser = jaegerCloser
 	app.zipkinReporter = zipkinReporter
 	app.dbInterface = dbInterface
+	app.dbPool = dbInterface
+	app.schemaVersions = schemaVersions
+	app.dbReplicas = dbReplicas
+	app.productsCache = productsCache
+	app.dbListener = dbListener
 	app.productsServer = prodServer
+	app.grpcServer = grpcServer
+	app.outboxRelay = relay
 
 	kubeServer, kubeErr := createKubeProbes(app)
 	if kubeErr != nil {
@@ -82,6 +139,17 @@ func (a *Application) Start() error {
 		return err
 	}
 
+	if a.grpcServer != nil {
+		grpcErr := a.grpcServer.Start()
+		if grpcErr != nil {
+			return grpcErr
+		}
+	}
+
+	if a.outboxRelay != nil {
+		a.outboxRelay.Start()
+	}
+
 	if a.enableKubeProbes {
 		a.k8sProbesServer.Start()
 	}
@@ -114,10 +182,34 @@ func (a *Application) Shutdown(timeout time.Duration) {
 		}
 	}
 
+	// before the Products server, sharing its change feed
+	if a.grpcServer != nil {
+		a.grpcServer.Shutdown(timeout)
+	}
+
 	if a.productsServer != nil {
 		a.productsServer.Shutdown(timeout)
 	}
 
+	// after the Products server, not to leave behind the events of the last changes
+	if a.outboxRelay != nil {
+		a.outboxRelay.Shutdown()
+	}
+
+	if a.dbListener != nil {
+		err := a.dbListener.Close()
+		if err != nil {
+			logging.SugaredLog.Errorf("DB listener closing failed: %s", err.Error())
+		}
+	}
+
+	if a.dbReplicas != nil {
+		err := a.dbReplicas.Close()
+		if err != nil {
+			logging.SugaredLog.Errorf("DB replica set closing failed: %s", err.Error())
+		}
+	}
+
 	if a.dbInterface != nil {
 		err := a.dbInterface.Close()
 		if err != nil {
@@ -3,13 +3,17 @@ package app
 import (
 	"database/sql"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/openzipkin/zipkin-go/reporter"
 
+	"github.com/bygui86/go-k8s-probes/database"
 	"github.com/bygui86/go-k8s-probes/kubernetes"
 	"github.com/bygui86/go-k8s-probes/monitoring"
+	"github.com/bygui86/go-k8s-probes/outbox"
 	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc"
 )
 
 // Application implements kubernetes.Component
@@ -24,8 +28,19 @@ type Application struct {
 	jaegerCloser     io.Closer
 	zipkinReporter   reporter.Reporter
 	dbInterface      *sql.DB
+	dbPool           rest.PoolStats // dbInterface, unless faked
+	schemaVersions   []int64        // migrations embedded, all expected applied to the DB
+	dbReplicas       *database.ReplicaSet
+	productsCache    *database.CachedRepository // nil if disabled
+	dbListener       *database.Listener         // nil if disabled
 	productsServer   *rest.Server
+	grpcServer       *rpc.Server   // nil if disabled
+	outboxRelay      *outbox.Relay // nil if disabled
 	k8sProbesServer  *kubernetes.Server
+
+	// DB connection pool stats at previous health check, to spot callers waiting for a connection
+	lastDbStats      sql.DBStats
+	lastDbStatsMutex sync.Mutex
 }
 
 type config struct {
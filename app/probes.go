@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,14 +10,21 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 
 	"github.com/bygui86/go-k8s-probes/commons"
 	"github.com/bygui86/go-k8s-probes/database"
 	"github.com/bygui86/go-k8s-probes/kubernetes"
 	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
 	"github.com/bygui86/go-k8s-probes/time_measure"
 )
 
@@ -24,10 +32,14 @@ const (
 	headerAccept          = "Accept"
 	headerContentType     = "Content-Type"
 	headerApplicationJson = "application/json"
+	headerApiKey          = "X-API-Key"
 )
 
 var restClient *http.Client
 
+// errRequestRejected is returned for the requests refused on purpose, i.e. rate limited or shed while overloaded
+var errRequestRejected = errors.New("request rejected")
+
 func (a *Application) CheckStatus() map[string]*kubernetes.ComponentProbe {
 	logging.SugaredLog.Debugf("Check %s status", commons.ServiceName)
 
@@ -37,13 +49,28 @@ func (a *Application) CheckStatus() map[string]*kubernetes.ComponentProbe {
 		}
 	}
 
-	components := make(map[string]*kubernetes.ComponentProbe, 4)
+	components := make(map[string]*kubernetes.ComponentProbe, 9)
 	// required
 	components["db"] = a.checkDbStatus()
 	components["products"] = a.checkProductsStatus()
+	if a.grpcServer != nil {
+		components["grpc"] = a.checkGrpcStatus()
+	}
 	components["monitoring"] = a.checkMonitoringStatus()
+	if a.outboxRelay != nil {
+		components["outbox"] = a.checkOutboxStatus()
+	}
+	if sheddingStatus := a.productsServer.GetLoadSheddingStatus(); sheddingStatus != nil {
+		components["load-shedding"] = a.checkLoadSheddingStatus(sheddingStatus)
+	}
 	// not required
 	components["tracing"] = a.checkTracingStatus()
+	if a.dbReplicas != nil {
+		components["db-replicas"] = a.checkDbReplicasStatus()
+	}
+	if a.dbListener != nil {
+		components["db-listener"] = a.checkDbListenerStatus()
+	}
 
 	return components
 }
@@ -66,6 +93,15 @@ func (a *Application) checkDbStatus() *kubernetes.ComponentProbe {
 			status = kubernetes.ResponseStatusError
 			code = kubernetes.ResponseCodeError
 			msg = fmt.Sprintf("DB interface NOT HEALTHY: %s", err.Error())
+		} else if schemaErr := database.CheckSchemaVersions(a.dbInterface, a.schemaVersions, ctx); schemaErr != nil {
+			status = kubernetes.ResponseStatusError
+			code = kubernetes.ResponseCodeError
+			msg = fmt.Sprintf("DB schema NOT UP TO DATE: %s", schemaErr.Error())
+		} else if stats, saturated := a.checkDbPoolSaturation(); saturated {
+			status = kubernetes.ResponseStatusDegraded
+			code = kubernetes.ResponseCodeOk
+			msg = fmt.Sprintf("DB interface DEGRADED: connection pool saturated (in use %d/%d, wait count %d)",
+				stats.InUse, stats.MaxOpenConnections, stats.WaitCount)
 		} else {
 			status = kubernetes.ResponseStatusOk
 			code = kubernetes.ResponseCodeOk
@@ -90,6 +126,165 @@ func (a *Application) checkDbStatus() *kubernetes.ComponentProbe {
 	}
 }
 
+func (a *Application) checkDbPoolSaturation() (sql.DBStats, bool) {
+	a.lastDbStatsMutex.Lock()
+	defer a.lastDbStatsMutex.Unlock()
+
+	stats := a.dbPool.Stats()
+	saturated := database.IsPoolSaturated(stats, a.lastDbStats)
+	a.lastDbStats = stats
+	return stats, saturated
+}
+
+func (a *Application) checkDbReplicasStatus() *kubernetes.ComponentProbe {
+	timeMeasure := time_measure.StartTimeMeasure()
+
+	logging.Log.Debug("Check DB replicas status")
+	var status kubernetes.Status
+	var code kubernetes.Code
+	var msg string
+
+	replicas := a.dbReplicas.GetStatus()
+	unhealthy := make([]string, 0)
+	for _, replica := range replicas {
+		if !replica.Healthy {
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", replica.Name, replica.Error))
+		}
+	}
+
+	switch {
+	case len(unhealthy) == 0:
+		status = kubernetes.ResponseStatusOk
+		code = kubernetes.ResponseCodeOk
+		msg = fmt.Sprintf("DB replicas healthy, replication lag below %s", a.dbReplicas.GetMaxLag())
+	case len(unhealthy) < len(replicas):
+		status = kubernetes.ResponseStatusDegraded
+		code = kubernetes.ResponseCodeOk
+		msg = fmt.Sprintf("DB replicas DEGRADED, removed from rotation: %s", strings.Join(unhealthy, ", "))
+	default:
+		status = kubernetes.ResponseStatusError
+		code = kubernetes.ResponseCodeError
+		msg = fmt.Sprintf("DB replicas NOT HEALTHY, reads fall back to primary: %s", strings.Join(unhealthy, ", "))
+	}
+
+	timeMeasure.StopTimeMeasure()
+	milliSec, _ := timeMeasure.GetDeltaInMil().Float64()
+
+	logging.Log.Debug("DB replicas status checked")
+	return &kubernetes.ComponentProbe{
+		Status:       status,
+		Code:         code,
+		Message:      msg,
+		TimeConsumed: milliSec,
+		IsRequired:   false,
+	}
+}
+
+func (a *Application) checkDbListenerStatus() *kubernetes.ComponentProbe {
+	timeMeasure := time_measure.StartTimeMeasure()
+
+	logging.Log.Debug("Check DB listener status")
+	var status kubernetes.Status
+	var code kubernetes.Code
+	var msg string
+
+	listenerStatus := a.dbListener.GetStatus()
+	if listenerStatus.Connected {
+		status = kubernetes.ResponseStatusOk
+		code = kubernetes.ResponseCodeOk
+		msg = fmt.Sprintf("DB listener healthy, listening to %s", strings.Join(listenerStatus.Channels, ", "))
+	} else {
+		status = kubernetes.ResponseStatusError
+		code = kubernetes.ResponseCodeError
+		msg = fmt.Sprintf("DB listener NOT HEALTHY, notifications from other instances lost: %s", listenerStatus.Error)
+	}
+
+	timeMeasure.StopTimeMeasure()
+	milliSec, _ := timeMeasure.GetDeltaInMil().Float64()
+
+	logging.Log.Debug("DB listener status checked")
+	return &kubernetes.ComponentProbe{
+		Status:       status,
+		Code:         code,
+		Message:      msg,
+		TimeConsumed: milliSec,
+		IsRequired:   false,
+	}
+}
+
+func (a *Application) checkOutboxStatus() *kubernetes.ComponentProbe {
+	timeMeasure := time_measure.StartTimeMeasure()
+
+	logging.Log.Debug("Check Outbox status")
+	var status kubernetes.Status
+	var code kubernetes.Code
+	var msg string
+
+	outboxStatus := a.outboxRelay.GetStatus()
+	maxLag := a.outboxRelay.GetMaxLag()
+	switch {
+	case outboxStatus.Lag > maxLag:
+		status = kubernetes.ResponseStatusError
+		code = kubernetes.ResponseCodeError
+		msg = fmt.Sprintf("Outbox NOT HEALTHY: %d events pending, lag %s above %s",
+			outboxStatus.Pending, outboxStatus.Lag.Truncate(time.Second), maxLag)
+		if outboxStatus.Error != nil {
+			msg += ": " + outboxStatus.Error.Error()
+		}
+	case outboxStatus.Error != nil:
+		status = kubernetes.ResponseStatusDegraded
+		code = kubernetes.ResponseCodeOk
+		msg = fmt.Sprintf("Outbox DEGRADED: %d events pending: %s", outboxStatus.Pending, outboxStatus.Error.Error())
+	default:
+		status = kubernetes.ResponseStatusOk
+		code = kubernetes.ResponseCodeOk
+		msg = fmt.Sprintf("Outbox healthy, %d events pending", outboxStatus.Pending)
+	}
+
+	timeMeasure.StopTimeMeasure()
+	milliSec, _ := timeMeasure.GetDeltaInMil().Float64()
+
+	logging.Log.Debug("Outbox status checked")
+	return &kubernetes.ComponentProbe{
+		Status:       status,
+		Code:         code,
+		Message:      msg,
+		TimeConsumed: milliSec,
+		IsRequired:   true,
+	}
+}
+
+func (a *Application) checkLoadSheddingStatus(sheddingStatus *rest.LoadSheddingStatus) *kubernetes.ComponentProbe {
+	timeMeasure := time_measure.StartTimeMeasure()
+
+	logging.Log.Debug("Check Load shedding status")
+	var status kubernetes.Status
+	var msg string
+
+	if sheddingStatus.Shedding {
+		status = kubernetes.ResponseStatusDegraded
+		msg = fmt.Sprintf("Load shedding DEGRADED: requests shed lately, reason %s (%d in flight, DB wait %s)",
+			sheddingStatus.Reason, sheddingStatus.InFlight, sheddingStatus.DbWait)
+	} else {
+		status = kubernetes.ResponseStatusOk
+		msg = fmt.Sprintf("Load shedding idle (%d in flight, DB wait %s)",
+			sheddingStatus.InFlight, sheddingStatus.DbWait)
+	}
+
+	timeMeasure.StopTimeMeasure()
+	milliSec, _ := timeMeasure.GetDeltaInMil().Float64()
+
+	logging.Log.Debug("Load shedding status checked")
+	return &kubernetes.ComponentProbe{
+		Status: status,
+		// shedding keeps the server serving, it must not be taken out of the load balancing
+		Code:         kubernetes.ResponseCodeOk,
+		Message:      msg,
+		TimeConsumed: milliSec,
+		IsRequired:   true,
+	}
+}
+
 func (a *Application) checkProductsStatus() *kubernetes.ComponentProbe {
 	timeMeasure := time_measure.StartTimeMeasure()
 
@@ -122,18 +317,27 @@ func (a *Application) checkProductsStatus() *kubernetes.ComponentProbe {
 	}
 
 	logging.Log.Debug("Check Rest response")
+	headers := map[string]string{
+		headerAccept:      headerApplicationJson,
+		headerContentType: headerApplicationJson,
+	}
+	if apiKey := a.productsServer.GetProbeApiKey(); apiKey != "" {
+		headers[headerApiKey] = apiKey
+	}
 	metricsErr := responseChecker(
 		"Products",
 		a.productsServer.GetRestHost(),
 		a.productsServer.GetRestPort(),
 		a.productsServer.GetProductsEndpoint(),
-		map[string]string{
-			headerAccept:      headerApplicationJson,
-			headerContentType: headerApplicationJson,
-		},
+		headers,
 		checkProductsResponse,
 	)
-	if metricsErr != nil {
+	if errors.Is(metricsErr, errRequestRejected) {
+		// still serving, just not everybody
+		status = kubernetes.ResponseStatusDegraded
+		code = kubernetes.ResponseCodeOk
+		msg = fmt.Sprintf("Products API DEGRADED: %s", metricsErr.Error())
+	} else if metricsErr != nil {
 		status = kubernetes.ResponseStatusError
 		code = kubernetes.ResponseCodeError
 		msg = fmt.Sprintf("Monitoring NOT HEALTHY: %s", metricsErr.Error())
@@ -165,6 +369,59 @@ func checkProductsResponse(response *http.Response) error {
 	return nil
 }
 
+// checkGrpcStatus asks the standard gRPC health service whether the products service is serving
+func (a *Application) checkGrpcStatus() *kubernetes.ComponentProbe {
+	timeMeasure := time_measure.StartTimeMeasure()
+
+	logging.Log.Debug("Check Products gRPC status")
+	var status kubernetes.Status
+	var code kubernetes.Code
+	var msg string
+
+	healthErr := checkGrpcHealth(fmt.Sprintf("localhost:%d", a.grpcServer.GetGrpcPort()), a.cfg.restHealthCheckTimeout)
+	if healthErr != nil {
+		status = kubernetes.ResponseStatusError
+		code = kubernetes.ResponseCodeError
+		msg = fmt.Sprintf("Products gRPC API NOT HEALTHY: %s", healthErr.Error())
+	} else {
+		status = kubernetes.ResponseStatusOk
+		code = kubernetes.ResponseCodeOk
+		msg = "Products gRPC API healthy"
+	}
+
+	timeMeasure.StopTimeMeasure()
+	milliSec, _ := timeMeasure.GetDeltaInMil().Float64()
+
+	logging.Log.Debug("Products gRPC status checked")
+	return &kubernetes.ComponentProbe{
+		Status:       status,
+		Code:         code,
+		Message:      msg,
+		TimeConsumed: milliSec,
+		IsRequired:   true,
+	}
+}
+
+func checkGrpcHealth(address string, timeout time.Duration) error {
+	conn, connErr := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if connErr != nil {
+		return connErr
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	response, checkErr := healthpb.NewHealthClient(conn).Check(ctx,
+		&healthpb.HealthCheckRequest{Service: productspb.ProductService_ServiceDesc.ServiceName})
+	if checkErr != nil {
+		return checkErr
+	}
+	if response.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("products service %s", response.GetStatus().String())
+	}
+	return nil
+}
+
 func (a *Application) checkMonitoringStatus() *kubernetes.ComponentProbe {
 	timeMeasure := time_measure.StartTimeMeasure()
 
@@ -313,11 +570,15 @@ func responseChecker(
 	if respErr != nil {
 		return respErr
 	}
+	defer closeResponse(response)
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		logging.SugaredLog.Debugf("%s response code %d", system, response.StatusCode)
+		return fmt.Errorf("%s response code %d: %w", system, response.StatusCode, errRequestRejected)
+	}
 	if response.StatusCode != http.StatusOK {
 		logging.SugaredLog.Debugf("%s response code %d", system, response.StatusCode)
 		return fmt.Errorf("%s response code %d", system, response.StatusCode)
 	}
-	defer closeResponse(response)
 
 	// check response
 	return checkResponse(response)
@@ -0,0 +1,77 @@
+package app
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/kubernetes"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+func TestMain(m *testing.M) {
+	err := logging.InitGlobalLogger()
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// fakePool reports the stats set, as the pool of the DB interface would
+type fakePool struct {
+	stats sql.DBStats
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	return p.stats
+}
+
+func TestDbPoolSaturation(t *testing.T) {
+	t.Setenv("DB_DRIVER", "sqlite")
+	t.Setenv("DB_PATH", ":memory:")
+	db, dbErr := database.New()
+	if dbErr != nil {
+		t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+	}
+	defer db.Close()
+	schemaVersions, versionsErr := database.GetSchemaVersions()
+	if versionsErr != nil {
+		t.Fatal(versionsErr)
+	}
+
+	pool := &fakePool{}
+	app := &Application{
+		cfg:            &config{dbHealthCheckTimeout: time.Second},
+		dbInterface:    db,
+		dbPool:         pool,
+		schemaVersions: schemaVersions,
+	}
+
+	// checked in turn, saturation is told from the stats of the previous check
+	tests := []struct {
+		name           string
+		stats          sql.DBStats
+		expectedStatus kubernetes.Status
+	}{
+		{"connections available", sql.DBStats{MaxOpenConnections: 10, InUse: 9}, kubernetes.ResponseStatusOk},
+		{"all connections in use", sql.DBStats{MaxOpenConnections: 10, InUse: 10}, kubernetes.ResponseStatusDegraded},
+		{"callers waited", sql.DBStats{MaxOpenConnections: 10, InUse: 2, WaitCount: 3}, kubernetes.ResponseStatusDegraded},
+		{"no more waits", sql.DBStats{MaxOpenConnections: 10, InUse: 2, WaitCount: 3}, kubernetes.ResponseStatusOk},
+		{"unlimited connections", sql.DBStats{InUse: 100, WaitCount: 3}, kubernetes.ResponseStatusOk},
+	}
+	for _, test := range tests {
+		pool.stats = test.stats
+		probe := app.checkDbStatus()
+		if probe.Status != test.expectedStatus || probe.Code != kubernetes.ResponseCodeOk {
+			t.Fatalf("%s: expected %s, got %s %d: %s", test.name, test.expectedStatus, probe.Status, probe.Code,
+				probe.Message)
+		}
+		degraded := test.expectedStatus == kubernetes.ResponseStatusDegraded
+		if strings.Contains(probe.Message, "pool saturated") != degraded {
+			t.Fatalf("%s: unexpected message %q", test.name, probe.Message)
+		}
+	}
+}
@@ -9,7 +9,9 @@ import (
 	"github.com/bygui86/go-k8s-probes/kubernetes"
 	"github.com/bygui86/go-k8s-probes/logging"
 	"github.com/bygui86/go-k8s-probes/monitoring"
+	"github.com/bygui86/go-k8s-probes/outbox"
 	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc"
 	"github.com/bygui86/go-k8s-probes/tracing"
 )
 
@@ -30,9 +32,47 @@ func initDb(enableTracing bool) (*sql.DB, error) {
 	return db, nil
 }
 
-func createProducts(dbInterface *sql.DB) (*rest.Server, error) {
+func initDbReplicas(enableTracing bool) (*database.ReplicaSet, error) {
+	logging.Log.Debug("Create new DB replica set")
+
+	if enableTracing {
+		return database.NewReplicaSetWithWrappedTracing()
+	}
+	return database.NewReplicaSet()
+}
+
+func initRepository(dbInterface *sql.DB, dbReplicas *database.ReplicaSet) (*database.SQLRepository, error) {
+	logging.Log.Debug("Create new Products repository")
+	repository, repoErr := database.NewRepository(dbInterface)
+	if repoErr != nil {
+		return nil, repoErr
+	}
+	repository.SetReplicas(dbReplicas)
+	return repository, nil
+}
+
+func createProducts(repository *database.SQLRepository, cache *database.CachedRepository,
+	db *sql.DB) (*rest.Server, error) {
 	logging.Log.Debug("Create new Products server")
-	return rest.New(dbInterface)
+	if cache != nil {
+		return rest.New(cache, repository, db)
+	}
+	return rest.New(repository, repository, db)
+}
+
+// createGrpc returns nil if the gRPC server is disabled
+func createGrpc(repository *database.SQLRepository, cache *database.CachedRepository,
+	prodServer *rest.Server) *rpc.Server {
+	logging.Log.Debug("Create new Products gRPC server")
+	if cache != nil {
+		return rpc.New(cache, prodServer)
+	}
+	return rpc.New(repository, prodServer)
+}
+
+func createOutboxRelay(repository *database.SQLRepository) (*outbox.Relay, error) {
+	logging.Log.Debug("Create new Outbox relay")
+	return outbox.New(repository)
 }
 
 func (a *Application) startProducts() error {
@@ -59,9 +99,6 @@ func (a *Application) startMonitoring() {
 	logging.Log.Info("Start Monitoring server")
 	a.monitoringServer.Start()
 	logging.Log.Info("Monitoring server successfully started")
-
-	rest.RegisterCustomMetrics()
-	logging.Log.Info("Custom metrics successfully registered")
 }
 
 func initJaegerTracer() (io.Closer, error) {
@@ -0,0 +1,255 @@
+package database
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	cacheSubsystem = "cache"
+
+	evictedReasonCapacity = "capacity"
+	evictedReasonExpired  = "expired"
+)
+
+// NewCachedRepository decorates the repository with a products cache if enabled, it returns nil otherwise.
+// Products changed through it are invalidated right away; changes made elsewhere, e.g. by other instances, are seen
+// once the products expire, unless notified through OnProductChange or InvalidateProduct. Concurrent reads of a
+// product missing from the cache share a single load from the primary, reads meant for the primary (see WithPrimary)
+// bypass it.
+func NewCachedRepository(repository ProductRepository) *CachedRepository {
+	cfg := loadConfig()
+	if !cfg.cacheEnabled {
+		logging.Log.Debug("DB cache disabled, all the products are read from the DB")
+		return nil
+	}
+
+	logging.SugaredLog.Infof("Create new DB cache of %d products at most, for %.0f seconds",
+		cfg.cacheMaxEntries, cfg.cacheTtl.Seconds())
+	return newCachedRepository(repository, cfg.cacheMaxEntries, cfg.cacheTtl)
+}
+
+func newCachedRepository(repository ProductRepository, maxEntries int, ttl time.Duration) *CachedRepository {
+	return &CachedRepository{
+		ProductRepository: repository,
+		maxEntries:        maxEntries,
+		ttl:               ttl,
+		now:               time.Now,
+		entries:           make(map[int]*list.Element),
+		lru:               list.New(),
+		hitsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, cacheSubsystem, "hits_total"),
+			"Number of products read from the cache", nil, nil),
+		missesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, cacheSubsystem, "misses_total"),
+			"Number of products missing from the cache, read from the DB", nil, nil),
+		evictionsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, cacheSubsystem, "evictions_total"),
+			"Number of products evicted from the cache, by reason: capacity or expired", []string{"reason"}, nil),
+		invalidationsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, cacheSubsystem, "invalidations_total"),
+			"Number of product invalidations, flushes excluded", nil, nil),
+		entriesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, cacheSubsystem, "entries"),
+			"Number of products in the cache", nil, nil),
+	}
+}
+
+func (r *CachedRepository) GetProduct(product *Product, includeDeleted bool, ctx context.Context) error {
+	if usePrimary(ctx) {
+		return r.ProductRepository.GetProduct(product, includeDeleted, ctx)
+	}
+
+	span := opentracing.StartSpan(
+		"get-product-cache",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	cached, generation := r.lookup(product.ID)
+	span.SetTag("product-id", product.ID)
+	span.SetTag("cache-hit", cached != nil)
+	span.LogKV("product-id", product.ID, "cache-hit", cached != nil)
+	if cached == nil {
+		var loadErr error
+		cached, loadErr = r.load(product.ID, generation, opentracing.ContextWithSpan(ctx, span))
+		if loadErr != nil {
+			return loadErr
+		}
+	}
+
+	*product = *copyProduct(cached)
+	if product.DeletedAt != nil && !includeDeleted {
+		return ErrProductNotFound
+	}
+	return nil
+}
+
+func (r *CachedRepository) UpdateProduct(product *Product, ctx context.Context) error {
+	defer r.InvalidateProduct(product.ID)
+	return r.ProductRepository.UpdateProduct(product, ctx)
+}
+
+func (r *CachedRepository) PatchProduct(product *Product, patch ProductPatch, ctx context.Context) error {
+	defer r.InvalidateProduct(product.ID)
+	return r.ProductRepository.PatchProduct(product, patch, ctx)
+}
+
+func (r *CachedRepository) DeleteProduct(productId, version int, ctx context.Context) error {
+	defer r.InvalidateProduct(productId)
+	return r.ProductRepository.DeleteProduct(productId, version, ctx)
+}
+
+func (r *CachedRepository) RestoreProduct(product *Product, ctx context.Context) error {
+	defer r.InvalidateProduct(product.ID)
+	return r.ProductRepository.RestoreProduct(product, ctx)
+}
+
+// OnProductChange invalidates the product changed, or flushes all the products if notifications were lost.
+// Subscribed to ProductChangesChannel, it keeps the cache up to date with the changes made by other instances.
+func (r *CachedRepository) OnProductChange(notification *Notification) {
+	if notification.Lost {
+		r.FlushProducts()
+		return
+	}
+
+	change := &ProductChangeNotification{}
+	err := json.Unmarshal([]byte(notification.Payload), change)
+	if err != nil {
+		logging.SugaredLog.Errorf("Invalid product change notification %q, flush DB cache: %s",
+			notification.Payload, err.Error())
+		r.FlushProducts()
+		return
+	}
+	// products missing are not cached, inserts can't make the cache stale
+	if change.Operation != ProductChangeInsert {
+		r.InvalidateProduct(change.ProductID)
+	}
+}
+
+// InvalidateProduct drops the product, loads in progress are not cached
+func (r *CachedRepository) InvalidateProduct(productId int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.generation++
+	r.stats.invalidations++
+	if element, found := r.entries[productId]; found {
+		r.remove(element)
+	}
+}
+
+// FlushProducts drops all the products, loads in progress are not cached
+func (r *CachedRepository) FlushProducts() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.generation++
+	flushed := r.lru.Len()
+	r.entries = make(map[int]*list.Element)
+	r.lru.Init()
+	logging.SugaredLog.Infof("DB cache flushed, %d products dropped", flushed)
+	return flushed
+}
+
+// lookup returns the product cached, nil if missing or expired, along with the current generation
+func (r *CachedRepository) lookup(productId int) (*Product, uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	element, found := r.entries[productId]
+	if !found {
+		r.stats.misses++
+		return nil, r.generation
+	}
+	entry := element.Value.(*cacheEntry)
+	if !r.now().Before(entry.expiresAt) {
+		r.remove(element)
+		r.stats.expiredEvictions++
+		r.stats.misses++
+		return nil, r.generation
+	}
+
+	r.lru.MoveToFront(element)
+	r.stats.hits++
+	return entry.product, r.generation
+}
+
+// load reads the product from the primary DB, deleted or not, along with the concurrent readers of the same generation.
+// The product returned is shared, it must not be modified.
+func (r *CachedRepository) load(productId int, generation uint64, ctx context.Context) (*Product, error) {
+	key := strconv.Itoa(productId) + "-" + strconv.FormatUint(generation, 10)
+	loaded, loadErr, _ := r.loads.Do(key, func() (interface{}, error) {
+		// the readers sharing the load must not fail if the first one gives up. Read from the primary: a lagging
+		// replica could return the product as before the change just invalidated, to be cached until expired.
+		product := &Product{ID: productId}
+		err := r.ProductRepository.GetProduct(product, true, WithPrimary(context.WithoutCancel(ctx)))
+		if err != nil {
+			return nil, err
+		}
+		r.store(product, generation)
+		return product, nil
+	})
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	return loaded.(*Product), nil
+}
+
+// store caches the product unless invalidated since loaded, evicting the least recently used ones if full
+func (r *CachedRepository) store(product *Product, generation uint64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if generation != r.generation {
+		return
+	}
+	entry := &cacheEntry{product: product, expiresAt: r.now().Add(r.ttl)}
+	if element, found := r.entries[product.ID]; found {
+		element.Value = entry
+		r.lru.MoveToFront(element)
+		return
+	}
+	r.entries[product.ID] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.maxEntries {
+		r.remove(r.lru.Back())
+		r.stats.capacityEvictions++
+	}
+}
+
+// remove must be invoked holding the mutex
+func (r *CachedRepository) remove(element *list.Element) {
+	r.lru.Remove(element)
+	delete(r.entries, element.Value.(*cacheEntry).product.ID)
+}
+
+func (r *CachedRepository) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.hitsDesc
+	ch <- r.missesDesc
+	ch <- r.evictionsDesc
+	ch <- r.invalidationsDesc
+	ch <- r.entriesDesc
+}
+
+func (r *CachedRepository) Collect(ch chan<- prometheus.Metric) {
+	r.mutex.Lock()
+	stats := r.stats
+	entries := r.lru.Len()
+	r.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(r.hitsDesc, prometheus.CounterValue, float64(stats.hits))
+	ch <- prometheus.MustNewConstMetric(r.missesDesc, prometheus.CounterValue, float64(stats.misses))
+	ch <- prometheus.MustNewConstMetric(r.evictionsDesc, prometheus.CounterValue,
+		float64(stats.capacityEvictions), evictedReasonCapacity)
+	ch <- prometheus.MustNewConstMetric(r.evictionsDesc, prometheus.CounterValue,
+		float64(stats.expiredEvictions), evictedReasonExpired)
+	ch <- prometheus.MustNewConstMetric(r.invalidationsDesc, prometheus.CounterValue, float64(stats.invalidations))
+	ch <- prometheus.MustNewConstMetric(r.entriesDesc, prometheus.GaugeValue, float64(entries))
+}
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachedRepository(t *testing.T) {
+	testProductRepository(t, func(t *testing.T) ProductRepository {
+		return newCachedRepository(NewMemoryRepository(), 100, time.Minute)
+	})
+}
+
+// countingRepository counts the reads of products, blocking them until released if a gate is set
+type countingRepository struct {
+	*MemoryRepository
+	reads atomic.Int32
+	gate  chan struct{}
+}
+
+func (r *countingRepository) GetProduct(product *Product, includeDeleted bool, ctx context.Context) error {
+	r.reads.Add(1)
+	if r.gate != nil {
+		<-r.gate
+	}
+	return r.MemoryRepository.GetProduct(product, includeDeleted, ctx)
+}
+
+func newCountingCache(t *testing.T, maxEntries int, products ...*Product) (*CachedRepository, *countingRepository) {
+	t.Helper()
+	counting := &countingRepository{MemoryRepository: NewMemoryRepository()}
+	mustCreate(t, counting, products...)
+	return newCachedRepository(counting, maxEntries, time.Minute), counting
+}
+
+func TestCacheHitsAndInvalidations(t *testing.T) {
+	cache, counting := newCountingCache(t, 10, &Product{Name: "lamp", Price: price("1"), Currency: "EUR"})
+	ctx := testContext()
+
+	for i := 0; i < 3; i++ {
+		product := &Product{ID: 1}
+		if err := cache.GetProduct(product, false, ctx); err != nil || product.Name != "lamp" {
+			t.Fatalf("expected lamp, got %v (%v)", product, err)
+		}
+		// callers own the product returned
+		product.Name = "modified"
+	}
+	if reads := counting.reads.Load(); reads != 1 {
+		t.Fatalf("expected 1 read, got %d", reads)
+	}
+
+	update := &Product{ID: 1, Name: "desk", Price: price("2"), Currency: "EUR"}
+	if err := cache.UpdateProduct(update, ctx); err != nil {
+		t.Fatal(err)
+	}
+	product := &Product{ID: 1}
+	if err := cache.GetProduct(product, false, ctx); err != nil || product.Name != "desk" {
+		t.Fatalf("expected update visible, got %v (%v)", product, err)
+	}
+
+	if err := cache.DeleteProduct(1, 0, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.GetProduct(&Product{ID: 1}, false, ctx); err != ErrProductNotFound {
+		t.Fatalf("expected deleted product not found, got %v", err)
+	}
+	if err := cache.GetProduct(&Product{ID: 1}, true, ctx); err != nil {
+		t.Fatalf("expected deleted product found when included, got %v", err)
+	}
+
+	// reads meant for the primary always go to the DB
+	readsBefore := counting.reads.Load()
+	if err := cache.GetProduct(&Product{ID: 1}, true, WithPrimary(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if reads := counting.reads.Load(); reads != readsBefore+1 {
+		t.Fatalf("expected cache bypassed, got %d reads", reads-readsBefore)
+	}
+
+	if stats := cache.stats; stats.hits != 3 || stats.misses != 3 || stats.invalidations != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheEvictions(t *testing.T) {
+	cache, counting := newCountingCache(t, 2,
+		&Product{Name: "lamp", Price: price("1"), Currency: "EUR"},
+		&Product{Name: "desk", Price: price("2"), Currency: "EUR"},
+		&Product{Name: "sofa", Price: price("3"), Currency: "EUR"})
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	ctx := testContext()
+
+	// 1 is the least recently used when 3 is cached
+	for _, id := range []int{1, 2, 1, 3, 1} {
+		if err := cache.GetProduct(&Product{ID: id}, false, ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reads := counting.reads.Load(); reads != 3 {
+		t.Fatalf("expected 3 reads, got %d", reads)
+	}
+	if _, found := cache.entries[2]; found || cache.stats.capacityEvictions != 1 {
+		t.Fatalf("expected 2 evicted, got %v", cache.entries)
+	}
+
+	now = now.Add(time.Minute)
+	if err := cache.GetProduct(&Product{ID: 1}, false, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if reads := counting.reads.Load(); reads != 4 || cache.stats.expiredEvictions != 1 {
+		t.Fatalf("expected expired product read again, got %d reads", reads)
+	}
+
+	if flushed := cache.FlushProducts(); flushed != 2 || len(cache.entries) != 0 {
+		t.Fatalf("expected 2 products flushed, got %d", flushed)
+	}
+}
+
+func TestCacheCollapsesConcurrentLoads(t *testing.T) {
+	cache, counting := newCountingCache(t, 10, &Product{Name: "lamp", Price: price("1"), Currency: "EUR"})
+	counting.gate = make(chan struct{})
+	ctx := testContext()
+
+	var readers sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			product := &Product{ID: 1}
+			if err := cache.GetProduct(product, false, ctx); err != nil || product.Name != "lamp" {
+				t.Errorf("expected lamp, got %v (%v)", product, err)
+			}
+		}()
+	}
+	// let the readers pile up on the first load
+	time.Sleep(50 * time.Millisecond)
+	close(counting.gate)
+	readers.Wait()
+
+	if reads := counting.reads.Load(); reads != 1 {
+		t.Fatalf("expected a single read, got %d", reads)
+	}
+}
+
+func TestCacheSkipsLoadsInvalidated(t *testing.T) {
+	cache, counting := newCountingCache(t, 10, &Product{Name: "lamp", Price: price("1"), Currency: "EUR"})
+	counting.gate = make(chan struct{})
+	ctx := testContext()
+
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		_ = cache.GetProduct(&Product{ID: 1}, false, ctx)
+	}()
+	for counting.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// changed by another instance while being loaded
+	cache.InvalidateProduct(1)
+	close(counting.gate)
+	<-loaded
+
+	if _, found := cache.entries[1]; found {
+		t.Fatal("expected product loaded before the invalidation not cached")
+	}
+}
+
+// laggingReplicaRepository serves the reads not meant for the primary from a snapshot, as a lagging replica would
+type laggingReplicaRepository struct {
+	*MemoryRepository
+	replica *MemoryRepository
+}
+
+func (r *laggingReplicaRepository) GetProduct(product *Product, includeDeleted bool, ctx context.Context) error {
+	if usePrimary(ctx) {
+		return r.MemoryRepository.GetProduct(product, includeDeleted, ctx)
+	}
+	return r.replica.GetProduct(product, includeDeleted, ctx)
+}
+
+func TestCacheIgnoresLaggingReplicas(t *testing.T) {
+	primary := NewMemoryRepository()
+	replica := NewMemoryRepository()
+	mustCreate(t, primary, &Product{Name: "lamp", Price: price("1"), Currency: "EUR"})
+	mustCreate(t, replica, &Product{Name: "lamp", Price: price("1"), Currency: "EUR"})
+	cache := newCachedRepository(&laggingReplicaRepository{MemoryRepository: primary, replica: replica}, 10, time.Minute)
+	ctx := testContext()
+
+	// the replica never catches up with the update
+	if err := cache.UpdateProduct(&Product{ID: 1, Name: "desk", Price: price("2"), Currency: "EUR"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		product := &Product{ID: 1}
+		if err := cache.GetProduct(product, false, ctx); err != nil || product.Name != "desk" {
+			t.Fatalf("expected update visible, got %v (%v)", product, err)
+		}
+	}
+}
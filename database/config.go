@@ -1,34 +1,190 @@
 package database
 
 import (
+	"time"
+
 	"github.com/bygui86/go-k8s-probes/logging"
 	"github.com/bygui86/go-k8s-probes/utils"
 )
 
 const (
-	dbHostEnvVar     = "DB_HOST"
-	dbPortEnvVar     = "DB_PORT"
-	dbUsernameEnvVar = "DB_USERNAME"
-	dbPasswordEnvVar = "DB_PASSWORD"
-	dbNameEnvVar     = "DB_NAME"
-	dbSslModeEnvVar  = "DB_SSL_MODE"
-
-	dbHostEnvVarDefault     = "localhost"
-	dbPortEnvVarDefault     = 5432
-	dbUsernameEnvVarDefault = "username"
-	dbPasswordEnvVarDefault = "password"
-	dbNameEnvVarDefault     = "db"
-	dbSslModeEnvVarDefault  = "disable"
+	dbDriverEnvVar      = "DB_DRIVER" // available values: postgres (default), sqlite
+	dbPathEnvVar        = "DB_PATH"   // sqlite only
+	dbHostEnvVar        = "DB_HOST"
+	dbPortEnvVar        = "DB_PORT"
+	dbUsernameEnvVar    = "DB_USERNAME"
+	dbPasswordEnvVar    = "DB_PASSWORD"
+	dbNameEnvVar        = "DB_NAME"
+	dbSslModeEnvVar     = "DB_SSL_MODE"
+	dbAutoMigrateEnvVar = "DB_AUTO_MIGRATE" // bool
+
+	dbMaxOpenConnsEnvVar    = "DB_MAX_OPEN_CONNS"     // 0 means unlimited
+	dbMaxIdleConnsEnvVar    = "DB_MAX_IDLE_CONNS"     // 0 means no idle connections retained
+	dbConnMaxLifetimeEnvVar = "DB_CONN_MAX_LIFETIME"  // in seconds, 0 means connections are reused forever
+	dbConnMaxIdleTimeEnvVar = "DB_CONN_MAX_IDLE_TIME" // in seconds, 0 means connections are not closed due to idle time
+
+	dbReplicaDsnsEnvVar          = "DB_REPLICA_DSNS"           // comma-separated, postgres only
+	dbReplicaMaxLagEnvVar        = "DB_REPLICA_MAX_LAG"        // in seconds
+	dbReplicaCheckIntervalEnvVar = "DB_REPLICA_CHECK_INTERVAL" // in seconds
+
+	dbDefaultCurrencyEnvVar = "DB_DEFAULT_CURRENCY" // ISO-4217, backfilled in existing products by migrations
+
+	dbCacheEnabledEnvVar    = "DB_CACHE_ENABLED" // bool
+	dbCacheMaxEntriesEnvVar = "DB_CACHE_MAX_ENTRIES"
+	dbCacheTtlEnvVar        = "DB_CACHE_TTL" // in seconds
+
+	dbListenerEnabledEnvVar              = "DB_LISTENER_ENABLED"                // bool, postgres only
+	dbListenerMinReconnectIntervalEnvVar = "DB_LISTENER_MIN_RECONNECT_INTERVAL" // in seconds
+	dbListenerMaxReconnectIntervalEnvVar = "DB_LISTENER_MAX_RECONNECT_INTERVAL" // in seconds
+	dbListenerPingIntervalEnvVar         = "DB_LISTENER_PING_INTERVAL"          // in seconds
+
+	dbDriverEnvVarDefault      = postgresDriver
+	dbPathEnvVarDefault        = "products.db"
+	dbHostEnvVarDefault        = "localhost"
+	dbPortEnvVarDefault        = 5432
+	dbUsernameEnvVarDefault    = "username"
+	dbPasswordEnvVarDefault    = "password"
+	dbNameEnvVarDefault        = "db"
+	dbSslModeEnvVarDefault     = "disable"
+	dbAutoMigrateEnvVarDefault = true
+
+	dbMaxOpenConnsDefault    = 20
+	dbMaxIdleConnsDefault    = 5
+	dbConnMaxLifetimeDefault = 1800
+	dbConnMaxIdleTimeDefault = 300
+
+	dbReplicaMaxLagDefault        = 10
+	dbReplicaCheckIntervalDefault = 5
+
+	dbDefaultCurrencyDefault = "EUR"
+
+	dbCacheEnabledDefault    = false
+	dbCacheMaxEntriesDefault = 10000
+	dbCacheTtlDefault        = 30
+
+	dbListenerEnabledDefault              = true
+	dbListenerMinReconnectIntervalDefault = 1
+	dbListenerMaxReconnectIntervalDefault = 60
+	dbListenerPingIntervalDefault         = 30
 )
 
 func loadConfig() *config {
 	logging.Log.Debug("Load DB configurations")
+
+	maxOpenConns := utils.GetIntEnv(dbMaxOpenConnsEnvVar, dbMaxOpenConnsDefault)
+	if maxOpenConns < 0 {
+		logging.SugaredLog.Warnf("DB max open connections must be greater or equal to 0, fallback to default %d",
+			dbMaxOpenConnsDefault)
+		maxOpenConns = dbMaxOpenConnsDefault
+	}
+
+	maxIdleConns := utils.GetIntEnv(dbMaxIdleConnsEnvVar, dbMaxIdleConnsDefault)
+	if maxIdleConns < 0 {
+		logging.SugaredLog.Warnf("DB max idle connections must be greater or equal to 0, fallback to default %d",
+			dbMaxIdleConnsDefault)
+		maxIdleConns = dbMaxIdleConnsDefault
+	}
+
+	connMaxLifetime := utils.GetIntEnv(dbConnMaxLifetimeEnvVar, dbConnMaxLifetimeDefault)
+	if connMaxLifetime < 0 {
+		logging.SugaredLog.Warnf("DB connection max lifetime must be greater or equal to 0, fallback to default %d",
+			dbConnMaxLifetimeDefault)
+		connMaxLifetime = dbConnMaxLifetimeDefault
+	}
+
+	connMaxIdleTime := utils.GetIntEnv(dbConnMaxIdleTimeEnvVar, dbConnMaxIdleTimeDefault)
+	if connMaxIdleTime < 0 {
+		logging.SugaredLog.Warnf("DB connection max idle time must be greater or equal to 0, fallback to default %d",
+			dbConnMaxIdleTimeDefault)
+		connMaxIdleTime = dbConnMaxIdleTimeDefault
+	}
+
+	replicaMaxLag := utils.GetIntEnv(dbReplicaMaxLagEnvVar, dbReplicaMaxLagDefault)
+	if replicaMaxLag < 1 {
+		logging.SugaredLog.Warnf("DB replica max lag must be greater or equal to 1, fallback to default %d",
+			dbReplicaMaxLagDefault)
+		replicaMaxLag = dbReplicaMaxLagDefault
+	}
+
+	replicaCheckInterval := utils.GetIntEnv(dbReplicaCheckIntervalEnvVar, dbReplicaCheckIntervalDefault)
+	if replicaCheckInterval < 1 {
+		logging.SugaredLog.Warnf("DB replica check interval must be greater or equal to 1, fallback to default %d",
+			dbReplicaCheckIntervalDefault)
+		replicaCheckInterval = dbReplicaCheckIntervalDefault
+	}
+
+	defaultCurrency := utils.GetStringEnv(dbDefaultCurrencyEnvVar, dbDefaultCurrencyDefault)
+	// the value ends up in migration scripts, only well-known codes are accepted
+	if productValidator.Var(defaultCurrency, iso4217Tag) != nil {
+		logging.SugaredLog.Warnf("DB default currency must be an ISO-4217 code, fallback to default %s",
+			dbDefaultCurrencyDefault)
+		defaultCurrency = dbDefaultCurrencyDefault
+	}
+
+	cacheMaxEntries := utils.GetIntEnv(dbCacheMaxEntriesEnvVar, dbCacheMaxEntriesDefault)
+	if cacheMaxEntries < 1 {
+		logging.SugaredLog.Warnf("DB cache max entries must be greater or equal to 1, fallback to default %d",
+			dbCacheMaxEntriesDefault)
+		cacheMaxEntries = dbCacheMaxEntriesDefault
+	}
+
+	cacheTtl := utils.GetIntEnv(dbCacheTtlEnvVar, dbCacheTtlDefault)
+	if cacheTtl < 1 {
+		logging.SugaredLog.Warnf("DB cache TTL must be greater or equal to 1, fallback to default %d",
+			dbCacheTtlDefault)
+		cacheTtl = dbCacheTtlDefault
+	}
+
+	listenerMinReconnect := utils.GetIntEnv(dbListenerMinReconnectIntervalEnvVar, dbListenerMinReconnectIntervalDefault)
+	if listenerMinReconnect < 1 {
+		logging.SugaredLog.Warnf("DB listener min reconnect interval must be greater or equal to 1, "+
+			"fallback to default %d", dbListenerMinReconnectIntervalDefault)
+		listenerMinReconnect = dbListenerMinReconnectIntervalDefault
+	}
+
+	listenerMaxReconnect := utils.GetIntEnv(dbListenerMaxReconnectIntervalEnvVar, dbListenerMaxReconnectIntervalDefault)
+	if listenerMaxReconnect < listenerMinReconnect {
+		logging.SugaredLog.Warnf("DB listener max reconnect interval must not be lower than min %d, fallback to %d",
+			listenerMinReconnect, listenerMinReconnect)
+		listenerMaxReconnect = listenerMinReconnect
+	}
+
+	listenerPingInterval := utils.GetIntEnv(dbListenerPingIntervalEnvVar, dbListenerPingIntervalDefault)
+	if listenerPingInterval < 1 {
+		logging.SugaredLog.Warnf("DB listener ping interval must be greater or equal to 1, fallback to default %d",
+			dbListenerPingIntervalDefault)
+		listenerPingInterval = dbListenerPingIntervalDefault
+	}
+
 	return &config{
-		dbHost:     utils.GetStringEnv(dbHostEnvVar, dbHostEnvVarDefault),
-		dbPort:     utils.GetIntEnv(dbPortEnvVar, dbPortEnvVarDefault),
-		dbUsername: utils.GetStringEnv(dbUsernameEnvVar, dbUsernameEnvVarDefault),
-		dbPassword: utils.GetStringEnv(dbPasswordEnvVar, dbPasswordEnvVarDefault),
-		dbName:     utils.GetStringEnv(dbNameEnvVar, dbNameEnvVarDefault),
-		dbSslMode:  utils.GetStringEnv(dbSslModeEnvVar, dbSslModeEnvVarDefault),
+		dbDriver:    utils.GetStringEnv(dbDriverEnvVar, dbDriverEnvVarDefault),
+		dbPath:      utils.GetStringEnv(dbPathEnvVar, dbPathEnvVarDefault),
+		dbHost:      utils.GetStringEnv(dbHostEnvVar, dbHostEnvVarDefault),
+		dbPort:      utils.GetIntEnv(dbPortEnvVar, dbPortEnvVarDefault),
+		dbUsername:  utils.GetStringEnv(dbUsernameEnvVar, dbUsernameEnvVarDefault),
+		dbPassword:  utils.GetStringEnv(dbPasswordEnvVar, dbPasswordEnvVarDefault),
+		dbName:      utils.GetStringEnv(dbNameEnvVar, dbNameEnvVarDefault),
+		dbSslMode:   utils.GetStringEnv(dbSslModeEnvVar, dbSslModeEnvVarDefault),
+		autoMigrate: utils.GetBoolEnv(dbAutoMigrateEnvVar, dbAutoMigrateEnvVarDefault),
+
+		maxOpenConns:    maxOpenConns,
+		maxIdleConns:    maxIdleConns,
+		connMaxLifetime: time.Duration(connMaxLifetime) * time.Second,
+		connMaxIdleTime: time.Duration(connMaxIdleTime) * time.Second,
+
+		replicaDsns:          utils.GetStringSliceEnv(dbReplicaDsnsEnvVar, []string{}),
+		replicaMaxLag:        time.Duration(replicaMaxLag) * time.Second,
+		replicaCheckInterval: time.Duration(replicaCheckInterval) * time.Second,
+
+		defaultCurrency: defaultCurrency,
+
+		cacheEnabled:    utils.GetBoolEnv(dbCacheEnabledEnvVar, dbCacheEnabledDefault),
+		cacheMaxEntries: cacheMaxEntries,
+		cacheTtl:        time.Duration(cacheTtl) * time.Second,
+
+		listenerEnabled:              utils.GetBoolEnv(dbListenerEnabledEnvVar, dbListenerEnabledDefault),
+		listenerMinReconnectInterval: time.Duration(listenerMinReconnect) * time.Second,
+		listenerMaxReconnectInterval: time.Duration(listenerMaxReconnect) * time.Second,
+		listenerPingInterval:         time.Duration(listenerPingInterval) * time.Second,
 	}
 }
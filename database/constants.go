@@ -1,16 +1,64 @@
 package database
 
 const (
-	createTableQuery = `CREATE TABLE IF NOT EXISTS products(
-	id SERIAL,
-	name TEXT NOT NULL,
-	price NUMERIC(10,2) NOT NULL DEFAULT 0.00,
-	CONSTRAINT products_pkey PRIMARY KEY (id)
-)`
-
-	getProductsQuery   = "SELECT id,name,price FROM products LIMIT $1 OFFSET $2"
-	getProductQuery    = "SELECT name, price FROM products WHERE id=$1"
-	createProductQuery = "INSERT INTO products(name, price) VALUES($1, $2) RETURNING id"
-	updateProductQuery = "UPDATE products SET name=$1, price=$2 WHERE id=$3"
-	deleteProductQuery = "DELETE FROM products WHERE id=$1"
+	getProductQuery        = "SELECT name, price, currency, version, deleted_at, updated_at FROM products WHERE id=$1"
+	getProductVersionQuery = "SELECT version FROM products WHERE id=$1 AND deleted_at IS NULL"
+	getProductStateQuery   = "SELECT version, deleted_at IS NOT NULL FROM products WHERE id=$1"
+	lockProductQuery       = "SELECT name, price, currency, version FROM products WHERE id=$1 AND deleted_at IS NULL"
+	createProductQuery     = "INSERT INTO products(name, price, currency, updated_at) VALUES($1, $2, $3, $4) RETURNING id, version"
+	// the latest product changed, through the updated_at index, MAX would lose the column type on SQLite
+	getLastModifiedQuery = "SELECT updated_at FROM products ORDER BY updated_at DESC LIMIT 1"
+	exportProductsQuery  = "SELECT id, name, price, currency, version, updated_at FROM products WHERE deleted_at IS NULL ORDER BY id"
+	// version 0 skips the optimistic concurrency check
+	updateProductQuery  = "UPDATE products SET name=$1, price=$2, currency=$3, version=version+1, updated_at=$6 WHERE id=$4 AND deleted_at IS NULL AND ($5 = 0 OR version=$5)"
+	deleteProductQuery  = "UPDATE products SET deleted_at=$3, version=version+1, updated_at=$3 WHERE id=$1 AND deleted_at IS NULL AND ($2 = 0 OR version=$2)"
+	restoreProductQuery = "UPDATE products SET deleted_at=NULL, version=version+1, updated_at=$3 WHERE id=$1 AND deleted_at IS NOT NULL AND ($2 = 0 OR version=$2)"
+	// IDs of imported products are allocated upfront, COPY can't return them
+	allocateProductIdsQuery = "SELECT nextval(pg_get_serial_sequence('products', 'id')) FROM generate_series(1, $1)"
+
+	// product history
+	insertProductChangeQuery = "INSERT INTO product_history(product_id, version, action, actor, name, price, currency, changed_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8)"
+	getProductHistoryQuery   = "SELECT version, action, actor, name, price, currency, changed_at FROM product_history WHERE product_id=$1 ORDER BY id"
+	countProductQuery        = "SELECT COUNT(*) FROM products WHERE id=$1"
+
+	initialVersion = 1
+
+	// outbox
+	insertOutboxEventQuery    = "INSERT INTO outbox(event_type, product_id, payload, created_at, next_attempt_at) VALUES($1, $2, $3, $4, $4)"
+	selectDueOutboxQuery      = "SELECT id, event_type, product_id, payload, created_at, attempts FROM outbox WHERE next_attempt_at <= $1 ORDER BY id LIMIT $2"
+	leaseOutboxEventQuery     = "UPDATE outbox SET attempts=attempts+1, next_attempt_at=$2 WHERE id=$1"
+	deleteOutboxEventQuery    = "DELETE FROM outbox WHERE id=$1"
+	rescheduleOutboxQuery     = "UPDATE outbox SET next_attempt_at=$2, last_error=$3 WHERE id=$1"
+	countOutboxQuery          = "SELECT COUNT(*) FROM outbox"
+	getOldestOutboxEventQuery = "SELECT created_at FROM outbox ORDER BY id LIMIT 1"
+
+	// idempotency keys
+	deleteExpiredIdempotencyKeyQuery  = "DELETE FROM idempotency_keys WHERE key=$1 AND expires_at < $2"
+	reserveIdempotencyKeyQuery        = "INSERT INTO idempotency_keys(key, fingerprint, expires_at) VALUES($1, $2, $3) ON CONFLICT (key) DO NOTHING"
+	getIdempotencyKeyQuery            = "SELECT fingerprint, status_code, response_headers, response_body FROM idempotency_keys WHERE key=$1"
+	completeIdempotencyKeyQuery       = "UPDATE idempotency_keys SET status_code=$2, response_headers=$3, response_body=$4, expires_at=$5 WHERE key=$1"
+	releaseIdempotencyKeyQuery        = "DELETE FROM idempotency_keys WHERE key=$1 AND status_code=0"
+	deleteExpiredIdempotencyKeysQuery = "DELETE FROM idempotency_keys WHERE expires_at < $1"
+
+	productsTable       = "products"
+	productHistoryTable = "product_history"
+	outboxTable         = "outbox"
+
+	// replicas, lag is 0 when the replica has replayed everything it received
+	getReplicaLagQuery = `SELECT CASE
+	WHEN NOT pg_is_in_recovery() THEN 0
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+	// migrations (see dialect for the schema_migrations table creation)
+	getAppliedMigrationsQuery = "SELECT version, applied_at FROM schema_migrations ORDER BY version"
+	getSchemaVersionsQuery    = "SELECT version FROM schema_migrations"
+	insertMigrationQuery      = "INSERT INTO schema_migrations(version, name) VALUES($1, $2)"
+	deleteMigrationQuery      = "DELETE FROM schema_migrations WHERE version=$1"
+	advisoryLockQuery         = "SELECT pg_advisory_lock($1)"
+	advisoryUnlockQuery       = "SELECT pg_advisory_unlock($1)"
+
+	// arbitrary application-wide key used to serialise migrations across pods
+	migrationsAdvisoryLockKey int64 = 7262834011
 )
@@ -3,23 +3,25 @@ package database
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 
 	"github.com/ExpansiveWorlds/instrumentedsql"
 	instrumentedsqlopentracing "github.com/ExpansiveWorlds/instrumentedsql/opentracing"
 	"github.com/lib/pq"
+	"modernc.org/sqlite"
 
 	"github.com/bygui86/go-k8s-probes/logging"
 )
 
 const (
 	// no tracing
-	dbConnectionStringFormat = "host=%s port=%d user=%s password=%s dbname=%s sslmode=%s"
-	dbDriverName             = "postgres"
+	dbConnectionStringFormat     = "host=%s port=%d user=%s password=%s dbname=%s sslmode=%s"
+	sqliteConnectionStringFormat = "file:%s?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
 
 	// with tracing
 	instrumentedDbConnectionStringFormat = "postgres://%s:%s@%s:%d/%s?sslmode=%s"
-	instrumentedDbDriverName             = "instrumented-" + dbDriverName
+	instrumentedDbDriverNamePrefix       = "instrumented-"
 )
 
 func New() (*sql.DB, error) {
@@ -27,45 +29,73 @@ func New() (*sql.DB, error) {
 
 	cfg := loadConfig()
 
-	db, dbErr := sql.Open(
-		dbDriverName,
-		fmt.Sprintf(dbConnectionStringFormat,
-			cfg.dbHost, cfg.dbPort,
-			cfg.dbUsername, cfg.dbPassword, cfg.dbName,
-			cfg.dbSslMode,
-		),
-	)
+	db, dbErr := open(cfg)
 	if dbErr != nil {
 		return nil, dbErr
 	}
 
-	_, tableErr := db.Exec(createTableQuery)
-	if tableErr != nil {
-		return nil, tableErr
+	migrateErr := migrateOnStartup(db, cfg)
+	if migrateErr != nil {
+		return nil, migrateErr
 	}
 
 	return db, nil
 }
 
+// Open creates a new DB interface without touching the schema, e.g. to run migrations on demand.
+func Open() (*sql.DB, error) {
+	logging.Log.Info("Open DB interface")
+
+	return open(loadConfig())
+}
+
+func open(cfg *config) (*sql.DB, error) {
+	d, dialectErr := getDialect(cfg.dbDriver)
+	if dialectErr != nil {
+		return nil, dialectErr
+	}
+
+	db, dbErr := sql.Open(d.name, buildDataSourceName(cfg))
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	configurePool(db, d, cfg)
+	return db, nil
+}
+
 func NewWithWrappedTracing() (*sql.DB, error) {
 	logging.Log.Info("Create new DB interface instrumented for tracing")
 
 	cfg := loadConfig()
 
-	// Get a database driver.Connector for a fixed configuration.
-	connector, connErr := pq.NewConnector(fmt.Sprintf(instrumentedDbConnectionStringFormat,
-		cfg.dbUsername, cfg.dbPassword,
-		cfg.dbHost, cfg.dbPort,
-		cfg.dbName, cfg.dbSslMode,
-	))
-	if connErr != nil {
-		return nil, connErr
+	d, dialectErr := getDialect(cfg.dbDriver)
+	if dialectErr != nil {
+		return nil, dialectErr
+	}
+
+	var baseDriver driver.Driver
+	switch d {
+	case postgresDialect:
+		// Get a database driver.Connector for a fixed configuration.
+		connector, connErr := pq.NewConnector(fmt.Sprintf(instrumentedDbConnectionStringFormat,
+			cfg.dbUsername, cfg.dbPassword,
+			cfg.dbHost, cfg.dbPort,
+			cfg.dbName, cfg.dbSslMode,
+		))
+		if connErr != nil {
+			return nil, connErr
+		}
+		baseDriver = connector.Driver()
+	case sqliteDialect:
+		baseDriver = &sqlite.Driver{}
 	}
 
+	instrumentedDriverName := instrumentedDbDriverNamePrefix + d.name
 	sql.Register(
-		instrumentedDbDriverName,
+		instrumentedDriverName,
 		instrumentedsql.WrapDriver(
-			connector.Driver(),
+			baseDriver,
 			instrumentedsql.WithTracer(instrumentedsqlopentracing.NewTracer()),
 			instrumentedsql.WithLogger(
 				instrumentedsql.LoggerFunc(func(ctx context.Context, msg string, keyvals ...interface{}) {
@@ -73,22 +103,56 @@ func NewWithWrappedTracing() (*sql.DB, error) {
 				})),
 		),
 	)
-	db, dbErr := sql.Open(
-		instrumentedDbDriverName,
-		fmt.Sprintf(dbConnectionStringFormat,
-			cfg.dbHost, cfg.dbPort,
-			cfg.dbUsername, cfg.dbPassword, cfg.dbName,
-			cfg.dbSslMode,
-		),
-	)
+	db, dbErr := sql.Open(instrumentedDriverName, buildDataSourceName(cfg))
 	if dbErr != nil {
 		return nil, dbErr
 	}
 
-	_, tableErr := db.Exec(createTableQuery)
-	if tableErr != nil {
-		return nil, tableErr
+	configurePool(db, d, cfg)
+
+	migrateErr := migrateOnStartup(db, cfg)
+	if migrateErr != nil {
+		return nil, migrateErr
 	}
 
 	return db, nil
 }
+
+func buildDataSourceName(cfg *config) string {
+	if cfg.dbDriver == sqliteDriver {
+		return fmt.Sprintf(sqliteConnectionStringFormat, cfg.dbPath)
+	}
+
+	return fmt.Sprintf(dbConnectionStringFormat,
+		cfg.dbHost, cfg.dbPort,
+		cfg.dbUsername, cfg.dbPassword, cfg.dbName,
+		cfg.dbSslMode,
+	)
+}
+
+func configurePool(db *sql.DB, d *dialect, cfg *config) {
+	if d == sqliteDialect {
+		// a single connection avoids "database is locked" errors and keeps in-memory databases (:memory:) alive,
+		// so it must never be closed because of lifetime or idle time
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		return
+	}
+
+	logging.SugaredLog.Debugf("Configure DB connection pool: max open %d, max idle %d, max lifetime %s, max idle time %s",
+		cfg.maxOpenConns, cfg.maxIdleConns, cfg.connMaxLifetime, cfg.connMaxIdleTime)
+	db.SetMaxOpenConns(cfg.maxOpenConns)
+	db.SetMaxIdleConns(cfg.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.connMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.connMaxIdleTime)
+}
+
+func migrateOnStartup(db *sql.DB, cfg *config) error {
+	if !cfg.autoMigrate {
+		logging.Log.Warn("DB schema auto-migration disabled, schema must be migrated manually")
+		return nil
+	}
+
+	_, migrateErr := MigrateUp(db, 0, context.Background())
+	return migrateErr
+}
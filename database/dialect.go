@@ -0,0 +1,116 @@
+package database
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	postgresDriver = "postgres"
+	sqliteDriver   = "sqlite"
+)
+
+var (
+	postgresDialect = &dialect{
+		name:                 postgresDriver,
+		migrationsDir:        migrationsDir + "/" + postgresDriver,
+		supportsReturning:    true,
+		supportsAdvisoryLock: true,
+		supportsCopy:         true,
+		caseInsensitiveLike:  "ILIKE",
+		lockRowClause:        " FOR UPDATE",
+		skipLockedClause:     " FOR UPDATE SKIP LOCKED",
+		binaryCollation:      ` COLLATE "C"`,
+		searchCondition:      "search_vector @@ plainto_tsquery('simple', %s)",
+		searchArg: func(tokens []string) string {
+			return strings.Join(tokens, " ")
+		},
+		createMigrationsTableQuery: `CREATE TABLE IF NOT EXISTS schema_migrations(
+	version BIGINT NOT NULL,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	CONSTRAINT schema_migrations_pkey PRIMARY KEY (version)
+)`,
+	}
+
+	sqliteDialect = &dialect{
+		name:          sqliteDriver,
+		migrationsDir: migrationsDir + "/" + sqliteDriver,
+		// RETURNING is available only since SQLite 3.35, rely on LastInsertId to stay portable
+		supportsReturning: false,
+		// SQLite serialises writers on its own, connections are also limited to 1 (see openSQLite)
+		supportsAdvisoryLock: false,
+		// ASCII only, Postgres ILIKE folds any letter instead
+		caseInsensitiveLike: "LIKE",
+		// writers are serialised by the single connection already
+		lockRowClause: "",
+		// concurrent relays are serialised by the single connection too
+		skipLockedClause: "",
+		// BINARY is the default collation
+		binaryCollation: "",
+		searchCondition: "id IN (SELECT rowid FROM products_search WHERE products_search MATCH %s)",
+		searchArg: func(tokens []string) string {
+			// tokens are made of letters and digits only, quoted not to be taken as FTS5 operators
+			return `"` + strings.Join(tokens, `" "`) + `"`
+		},
+		createMigrationsTableQuery: `CREATE TABLE IF NOT EXISTS schema_migrations(
+	version INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`,
+	}
+
+	dialects = map[string]*dialect{
+		postgresDialect.name: postgresDialect,
+		sqliteDialect.name:   sqliteDialect,
+	}
+
+	// $1, $2, ...
+	postgresPlaceholderRegex = regexp.MustCompile(`\$(\d+)`)
+	returningClauseRegex     = regexp.MustCompile(`(?i)\s+RETURNING\s+.*$`)
+)
+
+// dialect collects the differences among the supported SQL databases.
+// Queries are written in Postgres flavour and translated through rebind.
+type dialect struct {
+	name                       string
+	migrationsDir              string
+	supportsReturning          bool
+	supportsAdvisoryLock       bool
+	supportsCopy               bool
+	createMigrationsTableQuery string
+	caseInsensitiveLike        string
+	lockRowClause              string
+	skipLockedClause           string // locks the rows selected, skipping the ones locked already
+	binaryCollation            string
+	searchCondition            string // on the search arg placeholder
+	searchArg                  func(tokens []string) string
+}
+
+func getDialect(driver string) (*dialect, error) {
+	d, found := dialects[driver]
+	if !found {
+		return nil, fmt.Errorf("unsupported DB driver %s", driver)
+	}
+	return d, nil
+}
+
+// loadDialect returns the dialect of the DB driver currently configured
+func loadDialect() (*dialect, error) {
+	return getDialect(loadConfig().dbDriver)
+}
+
+// rebind translates a Postgres query to the dialect, i.e. numbered placeholders and RETURNING clause
+func (d *dialect) rebind(query string) string {
+	if d == postgresDialect {
+		return query
+	}
+
+	// SQLite supports numbered placeholders as ?NNN
+	query = postgresPlaceholderRegex.ReplaceAllString(query, "?$1")
+	if !d.supportsReturning {
+		query = returningClauseRegex.ReplaceAllString(query, "")
+	}
+	return query
+}
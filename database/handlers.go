@@ -3,26 +3,89 @@ package database
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/opentracing/opentracing-go"
+
+	"github.com/bygui86/go-k8s-probes/logging"
 )
 
-func GetProducts(db *sql.DB, start, count int, ctx context.Context) ([]*Product, error) {
+// SQLRepository implements ProductRepository on top of the supported SQL databases
+type SQLRepository struct {
+	db       *sql.DB
+	dialect  *dialect
+	replicas *ReplicaSet
+}
+
+// NewRepository creates a SQLRepository for the DB driver currently configured
+func NewRepository(db *sql.DB) (*SQLRepository, error) {
+	d, dialectErr := loadDialect()
+	if dialectErr != nil {
+		return nil, dialectErr
+	}
+	return &SQLRepository{db: db, dialect: d}, nil
+}
+
+func NewPostgresRepository(db *sql.DB) *SQLRepository {
+	return &SQLRepository{db: db, dialect: postgresDialect}
+}
+
+func NewSQLiteRepository(db *sql.DB) *SQLRepository {
+	return &SQLRepository{db: db, dialect: sqliteDialect}
+}
+
+// SetReplicas routes reads to the given replicas, unless the context requires the primary (see WithPrimary)
+func (r *SQLRepository) SetReplicas(replicas *ReplicaSet) {
+	r.replicas = replicas
+}
+
+// readDB returns the DB interface reads should go to, a healthy replica if any
+func (r *SQLRepository) readDB(ctx context.Context) (*sql.DB, string) {
+	if r.replicas == nil || usePrimary(ctx) {
+		return r.db, primaryTarget
+	}
+	rep := r.replicas.pick()
+	if rep == nil {
+		return r.db, primaryTarget
+	}
+	return rep.db, rep.name
+}
+
+func (r *SQLRepository) GetProducts(query *ProductsQuery, ctx context.Context) (*ProductsPage, error) {
 	span := opentracing.StartSpan(
 		"get-products-db",
 		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
 	defer span.Finish()
 
-	span.SetTag("query", getProductsQuery)
-	span.SetTag("count", count)
-	span.SetTag("start", start)
+	keys, boundary, direction, queryErr := resolveQuery(query)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	// one more than requested, to know whether there is another page
+	productsQuery, args := buildProductsQuery(r.dialect, query, keys, boundary, direction, query.Limit+1)
+
+	db, target := r.readDB(ctx)
+	span.SetTag("query", productsQuery)
+	span.SetTag("count", query.Limit)
+	span.SetTag("sort", formatSort(keys))
+	span.SetTag("db-target", target)
 	span.LogKV(
-		"query", getProductsQuery,
-		"count", count,
-		"start", start,
+		"query", productsQuery,
+		"count", query.Limit,
+		"sort", formatSort(keys),
+		"db-target", target,
 	)
 
-	rows, err := db.QueryContext(ctx, getProductsQuery, count, start)
+	// read first, a product changed while reading the page makes the list look modified the next time
+	var lastModified time.Time
+	err := db.QueryRowContext(ctx, getLastModifiedQuery).Scan(&lastModified)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, productsQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -31,32 +94,55 @@ func GetProducts(db *sql.DB, start, count int, ctx context.Context) ([]*Product,
 	products := make([]*Product, 0)
 	for rows.Next() {
 		var prod Product
-		if err := rows.Scan(&prod.ID, &prod.Name, &prod.Price); err != nil {
+		if err := rows.Scan(&prod.ID, &prod.Name, &prod.Price, &prod.Currency, &prod.Version, &prod.DeletedAt,
+			&prod.UpdatedAt); err != nil {
 			return nil, err
 		}
 		products = append(products, &prod)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	span.SetTag("products-found", len(products))
-	span.LogKV("products-found", len(products))
+	page := buildPage(products, query, keys, direction)
+	page.LastModified = lastModified
+	if query.WithTotal {
+		countQuery, countArgs := buildCountQuery(r.dialect, query)
+		err = db.QueryRowContext(ctx, countQuery, countArgs...).Scan(&page.Total)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	span.SetTag("products-found", len(page.Products))
+	span.LogKV("products-found", len(page.Products))
 
-	return products, nil
+	return page, nil
 }
 
-func GetProduct(db *sql.DB, product *Product, ctx context.Context) error {
+func (r *SQLRepository) GetProduct(product *Product, includeDeleted bool, ctx context.Context) error {
 	span := opentracing.StartSpan(
 		"get-product-db",
 		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
 	defer span.Finish()
 
+	db, target := r.readDB(ctx)
 	span.SetTag("product-id", product.ID)
-	span.LogKV("product-id", product.ID)
+	span.SetTag("include-deleted", includeDeleted)
+	span.SetTag("db-target", target)
+	span.LogKV("product-id", product.ID, "include-deleted", includeDeleted, "db-target", target)
 
-	return db.QueryRowContext(ctx, getProductQuery, product.ID).
-		Scan(&product.Name, &product.Price)
+	err := r.readProduct(db, product, ctx)
+	if err != nil {
+		return err
+	}
+	if product.DeletedAt != nil && !includeDeleted {
+		return ErrProductNotFound
+	}
+	return nil
 }
 
-func CreateProduct(db *sql.DB, product *Product, ctx context.Context) error {
+func (r *SQLRepository) CreateProduct(product *Product, ctx context.Context) error {
 	span := opentracing.StartSpan(
 		"create-product-db",
 		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
@@ -65,14 +151,25 @@ func CreateProduct(db *sql.DB, product *Product, ctx context.Context) error {
 	span.SetTag("product", product.String())
 	span.LogKV("product", product.String())
 
-	err := db.QueryRowContext(ctx, createProductQuery, product.Name, product.Price).Scan(&product.ID)
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer rollback(tx)
+
+	product.UpdatedAt = changeTime()
+	err := r.insertProduct(tx, product, ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	err = r.recordChange(tx, ActionCreate, product, product.UpdatedAt, ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func UpdateProduct(db *sql.DB, product *Product, ctx context.Context) error {
+func (r *SQLRepository) UpdateProduct(product *Product, ctx context.Context) error {
 	span := opentracing.StartSpan(
 		"update-product-db",
 		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
@@ -81,19 +178,456 @@ func UpdateProduct(db *sql.DB, product *Product, ctx context.Context) error {
 	span.SetTag("product", product.String())
 	span.LogKV("product", product.String())
 
-	_, err := db.ExecContext(ctx, updateProductQuery, product.Name, product.Price, product.ID)
-	return err
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer rollback(tx)
+
+	updatedAt := changeTime()
+	result, err := tx.ExecContext(ctx, r.dialect.rebind(updateProductQuery),
+		product.Name, product.Price, product.Currency, product.ID, product.Version, updatedAt)
+	if err != nil {
+		return err
+	}
+	affected, affErr := result.RowsAffected()
+	if affErr != nil {
+		return affErr
+	}
+	if affected == 0 {
+		return r.explainNoRowsAffected(tx, product.ID, ctx)
+	}
+
+	// read back the new version within the same transaction, not to catch other writers changes
+	err = tx.QueryRowContext(ctx, r.dialect.rebind(getProductVersionQuery), product.ID).Scan(&product.Version)
+	if err != nil {
+		return err
+	}
+	product.DeletedAt = nil
+	product.UpdatedAt = updatedAt
+	err = r.recordChange(tx, ActionUpdate, product, updatedAt, ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// PatchProduct reads the product locking it, applies the patch and writes it back, all in one transaction
+func (r *SQLRepository) PatchProduct(product *Product, patch ProductPatch, ctx context.Context) error {
+	span := opentracing.StartSpan(
+		"patch-product-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	span.SetTag("product-id", product.ID)
+	span.SetTag("product-version", product.Version)
+	span.LogKV("product-id", product.ID, "product-version", product.Version)
+
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer rollback(tx)
+
+	current := &Product{ID: product.ID}
+	err := tx.QueryRowContext(ctx, r.dialect.rebind(lockProductQuery+r.dialect.lockRowClause), product.ID).
+		Scan(&current.Name, &current.Price, &current.Currency, &current.Version)
+	if err == sql.ErrNoRows {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if product.Version != 0 && product.Version != current.Version {
+		return ErrVersionMismatch
+	}
+
+	patched := *current
+	patchErr := patch(&patched)
+	if patchErr != nil {
+		return patchErr
+	}
+
+	// the row is locked, the version can't change in the meantime
+	updatedAt := changeTime()
+	_, err = tx.ExecContext(ctx, r.dialect.rebind(updateProductQuery),
+		patched.Name, patched.Price, patched.Currency, current.ID, current.Version, updatedAt)
+	if err != nil {
+		return err
+	}
+	patched.ID = current.ID
+	patched.Version = current.Version + 1
+	patched.DeletedAt = nil
+	patched.UpdatedAt = updatedAt
+	err = r.recordChange(tx, ActionUpdate, &patched, updatedAt, ctx)
+	if err != nil {
+		return err
+	}
+	commitErr := tx.Commit()
+	if commitErr != nil {
+		return commitErr
+	}
+
+	*product = patched
+	return nil
 }
 
-func DeleteProduct(db *sql.DB, productId int, ctx context.Context) error {
+// DeleteProduct marks the product as deleted, it's kept to be restored and for the history
+func (r *SQLRepository) DeleteProduct(productId, version int, ctx context.Context) error {
 	span := opentracing.StartSpan(
 		"delete-product-db",
 		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
 	defer span.Finish()
 
 	span.SetTag("product-id", productId)
-	span.LogKV("product-id", productId)
+	span.SetTag("product-version", version)
+	span.LogKV("product-id", productId, "product-version", version)
+
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer rollback(tx)
+
+	deletedAt := changeTime()
+	result, err := tx.ExecContext(ctx, r.dialect.rebind(deleteProductQuery), productId, version, deletedAt)
+	if err != nil {
+		return err
+	}
+	affected, affErr := result.RowsAffected()
+	if affErr != nil {
+		return affErr
+	}
+	if affected == 0 {
+		return r.explainNoRowsAffected(tx, productId, ctx)
+	}
+
+	deleted := &Product{ID: productId}
+	err = r.readProduct(tx, deleted, ctx)
+	if err != nil {
+		return err
+	}
+	err = r.recordChange(tx, ActionDelete, deleted, deletedAt, ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLRepository) RestoreProduct(product *Product, ctx context.Context) error {
+	span := opentracing.StartSpan(
+		"restore-product-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	span.SetTag("product-id", product.ID)
+	span.SetTag("product-version", product.Version)
+	span.LogKV("product-id", product.ID, "product-version", product.Version)
+
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer rollback(tx)
+
+	restoredAt := changeTime()
+	result, err := tx.ExecContext(ctx, r.dialect.rebind(restoreProductQuery), product.ID, product.Version, restoredAt)
+	if err != nil {
+		return err
+	}
+	affected, affErr := result.RowsAffected()
+	if affErr != nil {
+		return affErr
+	}
+	if affected == 0 {
+		return r.explainNotRestored(tx, product, ctx)
+	}
 
-	_, err := db.ExecContext(ctx, deleteProductQuery, productId)
+	err = r.readProduct(tx, product, ctx)
+	if err != nil {
+		return err
+	}
+	err = r.recordChange(tx, ActionRestore, product, restoredAt, ctx)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *SQLRepository) ImportProducts(products []*Product, ctx context.Context) error {
+	span := opentracing.StartSpan(
+		"import-products-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	span.SetTag("products-count", len(products))
+	span.SetTag("copy", r.dialect.supportsCopy)
+	span.LogKV("products-count", len(products), "copy", r.dialect.supportsCopy)
+
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+	defer rollback(tx)
+
+	var err error
+	if r.dialect.supportsCopy {
+		err = r.copyProducts(tx, products, ctx)
+	} else {
+		err = r.insertProducts(tx, products, ctx)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// copyProducts streams all the rows at once through COPY, for products, their history and outbox events
+func (r *SQLRepository) copyProducts(tx *sql.Tx, products []*Product, ctx context.Context) error {
+	changedAt := changeTime()
+	rows, err := tx.QueryContext(ctx, allocateProductIdsQuery, len(products))
+	if err != nil {
+		return err
+	}
+	for index, product := range products {
+		if !rows.Next() {
+			_ = rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			// products left without ID must not be inserted, the whole batch is rolled back
+			return fmt.Errorf("product IDs allocation failed: %d IDs allocated for %d products", index, len(products))
+		}
+		if err := rows.Scan(&product.ID); err != nil {
+			_ = rows.Close()
+			return err
+		}
+		product.Version = initialVersion
+		product.UpdatedAt = changedAt
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	productsStmt, stmtErr := tx.PrepareContext(ctx, pq.CopyIn(productsTable, "id", "name", "price", "currency", "updated_at"))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer productsStmt.Close()
+	for _, product := range products {
+		_, err := productsStmt.ExecContext(ctx, product.ID, product.Name, product.Price, product.Currency,
+			product.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	// flushes the buffered rows
+	_, err = productsStmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	historyStmt, stmtErr := tx.PrepareContext(ctx, pq.CopyIn(productHistoryTable,
+		"product_id", "version", "action", "actor", "name", "price", "currency", "changed_at"))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer historyStmt.Close()
+	for _, product := range products {
+		change := newProductChange(ActionCreate, product, changedAt, ctx)
+		_, err := historyStmt.ExecContext(ctx, product.ID, change.Version, change.Action, change.Actor,
+			change.Name, change.Price, change.Currency, change.ChangedAt.UTC())
+		if err != nil {
+			return err
+		}
+	}
+	_, err = historyStmt.ExecContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	outboxStmt, stmtErr := tx.PrepareContext(ctx, pq.CopyIn(outboxTable,
+		"event_type", "product_id", "payload", "created_at", "next_attempt_at"))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer outboxStmt.Close()
+	for _, product := range products {
+		event, eventErr := newOutboxEvent(newProductChange(ActionCreate, product, changedAt, ctx), product)
+		if eventErr != nil {
+			return eventErr
+		}
+		_, err := outboxStmt.ExecContext(ctx, event.Type, event.ProductID, string(event.Payload),
+			event.CreatedAt, event.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = outboxStmt.ExecContext(ctx)
+	return err
+}
+
+// insertProducts inserts the rows one by one, through prepared statements not to parse them every time
+func (r *SQLRepository) insertProducts(tx *sql.Tx, products []*Product, ctx context.Context) error {
+	productsStmt, stmtErr := tx.PrepareContext(ctx, r.dialect.rebind(createProductQuery))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer productsStmt.Close()
+	historyStmt, stmtErr := tx.PrepareContext(ctx, r.dialect.rebind(insertProductChangeQuery))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer historyStmt.Close()
+	outboxStmt, stmtErr := tx.PrepareContext(ctx, r.dialect.rebind(insertOutboxEventQuery))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer outboxStmt.Close()
+
+	changedAt := changeTime()
+	for _, product := range products {
+		product.UpdatedAt = changedAt
+		err := r.execInsertProduct(productsStmt, product, ctx)
+		if err != nil {
+			return err
+		}
+		change := newProductChange(ActionCreate, product, changedAt, ctx)
+		_, err = historyStmt.ExecContext(ctx, product.ID, change.Version, change.Action, change.Actor,
+			change.Name, change.Price, change.Currency, change.ChangedAt.UTC())
+		if err != nil {
+			return err
+		}
+		err = execInsertOutboxEvent(outboxStmt.ExecContext, change, product, ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SQLRepository) insertProduct(tx *sql.Tx, product *Product, ctx context.Context) error {
+	stmt, stmtErr := tx.PrepareContext(ctx, r.dialect.rebind(createProductQuery))
+	if stmtErr != nil {
+		return stmtErr
+	}
+	defer stmt.Close()
+	return r.execInsertProduct(stmt, product, ctx)
+}
+
+// execInsertProduct runs the prepared createProductQuery, setting the ID and version of the product.
+// The update time must be set already.
+func (r *SQLRepository) execInsertProduct(stmt *sql.Stmt, product *Product, ctx context.Context) error {
+	product.DeletedAt = nil
+	if !r.dialect.supportsReturning {
+		result, err := stmt.ExecContext(ctx, product.Name, product.Price, product.Currency, product.UpdatedAt)
+		if err != nil {
+			return err
+		}
+		id, idErr := result.LastInsertId()
+		if idErr != nil {
+			return idErr
+		}
+		product.ID = int(id)
+		product.Version = initialVersion
+		return nil
+	}
+
+	return stmt.QueryRowContext(ctx, product.Name, product.Price, product.Currency, product.UpdatedAt).
+		Scan(&product.ID, &product.Version)
+}
+
+func (r *SQLRepository) ExportProducts(fn func(product *Product) error, ctx context.Context) error {
+	span := opentracing.StartSpan(
+		"export-products-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	db, target := r.readDB(ctx)
+	span.SetTag("db-target", target)
+	span.LogKV("db-target", target)
+
+	rows, err := db.QueryContext(ctx, exportProductsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	exported := 0
+	// a single product is reused, rows are streamed without being held in memory
+	var product Product
+	for rows.Next() {
+		if err := rows.Scan(&product.ID, &product.Name, &product.Price, &product.Currency, &product.Version,
+			&product.UpdatedAt); err != nil {
+			return err
+		}
+		if err := fn(&product); err != nil {
+			return err
+		}
+		exported++
+	}
+
+	span.SetTag("products-exported", exported)
+	span.LogKV("products-exported", exported)
+
+	return rows.Err()
+}
+
+// explainNoRowsAffected tells apart a missing product from a version mismatch
+func (r *SQLRepository) explainNoRowsAffected(tx *sql.Tx, productId int, ctx context.Context) error {
+	var version int
+	err := tx.QueryRowContext(ctx, r.dialect.rebind(getProductVersionQuery), productId).Scan(&version)
+	if err == sql.ErrNoRows {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
+// explainNotRestored tells apart a missing product from one not deleted and from a version mismatch
+func (r *SQLRepository) explainNotRestored(tx *sql.Tx, product *Product, ctx context.Context) error {
+	var version int
+	var deleted bool
+	err := tx.QueryRowContext(ctx, r.dialect.rebind(getProductStateQuery), product.ID).Scan(&version, &deleted)
+	if err == sql.ErrNoRows {
+		return ErrProductNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrNotDeleted
+	}
+	return ErrVersionMismatch
+}
+
+// queryRower is implemented by both sql.DB and sql.Tx
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// readProduct reads the product by ID, deleted or not
+func (r *SQLRepository) readProduct(db queryRower, product *Product, ctx context.Context) error {
+	err := db.QueryRowContext(ctx, r.dialect.rebind(getProductQuery), product.ID).
+		Scan(&product.Name, &product.Price, &product.Currency, &product.Version, &product.DeletedAt, &product.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return ErrProductNotFound
+	}
 	return err
 }
+
+// changeTime returns the time of a change, truncated to microseconds as Postgres stores it, not to differ once read back
+func changeTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// rollback is meant to be deferred, it's a no-op if the transaction has been committed already
+func rollback(tx *sql.Tx) {
+	err := tx.Rollback()
+	if err != nil && err != sql.ErrTxDone {
+		logging.SugaredLog.Errorf("DB transaction rollback failed: %s", err.Error())
+	}
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	actorContextKey contextKey = "actor"
+
+	// recorded for changes made without an actor in context
+	anonymousActor = "anonymous"
+)
+
+// WithActor sets who is making the changes through the context, to be recorded in the product history
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey, actor)
+}
+
+func actorFromContext(ctx context.Context) string {
+	actor, ok := ctx.Value(actorContextKey).(string)
+	if !ok || actor == "" {
+		return anonymousActor
+	}
+	return actor
+}
+
+func newProductChange(action string, product *Product, changedAt time.Time, ctx context.Context) *ProductChange {
+	return &ProductChange{
+		Version:   product.Version,
+		Action:    action,
+		Actor:     actorFromContext(ctx),
+		Name:      product.Name,
+		Price:     product.Price,
+		Currency:  product.Currency,
+		ChangedAt: changedAt,
+	}
+}
+
+// recordChange appends the product state to its history and the change event to the outbox,
+// within the transaction of the change
+func (r *SQLRepository) recordChange(tx *sql.Tx, action string, product *Product, changedAt time.Time,
+	ctx context.Context) error {
+
+	change := newProductChange(action, product, changedAt, ctx)
+	_, err := tx.ExecContext(ctx, r.dialect.rebind(insertProductChangeQuery),
+		product.ID, change.Version, change.Action, change.Actor, change.Name, change.Price, change.Currency,
+		change.ChangedAt.UTC())
+	if err != nil {
+		return err
+	}
+	return execInsertOutboxEvent(func(ctx context.Context, args ...interface{}) (sql.Result, error) {
+		return tx.ExecContext(ctx, r.dialect.rebind(insertOutboxEventQuery), args...)
+	}, change, product, ctx)
+}
+
+func (r *SQLRepository) GetProductHistory(productId int, ctx context.Context) ([]*ProductChange, error) {
+	span := opentracing.StartSpan(
+		"get-product-history-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	db, target := r.readDB(ctx)
+	span.SetTag("product-id", productId)
+	span.SetTag("db-target", target)
+	span.LogKV("product-id", productId, "db-target", target)
+
+	rows, err := db.QueryContext(ctx, r.dialect.rebind(getProductHistoryQuery), productId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make([]*ProductChange, 0)
+	for rows.Next() {
+		var change ProductChange
+		err := rows.Scan(&change.Version, &change.Action, &change.Actor,
+			&change.Name, &change.Price, &change.Currency, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, &change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// products created before the history was introduced have none
+	if len(history) == 0 {
+		var count int
+		err := db.QueryRowContext(ctx, r.dialect.rebind(countProductQuery), productId).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, ErrProductNotFound
+		}
+	}
+
+	span.SetTag("changes-found", len(history))
+	span.LogKV("changes-found", len(history))
+
+	return history, nil
+}
+
+func (r *MemoryRepository) GetProductHistory(productId int, ctx context.Context) ([]*ProductChange, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if _, found := r.products[productId]; !found {
+		return nil, ErrProductNotFound
+	}
+	history := make([]*ProductChange, 0, len(r.history[productId]))
+	for _, change := range r.history[productId] {
+		changeCopy := *change
+		history = append(history, &changeCopy)
+	}
+	return history, nil
+}
+
+// recordChange must be invoked holding the write lock
+func (r *MemoryRepository) recordChange(action string, product *Product, changedAt time.Time, ctx context.Context) {
+	change := newProductChange(action, product, changedAt, ctx)
+	r.history[product.ID] = append(r.history[product.ID], change)
+	r.enqueueEvent(change, product)
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+func (r *SQLRepository) ReserveIdempotencyKey(key, fingerprint string, expiresAt time.Time,
+	ctx context.Context) (*IdempotencyRecord, error) {
+
+	span := opentracing.StartSpan(
+		"reserve-idempotency-key-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer rollback(tx)
+
+	// an expired key not collected by the janitor yet must not be replayed
+	_, err := tx.ExecContext(ctx, r.dialect.rebind(deleteExpiredIdempotencyKeyQuery), key, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.ExecContext(ctx, r.dialect.rebind(reserveIdempotencyKeyQuery), key, fingerprint, expiresAt.UTC())
+	if err != nil {
+		return nil, err
+	}
+	reserved, affErr := result.RowsAffected()
+	if affErr != nil {
+		return nil, affErr
+	}
+
+	span.SetTag("reserved", reserved == 1)
+	span.LogKV("reserved", reserved == 1)
+
+	if reserved == 1 {
+		return nil, tx.Commit()
+	}
+
+	record := &IdempotencyRecord{Key: key}
+	var headers string
+	err = tx.QueryRowContext(ctx, r.dialect.rebind(getIdempotencyKeyQuery), key).
+		Scan(&record.Fingerprint, &record.StatusCode, &headers, &record.Body)
+	if err != nil {
+		return nil, err
+	}
+	unmarshErr := json.Unmarshal([]byte(headers), &record.Headers)
+	if unmarshErr != nil {
+		return nil, unmarshErr
+	}
+	return record, tx.Commit()
+}
+
+func (r *SQLRepository) CompleteIdempotencyKey(record *IdempotencyRecord, expiresAt time.Time,
+	ctx context.Context) error {
+
+	span := opentracing.StartSpan(
+		"complete-idempotency-key-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	span.SetTag("status-code", record.StatusCode)
+	span.LogKV("status-code", record.StatusCode)
+
+	headers, marshErr := json.Marshal(record.Headers)
+	if marshErr != nil {
+		return marshErr
+	}
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind(completeIdempotencyKeyQuery),
+		record.Key, record.StatusCode, string(headers), record.Body, expiresAt.UTC())
+	return err
+}
+
+func (r *SQLRepository) ReleaseIdempotencyKey(key string, ctx context.Context) error {
+	span := opentracing.StartSpan(
+		"release-idempotency-key-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind(releaseIdempotencyKeyQuery), key)
+	return err
+}
+
+func (r *SQLRepository) DeleteExpiredIdempotencyKeys(now time.Time, ctx context.Context) (int64, error) {
+	result, err := r.db.ExecContext(ctx, r.dialect.rebind(deleteExpiredIdempotencyKeysQuery), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *MemoryRepository) ReserveIdempotencyKey(key, fingerprint string, expiresAt time.Time,
+	ctx context.Context) (*IdempotencyRecord, error) {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, found := r.idempotencyKeys[key]
+	if found && stored.expiresAt.After(time.Now()) {
+		return copyIdempotencyRecord(&stored.IdempotencyRecord), nil
+	}
+	r.idempotencyKeys[key] = &memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{Key: key, Fingerprint: fingerprint},
+		expiresAt:         expiresAt,
+	}
+	return nil, nil
+}
+
+func (r *MemoryRepository) CompleteIdempotencyKey(record *IdempotencyRecord, expiresAt time.Time,
+	ctx context.Context) error {
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, found := r.idempotencyKeys[record.Key]
+	if !found {
+		return sql.ErrNoRows
+	}
+	completed := copyIdempotencyRecord(record)
+	completed.Fingerprint = stored.Fingerprint
+	stored.IdempotencyRecord = *completed
+	stored.expiresAt = expiresAt
+	return nil
+}
+
+func (r *MemoryRepository) ReleaseIdempotencyKey(key string, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, found := r.idempotencyKeys[key]
+	if found && stored.StatusCode == 0 {
+		delete(r.idempotencyKeys, key)
+	}
+	return nil
+}
+
+func (r *MemoryRepository) DeleteExpiredIdempotencyKeys(now time.Time, ctx context.Context) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var deleted int64
+	for key, stored := range r.idempotencyKeys {
+		if stored.expiresAt.Before(now) {
+			delete(r.idempotencyKeys, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func copyIdempotencyRecord(record *IdempotencyRecord) *IdempotencyRecord {
+	recordCopy := *record
+	recordCopy.Headers = make(map[string]string, len(record.Headers))
+	for name, value := range record.Headers {
+		recordCopy.Headers[name] = value
+	}
+	recordCopy.Body = append([]byte(nil), record.Body...)
+	return &recordCopy
+}
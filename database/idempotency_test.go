@@ -0,0 +1,139 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	testIdempotencyStore(t, func(t *testing.T) IdempotencyStore {
+		return NewMemoryRepository()
+	})
+}
+
+func TestSQLiteIdempotencyStore(t *testing.T) {
+	t.Setenv(dbDriverEnvVar, sqliteDriver)
+	t.Setenv(dbPathEnvVar, sqliteInMemoryPath)
+
+	testIdempotencyStore(t, func(t *testing.T) IdempotencyStore {
+		db, dbErr := New()
+		if dbErr != nil {
+			t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return NewSQLiteRepository(db)
+	})
+}
+
+// testIdempotencyStore is the conformance suite every IdempotencyStore implementation must pass.
+// newStore must return an empty store on every invocation.
+func testIdempotencyStore(t *testing.T, newStore func(t *testing.T) IdempotencyStore) {
+	expiresAt := time.Now().Add(time.Hour)
+
+	t.Run("reserve new key", func(t *testing.T) {
+		store := newStore(t)
+		record := mustReserve(t, store, "key", "fingerprint", expiresAt)
+		if record != nil {
+			t.Fatalf("expected key reserved, got record %+v", record)
+		}
+	})
+
+	t.Run("reserve key in progress", func(t *testing.T) {
+		store := newStore(t)
+		mustReserve(t, store, "key", "fingerprint", expiresAt)
+		record := mustReserve(t, store, "key", "other", expiresAt)
+		if record == nil || record.StatusCode != 0 || record.Fingerprint != "fingerprint" {
+			t.Fatalf("expected key in progress with original fingerprint, got %+v", record)
+		}
+	})
+
+	t.Run("replay completed key", func(t *testing.T) {
+		store := newStore(t)
+		mustReserve(t, store, "key", "fingerprint", expiresAt)
+		completeErr := store.CompleteIdempotencyKey(&IdempotencyRecord{
+			Key:        "key",
+			StatusCode: 201,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       []byte(`{"id":1}`),
+		}, expiresAt, testContext())
+		if completeErr != nil {
+			t.Fatalf("key completion failed: %s", completeErr.Error())
+		}
+
+		record := mustReserve(t, store, "key", "fingerprint", expiresAt)
+		if record == nil || record.StatusCode != 201 || record.Fingerprint != "fingerprint" ||
+			record.Headers["Content-Type"] != "application/json" || !bytes.Equal(record.Body, []byte(`{"id":1}`)) {
+			t.Fatalf("expected completed record, got %+v", record)
+		}
+	})
+
+	t.Run("release key in progress", func(t *testing.T) {
+		store := newStore(t)
+		mustReserve(t, store, "key", "fingerprint", expiresAt)
+		releaseErr := store.ReleaseIdempotencyKey("key", testContext())
+		if releaseErr != nil {
+			t.Fatalf("key release failed: %s", releaseErr.Error())
+		}
+		if record := mustReserve(t, store, "key", "other", expiresAt); record != nil {
+			t.Fatalf("expected released key reserved again, got record %+v", record)
+		}
+	})
+
+	t.Run("release keeps completed key", func(t *testing.T) {
+		store := newStore(t)
+		mustReserve(t, store, "key", "fingerprint", expiresAt)
+		_ = store.CompleteIdempotencyKey(&IdempotencyRecord{Key: "key", StatusCode: 201}, expiresAt, testContext())
+		_ = store.ReleaseIdempotencyKey("key", testContext())
+		if record := mustReserve(t, store, "key", "fingerprint", expiresAt); record == nil || record.StatusCode != 201 {
+			t.Fatalf("expected completed record, got %+v", record)
+		}
+	})
+
+	t.Run("completion extends the lease", func(t *testing.T) {
+		store := newStore(t)
+		lease := time.Now().Add(100 * time.Millisecond)
+		mustReserve(t, store, "key", "fingerprint", lease)
+		_ = store.CompleteIdempotencyKey(&IdempotencyRecord{Key: "key", StatusCode: 201}, expiresAt, testContext())
+		time.Sleep(time.Until(lease))
+		if record := mustReserve(t, store, "key", "fingerprint", expiresAt); record == nil || record.StatusCode != 201 {
+			t.Fatalf("expected completed record kept after the lease, got %+v", record)
+		}
+	})
+
+	t.Run("expired key reserved again", func(t *testing.T) {
+		store := newStore(t)
+		mustReserve(t, store, "key", "fingerprint", time.Now().Add(-time.Minute))
+		if record := mustReserve(t, store, "key", "other", expiresAt); record != nil {
+			t.Fatalf("expected expired key reserved again, got record %+v", record)
+		}
+	})
+
+	t.Run("delete expired keys", func(t *testing.T) {
+		store := newStore(t)
+		mustReserve(t, store, "expired", "fingerprint", time.Now().Add(-time.Minute))
+		mustReserve(t, store, "valid", "fingerprint", expiresAt)
+
+		deleted, deleteErr := store.DeleteExpiredIdempotencyKeys(time.Now(), testContext())
+		if deleteErr != nil {
+			t.Fatalf("expired keys deletion failed: %s", deleteErr.Error())
+		}
+		if deleted != 1 {
+			t.Errorf("expected 1 expired key deleted, got %d", deleted)
+		}
+		if record := mustReserve(t, store, "valid", "other", expiresAt); record == nil {
+			t.Errorf("expected valid key kept")
+		}
+	})
+}
+
+func mustReserve(t *testing.T, store IdempotencyStore, key, fingerprint string,
+	expiresAt time.Time) *IdempotencyRecord {
+
+	t.Helper()
+	record, err := store.ReserveIdempotencyKey(key, fingerprint, expiresAt, testContext())
+	if err != nil {
+		t.Fatalf("key %s reservation failed: %s", key, err.Error())
+	}
+	return record
+}
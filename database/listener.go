@@ -0,0 +1,182 @@
+package database
+
+import (
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	// ProductChangesChannel carries a ProductChangeNotification for every product inserted, updated or deleted
+	ProductChangesChannel = "product_changes"
+
+	ProductChangeInsert = "insert"
+	ProductChangeUpdate = "update"
+	ProductChangeDelete = "delete"
+)
+
+// NewListener connects the notifications listener in background, it returns nil if disabled or if the DB driver
+// doesn't support notifications
+func NewListener() *Listener {
+	logging.Log.Info("Create new DB listener")
+
+	cfg := loadConfig()
+	if !cfg.listenerEnabled {
+		logging.Log.Debug("DB listener disabled, no notification received from other instances")
+		return nil
+	}
+	if cfg.dbDriver != postgresDriver {
+		logging.SugaredLog.Debugf("DB notifications not supported by %s driver, no DB listener created", cfg.dbDriver)
+		return nil
+	}
+
+	listener := newListener(cfg.listenerPingInterval)
+	listener.listener = pq.NewListener(buildDataSourceName(cfg),
+		cfg.listenerMinReconnectInterval, cfg.listenerMaxReconnectInterval, listener.onEvent)
+	listener.stopped.Add(1)
+	go listener.run()
+	return listener
+}
+
+func newListener(pingInterval time.Duration) *Listener {
+	return &Listener{
+		pingInterval: pingInterval,
+		stop:         make(chan struct{}),
+		subscribers:  make(map[string][]NotificationHandler),
+	}
+}
+
+// Subscribe invokes handler for every notification on the channel from now on.
+// The channel is LISTENed to in background, as soon as connected.
+func (l *Listener) Subscribe(channel string, handler NotificationHandler) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, found := l.subscribers[channel]; !found {
+		// blocks until connected
+		go l.listen(channel)
+	}
+	l.subscribers[channel] = append(l.subscribers[channel], handler)
+}
+
+func (l *Listener) listen(channel string) {
+	err := l.listener.Listen(channel)
+	if err != nil {
+		select {
+		case <-l.stop:
+			// closed before ever connecting
+			return
+		default:
+		}
+		logging.SugaredLog.Errorf("DB listener subscription to %s failed: %s", channel, err.Error())
+		return
+	}
+	logging.SugaredLog.Infof("DB listener subscribed to %s", channel)
+}
+
+// Close stops the fan-out and closes the connection
+func (l *Listener) Close() error {
+	logging.Log.Info("Close DB listener")
+
+	select {
+	case <-l.stop:
+		// already closed
+		return nil
+	default:
+		close(l.stop)
+	}
+	l.stopped.Wait()
+	return l.listener.Close()
+}
+
+// GetStatus returns the state of the connection as of the last listener event
+func (l *Listener) GetStatus() *ListenerStatus {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	status := &ListenerStatus{
+		Connected: l.connected,
+		Channels:  make([]string, 0, len(l.subscribers)),
+	}
+	for channel := range l.subscribers {
+		status.Channels = append(status.Channels, channel)
+	}
+	sort.Strings(status.Channels)
+	if l.lastError != nil {
+		status.Error = l.lastError.Error()
+	}
+	return status
+}
+
+func (l *Listener) run() {
+	defer l.stopped.Done()
+
+	// notifications may not arrive for long, pings spot the connections broken meanwhile
+	ticker := time.NewTicker(l.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case received, ok := <-l.listener.Notify:
+			if !ok {
+				return
+			}
+			l.dispatch(received)
+		case <-ticker.C:
+			err := l.listener.Ping()
+			if err != nil {
+				logging.SugaredLog.Debugf("DB listener ping failed: %s", err.Error())
+			}
+		}
+	}
+}
+
+// dispatch invokes the subscribers of the channel, all of them if received is nil: pq sends nil after reconnecting
+func (l *Listener) dispatch(received *pq.Notification) {
+	l.mutex.RLock()
+	notifications := make(map[*Notification][]NotificationHandler)
+	if received == nil {
+		for channel, handlers := range l.subscribers {
+			notifications[&Notification{Channel: channel, Lost: true}] = handlers
+		}
+	} else if handlers := l.subscribers[received.Channel]; len(handlers) > 0 {
+		notifications[&Notification{Channel: received.Channel, Payload: received.Extra}] = handlers
+	}
+	// handlers invoked without holding the mutex, they may subscribe in turn
+	l.mutex.RUnlock()
+
+	for notification, handlers := range notifications {
+		for _, handler := range handlers {
+			handler(notification)
+		}
+	}
+}
+
+// onEvent tracks the state of the connection, invoked by pq.Listener
+func (l *Listener) onEvent(event pq.ListenerEventType, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	switch event {
+	case pq.ListenerEventConnected:
+		logging.Log.Info("DB listener connected")
+		l.connected = true
+		l.lastError = nil
+	case pq.ListenerEventReconnected:
+		logging.Log.Info("DB listener reconnected, notifications sent meanwhile are lost")
+		l.connected = true
+		l.lastError = nil
+	case pq.ListenerEventDisconnected:
+		logging.SugaredLog.Warnf("DB listener disconnected: %s", err.Error())
+		l.connected = false
+		l.lastError = err
+	case pq.ListenerEventConnectionAttemptFailed:
+		logging.SugaredLog.Warnf("DB listener connection failed: %s", err.Error())
+		l.connected = false
+		l.lastError = err
+	}
+}
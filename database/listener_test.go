@@ -0,0 +1,137 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/bygui86/go-k8s-probes/utils"
+)
+
+func TestListenerFanOut(t *testing.T) {
+	listener := newListener(time.Minute)
+	received := make(map[string][]Notification)
+	subscribe := func(name, channel string) {
+		listener.subscribers[channel] = append(listener.subscribers[channel], func(notification *Notification) {
+			received[name] = append(received[name], *notification)
+		})
+	}
+	subscribe("first", ProductChangesChannel)
+	subscribe("second", ProductChangesChannel)
+	subscribe("other", "other_changes")
+
+	listener.dispatch(&pq.Notification{Channel: ProductChangesChannel, Extra: `{"op":"update","id":1}`})
+	listener.dispatch(&pq.Notification{Channel: "unknown", Extra: "ignored"})
+	// after reconnecting
+	listener.dispatch(nil)
+
+	expected := map[string][]Notification{
+		"first": {
+			{Channel: ProductChangesChannel, Payload: `{"op":"update","id":1}`},
+			{Channel: ProductChangesChannel, Lost: true},
+		},
+		"second": {
+			{Channel: ProductChangesChannel, Payload: `{"op":"update","id":1}`},
+			{Channel: ProductChangesChannel, Lost: true},
+		},
+		"other": {
+			{Channel: "other_changes", Lost: true},
+		},
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Fatalf("expected %v, got %v", expected, received)
+	}
+}
+
+func TestListenerStatus(t *testing.T) {
+	listener := newListener(time.Minute)
+	listener.subscribers[ProductChangesChannel] = nil
+
+	listener.onEvent(pq.ListenerEventConnectionAttemptFailed, errors.New("connection refused"))
+	if status := listener.GetStatus(); status.Connected || status.Error != "connection refused" {
+		t.Fatalf("expected disconnected, got %+v", status)
+	}
+
+	listener.onEvent(pq.ListenerEventConnected, nil)
+	expected := &ListenerStatus{Connected: true, Channels: []string{ProductChangesChannel}}
+	if status := listener.GetStatus(); !reflect.DeepEqual(status, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, status)
+	}
+}
+
+func TestCacheFollowsProductChanges(t *testing.T) {
+	cache, counting := newCountingCache(t, 10,
+		&Product{Name: "lamp", Price: price("1"), Currency: "EUR"},
+		&Product{Name: "desk", Price: price("2"), Currency: "EUR"})
+	ctx := testContext()
+	readAll := func() {
+		for _, id := range []int{1, 2} {
+			if err := cache.GetProduct(&Product{ID: id}, false, ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	readAll()
+
+	tests := []struct {
+		notification  *Notification
+		expectedReads int32
+	}{
+		{&Notification{Channel: ProductChangesChannel, Payload: `{"op":"insert","id":3}`}, 0},
+		{&Notification{Channel: ProductChangesChannel, Payload: `{"op":"update","id":1}`}, 1},
+		{&Notification{Channel: ProductChangesChannel, Payload: `{"op":"delete","id":2}`}, 1},
+		{&Notification{Channel: ProductChangesChannel, Lost: true}, 2},
+		{&Notification{Channel: ProductChangesChannel, Payload: "garbage"}, 2},
+	}
+	for _, test := range tests {
+		readsBefore := counting.reads.Load()
+		cache.OnProductChange(test.notification)
+		readAll()
+		if reads := counting.reads.Load() - readsBefore; reads != test.expectedReads {
+			t.Errorf("%+v: expected %d reads, got %d", test.notification, test.expectedReads, reads)
+		}
+	}
+}
+
+func TestPostgresListener(t *testing.T) {
+	if !utils.GetBoolEnv(testPostgresEnvVar, false) {
+		t.Skipf("%s not set, skipping PostgreSQL listener tests", testPostgresEnvVar)
+	}
+
+	db, dbErr := New()
+	if dbErr != nil {
+		t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+	}
+	defer db.Close()
+
+	listener := NewListener()
+	defer listener.Close()
+	notifications := make(chan *Notification, 10)
+	listener.Subscribe(ProductChangesChannel, func(notification *Notification) {
+		notifications <- notification
+	})
+	for !listener.GetStatus().Connected {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// LISTEN is issued in background
+	time.Sleep(100 * time.Millisecond)
+
+	repository := NewPostgresRepository(db)
+	product := &Product{Name: "lamp", Price: price("1"), Currency: "EUR"}
+	mustCreate(t, repository, product)
+
+	select {
+	case notification := <-notifications:
+		change := &ProductChangeNotification{}
+		if err := json.Unmarshal([]byte(notification.Payload), change); err != nil ||
+			*change != (ProductChangeNotification{Operation: ProductChangeInsert, ProductID: product.ID}) {
+			t.Fatalf("expected insert of %d notified, got %s", product.ID, notification.Payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("product change not notified")
+	}
+}
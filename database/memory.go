@@ -0,0 +1,249 @@
+package database
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository implements ProductRepository, keeping products in memory (e.g. for tests)
+type MemoryRepository struct {
+	mutex           sync.RWMutex
+	products        map[int]*Product
+	lastID          int
+	history         map[int][]*ProductChange
+	outbox          []*memoryOutboxEvent
+	lastOutboxID    int64
+	idempotencyKeys map[string]*memoryIdempotencyRecord
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	expiresAt time.Time
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		products:        make(map[int]*Product),
+		history:         make(map[int][]*ProductChange),
+		idempotencyKeys: make(map[string]*memoryIdempotencyRecord),
+	}
+}
+
+func (r *MemoryRepository) GetProducts(query *ProductsQuery, ctx context.Context) (*ProductsPage, error) {
+	keys, boundary, direction, queryErr := resolveQuery(query)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	tokens := searchTokens(query.Search)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var lastModified time.Time
+	found := make([]*Product, 0)
+	for _, product := range r.products {
+		if product.UpdatedAt.After(lastModified) {
+			lastModified = product.UpdatedAt
+		}
+		if !matches(product, query, tokens) {
+			continue
+		}
+		found = append(found, product)
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return compareProducts(found[i], found[j], keys, direction) < 0
+	})
+
+	products := make([]*Product, 0)
+	skipped := 0
+	for _, product := range found {
+		if len(products) > query.Limit {
+			break
+		}
+		if boundary != nil && compareProducts(product, boundary.product(), keys, direction) <= 0 {
+			continue
+		}
+		if boundary == nil && skipped < query.Offset {
+			skipped++
+			continue
+		}
+		products = append(products, copyProduct(product))
+	}
+
+	page := buildPage(products, query, keys, direction)
+	page.LastModified = lastModified
+	if query.WithTotal {
+		page.Total = len(found)
+	}
+	return page, nil
+}
+
+func (r *MemoryRepository) GetProduct(product *Product, includeDeleted bool, ctx context.Context) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	stored, found := r.products[product.ID]
+	if !found || (stored.DeletedAt != nil && !includeDeleted) {
+		return ErrProductNotFound
+	}
+	*product = *stored
+	return nil
+}
+
+func (r *MemoryRepository) CreateProduct(product *Product, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lastID++
+	product.ID = r.lastID
+	product.Version = initialVersion
+	product.DeletedAt = nil
+	product.UpdatedAt = changeTime()
+	r.products[product.ID] = copyProduct(product)
+	r.recordChange(ActionCreate, product, product.UpdatedAt, ctx)
+	return nil
+}
+
+func (r *MemoryRepository) UpdateProduct(product *Product, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, err := r.checkVersion(product.ID, product.Version)
+	if err != nil {
+		return err
+	}
+
+	product.Version = stored.Version + 1
+	product.DeletedAt = nil
+	product.UpdatedAt = changeTime()
+	r.products[product.ID] = copyProduct(product)
+	r.recordChange(ActionUpdate, product, product.UpdatedAt, ctx)
+	return nil
+}
+
+func (r *MemoryRepository) PatchProduct(product *Product, patch ProductPatch, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, err := r.checkVersion(product.ID, product.Version)
+	if err != nil {
+		return err
+	}
+
+	patched := copyProduct(stored)
+	patchErr := patch(patched)
+	if patchErr != nil {
+		return patchErr
+	}
+	patched.ID = stored.ID
+	patched.Version = stored.Version + 1
+	patched.DeletedAt = nil
+	patched.UpdatedAt = changeTime()
+
+	r.products[patched.ID] = copyProduct(patched)
+	r.recordChange(ActionUpdate, patched, patched.UpdatedAt, ctx)
+	*product = *patched
+	return nil
+}
+
+func (r *MemoryRepository) DeleteProduct(productId, version int, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, err := r.checkVersion(productId, version)
+	if err != nil {
+		return err
+	}
+
+	deletedAt := changeTime()
+	deleted := copyProduct(stored)
+	deleted.Version++
+	deleted.DeletedAt = &deletedAt
+	deleted.UpdatedAt = deletedAt
+	r.products[productId] = deleted
+	r.recordChange(ActionDelete, deleted, deletedAt, ctx)
+	return nil
+}
+
+func (r *MemoryRepository) RestoreProduct(product *Product, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, found := r.products[product.ID]
+	if !found {
+		return ErrProductNotFound
+	}
+	if stored.DeletedAt == nil {
+		return ErrNotDeleted
+	}
+	if product.Version != 0 && stored.Version != product.Version {
+		return ErrVersionMismatch
+	}
+
+	restored := copyProduct(stored)
+	restored.Version++
+	restored.DeletedAt = nil
+	restored.UpdatedAt = changeTime()
+	r.products[product.ID] = restored
+	r.recordChange(ActionRestore, restored, restored.UpdatedAt, ctx)
+	*product = *restored
+	return nil
+}
+
+func (r *MemoryRepository) ImportProducts(products []*Product, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changedAt := changeTime()
+	for _, product := range products {
+		r.lastID++
+		product.ID = r.lastID
+		product.Version = initialVersion
+		product.DeletedAt = nil
+		product.UpdatedAt = changedAt
+		r.products[product.ID] = copyProduct(product)
+		r.recordChange(ActionCreate, product, changedAt, ctx)
+	}
+	return nil
+}
+
+func (r *MemoryRepository) ExportProducts(fn func(product *Product) error, ctx context.Context) error {
+	// fn may be slow, e.g. writing to the network, better not to hold the lock meanwhile
+	r.mutex.RLock()
+	products := make([]*Product, 0, len(r.products))
+	for _, product := range r.products {
+		if product.DeletedAt == nil {
+			products = append(products, copyProduct(product))
+		}
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(products, func(i, j int) bool {
+		return products[i].ID < products[j].ID
+	})
+	for _, product := range products {
+		if err := fn(product); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVersion must be invoked holding the write lock, deleted products are not found
+func (r *MemoryRepository) checkVersion(productId, version int) (*Product, error) {
+	stored, found := r.products[productId]
+	if !found || stored.DeletedAt != nil {
+		return nil, ErrProductNotFound
+	}
+	if version != 0 && stored.Version != version {
+		return nil, ErrVersionMismatch
+	}
+	return stored, nil
+}
+
+func copyProduct(product *Product) *Product {
+	productCopy := *product
+	return &productCopy
+}
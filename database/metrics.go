@@ -0,0 +1,93 @@
+package database
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "db"
+	metricsSubsystem = "pool"
+
+	closedReasonMaxIdle     = "max_idle"
+	closedReasonMaxIdleTime = "max_idle_time"
+	closedReasonMaxLifetime = "max_lifetime"
+)
+
+// statsCollector implements prometheus.Collector exposing sql.DBStats of a DB interface
+type statsCollector struct {
+	db *sql.DB
+
+	maxOpenConnections *prometheus.Desc
+	openConnections    *prometheus.Desc
+	inUseConnections   *prometheus.Desc
+	idleConnections    *prometheus.Desc
+	waitCount          *prometheus.Desc
+	waitDuration       *prometheus.Desc
+	closedConnections  *prometheus.Desc
+}
+
+// NewStatsCollector creates a prometheus.Collector reading the connection pool stats of db at every scrape
+func NewStatsCollector(db *sql.DB) prometheus.Collector {
+	return &statsCollector{
+		db: db,
+		maxOpenConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "max_open_connections"),
+			"Maximum number of open connections to the database, 0 means unlimited", nil, nil),
+		openConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "open_connections"),
+			"Number of established connections, both in use and idle", nil, nil),
+		inUseConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "in_use_connections"),
+			"Number of connections currently in use", nil, nil),
+		idleConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "idle_connections"),
+			"Number of idle connections", nil, nil),
+		waitCount: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "wait_count_total"),
+			"Total number of connections waited for", nil, nil),
+		waitDuration: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "wait_duration_seconds_total"),
+			"Total time blocked waiting for a new connection in seconds", nil, nil),
+		closedConnections: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, metricsSubsystem, "closed_connections_total"),
+			"Total number of connections closed, by reason", []string{"reason"}, nil),
+	}
+}
+
+func (c *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.maxOpenConnections
+	ch <- c.openConnections
+	ch <- c.inUseConnections
+	ch <- c.idleConnections
+	ch <- c.waitCount
+	ch <- c.waitDuration
+	ch <- c.closedConnections
+}
+
+func (c *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.db.Stats()
+
+	ch <- prometheus.MustNewConstMetric(c.maxOpenConnections, prometheus.GaugeValue, float64(stats.MaxOpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.openConnections, prometheus.GaugeValue, float64(stats.OpenConnections))
+	ch <- prometheus.MustNewConstMetric(c.inUseConnections, prometheus.GaugeValue, float64(stats.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idleConnections, prometheus.GaugeValue, float64(stats.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waitCount, prometheus.CounterValue, float64(stats.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, stats.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.closedConnections, prometheus.CounterValue,
+		float64(stats.MaxIdleClosed), closedReasonMaxIdle)
+	ch <- prometheus.MustNewConstMetric(c.closedConnections, prometheus.CounterValue,
+		float64(stats.MaxIdleTimeClosed), closedReasonMaxIdleTime)
+	ch <- prometheus.MustNewConstMetric(c.closedConnections, prometheus.CounterValue,
+		float64(stats.MaxLifetimeClosed), closedReasonMaxLifetime)
+}
+
+// IsPoolSaturated reports whether all the connections allowed are in use,
+// or whether callers had to wait for a connection since the previous stats were taken
+func IsPoolSaturated(current, previous sql.DBStats) bool {
+	if current.MaxOpenConnections > 0 && current.InUse >= current.MaxOpenConnections {
+		return true
+	}
+	return current.WaitCount > previous.WaitCount
+}
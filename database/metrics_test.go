@@ -0,0 +1,29 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestIsPoolSaturated(t *testing.T) {
+	tests := []struct {
+		name     string
+		current  sql.DBStats
+		previous sql.DBStats
+		expected bool
+	}{
+		{"idle", sql.DBStats{MaxOpenConnections: 5}, sql.DBStats{}, false},
+		{"connections available", sql.DBStats{MaxOpenConnections: 5, InUse: 4}, sql.DBStats{}, false},
+		{"all connections in use", sql.DBStats{MaxOpenConnections: 5, InUse: 5}, sql.DBStats{}, true},
+		{"unlimited connections", sql.DBStats{InUse: 50}, sql.DBStats{}, false},
+		{"callers waited since", sql.DBStats{MaxOpenConnections: 5, WaitCount: 2}, sql.DBStats{WaitCount: 1}, true},
+		{"callers waited before only", sql.DBStats{MaxOpenConnections: 5, WaitCount: 2}, sql.DBStats{WaitCount: 2}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if saturated := IsPoolSaturated(test.current, test.previous); saturated != test.expected {
+				t.Fatalf("expected saturated %v, got %v", test.expected, saturated)
+			}
+		})
+	}
+}
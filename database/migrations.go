@@ -0,0 +1,361 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	migrationsDir = "migrations"
+
+	migrationDirectionUp   = "up"
+	migrationDirectionDown = "down"
+)
+
+//go:embed migrations
+var migrationsFs embed.FS
+
+// e.g. 0001_create_products_table.up.sql
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// MigrateUp applies up to steps pending migrations in version order, all of them if steps is lower than 1.
+// It returns the number of migrations applied.
+func MigrateUp(db *sql.DB, steps int, ctx context.Context) (int, error) {
+	logging.Log.Info("Apply DB schema migrations")
+
+	d, dialectErr := loadDialect()
+	if dialectErr != nil {
+		return 0, dialectErr
+	}
+	migrations, loadErr := loadMigrations(d)
+	if loadErr != nil {
+		return 0, loadErr
+	}
+
+	applied := 0
+	lockErr := withMigrationsLock(db, d, ctx, func(conn *sql.Conn) error {
+		appliedVersions, getErr := getAppliedMigrations(conn, d, ctx)
+		if getErr != nil {
+			return getErr
+		}
+
+		for _, mig := range migrations {
+			if steps > 0 && applied >= steps {
+				break
+			}
+			if _, ok := appliedVersions[mig.Version]; ok {
+				continue
+			}
+
+			logging.SugaredLog.Infof("Apply migration %d %s", mig.Version, mig.Name)
+			applyErr := runMigration(conn, mig.up, ctx,
+				d.rebind(insertMigrationQuery), mig.Version, mig.Name)
+			if applyErr != nil {
+				return fmt.Errorf("migration %d %s failed: %s", mig.Version, mig.Name, applyErr.Error())
+			}
+			applied++
+		}
+		return nil
+	})
+
+	logging.SugaredLog.Infof("%d DB schema migrations applied", applied)
+	return applied, lockErr
+}
+
+// MigrateDown reverts up to steps applied migrations in reverse version order, all of them if steps is lower than 1.
+// It returns the number of migrations reverted.
+func MigrateDown(db *sql.DB, steps int, ctx context.Context) (int, error) {
+	logging.Log.Info("Revert DB schema migrations")
+
+	d, dialectErr := loadDialect()
+	if dialectErr != nil {
+		return 0, dialectErr
+	}
+	migrations, loadErr := loadMigrations(d)
+	if loadErr != nil {
+		return 0, loadErr
+	}
+
+	reverted := 0
+	lockErr := withMigrationsLock(db, d, ctx, func(conn *sql.Conn) error {
+		appliedVersions, getErr := getAppliedMigrations(conn, d, ctx)
+		if getErr != nil {
+			return getErr
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			mig := migrations[i]
+			if steps > 0 && reverted >= steps {
+				break
+			}
+			if _, ok := appliedVersions[mig.Version]; !ok {
+				continue
+			}
+
+			logging.SugaredLog.Infof("Revert migration %d %s", mig.Version, mig.Name)
+			revertErr := runMigration(conn, mig.down, ctx,
+				d.rebind(deleteMigrationQuery), mig.Version)
+			if revertErr != nil {
+				return fmt.Errorf("migration %d %s revert failed: %s", mig.Version, mig.Name, revertErr.Error())
+			}
+			reverted++
+		}
+		return nil
+	})
+
+	logging.SugaredLog.Infof("%d DB schema migrations reverted", reverted)
+	return reverted, lockErr
+}
+
+// GetMigrationsStatus returns every known migration, flagging the ones already applied to the DB.
+func GetMigrationsStatus(db *sql.DB, ctx context.Context) ([]*MigrationStatus, error) {
+	logging.Log.Debug("Get DB schema migrations status")
+
+	d, dialectErr := loadDialect()
+	if dialectErr != nil {
+		return nil, dialectErr
+	}
+	migrations, loadErr := loadMigrations(d)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	conn, connErr := db.Conn(ctx)
+	if connErr != nil {
+		return nil, connErr
+	}
+	defer conn.Close()
+
+	_, tableErr := conn.ExecContext(ctx, d.createMigrationsTableQuery)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+	appliedVersions, getErr := getAppliedMigrations(conn, d, ctx)
+	if getErr != nil {
+		return nil, getErr
+	}
+
+	statuses := make([]*MigrationStatus, 0, len(migrations))
+	for _, mig := range migrations {
+		status := &MigrationStatus{
+			Version: mig.Version,
+			Name:    mig.Name,
+		}
+		if appliedAt, ok := appliedVersions[mig.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// CheckSchemaVersions returns an error if any of the expected versions, i.e. the ones returned by GetSchemaVersions,
+// is not applied to the DB schema. Meant to be invoked frequently, e.g. by readiness probes, it only queries the DB.
+func CheckSchemaVersions(db *sql.DB, expected []int64, ctx context.Context) error {
+	rows, queryErr := db.QueryContext(ctx, getSchemaVersionsQuery)
+	if queryErr != nil {
+		return fmt.Errorf("schema versions check failed: %s", queryErr.Error())
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]bool)
+	for rows.Next() {
+		var version int64
+		if scanErr := rows.Scan(&version); scanErr != nil {
+			return fmt.Errorf("schema versions check failed: %s", scanErr.Error())
+		}
+		applied[version] = true
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return fmt.Errorf("schema versions check failed: %s", rowsErr.Error())
+	}
+
+	// a skipped migration is missing as well, even if later ones are applied
+	missing := make([]int64, 0)
+	for _, version := range expected {
+		if !applied[version] {
+			missing = append(missing, version)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("schema versions %v not applied", missing)
+	}
+	return nil
+}
+
+// GetSchemaVersions returns the versions of the migrations embedded in the binary, in order, loading all of them.
+func GetSchemaVersions() ([]int64, error) {
+	d, dialectErr := loadDialect()
+	if dialectErr != nil {
+		return nil, dialectErr
+	}
+	migrations, loadErr := loadMigrations(d)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	versions := make([]int64, 0, len(migrations))
+	for _, mig := range migrations {
+		versions = append(versions, mig.Version)
+	}
+	return versions, nil
+}
+
+func loadMigrations(d *dialect) ([]*migration, error) {
+	entries, readErr := migrationsFs.ReadDir(d.migrationsDir)
+	if readErr != nil {
+		return nil, readErr
+	}
+	params := &migrationParams{DefaultCurrency: loadConfig().defaultCurrency}
+
+	byVersion := make(map[int64]*migration, len(entries)/2)
+	for _, entry := range entries {
+		matches := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+
+		version, _ := strconv.ParseInt(matches[1], 10, 64)
+		script, scriptErr := renderMigration(path.Join(d.migrationsDir, entry.Name()), params)
+		if scriptErr != nil {
+			return nil, scriptErr
+		}
+
+		mig, found := byVersion[version]
+		if !found {
+			mig = &migration{Version: version, Name: matches[2]}
+			byVersion[version] = mig
+		} else if mig.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, mig.Name, matches[2])
+		}
+
+		switch matches[3] {
+		case migrationDirectionUp:
+			mig.up = script
+		case migrationDirectionDown:
+			mig.down = script
+		}
+	}
+
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.up == "" || mig.down == "" {
+			return nil, fmt.Errorf("migration %d %s must provide both up and down scripts", mig.Version, mig.Name)
+		}
+		migrations = append(migrations, mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// renderMigration executes the migration script as a template, params must be validated beforehand
+// as they are not escaped
+func renderMigration(scriptPath string, params *migrationParams) (string, error) {
+	script, readErr := migrationsFs.ReadFile(scriptPath)
+	if readErr != nil {
+		return "", readErr
+	}
+
+	tmpl, parseErr := template.New(path.Base(scriptPath)).Option("missingkey=error").Parse(string(script))
+	if parseErr != nil {
+		return "", fmt.Errorf("migration %s parsing failed: %s", scriptPath, parseErr.Error())
+	}
+	var rendered strings.Builder
+	execErr := tmpl.Execute(&rendered, params)
+	if execErr != nil {
+		return "", fmt.Errorf("migration %s rendering failed: %s", scriptPath, execErr.Error())
+	}
+	return rendered.String(), nil
+}
+
+// withMigrationsLock runs fn on a dedicated connection holding a Postgres session-level advisory lock,
+// so that concurrent pods starting at the same time don't race applying the same migrations.
+func withMigrationsLock(db *sql.DB, d *dialect, ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, connErr := db.Conn(ctx)
+	if connErr != nil {
+		return connErr
+	}
+	defer conn.Close()
+
+	if !d.supportsAdvisoryLock {
+		_, tableErr := conn.ExecContext(ctx, d.createMigrationsTableQuery)
+		if tableErr != nil {
+			return tableErr
+		}
+		return fn(conn)
+	}
+
+	logging.Log.Debug("Acquire DB schema migrations lock")
+	_, lockErr := conn.ExecContext(ctx, advisoryLockQuery, migrationsAdvisoryLockKey)
+	if lockErr != nil {
+		return fmt.Errorf("migrations lock acquisition failed: %s", lockErr.Error())
+	}
+	defer func() {
+		// the lock must be released even if ctx has been cancelled in the meantime
+		_, unlockErr := conn.ExecContext(context.Background(), advisoryUnlockQuery, migrationsAdvisoryLockKey)
+		if unlockErr != nil {
+			logging.SugaredLog.Errorf("DB schema migrations lock release failed: %s", unlockErr.Error())
+		}
+	}()
+
+	_, tableErr := conn.ExecContext(ctx, d.createMigrationsTableQuery)
+	if tableErr != nil {
+		return tableErr
+	}
+
+	return fn(conn)
+}
+
+func getAppliedMigrations(conn *sql.Conn, d *dialect, ctx context.Context) (map[int64]*time.Time, error) {
+	rows, err := conn.QueryContext(ctx, d.rebind(getAppliedMigrationsQuery))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int64]*time.Time)
+	for rows.Next() {
+		var version int64
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = &appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigration executes a migration script and records it through trackQuery in a single transaction.
+func runMigration(conn *sql.Conn, script string, ctx context.Context, trackQuery string, trackArgs ...interface{}) error {
+	tx, txErr := conn.BeginTx(ctx, nil)
+	if txErr != nil {
+		return txErr
+	}
+
+	_, scriptErr := tx.ExecContext(ctx, script)
+	if scriptErr != nil {
+		_ = tx.Rollback()
+		return scriptErr
+	}
+
+	_, trackErr := tx.ExecContext(ctx, trackQuery, trackArgs...)
+	if trackErr != nil {
+		_ = tx.Rollback()
+		return trackErr
+	}
+
+	return tx.Commit()
+}
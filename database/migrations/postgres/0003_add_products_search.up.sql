@@ -0,0 +1,5 @@
+-- 'simple' configuration: no stemming nor stop words, product names are matched word by word
+ALTER TABLE products ADD COLUMN search_vector tsvector
+	GENERATED ALWAYS AS (to_tsvector('simple', name)) STORED;
+
+CREATE INDEX products_search_vector_idx ON products USING GIN (search_vector);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	key TEXT NOT NULL,
+	fingerprint TEXT NOT NULL,
+	-- 0 while the request is in progress
+	status_code INTEGER NOT NULL DEFAULT 0,
+	response_headers TEXT NOT NULL DEFAULT '{}',
+	response_body BYTEA,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	CONSTRAINT idempotency_keys_pkey PRIMARY KEY (key)
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
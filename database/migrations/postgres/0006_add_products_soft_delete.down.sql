@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS product_history;
+DROP FUNCTION IF EXISTS product_history_append_only();
+ALTER TABLE products DROP COLUMN deleted_at;
@@ -0,0 +1,27 @@
+-- deleted products are kept, hidden unless explicitly asked for
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMPTZ;
+
+-- every change of a product, written in the same transaction as the change itself
+CREATE TABLE IF NOT EXISTS product_history(
+	id BIGSERIAL,
+	product_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	name TEXT NOT NULL,
+	price NUMERIC(10,2) NOT NULL,
+	currency CHAR(3) NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL,
+	CONSTRAINT product_history_pkey PRIMARY KEY (id)
+);
+
+CREATE INDEX product_history_product_id_idx ON product_history(product_id, id);
+
+CREATE FUNCTION product_history_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'product_history is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER product_history_append_only BEFORE UPDATE OR DELETE ON product_history
+	FOR EACH ROW EXECUTE FUNCTION product_history_append_only();
@@ -0,0 +1,10 @@
+-- time of the last change of every product, served as Last-Modified
+ALTER TABLE products ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- existing products are backfilled from their history, if any
+UPDATE products SET updated_at = h.changed_at
+FROM (SELECT product_id, MAX(changed_at) AS changed_at FROM product_history GROUP BY product_id) h
+WHERE h.product_id = products.id;
+
+-- the latest change is looked up to tell whether lists have changed
+CREATE INDEX products_updated_at_idx ON products(updated_at);
@@ -0,0 +1,18 @@
+-- notifies the instances listening of every product change, e.g. to invalidate their caches.
+-- Notifications are sent on commit, the payload is a ProductChangeNotification.
+CREATE OR REPLACE FUNCTION notify_product_change() RETURNS trigger AS $$
+DECLARE
+	product_id INTEGER;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		product_id := OLD.id;
+	ELSE
+		product_id := NEW.id;
+	END IF;
+	PERFORM pg_notify('product_changes', json_build_object('op', lower(TG_OP), 'id', product_id)::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER products_notify_change AFTER INSERT OR UPDATE OR DELETE ON products
+	FOR EACH ROW EXECUTE FUNCTION notify_product_change();
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS products_search_vector_idx;
+
+ALTER TABLE products DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE products ADD COLUMN search_vector tsvector
+	GENERATED ALWAYS AS (to_tsvector('simple', name)) STORED;
+
+CREATE INDEX products_search_vector_idx ON products USING GIN (search_vector);
@@ -0,0 +1,10 @@
+-- names are split into words of letters and digits, as SQLite FTS5 and the memory repository do:
+-- the default parser would keep tokens like hosts, paths, versions or signed numbers whole otherwise
+DROP INDEX IF EXISTS products_search_vector_idx;
+
+ALTER TABLE products DROP COLUMN IF EXISTS search_vector;
+
+ALTER TABLE products ADD COLUMN search_vector tsvector
+	GENERATED ALWAYS AS (to_tsvector('simple', regexp_replace(name, '[^[:alnum:]]+', ' ', 'g'))) STORED;
+
+CREATE INDEX products_search_vector_idx ON products USING GIN (search_vector);
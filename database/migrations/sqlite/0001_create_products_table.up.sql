@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS products(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	price NUMERIC(10,2) NOT NULL DEFAULT 0.00
+);
@@ -0,0 +1,22 @@
+-- full-text index kept in sync with the products table, as the Postgres generated tsvector column
+CREATE VIRTUAL TABLE products_search USING fts5(
+	name,
+	content='products',
+	content_rowid='id',
+	tokenize='unicode61 remove_diacritics 0'
+);
+
+CREATE TRIGGER products_search_insert AFTER INSERT ON products BEGIN
+	INSERT INTO products_search(rowid, name) VALUES (new.id, new.name);
+END;
+
+CREATE TRIGGER products_search_delete AFTER DELETE ON products BEGIN
+	INSERT INTO products_search(products_search, rowid, name) VALUES ('delete', old.id, old.name);
+END;
+
+CREATE TRIGGER products_search_update AFTER UPDATE OF name ON products BEGIN
+	INSERT INTO products_search(products_search, rowid, name) VALUES ('delete', old.id, old.name);
+	INSERT INTO products_search(rowid, name) VALUES (new.id, new.name);
+END;
+
+INSERT INTO products_search(products_search) VALUES ('rebuild');
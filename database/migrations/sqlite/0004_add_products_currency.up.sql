@@ -0,0 +1,2 @@
+-- existing products are backfilled with the default currency configured (DB_DEFAULT_CURRENCY)
+ALTER TABLE products ADD COLUMN currency CHAR(3) NOT NULL DEFAULT '{{ .DefaultCurrency }}';
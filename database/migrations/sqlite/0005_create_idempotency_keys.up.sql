@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys(
+	key TEXT NOT NULL PRIMARY KEY,
+	fingerprint TEXT NOT NULL,
+	-- 0 while the request is in progress
+	status_code INTEGER NOT NULL DEFAULT 0,
+	response_headers TEXT NOT NULL DEFAULT '{}',
+	response_body BLOB,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
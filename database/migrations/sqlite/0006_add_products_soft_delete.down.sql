@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS product_history;
+ALTER TABLE products DROP COLUMN deleted_at;
@@ -0,0 +1,25 @@
+-- deleted products are kept, hidden unless explicitly asked for
+ALTER TABLE products ADD COLUMN deleted_at TIMESTAMP;
+
+-- every change of a product, written in the same transaction as the change itself
+CREATE TABLE IF NOT EXISTS product_history(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	product_id INTEGER NOT NULL,
+	version INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	name TEXT NOT NULL,
+	price NUMERIC(10,2) NOT NULL,
+	currency CHAR(3) NOT NULL,
+	changed_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX product_history_product_id_idx ON product_history(product_id, id);
+
+CREATE TRIGGER product_history_no_update BEFORE UPDATE ON product_history BEGIN
+	SELECT RAISE(ABORT, 'product_history is append-only');
+END;
+
+CREATE TRIGGER product_history_no_delete BEFORE DELETE ON product_history BEGIN
+	SELECT RAISE(ABORT, 'product_history is append-only');
+END;
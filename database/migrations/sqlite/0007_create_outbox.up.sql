@@ -0,0 +1,14 @@
+-- product changes to be published, written in the same transaction as the change and deleted once delivered
+CREATE TABLE IF NOT EXISTS outbox(
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_type TEXT NOT NULL,
+	product_id INTEGER NOT NULL,
+	payload TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	-- also leases the event to the relay delivering it
+	next_attempt_at TIMESTAMP NOT NULL,
+	last_error TEXT
+);
+
+CREATE INDEX outbox_next_attempt_at_idx ON outbox(next_attempt_at, id);
@@ -0,0 +1,12 @@
+-- time of the last change of every product, served as Last-Modified.
+-- SQLite accepts only constant defaults on new columns, existing products are backfilled right after.
+ALTER TABLE products ADD COLUMN updated_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
+
+-- from their history if any, from now otherwise
+UPDATE products SET updated_at = COALESCE(
+	(SELECT MAX(changed_at) FROM product_history WHERE product_history.product_id = products.id),
+	CURRENT_TIMESTAMP
+);
+
+-- the latest change is looked up to tell whether lists have changed
+CREATE INDEX products_updated_at_idx ON products(updated_at);
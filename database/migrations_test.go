@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/utils"
+)
+
+func TestMigrationsBackfillExistingProducts(t *testing.T) {
+	t.Setenv(dbDriverEnvVar, sqliteDriver)
+	t.Setenv(dbPathEnvVar, sqliteInMemoryPath)
+	t.Setenv(dbDefaultCurrencyEnvVar, "USD")
+
+	db, dbErr := Open()
+	if dbErr != nil {
+		t.Fatalf("DB interface opening failed: %s", dbErr.Error())
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	_, migrateErr := MigrateUp(db, 3, ctx)
+	if migrateErr != nil {
+		t.Fatalf("migration failed: %s", migrateErr.Error())
+	}
+	_, insertErr := db.Exec("INSERT INTO products(name, price) VALUES('lamp', 10)")
+	if insertErr != nil {
+		t.Fatalf("product insertion failed: %s", insertErr.Error())
+	}
+
+	_, migrateErr = MigrateUp(db, 0, ctx)
+	if migrateErr != nil {
+		t.Fatalf("migration failed: %s", migrateErr.Error())
+	}
+	var currency string
+	scanErr := db.QueryRow("SELECT currency FROM products WHERE name='lamp'").Scan(&currency)
+	if scanErr != nil {
+		t.Fatalf("currency reading failed: %s", scanErr.Error())
+	}
+	if currency != "USD" {
+		t.Errorf("expected currency USD, got %s", currency)
+	}
+	var updatedAt time.Time
+	scanErr = db.QueryRow("SELECT updated_at FROM products WHERE name='lamp'").Scan(&updatedAt)
+	if scanErr != nil {
+		t.Fatalf("update time reading failed: %s", scanErr.Error())
+	}
+	if time.Since(updatedAt) > time.Minute {
+		t.Errorf("expected update time backfilled with the current time, got %v", updatedAt)
+	}
+
+	_, migrateErr = MigrateDown(db, 1, ctx)
+	if migrateErr != nil {
+		t.Fatalf("migration rollback failed: %s", migrateErr.Error())
+	}
+}
+
+func TestMigrationsRoundTrip(t *testing.T) {
+	t.Setenv(dbDriverEnvVar, sqliteDriver)
+	t.Setenv(dbPathEnvVar, sqliteInMemoryPath)
+
+	db, dbErr := Open()
+	if dbErr != nil {
+		t.Fatalf("DB interface opening failed: %s", dbErr.Error())
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	versions, versionsErr := GetSchemaVersions()
+	if versionsErr != nil {
+		t.Fatalf("schema versions loading failed: %s", versionsErr.Error())
+	}
+	total := len(mustGetMigrationsStatus(t, db, 0))
+	if total < 2 || len(versions) != total {
+		t.Fatalf("expected %d schema versions and at least 2 migrations embedded, got %v", total, versions)
+	}
+	latest := versions[total-1]
+	if CheckSchemaVersions(db, versions, ctx) == nil {
+		t.Fatal("expected empty schema behind the latest version")
+	}
+
+	mustMigrate(t, MigrateUp, db, 0, total)
+	mustGetMigrationsStatus(t, db, total)
+	if checkErr := CheckSchemaVersions(db, versions, ctx); checkErr != nil {
+		t.Fatalf("expected schema up to date, got %s", checkErr.Error())
+	}
+	mustMigrate(t, MigrateUp, db, 0, 0)
+
+	// down reverts the latest first
+	mustMigrate(t, MigrateDown, db, 1, 1)
+	statuses := mustGetMigrationsStatus(t, db, total-1)
+	if statuses[total-1].Applied || statuses[total-1].Version != latest {
+		t.Fatalf("expected latest migration %d reverted, got %+v", latest, statuses[total-1])
+	}
+	if CheckSchemaVersions(db, versions, ctx) == nil {
+		t.Fatal("expected schema behind the latest version")
+	}
+
+	// every down script undoes its up script, the schema can be rebuilt from scratch
+	mustMigrate(t, MigrateDown, db, 0, total-1)
+	mustGetMigrationsStatus(t, db, 0)
+	mustMigrate(t, MigrateUp, db, 2, 2)
+	mustMigrate(t, MigrateUp, db, 0, total-2)
+	if checkErr := CheckSchemaVersions(db, versions, ctx); checkErr != nil {
+		t.Fatalf("expected schema up to date, got %s", checkErr.Error())
+	}
+
+	// a skipped migration is told apart, even if the latest one is applied
+	if _, deleteErr := db.ExecContext(ctx, deleteMigrationQuery, versions[1]); deleteErr != nil {
+		t.Fatalf("schema migration deletion failed: %s", deleteErr.Error())
+	}
+	if checkErr := CheckSchemaVersions(db, versions, ctx); checkErr == nil ||
+		checkErr.Error() != fmt.Sprintf("schema versions [%d] not applied", versions[1]) {
+		t.Fatalf("expected skipped schema version %d reported, got %v", versions[1], checkErr)
+	}
+}
+
+func TestPostgresMigrationsLock(t *testing.T) {
+	if !utils.GetBoolEnv(testPostgresEnvVar, false) {
+		t.Skipf("%s not set, skipping PostgreSQL migrations tests", testPostgresEnvVar)
+	}
+
+	db, dbErr := Open()
+	if dbErr != nil {
+		t.Fatalf("DB interface opening failed: %s", dbErr.Error())
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	if _, err := MigrateDown(db, 0, ctx); err != nil {
+		t.Fatalf("migrations revert failed: %s", err.Error())
+	}
+	total := len(mustGetMigrationsStatus(t, db, 0))
+
+	// pods starting at the same time apply every migration once between them
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	applied := 0
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count, err := MigrateUp(db, 0, ctx)
+			if err != nil {
+				t.Errorf("concurrent migration failed: %s", err.Error())
+			}
+			mutex.Lock()
+			applied += count
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if applied != total {
+		t.Fatalf("expected %d migrations applied once, got %d applied", total, applied)
+	}
+	mustGetMigrationsStatus(t, db, total)
+}
+
+func mustMigrate(t *testing.T, migrate func(db *sql.DB, steps int, ctx context.Context) (int, error), db *sql.DB,
+	steps, expected int) {
+
+	t.Helper()
+	count, err := migrate(db, steps, context.Background())
+	if err != nil {
+		t.Fatalf("migration failed: %s", err.Error())
+	}
+	if count != expected {
+		t.Fatalf("expected %d migrations run, got %d", expected, count)
+	}
+}
+
+// mustGetMigrationsStatus returns the status of every migration, expecting as many applied
+func mustGetMigrationsStatus(t *testing.T, db *sql.DB, expectedApplied int) []*MigrationStatus {
+	t.Helper()
+	statuses, err := GetMigrationsStatus(db, context.Background())
+	if err != nil {
+		t.Fatalf("migrations status failed: %s", err.Error())
+	}
+	applied := 0
+	for _, status := range statuses {
+		if status.Applied {
+			applied++
+		}
+	}
+	if applied != expectedApplied {
+		t.Fatalf("expected %d migrations applied, got %d", expectedApplied, applied)
+	}
+	return statuses
+}
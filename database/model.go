@@ -1,23 +1,362 @@
 package database
 
-import "fmt"
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shopspring/decimal"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrVersionMismatch = errors.New("product version mismatch")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrInvalidSort     = errors.New("invalid sort")
+	ErrNotDeleted      = errors.New("product not deleted")
+)
 
 type config struct {
-	dbHost     string
-	dbPort     int
-	dbUsername string
-	dbPassword string
-	dbName     string
-	dbSslMode  string
+	dbDriver    string
+	dbPath      string
+	dbHost      string
+	dbPort      int
+	dbUsername  string
+	dbPassword  string
+	dbName      string
+	dbSslMode   string
+	autoMigrate bool
+
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	connMaxIdleTime time.Duration
+
+	replicaDsns          []string
+	replicaMaxLag        time.Duration
+	replicaCheckInterval time.Duration
+
+	defaultCurrency string
+
+	cacheEnabled    bool
+	cacheMaxEntries int
+	cacheTtl        time.Duration
+
+	listenerEnabled              bool
+	listenerMinReconnectInterval time.Duration
+	listenerMaxReconnectInterval time.Duration
+	listenerPingInterval         time.Duration
+}
+
+// ProductRepository abstracts the products storage, implemented by SQLRepository and MemoryRepository.
+// Update and delete return ErrProductNotFound if the product doesn't exist and, when a version other than 0
+// is given, ErrVersionMismatch if the product has been modified in the meantime (optimistic concurrency).
+// Deleted products are kept, but treated as not found unless includeDeleted, and can't be modified until restored.
+// Every change is recorded in the product history, along with the actor in context (see WithActor).
+type ProductRepository interface {
+	GetProducts(query *ProductsQuery, ctx context.Context) (*ProductsPage, error)
+	GetProduct(product *Product, includeDeleted bool, ctx context.Context) error
+	CreateProduct(product *Product, ctx context.Context) error
+	UpdateProduct(product *Product, ctx context.Context) error
+	PatchProduct(product *Product, patch ProductPatch, ctx context.Context) error
+	DeleteProduct(productId, version int, ctx context.Context) error
+	// RestoreProduct undeletes the product, returning ErrNotDeleted if it's not deleted
+	RestoreProduct(product *Product, ctx context.Context) error
+	// GetProductHistory returns the changes of the product, deleted or not, oldest first
+	GetProductHistory(productId int, ctx context.Context) ([]*ProductChange, error)
+	// ImportProducts creates all the products in a single transaction
+	ImportProducts(products []*Product, ctx context.Context) error
+	// ExportProducts invokes fn on every product in ID order, stopping at the first error.
+	// Products must not be retained after fn returns.
+	ExportProducts(fn func(product *Product) error, ctx context.Context) error
+}
+
+// IdempotencyStore keeps the responses of requests carrying an idempotency key, to replay them on retries.
+// Implemented by SQLRepository and MemoryRepository.
+type IdempotencyStore interface {
+	// ReserveIdempotencyKey records the key as in progress until expiresAt, a lease taken over by another request
+	// once expired. If the key exists already the stored record is returned instead, with StatusCode 0 if the
+	// original request is still in progress.
+	ReserveIdempotencyKey(key, fingerprint string, expiresAt time.Time, ctx context.Context) (*IdempotencyRecord, error)
+	// CompleteIdempotencyKey stores the response of the request that reserved the key, to replay until expiresAt
+	CompleteIdempotencyKey(record *IdempotencyRecord, expiresAt time.Time, ctx context.Context) error
+	// ReleaseIdempotencyKey removes a key still in progress, so that the request can be retried
+	ReleaseIdempotencyKey(key string, ctx context.Context) error
+	DeleteExpiredIdempotencyKeys(now time.Time, ctx context.Context) (int64, error)
+}
+
+// OutboxStore gives access to the product change events recorded along with the changes, to publish them.
+// Events are leased to a relay while being delivered, then acknowledged or rescheduled.
+// Implemented by SQLRepository and MemoryRepository.
+type OutboxStore interface {
+	// ClaimOutboxEvents leases up to limit events due for delivery, oldest first, until leaseUntil.
+	// Events leased by other relays are skipped.
+	ClaimOutboxEvents(limit int, leaseUntil time.Time, ctx context.Context) ([]*OutboxEvent, error)
+	// AckOutboxEvent removes a delivered event
+	AckOutboxEvent(eventId int64, ctx context.Context) error
+	// NackOutboxEvent reschedules the delivery of an event
+	NackOutboxEvent(eventId int64, retryAt time.Time, reason string, ctx context.Context) error
+	GetOutboxStatus(ctx context.Context) (*OutboxStatus, error)
+}
+
+type OutboxEvent struct {
+	ID        int64
+	Type      string
+	ProductID int
+	Payload   []byte // JSON, see outboxPayload
+	CreatedAt time.Time
+	Attempts  int // including the current one
+}
+
+type OutboxStatus struct {
+	Pending int
+	// creation time of the oldest event pending, nil if none
+	Oldest *time.Time
+}
+
+type IdempotencyRecord struct {
+	Key         string
+	Fingerprint string
+	StatusCode  int
+	Headers     map[string]string
+	Body        []byte
 }
 
+// ProductPatch modifies the current state of a product in place, returning an error to abort the update
+type ProductPatch func(product *Product) error
+
+// Product price is serialised as JSON string to keep it exact, numbers are accepted too
 type Product struct {
-	ID    int     `json:"id"`
-	Name  string  `json:"name"`
-	Price float64 `json:"price"`
+	ID       int             `json:"id"`
+	Name     string          `json:"name" validate:"notblank,max=255"`
+	Price    decimal.Decimal `json:"price" validate:"decimal_gte=0,decimal_lte=99999999.99,decimal_scale=2"` // fits NUMERIC(10,2)
+	Currency string          `json:"currency" validate:"required,iso4217"`
+	Version  int             `json:"version"` // incremented at every update
+	// set while the product is deleted
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// time of the last change, deletion and restore included
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+const (
+	ActionCreate  = "create"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+	ActionRestore = "restore"
+)
+
+// outboxPayload is the product change event published
+type outboxPayload struct {
+	Type       string    `json:"type"`
+	ProductID  int       `json:"productId"`
+	Version    int       `json:"version"`
+	Actor      string    `json:"actor"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Product    *Product  `json:"product"`
+}
+
+// ProductChange records the state of a product after a change, who did it and when
+type ProductChange struct {
+	Version   int             `json:"version"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	Name      string          `json:"name"`
+	Price     decimal.Decimal `json:"price"`
+	Currency  string          `json:"currency"`
+	ChangedAt time.Time       `json:"changedAt"`
+}
+
+// ValidationError lists the product fields violating their constraints, see Product.Validate
+type ValidationError struct {
+	InvalidParams []*InvalidParam
+}
+
+type InvalidParam struct {
+	Name   string
+	Reason string
 }
 
 func (p *Product) String() string {
-	return fmt.Sprintf("ID[%d], Name[%s], Price[%f]",
-		p.ID, p.Name, p.Price)
+	return fmt.Sprintf("ID[%d], Name[%s], Price[%s %s], Version[%d]",
+		p.ID, p.Name, p.Price.String(), p.Currency, p.Version)
+}
+
+// ProductsQuery selects a page of products matching all the filters set, ordered by ID unless sorted otherwise
+type ProductsQuery struct {
+	Limit     int
+	Cursor    string // as returned in ProductsPage for the same filters and sort, takes precedence over Offset
+	Offset    int    // products skipped from the first one, cursors should be preferred past the first pages
+	WithTotal bool
+
+	NamePrefix string           // case-insensitive
+	MinPrice   *decimal.Decimal // inclusive
+	MaxPrice   *decimal.Decimal // inclusive
+	Search     string           // full-text, all the words must appear in the name
+	Sort       []SortField
+
+	IncludeDeleted bool
+}
+
+// SortField sorts products by one of the sortable fields, see ParseSort
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+type ProductsPage struct {
+	Products   []*Product
+	NextCursor string // empty on the last page
+	PrevCursor string // empty on the first page
+	Total      int    // -1 unless requested through ProductsQuery.WithTotal
+	// last change of any product, deleted ones included as they're kept: no list can have changed since.
+	// Read before the products, zero if there are none.
+	LastModified time.Time
+}
+
+// cursor holds the sort keys of the product at the boundary of a page
+type cursor struct {
+	Direction string          `json:"d"`
+	Sort      string          `json:"s"`
+	ID        int             `json:"id"`
+	Name      string          `json:"n"`
+	Price     decimal.Decimal `json:"p"`
+}
+
+// migrationParams are available to migration scripts as template data, e.g. {{ .DefaultCurrency }}
+type migrationParams struct {
+	DefaultCurrency string
+}
+
+type migration struct {
+	Version int64
+	Name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// ReplicaSet routes reads to healthy read-replicas in round-robin
+type ReplicaSet struct {
+	replicas      []*replica
+	next          uint32
+	maxLag        time.Duration
+	checkInterval time.Duration
+	// (*replica).checkLag, unless faked
+	checkLag func(rep *replica, ctx context.Context) (time.Duration, error)
+	stop     chan struct{}
+	stopped  sync.WaitGroup
+}
+
+type replica struct {
+	name  string
+	db    *sql.DB
+	mutex sync.RWMutex
+	// fields below are updated by the health checks
+	healthy   bool
+	lag       time.Duration
+	lastError error
+}
+
+type ReplicaStatus struct {
+	Name    string        `json:"name"`
+	Healthy bool          `json:"healthy"`
+	Lag     time.Duration `json:"lag"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// ProductCache keeps products in memory, implemented by CachedRepository
+type ProductCache interface {
+	// InvalidateProduct drops the product, e.g. when changed by another instance
+	InvalidateProduct(productId int)
+	// FlushProducts drops all the products, returning how many were cached
+	FlushProducts() int
+}
+
+// CachedRepository decorates a ProductRepository keeping the products read by ID in a LRU cache, for up to a TTL
+type CachedRepository struct {
+	ProductRepository
+	maxEntries int
+	ttl        time.Duration
+	now        func() time.Time
+
+	mutex   sync.Mutex
+	entries map[int]*list.Element
+	// front is the most recently used
+	lru *list.List
+	// incremented at every invalidation, products loaded meanwhile are not cached as they may be stale
+	generation uint64
+	loads      singleflight.Group
+	stats      cacheStats
+
+	hitsDesc          *prometheus.Desc
+	missesDesc        *prometheus.Desc
+	evictionsDesc     *prometheus.Desc
+	invalidationsDesc *prometheus.Desc
+	entriesDesc       *prometheus.Desc
+}
+
+type cacheEntry struct {
+	product   *Product
+	expiresAt time.Time
+}
+
+type cacheStats struct {
+	hits              uint64
+	misses            uint64
+	capacityEvictions uint64
+	expiredEvictions  uint64
+	invalidations     uint64
+}
+
+// Listener receives the notifications sent through Postgres NOTIFY on a dedicated connection, re-established
+// automatically, and fans them out to the subscribers of their channel
+type Listener struct {
+	listener     *pq.Listener
+	pingInterval time.Duration
+	stop         chan struct{}
+	stopped      sync.WaitGroup
+
+	mutex       sync.RWMutex
+	subscribers map[string][]NotificationHandler
+	// fields below are updated by the listener events
+	connected bool
+	lastError error
 }
+
+// NotificationHandler is invoked by the Listener for every notification, one at a time: it must not block
+type NotificationHandler func(notification *Notification)
+
+// Notification is a message received on a channel. Lost is set instead when messages may have been missed,
+// e.g. while reconnecting: subscribers must then refresh whatever they derived from the notifications.
+type Notification struct {
+	Channel string
+	Payload string
+	Lost    bool
+}
+
+type ListenerStatus struct {
+	Connected bool     `json:"connected"`
+	Channels  []string `json:"channels"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// ProductChangeNotification is the payload of the notifications on ProductChangesChannel, sent by a trigger
+type ProductChangeNotification struct {
+	Operation string `json:"op"` // insert, update or delete
+	ProductID int    `json:"id"`
+}
+
+type contextKey string
@@ -0,0 +1,211 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// outboxEventTypes maps the product history actions to the types of the events published
+var outboxEventTypes = map[string]string{
+	ActionCreate:  "product.created",
+	ActionUpdate:  "product.updated",
+	ActionDelete:  "product.deleted",
+	ActionRestore: "product.restored",
+}
+
+func newOutboxEvent(change *ProductChange, product *Product) (*OutboxEvent, error) {
+	productCopy := *product
+	payload, marshErr := json.Marshal(&outboxPayload{
+		Type:       outboxEventTypes[change.Action],
+		ProductID:  product.ID,
+		Version:    change.Version,
+		Actor:      change.Actor,
+		OccurredAt: change.ChangedAt.UTC(),
+		Product:    &productCopy,
+	})
+	if marshErr != nil {
+		return nil, marshErr
+	}
+	return &OutboxEvent{
+		Type:      outboxEventTypes[change.Action],
+		ProductID: product.ID,
+		Payload:   payload,
+		CreatedAt: change.ChangedAt.UTC(),
+	}, nil
+}
+
+// execInsertOutboxEvent runs insertOutboxEventQuery, prepared or not
+func execInsertOutboxEvent(exec func(ctx context.Context, args ...interface{}) (sql.Result, error),
+	change *ProductChange, product *Product, ctx context.Context) error {
+
+	event, eventErr := newOutboxEvent(change, product)
+	if eventErr != nil {
+		return eventErr
+	}
+	_, err := exec(ctx, event.Type, event.ProductID, string(event.Payload), event.CreatedAt)
+	return err
+}
+
+func (r *SQLRepository) ClaimOutboxEvents(limit int, leaseUntil time.Time, ctx context.Context) ([]*OutboxEvent, error) {
+	span := opentracing.StartSpan(
+		"claim-outbox-events-db",
+		opentracing.ChildOf(opentracing.SpanFromContext(ctx).Context()))
+	defer span.Finish()
+
+	tx, txErr := r.db.BeginTx(ctx, nil)
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer rollback(tx)
+
+	// the lock is held only while leasing, not to keep the transaction open during the delivery
+	rows, err := tx.QueryContext(ctx, r.dialect.rebind(selectDueOutboxQuery+r.dialect.skipLockedClause),
+		time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*OutboxEvent, 0)
+	for rows.Next() {
+		var event OutboxEvent
+		var payload string
+		err := rows.Scan(&event.ID, &event.Type, &event.ProductID, &payload, &event.CreatedAt, &event.Attempts)
+		if err != nil {
+			_ = rows.Close()
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		event.Attempts++
+		events = append(events, &event)
+	}
+	_ = rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		_, err := tx.ExecContext(ctx, r.dialect.rebind(leaseOutboxEventQuery), event.ID, leaseUntil.UTC())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	span.SetTag("events-claimed", len(events))
+	span.LogKV("events-claimed", len(events))
+
+	return events, tx.Commit()
+}
+
+func (r *SQLRepository) AckOutboxEvent(eventId int64, ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind(deleteOutboxEventQuery), eventId)
+	return err
+}
+
+func (r *SQLRepository) NackOutboxEvent(eventId int64, retryAt time.Time, reason string, ctx context.Context) error {
+	_, err := r.db.ExecContext(ctx, r.dialect.rebind(rescheduleOutboxQuery), eventId, retryAt.UTC(), reason)
+	return err
+}
+
+func (r *SQLRepository) GetOutboxStatus(ctx context.Context) (*OutboxStatus, error) {
+	status := &OutboxStatus{}
+	err := r.db.QueryRowContext(ctx, countOutboxQuery).Scan(&status.Pending)
+	if err != nil {
+		return nil, err
+	}
+	if status.Pending == 0 {
+		return status, nil
+	}
+
+	var oldest time.Time
+	err = r.db.QueryRowContext(ctx, getOldestOutboxEventQuery).Scan(&oldest)
+	if err == sql.ErrNoRows {
+		// delivered in the meantime
+		return &OutboxStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Oldest = &oldest
+	return status, nil
+}
+
+type memoryOutboxEvent struct {
+	OutboxEvent
+	nextAttemptAt time.Time
+	lastError     string
+}
+
+func (r *MemoryRepository) ClaimOutboxEvents(limit int, leaseUntil time.Time, ctx context.Context) ([]*OutboxEvent, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	events := make([]*OutboxEvent, 0)
+	for _, stored := range r.outbox {
+		if len(events) == limit {
+			break
+		}
+		if stored.nextAttemptAt.After(now) {
+			continue
+		}
+		stored.Attempts++
+		stored.nextAttemptAt = leaseUntil
+		event := stored.OutboxEvent
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+func (r *MemoryRepository) AckOutboxEvent(eventId int64, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, stored := range r.outbox {
+		if stored.ID == eventId {
+			r.outbox = append(r.outbox[:i], r.outbox[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) NackOutboxEvent(eventId int64, retryAt time.Time, reason string, ctx context.Context) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, stored := range r.outbox {
+		if stored.ID == eventId {
+			stored.nextAttemptAt = retryAt
+			stored.lastError = reason
+			break
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) GetOutboxStatus(ctx context.Context) (*OutboxStatus, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	status := &OutboxStatus{Pending: len(r.outbox)}
+	if len(r.outbox) > 0 {
+		oldest := r.outbox[0].CreatedAt
+		status.Oldest = &oldest
+	}
+	return status, nil
+}
+
+// enqueueEvent must be invoked holding the write lock
+func (r *MemoryRepository) enqueueEvent(change *ProductChange, product *Product) {
+	event, eventErr := newOutboxEvent(change, product)
+	if eventErr != nil {
+		// payloads are plain structs, marshalling can't fail
+		panic(eventErr)
+	}
+	r.lastOutboxID++
+	event.ID = r.lastOutboxID
+	r.outbox = append(r.outbox, &memoryOutboxEvent{OutboxEvent: *event, nextAttemptAt: event.CreatedAt})
+}
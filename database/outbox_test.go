@@ -0,0 +1,163 @@
+package database
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// outboxRepository is what the relay relies on: changes made through the repository end up in the outbox
+type outboxRepository interface {
+	ProductRepository
+	OutboxStore
+}
+
+func TestMemoryOutboxStore(t *testing.T) {
+	testOutboxStore(t, func(t *testing.T) outboxRepository {
+		return NewMemoryRepository()
+	})
+}
+
+func TestSQLiteOutboxStore(t *testing.T) {
+	t.Setenv(dbDriverEnvVar, sqliteDriver)
+	t.Setenv(dbPathEnvVar, sqliteInMemoryPath)
+
+	testOutboxStore(t, func(t *testing.T) outboxRepository {
+		db, dbErr := New()
+		if dbErr != nil {
+			t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return NewSQLiteRepository(db)
+	})
+}
+
+// testOutboxStore is the conformance suite every OutboxStore implementation must pass.
+// newRepository must return an empty repository on every invocation.
+func testOutboxStore(t *testing.T, newRepository func(t *testing.T) outboxRepository) {
+	leaseUntil := time.Now().Add(time.Hour)
+
+	t.Run("changes recorded in order", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "laptop", Price: price("999.99"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+		product.Price = price("899.99")
+		if err := repo.UpdateProduct(product, WithActor(testContext(), "alice")); err != nil {
+			t.Fatalf("update product failed: %s", err.Error())
+		}
+		if err := repo.DeleteProduct(product.ID, 0, testContext()); err != nil {
+			t.Fatalf("delete product failed: %s", err.Error())
+		}
+		if err := repo.RestoreProduct(&Product{ID: product.ID}, testContext()); err != nil {
+			t.Fatalf("restore product failed: %s", err.Error())
+		}
+
+		events := mustClaim(t, repo, 10, leaseUntil)
+		types := make([]string, 0, len(events))
+		for _, event := range events {
+			types = append(types, event.Type)
+			if event.ProductID != product.ID || event.Attempts != 1 {
+				t.Errorf("unexpected event %+v", event)
+			}
+		}
+		expected := []string{"product.created", "product.updated", "product.deleted", "product.restored"}
+		if !reflect.DeepEqual(types, expected) {
+			t.Fatalf("expected event types %v, got %v", expected, types)
+		}
+
+		var payload outboxPayload
+		if err := json.Unmarshal(events[1].Payload, &payload); err != nil {
+			t.Fatalf("payload unmarshalling failed: %s", err.Error())
+		}
+		if payload.Type != "product.updated" || payload.ProductID != product.ID || payload.Version != 2 ||
+			payload.Actor != "alice" || payload.Product == nil || !payload.Product.Price.Equal(price("899.99")) {
+			t.Fatalf("unexpected payload %s", events[1].Payload)
+		}
+	})
+
+	t.Run("imported products recorded", func(t *testing.T) {
+		repo := newRepository(t)
+		err := repo.ImportProducts([]*Product{
+			{Name: "mouse", Price: price("19.99"), Currency: "EUR"},
+			{Name: "keyboard", Price: price("49.99"), Currency: "EUR"},
+		}, testContext())
+		if err != nil {
+			t.Fatalf("import products failed: %s", err.Error())
+		}
+		if events := mustClaim(t, repo, 10, leaseUntil); len(events) != 2 || events[1].Type != "product.created" {
+			t.Fatalf("expected 2 created events, got %+v", events)
+		}
+	})
+
+	t.Run("claimed events leased", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo,
+			&Product{Name: "mouse", Price: price("19.99"), Currency: "EUR"},
+			&Product{Name: "keyboard", Price: price("49.99"), Currency: "EUR"})
+
+		if events := mustClaim(t, repo, 1, leaseUntil); len(events) != 1 || events[0].ProductID != 1 {
+			t.Fatalf("expected the oldest event only, got %+v", events)
+		}
+		if events := mustClaim(t, repo, 10, leaseUntil); len(events) != 1 || events[0].ProductID != 2 {
+			t.Fatalf("expected leased event skipped, got %+v", events)
+		}
+		if events := mustClaim(t, repo, 10, leaseUntil); len(events) != 0 {
+			t.Fatalf("expected no event due, got %+v", events)
+		}
+	})
+
+	t.Run("nacked event rescheduled", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo, &Product{Name: "mouse", Price: price("19.99"), Currency: "EUR"})
+		event := mustClaim(t, repo, 10, leaseUntil)[0]
+
+		if err := repo.NackOutboxEvent(event.ID, time.Now().Add(-time.Second), "unavailable", testContext()); err != nil {
+			t.Fatalf("nack failed: %s", err.Error())
+		}
+		events := mustClaim(t, repo, 10, leaseUntil)
+		if len(events) != 1 || events[0].ID != event.ID || events[0].Attempts != 2 {
+			t.Fatalf("expected event claimed again, got %+v", events)
+		}
+	})
+
+	t.Run("acked event removed", func(t *testing.T) {
+		repo := newRepository(t)
+		before := time.Now().Add(-time.Second)
+		mustCreate(t, repo,
+			&Product{Name: "mouse", Price: price("19.99"), Currency: "EUR"},
+			&Product{Name: "keyboard", Price: price("49.99"), Currency: "EUR"})
+
+		status := mustStatus(t, repo)
+		if status.Pending != 2 || status.Oldest == nil || status.Oldest.Before(before) {
+			t.Fatalf("expected 2 events pending, got %+v", status)
+		}
+
+		for _, event := range mustClaim(t, repo, 10, leaseUntil) {
+			if err := repo.AckOutboxEvent(event.ID, testContext()); err != nil {
+				t.Fatalf("ack failed: %s", err.Error())
+			}
+		}
+		if status := mustStatus(t, repo); status.Pending != 0 || status.Oldest != nil {
+			t.Fatalf("expected no event pending, got %+v", status)
+		}
+	})
+}
+
+func mustClaim(t *testing.T, store OutboxStore, limit int, leaseUntil time.Time) []*OutboxEvent {
+	t.Helper()
+	events, err := store.ClaimOutboxEvents(limit, leaseUntil, testContext())
+	if err != nil {
+		t.Fatalf("claim failed: %s", err.Error())
+	}
+	return events
+}
+
+func mustStatus(t *testing.T, store OutboxStore) *OutboxStatus {
+	t.Helper()
+	status, err := store.GetOutboxStatus(testContext())
+	if err != nil {
+		t.Fatalf("outbox status failed: %s", err.Error())
+	}
+	return status
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+const (
+	directionNext = "next"
+	directionPrev = "prev"
+)
+
+// encodeCursor returns the opaque token clients pass back to fetch the page next to or before the product given
+func encodeCursor(direction string, keys []SortField, product *Product) string {
+	raw, _ := json.Marshal(&cursor{
+		Direction: direction,
+		Sort:      formatSort(keys),
+		ID:        product.ID,
+		Name:      product.Name,
+		Price:     product.Price,
+	})
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(token string) (*cursor, error) {
+	raw, decodeErr := base64.RawURLEncoding.DecodeString(token)
+	if decodeErr != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cur cursor
+	unmarshErr := json.Unmarshal(raw, &cur)
+	if unmarshErr != nil || (cur.Direction != directionNext && cur.Direction != directionPrev) {
+		return nil, ErrInvalidCursor
+	}
+	return &cur, nil
+}
+
+// value returns the sort key of the boundary product
+func (c *cursor) value(field string) interface{} {
+	switch field {
+	case nameField:
+		return c.Name
+	case priceField:
+		return c.Price
+	default:
+		return c.ID
+	}
+}
+
+func (c *cursor) product() *Product {
+	return &Product{ID: c.ID, Name: c.Name, Price: c.Price}
+}
+
+// resolveQuery returns the sort keys, the boundary product to scan from (nil from the beginning) and the direction.
+// Products are scanned from the one following the boundary moving forward, preceding it moving backward.
+func resolveQuery(query *ProductsQuery) ([]SortField, *cursor, string, error) {
+	keys, sortErr := sortKeys(query)
+	if sortErr != nil {
+		return nil, nil, "", sortErr
+	}
+
+	if query.Cursor == "" {
+		return keys, nil, directionNext, nil
+	}
+
+	cur, cursorErr := decodeCursor(query.Cursor)
+	if cursorErr != nil {
+		return nil, nil, "", cursorErr
+	}
+	// sort keys of another sort can't locate the boundary
+	if cur.Sort != formatSort(keys) {
+		return nil, nil, "", ErrInvalidCursor
+	}
+	return keys, cur, cur.Direction, nil
+}
+
+// buildPage trims the products fetched, limit+1 to detect whether there are more, and links the pages around.
+// Products must be sorted in scan direction, the page is returned in sort order anyway.
+func buildPage(products []*Product, query *ProductsQuery, keys []SortField, direction string) *ProductsPage {
+	hasMore := len(products) > query.Limit
+	if hasMore {
+		products = products[:query.Limit]
+	}
+	if direction == directionPrev {
+		for i, j := 0, len(products)-1; i < j; i, j = i+1, j-1 {
+			products[i], products[j] = products[j], products[i]
+		}
+	}
+
+	page := &ProductsPage{Products: products, Total: -1}
+	if len(products) == 0 {
+		return page
+	}
+
+	first := products[0]
+	last := products[len(products)-1]
+	switch direction {
+	case directionNext:
+		if hasMore {
+			page.NextCursor = encodeCursor(directionNext, keys, last)
+		}
+		// coming from another page or skipping some, there may be products before
+		if query.Cursor != "" || query.Offset > 0 {
+			page.PrevCursor = encodeCursor(directionPrev, keys, first)
+		}
+	case directionPrev:
+		if hasMore {
+			page.PrevCursor = encodeCursor(directionPrev, keys, first)
+		}
+		page.NextCursor = encodeCursor(directionNext, keys, last)
+	}
+	return page
+}
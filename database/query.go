@@ -0,0 +1,255 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	idField    = "id"
+	nameField  = "name"
+	priceField = "price"
+
+	sortSeparator  = ","
+	sortDescPrefix = "-"
+
+	selectProductsQuery = "SELECT id,name,price,currency,version,deleted_at,updated_at FROM products"
+	selectCountQuery    = "SELECT COUNT(*) FROM products"
+)
+
+var (
+	// sortableFields whitelists the fields products can be sorted by, mapped to their column.
+	// Only columns coming from here end up in queries, never client input.
+	sortableFields = map[string]string{
+		idField:    "id",
+		nameField:  "name",
+		priceField: "price",
+	}
+
+	defaultSort = []SortField{{Field: idField}}
+
+	likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+)
+
+// ParseSort parses a comma-separated list of sortable fields (id, name, price), each optionally prefixed
+// by "-" to sort descending, e.g. "price,-name"
+func ParseSort(value string) ([]SortField, error) {
+	fields := make([]SortField, 0)
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(value, sortSeparator) {
+		item = strings.TrimSpace(item)
+		field := SortField{Field: strings.TrimPrefix(item, sortDescPrefix)}
+		field.Desc = field.Field != item
+
+		_, sortable := sortableFields[field.Field]
+		if !sortable || seen[field.Field] {
+			return nil, ErrInvalidSort
+		}
+		seen[field.Field] = true
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+func formatSort(fields []SortField) string {
+	items := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field.Desc {
+			items = append(items, sortDescPrefix+field.Field)
+		} else {
+			items = append(items, field.Field)
+		}
+	}
+	return strings.Join(items, sortSeparator)
+}
+
+// sortKeys returns the sort of the query with the ID as last key, so that products are always in a total order
+func sortKeys(query *ProductsQuery) ([]SortField, error) {
+	if len(query.Sort) == 0 {
+		return defaultSort, nil
+	}
+
+	keys := make([]SortField, 0, len(query.Sort)+1)
+	for _, field := range query.Sort {
+		if _, sortable := sortableFields[field.Field]; !sortable {
+			return nil, ErrInvalidSort
+		}
+		keys = append(keys, field)
+		if field.Field == idField {
+			// ID is unique, following keys are useless
+			return keys, nil
+		}
+	}
+	return append(keys, SortField{Field: idField}), nil
+}
+
+// searchTokens splits the full-text search into lowercase words of letters and digits, the same way names are indexed
+// by every repository: any other character separates words, matched whole and not by prefix
+func searchTokens(search string) []string {
+	return strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// queryBuilder collects the conditions of a products query with their args, as numbered placeholders
+type queryBuilder struct {
+	dialect    *dialect
+	conditions []string
+	args       []interface{}
+}
+
+func (b *queryBuilder) arg(value interface{}) string {
+	b.args = append(b.args, value)
+	return fmt.Sprintf("$%d", len(b.args))
+}
+
+func (b *queryBuilder) where() string {
+	if len(b.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(b.conditions, " AND ")
+}
+
+func (b *queryBuilder) addFilters(query *ProductsQuery) {
+	if !query.IncludeDeleted {
+		b.conditions = append(b.conditions, "deleted_at IS NULL")
+	}
+	if query.NamePrefix != "" {
+		b.conditions = append(b.conditions, fmt.Sprintf(`name %s %s ESCAPE '\'`,
+			b.dialect.caseInsensitiveLike, b.arg(likeEscaper.Replace(query.NamePrefix)+"%")))
+	}
+	if query.MinPrice != nil {
+		b.conditions = append(b.conditions, "price >= "+b.arg(*query.MinPrice))
+	}
+	if query.MaxPrice != nil {
+		b.conditions = append(b.conditions, "price <= "+b.arg(*query.MaxPrice))
+	}
+	if tokens := searchTokens(query.Search); len(tokens) > 0 {
+		b.conditions = append(b.conditions, fmt.Sprintf(b.dialect.searchCondition, b.arg(b.dialect.searchArg(tokens))))
+	}
+}
+
+// addKeyset restricts to the products after the boundary in scan direction, that is for keys k1, k2, ...
+// (k1 > v1) OR (k1 = v1 AND k2 > v2) OR ... with comparisons flipped on descending keys and moving backward
+func (b *queryBuilder) addKeyset(keys []SortField, boundary *cursor, direction string) {
+	alternatives := make([]string, 0, len(keys))
+	for i, key := range keys {
+		terms := make([]string, 0, i+1)
+		for _, previous := range keys[:i] {
+			terms = append(terms, fmt.Sprintf("%s = %s", b.column(previous), b.arg(boundary.value(previous.Field))))
+		}
+		operator := ">"
+		if key.Desc != (direction == directionPrev) {
+			operator = "<"
+		}
+		terms = append(terms, fmt.Sprintf("%s %s %s", b.column(key), operator, b.arg(boundary.value(key.Field))))
+		alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+	}
+	b.conditions = append(b.conditions, "("+strings.Join(alternatives, " OR ")+")")
+}
+
+// column returns the whitelisted column of the key, compared byte-wise on every DB as in Go
+func (b *queryBuilder) column(key SortField) string {
+	column := sortableFields[key.Field]
+	if key.Field == nameField {
+		return column + b.dialect.binaryCollation
+	}
+	return column
+}
+
+func (b *queryBuilder) orderBy(keys []SortField, direction string) string {
+	items := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key.Desc != (direction == directionPrev) {
+			items = append(items, b.column(key)+" DESC")
+		} else {
+			items = append(items, b.column(key)+" ASC")
+		}
+	}
+	return " ORDER BY " + strings.Join(items, ", ")
+}
+
+// buildProductsQuery returns the query fetching limit products after the boundary (nil for the first page),
+// skipping query.Offset products when there is no boundary
+func buildProductsQuery(d *dialect, query *ProductsQuery, keys []SortField, boundary *cursor, direction string,
+	limit int) (string, []interface{}) {
+
+	builder := &queryBuilder{dialect: d}
+	builder.addFilters(query)
+	if boundary != nil {
+		builder.addKeyset(keys, boundary, direction)
+	}
+	sqlQuery := selectProductsQuery + builder.where() + builder.orderBy(keys, direction) + " LIMIT " + builder.arg(limit)
+	if boundary == nil && query.Offset > 0 {
+		sqlQuery += " OFFSET " + builder.arg(query.Offset)
+	}
+	return d.rebind(sqlQuery), builder.args
+}
+
+func buildCountQuery(d *dialect, query *ProductsQuery) (string, []interface{}) {
+	builder := &queryBuilder{dialect: d}
+	builder.addFilters(query)
+	return d.rebind(selectCountQuery + builder.where()), builder.args
+}
+
+// matches reports whether the product passes all the query filters, mirroring addFilters
+func matches(product *Product, query *ProductsQuery, tokens []string) bool {
+	if !query.IncludeDeleted && product.DeletedAt != nil {
+		return false
+	}
+	if query.NamePrefix != "" && !strings.HasPrefix(strings.ToLower(product.Name), strings.ToLower(query.NamePrefix)) {
+		return false
+	}
+	if query.MinPrice != nil && product.Price.LessThan(*query.MinPrice) {
+		return false
+	}
+	if query.MaxPrice != nil && product.Price.GreaterThan(*query.MaxPrice) {
+		return false
+	}
+	if len(tokens) > 0 {
+		words := make(map[string]bool)
+		for _, word := range searchTokens(product.Name) {
+			words[word] = true
+		}
+		for _, token := range tokens {
+			if !words[token] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compareProducts compares two products by the sort keys, in scan direction
+func compareProducts(a, b *Product, keys []SortField, direction string) int {
+	for _, key := range keys {
+		result := 0
+		switch key.Field {
+		case idField:
+			result = compareValues(a.ID < b.ID, a.ID > b.ID)
+		case nameField:
+			result = strings.Compare(a.Name, b.Name)
+		case priceField:
+			result = a.Price.Cmp(b.Price)
+		}
+		if key.Desc != (direction == directionPrev) {
+			result = -result
+		}
+		if result != 0 {
+			return result
+		}
+	}
+	return 0
+}
+
+func compareValues(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	default:
+		return 0
+	}
+}
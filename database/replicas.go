@@ -0,0 +1,193 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	usePrimaryContextKey contextKey = "use-primary"
+
+	replicaNameFormat = "replica-%d"
+	primaryTarget     = "primary"
+)
+
+// NewReplicaSet opens the read-replicas configured, it returns nil if none is configured
+func NewReplicaSet() (*ReplicaSet, error) {
+	logging.Log.Info("Create new DB replica set")
+	return newReplicaSet(postgresDriver)
+}
+
+// NewReplicaSetWithWrappedTracing opens the read-replicas configured through the driver registered by
+// NewWithWrappedTracing, so it must be invoked afterwards. It returns nil if no replica is configured.
+func NewReplicaSetWithWrappedTracing() (*ReplicaSet, error) {
+	logging.Log.Info("Create new DB replica set instrumented for tracing")
+	return newReplicaSet(instrumentedDbDriverNamePrefix + postgresDriver)
+}
+
+func newReplicaSet(driverName string) (*ReplicaSet, error) {
+	cfg := loadConfig()
+	if len(cfg.replicaDsns) == 0 {
+		logging.Log.Debug("No DB replica configured, all queries go to the primary")
+		return nil, nil
+	}
+	if cfg.dbDriver != postgresDriver {
+		return nil, fmt.Errorf("DB replicas not supported by %s driver", cfg.dbDriver)
+	}
+
+	set := &ReplicaSet{
+		replicas:      make([]*replica, 0, len(cfg.replicaDsns)),
+		maxLag:        cfg.replicaMaxLag,
+		checkInterval: cfg.replicaCheckInterval,
+		checkLag:      (*replica).checkLag,
+		stop:          make(chan struct{}),
+	}
+	for i, dsn := range cfg.replicaDsns {
+		db, dbErr := sql.Open(driverName, dsn)
+		if dbErr != nil {
+			_ = set.Close()
+			return nil, fmt.Errorf("replica %d opening failed: %s", i, dbErr.Error())
+		}
+		configurePool(db, postgresDialect, cfg)
+		// name doesn't come from the DSN on purpose, to avoid leaking credentials in logs and probes
+		set.replicas = append(set.replicas, &replica{name: fmt.Sprintf(replicaNameFormat, i), db: db})
+	}
+
+	set.checkReplicas()
+	set.stopped.Add(1)
+	go set.startHealthChecks()
+
+	return set, nil
+}
+
+// WithPrimary marks the context so that reads go to the primary, e.g. to read your own writes
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, usePrimaryContextKey, true)
+}
+
+func usePrimary(ctx context.Context) bool {
+	value, ok := ctx.Value(usePrimaryContextKey).(bool)
+	return ok && value
+}
+
+// Close stops the health checks and closes all the replicas connections
+func (s *ReplicaSet) Close() error {
+	logging.Log.Info("Close DB replica set")
+
+	select {
+	case <-s.stop:
+		// already closed
+	default:
+		close(s.stop)
+	}
+	s.stopped.Wait()
+
+	var closeErr error
+	for _, rep := range s.replicas {
+		err := rep.db.Close()
+		if err != nil {
+			closeErr = err
+			logging.SugaredLog.Errorf("DB %s closing failed: %s", rep.name, err.Error())
+		}
+	}
+	return closeErr
+}
+
+// GetStatus returns the state of every replica as of the last health check
+func (s *ReplicaSet) GetStatus() []*ReplicaStatus {
+	statuses := make([]*ReplicaStatus, 0, len(s.replicas))
+	for _, rep := range s.replicas {
+		rep.mutex.RLock()
+		status := &ReplicaStatus{
+			Name:    rep.name,
+			Healthy: rep.healthy,
+			Lag:     rep.lag,
+		}
+		if rep.lastError != nil {
+			status.Error = rep.lastError.Error()
+		}
+		rep.mutex.RUnlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// GetMaxLag returns the replication lag above which a replica is removed from rotation
+func (s *ReplicaSet) GetMaxLag() time.Duration {
+	return s.maxLag
+}
+
+// pick returns the next healthy replica in round-robin, nil if none is healthy
+func (s *ReplicaSet) pick() *replica {
+	count := len(s.replicas)
+	start := int(atomic.AddUint32(&s.next, 1))
+	for i := 0; i < count; i++ {
+		rep := s.replicas[(start+i)%count]
+		if rep.isHealthy() {
+			return rep
+		}
+	}
+	return nil
+}
+
+func (s *ReplicaSet) startHealthChecks() {
+	defer s.stopped.Done()
+
+	ticker := time.NewTicker(s.checkInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.checkReplicas()
+		}
+	}
+}
+
+func (s *ReplicaSet) checkReplicas() {
+	for _, rep := range s.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), s.checkInterval)
+		lag, err := s.checkLag(rep, ctx)
+		cancel()
+
+		if err == nil && lag > s.maxLag {
+			err = fmt.Errorf("replication lag %s exceeds max %s", lag, s.maxLag)
+		}
+
+		rep.mutex.Lock()
+		if rep.healthy && err != nil {
+			logging.SugaredLog.Warnf("DB %s removed from rotation: %s", rep.name, err.Error())
+		} else if !rep.healthy && err == nil {
+			logging.SugaredLog.Infof("DB %s back in rotation", rep.name)
+		}
+		rep.healthy = err == nil
+		rep.lag = lag
+		rep.lastError = err
+		rep.mutex.Unlock()
+	}
+}
+
+func (r *replica) checkLag(ctx context.Context) (time.Duration, error) {
+	var lagSeconds float64
+	err := r.db.QueryRowContext(ctx, getReplicaLagQuery).Scan(&lagSeconds)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return 0, errors.New("health check timed out")
+		}
+		return 0, err
+	}
+	return time.Duration(lagSeconds * float64(time.Second)), nil
+}
+
+func (r *replica) isHealthy() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.healthy
+}
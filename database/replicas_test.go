@@ -0,0 +1,114 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReplicaMaxLag = time.Second
+
+func TestReplicaSet(t *testing.T) {
+	t.Setenv(dbDriverEnvVar, sqliteDriver)
+	t.Setenv(dbPathEnvVar, sqliteInMemoryPath)
+
+	// every DB holds a product named after it, to tell which one served a read
+	primary := newNamedDb(t, primaryTarget)
+	repo := NewSQLiteRepository(primary)
+	lags := map[string]time.Duration{}
+	lagErrs := map[string]error{}
+	replicas := &ReplicaSet{
+		maxLag:        testReplicaMaxLag,
+		checkInterval: time.Second,
+		checkLag: func(rep *replica, ctx context.Context) (time.Duration, error) {
+			return lags[rep.name], lagErrs[rep.name]
+		},
+		stop: make(chan struct{}),
+	}
+	for _, name := range []string{"replica-0", "replica-1"} {
+		replicas.replicas = append(replicas.replicas, &replica{name: name, db: newNamedDb(t, name)})
+	}
+	t.Cleanup(func() { _ = replicas.Close() })
+	repo.SetReplicas(replicas)
+
+	t.Run("round-robin", func(t *testing.T) {
+		replicas.checkReplicas()
+		served := readsServedBy(t, repo, 4, testContext())
+		if served[0] == served[1] || served[0] != served[2] || served[1] != served[3] ||
+			!strings.HasPrefix(served[0], "replica-") || !strings.HasPrefix(served[1], "replica-") {
+			t.Fatalf("expected reads alternating between the replicas, got %v", served)
+		}
+		if served = readsServedBy(t, repo, 1, WithPrimary(testContext())); served[0] != primaryTarget {
+			t.Fatalf("expected read from the primary when required, got %v", served)
+		}
+	})
+
+	t.Run("replication lag cutoff", func(t *testing.T) {
+		lags["replica-0"] = testReplicaMaxLag
+		lags["replica-1"] = testReplicaMaxLag + time.Millisecond
+		replicas.checkReplicas()
+
+		statuses := replicas.GetStatus()
+		if !statuses[0].Healthy || statuses[0].Lag != testReplicaMaxLag {
+			t.Fatalf("expected replica lagging by the max lag kept, got %+v", statuses[0])
+		}
+		if statuses[1].Healthy || !strings.Contains(statuses[1].Error, "exceeds max") {
+			t.Fatalf("expected replica lagging beyond the max lag removed, got %+v", statuses[1])
+		}
+		for _, servedBy := range readsServedBy(t, repo, 3, testContext()) {
+			if servedBy != "replica-0" {
+				t.Fatalf("expected reads from replica-0 only, got %s", servedBy)
+			}
+		}
+	})
+
+	t.Run("primary fallback", func(t *testing.T) {
+		lagErrs["replica-0"] = errors.New("connection refused")
+		replicas.checkReplicas()
+
+		if status := replicas.GetStatus()[0]; status.Healthy || status.Error != "connection refused" {
+			t.Fatalf("expected unhealthy replica removed, got %+v", status)
+		}
+		for _, servedBy := range readsServedBy(t, repo, 2, testContext()) {
+			if servedBy != primaryTarget {
+				t.Fatalf("expected reads from the primary with no healthy replica, got %s", servedBy)
+			}
+		}
+
+		delete(lagErrs, "replica-0")
+		lags = map[string]time.Duration{}
+		replicas.checkReplicas()
+		if served := readsServedBy(t, repo, 2, testContext()); served[0] == served[1] || served[0] == primaryTarget {
+			t.Fatalf("expected replicas back in rotation, got %v", served)
+		}
+	})
+}
+
+// newNamedDb returns an in-memory SQLite DB holding a single product, named as given
+func newNamedDb(t *testing.T, name string) *sql.DB {
+	t.Helper()
+	db, dbErr := New()
+	if dbErr != nil {
+		t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	mustCreate(t, NewSQLiteRepository(db), &Product{Name: name, Price: price("1"), Currency: "EUR"})
+	return db
+}
+
+// readsServedBy lists the names of the DBs serving the reads given
+func readsServedBy(t *testing.T, repo *SQLRepository, reads int, ctx context.Context) []string {
+	t.Helper()
+	served := make([]string, 0, reads)
+	for i := 0; i < reads; i++ {
+		page, err := repo.GetProducts(&ProductsQuery{Limit: 1}, ctx)
+		if err != nil || len(page.Products) != 1 {
+			t.Fatalf("get products failed: %v", err)
+		}
+		served = append(served, page.Products[0].Name)
+	}
+	return served
+}
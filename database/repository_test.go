@@ -0,0 +1,776 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shopspring/decimal"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/utils"
+)
+
+const (
+	testPostgresEnvVar = "TEST_POSTGRES" // bool, requires DB_* env vars pointing to a disposable PostgreSQL
+
+	truncateProductsQuery = "TRUNCATE TABLE products RESTART IDENTITY"
+	sqliteInMemoryPath    = ":memory:"
+)
+
+func TestMain(m *testing.M) {
+	err := logging.InitGlobalLogger()
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMemoryRepository(t *testing.T) {
+	testProductRepository(t, func(t *testing.T) ProductRepository {
+		return NewMemoryRepository()
+	})
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	t.Setenv(dbDriverEnvVar, sqliteDriver)
+	t.Setenv(dbPathEnvVar, sqliteInMemoryPath)
+
+	testProductRepository(t, func(t *testing.T) ProductRepository {
+		// every in-memory SQLite DB interface starts from scratch
+		db, dbErr := New()
+		if dbErr != nil {
+			t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+		}
+		t.Cleanup(func() { _ = db.Close() })
+		return NewSQLiteRepository(db)
+	})
+}
+
+func TestPostgresRepository(t *testing.T) {
+	if !utils.GetBoolEnv(testPostgresEnvVar, false) {
+		t.Skipf("%s not set, skipping PostgreSQL conformance tests", testPostgresEnvVar)
+	}
+
+	db, dbErr := New()
+	if dbErr != nil {
+		t.Fatalf("DB interface creation failed: %s", dbErr.Error())
+	}
+	defer db.Close()
+
+	testProductRepository(t, func(t *testing.T) ProductRepository {
+		_, truncErr := db.Exec(truncateProductsQuery)
+		if truncErr != nil {
+			t.Fatalf("products table truncation failed: %s", truncErr.Error())
+		}
+		return NewPostgresRepository(db)
+	})
+}
+
+// testProductRepository is the conformance suite every ProductRepository implementation must pass.
+// newRepository must return an empty repository on every invocation.
+func testProductRepository(t *testing.T, newRepository func(t *testing.T) ProductRepository) {
+	t.Run("create assigns ID", func(t *testing.T) {
+		repo := newRepository(t)
+		first := &Product{Name: "first", Price: price("1.5"), Currency: "EUR"}
+		second := &Product{Name: "second", Price: price("2.5"), Currency: "EUR"}
+		mustCreate(t, repo, first, second)
+
+		if first.ID < 1 || second.ID <= first.ID {
+			t.Errorf("expected increasing positive IDs, got %d and %d", first.ID, second.ID)
+		}
+		if first.Version != 1 {
+			t.Errorf("expected version 1, got %d", first.Version)
+		}
+	})
+
+	t.Run("get returns stored product", func(t *testing.T) {
+		repo := newRepository(t)
+		created := &Product{Name: "product", Price: price("10.25"), Currency: "EUR"}
+		mustCreate(t, repo, created)
+
+		fetched := &Product{ID: created.ID}
+		err := repo.GetProduct(fetched, false, testContext())
+		if err != nil {
+			t.Fatalf("get product failed: %s", err.Error())
+		}
+		if !sameProduct(fetched, created) {
+			t.Errorf("expected %s, got %s", created.String(), fetched.String())
+		}
+	})
+
+	t.Run("get missing product", func(t *testing.T) {
+		repo := newRepository(t)
+		err := repo.GetProduct(&Product{ID: 42}, false, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+	})
+
+	t.Run("list pages through products", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo,
+			&Product{Name: "a", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "b", Price: price("2"), Currency: "EUR"},
+			&Product{Name: "c", Price: price("3"), Currency: "EUR"},
+		)
+
+		all, err := repo.GetProducts(&ProductsQuery{Limit: 10, WithTotal: true}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if len(all.Products) != 3 || all.Total != 3 {
+			t.Errorf("expected 3 products out of 3, got %d out of %d", len(all.Products), all.Total)
+		}
+		if all.NextCursor != "" || all.PrevCursor != "" {
+			t.Errorf("expected no links on a single page, got next %q prev %q", all.NextCursor, all.PrevCursor)
+		}
+
+		first, err := repo.GetProducts(&ProductsQuery{Limit: 2}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if len(first.Products) != 2 || first.Products[0].Name != "a" || first.NextCursor == "" || first.PrevCursor != "" {
+			t.Fatalf("unexpected first page %+v", first)
+		}
+		if first.Total != -1 {
+			t.Errorf("expected no total unless requested, got %d", first.Total)
+		}
+
+		second, err := repo.GetProducts(&ProductsQuery{Limit: 2, Cursor: first.NextCursor}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if len(second.Products) != 1 || second.Products[0].Name != "c" || second.NextCursor != "" || second.PrevCursor == "" {
+			t.Fatalf("unexpected second page %+v", second)
+		}
+
+		back, err := repo.GetProducts(&ProductsQuery{Limit: 2, Cursor: second.PrevCursor}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if len(back.Products) != 2 || back.Products[0].Name != "a" || back.Products[1].Name != "b" {
+			t.Errorf("expected to get back to the first page, got %+v", back.Products)
+		}
+		if back.PrevCursor != "" || back.NextCursor == "" {
+			t.Errorf("unexpected links going back, next %q prev %q", back.NextCursor, back.PrevCursor)
+		}
+
+		started, err := repo.GetProducts(&ProductsQuery{Limit: 10, Offset: 1}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if len(started.Products) != 2 || started.Products[0].Name != "b" || started.PrevCursor == "" {
+			t.Errorf("expected 2 products starting from b, got %+v", started.Products)
+		}
+	})
+
+	t.Run("list rejects invalid cursor", func(t *testing.T) {
+		repo := newRepository(t)
+		_, err := repo.GetProducts(&ProductsQuery{Limit: 10, Cursor: "not-a-cursor"}, testContext())
+		if err != ErrInvalidCursor {
+			t.Errorf("expected ErrInvalidCursor, got %v", err)
+		}
+	})
+
+	t.Run("list filters products", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo,
+			&Product{Name: "Red apple", Price: price("1.5"), Currency: "EUR"},
+			&Product{Name: "green apple", Price: price("2"), Currency: "EUR"},
+			&Product{Name: "Red wine 100%", Price: price("12"), Currency: "EUR"},
+			&Product{Name: "red_pepper", Price: price("3"), Currency: "EUR"},
+		)
+
+		minPrice, maxPrice := price("1.5"), price("3")
+		tests := []struct {
+			name     string
+			query    *ProductsQuery
+			expected []string
+		}{
+			{"name prefix ignores case", &ProductsQuery{NamePrefix: "red"},
+				[]string{"Red apple", "Red wine 100%", "red_pepper"}},
+			{"name prefix escapes wildcards", &ProductsQuery{NamePrefix: "red_"}, []string{"red_pepper"}},
+			{"price range is inclusive", &ProductsQuery{MinPrice: &minPrice, MaxPrice: &maxPrice},
+				[]string{"Red apple", "green apple", "red_pepper"}},
+			{"search matches all words", &ProductsQuery{Search: "APPLE red"}, []string{"Red apple"}},
+			{"search matches whole words", &ProductsQuery{Search: "app"}, []string{}},
+			{"search splits on punctuation", &ProductsQuery{Search: "pepper, 100"}, []string{}},
+			{"search without words is ignored", &ProductsQuery{Search: "!?"},
+				[]string{"Red apple", "green apple", "Red wine 100%", "red_pepper"}},
+			{"filters combine", &ProductsQuery{NamePrefix: "red", MaxPrice: &maxPrice, Search: "pepper"},
+				[]string{"red_pepper"}},
+		}
+		for _, test := range tests {
+			test.query.Limit = 10
+			test.query.WithTotal = true
+			page, err := repo.GetProducts(test.query, testContext())
+			if err != nil {
+				t.Fatalf("%s: get products failed: %s", test.name, err.Error())
+			}
+			if names := productNames(page.Products); !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, names)
+			}
+			if page.Total != len(test.expected) {
+				t.Errorf("%s: expected total %d, got %d", test.name, len(test.expected), page.Total)
+			}
+		}
+	})
+
+	t.Run("list sorts and pages through sorted products", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo,
+			&Product{Name: "b", Price: price("2"), Currency: "EUR"},
+			&Product{Name: "a", Price: price("2"), Currency: "EUR"},
+			&Product{Name: "c", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "B", Price: price("3"), Currency: "EUR"},
+			&Product{Name: "a", Price: price("1"), Currency: "EUR"},
+		)
+
+		sortFields, sortErr := ParseSort("price,-name")
+		if sortErr != nil {
+			t.Fatalf("parse sort failed: %s", sortErr.Error())
+		}
+		// IDs break ties, names are compared byte-wise
+		expected := []string{"c:1", "a:1", "b:2", "a:2", "B:3"}
+
+		pages := make([][]string, 0)
+		query := &ProductsQuery{Limit: 2, Sort: sortFields}
+		var last *ProductsPage
+		for {
+			page, err := repo.GetProducts(query, testContext())
+			if err != nil {
+				t.Fatalf("get products failed: %s", err.Error())
+			}
+			pages = append(pages, productKeys(page.Products))
+			last = page
+			if page.NextCursor == "" {
+				break
+			}
+			query = &ProductsQuery{Limit: 2, Sort: sortFields, Cursor: page.NextCursor}
+		}
+		if all := flatten(pages); !reflect.DeepEqual(all, expected) {
+			t.Fatalf("expected %v, got %v", expected, all)
+		}
+
+		back, err := repo.GetProducts(&ProductsQuery{Limit: 2, Sort: sortFields, Cursor: last.PrevCursor}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if keys := productKeys(back.Products); !reflect.DeepEqual(keys, expected[2:4]) {
+			t.Errorf("expected %v going back, got %v", expected[2:4], keys)
+		}
+
+		_, err = repo.GetProducts(&ProductsQuery{Limit: 2, Cursor: last.PrevCursor}, testContext())
+		if err != ErrInvalidCursor {
+			t.Errorf("expected ErrInvalidCursor using a cursor with another sort, got %v", err)
+		}
+
+		skipped, err := repo.GetProducts(&ProductsQuery{Limit: 2, Sort: sortFields, Offset: 3}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if keys := productKeys(skipped.Products); !reflect.DeepEqual(keys, expected[3:5]) || skipped.NextCursor != "" {
+			t.Fatalf("expected %v skipping 3 products, got %v next %q", expected[3:5], keys, skipped.NextCursor)
+		}
+		back, err = repo.GetProducts(&ProductsQuery{Limit: 2, Sort: sortFields, Cursor: skipped.PrevCursor}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if keys := productKeys(back.Products); !reflect.DeepEqual(keys, expected[1:3]) {
+			t.Errorf("expected %v going back from the offset, got %v", expected[1:3], keys)
+		}
+	})
+
+	t.Run("search splits words on punctuation", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo,
+			&Product{Name: "e-mail holder", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "Lamp v2.5", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "desk/lamp", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "-5 degrees fridge", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "www.shop.example mug", Price: price("1"), Currency: "EUR"},
+			&Product{Name: "Éclair box", Price: price("1"), Currency: "EUR"},
+		)
+
+		tests := []struct {
+			search   string
+			expected []string
+		}{
+			{"mail", []string{"e-mail holder"}},
+			{"E-Mail", []string{"e-mail holder"}},
+			{"mai", []string{}},
+			{"lamp", []string{"Lamp v2.5", "desk/lamp"}},
+			{"desk lamp", []string{"desk/lamp"}},
+			{"5", []string{"Lamp v2.5", "-5 degrees fridge"}},
+			{"-5", []string{"Lamp v2.5", "-5 degrees fridge"}},
+			{"V2", []string{"Lamp v2.5"}},
+			{"v2.5", []string{"Lamp v2.5"}},
+			{"example", []string{"www.shop.example mug"}},
+			{"shop.example", []string{"www.shop.example mug"}},
+			{"éCLAIR", []string{"Éclair box"}},
+		}
+		for _, test := range tests {
+			page, err := repo.GetProducts(&ProductsQuery{Limit: 10, Search: test.search}, testContext())
+			if err != nil {
+				t.Fatalf("get products failed: %s", err.Error())
+			}
+			if names := productNames(page.Products); !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("searching %q expected %v, got %v", test.search, test.expected, names)
+			}
+		}
+	})
+
+	t.Run("search follows updates and deletes", func(t *testing.T) {
+		repo := newRepository(t)
+		kept := &Product{Name: "old kettle", Price: price("1"), Currency: "EUR"}
+		deleted := &Product{Name: "old lamp", Price: price("1"), Currency: "EUR"}
+		mustCreate(t, repo, kept, deleted)
+
+		err := repo.UpdateProduct(&Product{ID: kept.ID, Name: "new kettle", Price: price("1"), Currency: "EUR"}, testContext())
+		if err != nil {
+			t.Fatalf("update product failed: %s", err.Error())
+		}
+		err = repo.DeleteProduct(deleted.ID, 0, testContext())
+		if err != nil {
+			t.Fatalf("delete product failed: %s", err.Error())
+		}
+
+		for search, expected := range map[string][]string{"old": {}, "new": {"new kettle"}} {
+			page, err := repo.GetProducts(&ProductsQuery{Limit: 10, Search: search}, testContext())
+			if err != nil {
+				t.Fatalf("get products failed: %s", err.Error())
+			}
+			if names := productNames(page.Products); !reflect.DeepEqual(names, expected) {
+				t.Errorf("searching %q expected %v, got %v", search, expected, names)
+			}
+		}
+	})
+
+	t.Run("import and export products", func(t *testing.T) {
+		repo := newRepository(t)
+		mustCreate(t, repo, &Product{Name: "existing", Price: price("1"), Currency: "EUR"})
+
+		err := repo.ImportProducts([]*Product{
+			{Name: "first", Price: price("1.10"), Currency: "USD"},
+			{Name: "second", Price: price("2"), Currency: "EUR"},
+		}, testContext())
+		if err != nil {
+			t.Fatalf("import products failed: %s", err.Error())
+		}
+
+		exported := make([]string, 0)
+		err = repo.ExportProducts(func(product *Product) error {
+			exported = append(exported, fmt.Sprintf("%d:%s:%s:%s:%d",
+				product.ID, product.Name, product.Price.String(), product.Currency, product.Version))
+			return nil
+		}, testContext())
+		if err != nil {
+			t.Fatalf("export products failed: %s", err.Error())
+		}
+		expected := []string{"1:existing:1:EUR:1", "2:first:1.1:USD:1", "3:second:2:EUR:1"}
+		if !reflect.DeepEqual(exported, expected) {
+			t.Errorf("expected %v, got %v", expected, exported)
+		}
+
+		stopErr := errors.New("stop")
+		count := 0
+		err = repo.ExportProducts(func(product *Product) error {
+			count++
+			return stopErr
+		}, testContext())
+		if err != stopErr || count != 1 {
+			t.Errorf("expected export to stop at the first error, got %v after %d products", err, count)
+		}
+	})
+
+	t.Run("update overwrites product", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "old", Price: price("1"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+
+		updated := &Product{ID: product.ID, Name: "new", Price: price("2"), Currency: "EUR"}
+		err := repo.UpdateProduct(updated, testContext())
+		if err != nil {
+			t.Fatalf("update product failed: %s", err.Error())
+		}
+
+		fetched := &Product{ID: product.ID}
+		err = repo.GetProduct(fetched, false, testContext())
+		if err != nil {
+			t.Fatalf("get product failed: %s", err.Error())
+		}
+		if !sameProduct(fetched, updated) {
+			t.Errorf("expected %s, got %s", updated.String(), fetched.String())
+		}
+		if fetched.Version != 2 {
+			t.Errorf("expected version 2, got %d", fetched.Version)
+		}
+	})
+
+	t.Run("patch applies on the current product", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "lamp", Price: price("10"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+
+		patched := &Product{ID: product.ID, Version: product.Version}
+		err := repo.PatchProduct(patched, func(current *Product) error {
+			current.Price = current.Price.Mul(price("2"))
+			return nil
+		}, testContext())
+		if err != nil {
+			t.Fatalf("patch product failed: %s", err.Error())
+		}
+		if patched.Name != "lamp" || !patched.Price.Equal(price("20")) || patched.Version != 2 {
+			t.Errorf("unexpected patched product %s", patched.String())
+		}
+
+		abortErr := errors.New("abort")
+		err = repo.PatchProduct(&Product{ID: product.ID}, func(current *Product) error {
+			current.Name = "aborted"
+			return abortErr
+		}, testContext())
+		if err != abortErr {
+			t.Errorf("expected the patch error, got %v", err)
+		}
+
+		stored := &Product{ID: product.ID}
+		err = repo.GetProduct(stored, false, testContext())
+		if err != nil {
+			t.Fatalf("get product failed: %s", err.Error())
+		}
+		if stored.Name != "lamp" || !stored.Price.Equal(price("20")) || stored.Version != 2 {
+			t.Errorf("expected aborted patch not to be stored, got %s", stored.String())
+		}
+
+		noop := func(current *Product) error { return nil }
+		err = repo.PatchProduct(&Product{ID: product.ID, Version: 1}, noop, testContext())
+		if err != ErrVersionMismatch {
+			t.Errorf("expected ErrVersionMismatch, got %v", err)
+		}
+		err = repo.PatchProduct(&Product{ID: 42}, noop, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+	})
+
+	t.Run("update and delete missing product", func(t *testing.T) {
+		repo := newRepository(t)
+
+		err := repo.UpdateProduct(&Product{ID: 42, Name: "missing"}, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound on update, got %v", err)
+		}
+		err = repo.DeleteProduct(42, 0, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound on delete, got %v", err)
+		}
+	})
+
+	t.Run("optimistic concurrency", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "product", Price: price("1"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+
+		err := repo.UpdateProduct(&Product{ID: product.ID, Name: "first", Version: 1}, testContext())
+		if err != nil {
+			t.Fatalf("update product failed: %s", err.Error())
+		}
+
+		// a second writer still holding version 1
+		err = repo.UpdateProduct(&Product{ID: product.ID, Name: "second", Version: 1}, testContext())
+		if err != ErrVersionMismatch {
+			t.Errorf("expected ErrVersionMismatch on update, got %v", err)
+		}
+		err = repo.DeleteProduct(product.ID, 1, testContext())
+		if err != ErrVersionMismatch {
+			t.Errorf("expected ErrVersionMismatch on delete, got %v", err)
+		}
+
+		err = repo.DeleteProduct(product.ID, 2, testContext())
+		if err != nil {
+			t.Errorf("delete product failed: %s", err.Error())
+		}
+	})
+
+	t.Run("delete removes product", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "product", Price: price("1"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+
+		err := repo.DeleteProduct(product.ID, 0, testContext())
+		if err != nil {
+			t.Fatalf("delete product failed: %s", err.Error())
+		}
+
+		err = repo.GetProduct(&Product{ID: product.ID}, false, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+	})
+
+	t.Run("deleted product kept until restored", func(t *testing.T) {
+		repo := newRepository(t)
+		kept := &Product{Name: "kept", Price: price("1"), Currency: "EUR"}
+		deleted := &Product{Name: "deleted", Price: price("2"), Currency: "EUR"}
+		mustCreate(t, repo, kept, deleted)
+
+		err := repo.DeleteProduct(deleted.ID, 0, testContext())
+		if err != nil {
+			t.Fatalf("delete product failed: %s", err.Error())
+		}
+
+		fetched := &Product{ID: deleted.ID}
+		err = repo.GetProduct(fetched, true, testContext())
+		if err != nil {
+			t.Fatalf("get deleted product failed: %s", err.Error())
+		}
+		if fetched.DeletedAt == nil || fetched.Version != 2 {
+			t.Errorf("expected product deleted at version 2, got %s deleted at %v", fetched.String(), fetched.DeletedAt)
+		}
+
+		for includeDeleted, expected := range map[bool][]string{false: {"kept"}, true: {"kept", "deleted"}} {
+			page, err := repo.GetProducts(&ProductsQuery{Limit: 10, WithTotal: true, IncludeDeleted: includeDeleted}, testContext())
+			if err != nil {
+				t.Fatalf("get products failed: %s", err.Error())
+			}
+			if names := productNames(page.Products); !reflect.DeepEqual(names, expected) || page.Total != len(expected) {
+				t.Errorf("including deleted %t expected %v, got %v (total %d)", includeDeleted, expected, names, page.Total)
+			}
+		}
+
+		err = repo.UpdateProduct(&Product{ID: deleted.ID, Name: "updated", Price: price("1"), Currency: "EUR"}, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound on update, got %v", err)
+		}
+		err = repo.DeleteProduct(deleted.ID, 0, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound on second delete, got %v", err)
+		}
+
+		err = repo.RestoreProduct(&Product{ID: deleted.ID, Version: 1}, testContext())
+		if err != ErrVersionMismatch {
+			t.Errorf("expected ErrVersionMismatch on restore, got %v", err)
+		}
+		restored := &Product{ID: deleted.ID, Version: 2}
+		err = repo.RestoreProduct(restored, testContext())
+		if err != nil {
+			t.Fatalf("restore product failed: %s", err.Error())
+		}
+		if restored.Name != "deleted" || restored.Version != 3 || restored.DeletedAt != nil {
+			t.Errorf("expected product restored at version 3, got %s", restored.String())
+		}
+		err = repo.GetProduct(&Product{ID: deleted.ID}, false, testContext())
+		if err != nil {
+			t.Errorf("get restored product failed: %s", err.Error())
+		}
+	})
+
+	t.Run("restore requires deleted product", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "product", Price: price("1"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+
+		err := repo.RestoreProduct(&Product{ID: product.ID}, testContext())
+		if err != ErrNotDeleted {
+			t.Errorf("expected ErrNotDeleted, got %v", err)
+		}
+		err = repo.RestoreProduct(&Product{ID: 42}, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+	})
+
+	t.Run("update time follows every change", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "product", Price: price("1"), Currency: "EUR"}
+		mustCreate(t, repo, product)
+		fetched := &Product{ID: product.ID}
+		err := repo.GetProduct(fetched, false, testContext())
+		if err != nil {
+			t.Fatalf("get product failed: %s", err.Error())
+		}
+		if product.UpdatedAt.IsZero() || !fetched.UpdatedAt.Equal(product.UpdatedAt) {
+			t.Fatalf("expected update time %v read back, got %v", product.UpdatedAt, fetched.UpdatedAt)
+		}
+
+		created := product.UpdatedAt
+		product.Name = "updated"
+		err = repo.UpdateProduct(product, testContext())
+		if err != nil {
+			t.Fatalf("update product failed: %s", err.Error())
+		}
+		if product.UpdatedAt.Before(created) {
+			t.Errorf("expected update time after %v, got %v", created, product.UpdatedAt)
+		}
+
+		err = repo.DeleteProduct(product.ID, 0, testContext())
+		if err != nil {
+			t.Fatalf("delete product failed: %s", err.Error())
+		}
+		deleted := &Product{ID: product.ID}
+		err = repo.GetProduct(deleted, true, testContext())
+		if err != nil {
+			t.Fatalf("get product failed: %s", err.Error())
+		}
+		if deleted.DeletedAt == nil || !deleted.UpdatedAt.Equal(*deleted.DeletedAt) {
+			t.Errorf("expected update time %v equal to deletion time, got %v", deleted.DeletedAt, deleted.UpdatedAt)
+		}
+
+		// the list no longer holds the product, but has changed nonetheless
+		page, err := repo.GetProducts(&ProductsQuery{Limit: 10}, testContext())
+		if err != nil {
+			t.Fatalf("get products failed: %s", err.Error())
+		}
+		if len(page.Products) != 0 || !page.LastModified.Equal(deleted.UpdatedAt) {
+			t.Errorf("expected empty list modified at %v, got %d products modified at %v",
+				deleted.UpdatedAt, len(page.Products), page.LastModified)
+		}
+	})
+
+	t.Run("history records every change", func(t *testing.T) {
+		repo := newRepository(t)
+		product := &Product{Name: "lamp", Price: price("1"), Currency: "EUR"}
+		err := repo.CreateProduct(product, WithActor(testContext(), "alice"))
+		if err != nil {
+			t.Fatalf("create product failed: %s", err.Error())
+		}
+		err = repo.UpdateProduct(&Product{ID: product.ID, Name: "desk lamp", Price: price("1"), Currency: "EUR"},
+			WithActor(testContext(), "bob"))
+		if err != nil {
+			t.Fatalf("update product failed: %s", err.Error())
+		}
+		err = repo.PatchProduct(&Product{ID: product.ID}, func(p *Product) error {
+			p.Price = price("2.5")
+			return nil
+		}, WithActor(testContext(), "bob"))
+		if err != nil {
+			t.Fatalf("patch product failed: %s", err.Error())
+		}
+		err = repo.DeleteProduct(product.ID, 0, testContext())
+		if err != nil {
+			t.Fatalf("delete product failed: %s", err.Error())
+		}
+		err = repo.RestoreProduct(&Product{ID: product.ID}, WithActor(testContext(), "alice"))
+		if err != nil {
+			t.Fatalf("restore product failed: %s", err.Error())
+		}
+		err = repo.ImportProducts([]*Product{{Name: "imported", Price: price("3"), Currency: "USD"}},
+			WithActor(testContext(), "carol"))
+		if err != nil {
+			t.Fatalf("import products failed: %s", err.Error())
+		}
+
+		history, err := repo.GetProductHistory(product.ID, testContext())
+		if err != nil {
+			t.Fatalf("get product history failed: %s", err.Error())
+		}
+		expected := []string{
+			"1:create:alice:lamp:1",
+			"2:update:bob:desk lamp:1",
+			"3:update:bob:desk lamp:2.5",
+			"4:delete:anonymous:desk lamp:2.5",
+			"5:restore:alice:desk lamp:2.5",
+		}
+		if changes := changeKeys(history); !reflect.DeepEqual(changes, expected) {
+			t.Errorf("expected history %v, got %v", expected, changes)
+		}
+		for _, change := range history {
+			if change.ChangedAt.IsZero() {
+				t.Errorf("expected change time set, got %+v", change)
+			}
+		}
+
+		history, err = repo.GetProductHistory(product.ID+1, testContext())
+		if err != nil {
+			t.Fatalf("get product history failed: %s", err.Error())
+		}
+		if changes := changeKeys(history); !reflect.DeepEqual(changes, []string{"1:create:carol:imported:3"}) {
+			t.Errorf("expected imported product history, got %v", changes)
+		}
+
+		_, err = repo.GetProductHistory(42, testContext())
+		if err != ErrProductNotFound {
+			t.Errorf("expected ErrProductNotFound, got %v", err)
+		}
+	})
+}
+
+func mustCreate(t *testing.T, repo ProductRepository, products ...*Product) {
+	t.Helper()
+	for _, product := range products {
+		err := repo.CreateProduct(product, testContext())
+		if err != nil {
+			t.Fatalf("create product %s failed: %s", product.String(), err.Error())
+		}
+	}
+}
+
+// testContext mimics the rest handlers, which always pass a context holding a span
+func testContext() context.Context {
+	return opentracing.ContextWithSpan(context.Background(), opentracing.StartSpan("test"))
+}
+
+func price(value string) decimal.Decimal {
+	return decimal.RequireFromString(value)
+}
+
+func changeKeys(history []*ProductChange) []string {
+	keys := make([]string, 0, len(history))
+	for _, change := range history {
+		keys = append(keys, fmt.Sprintf("%d:%s:%s:%s:%s",
+			change.Version, change.Action, change.Actor, change.Name, change.Price.String()))
+	}
+	return keys
+}
+
+// sameProduct compares prices by value, as their representation may differ among DBs
+func sameProduct(a, b *Product) bool {
+	return a.ID == b.ID && a.Name == b.Name && a.Price.Equal(b.Price) && a.Currency == b.Currency &&
+		a.Version == b.Version
+}
+
+func productNames(products []*Product) []string {
+	names := make([]string, 0, len(products))
+	for _, product := range products {
+		names = append(names, product.Name)
+	}
+	return names
+}
+
+func productKeys(products []*Product) []string {
+	keys := make([]string, 0, len(products))
+	for _, product := range products {
+		keys = append(keys, fmt.Sprintf("%s:%s", product.Name, product.Price.String()))
+	}
+	return keys
+}
+
+func flatten(pages [][]string) []string {
+	all := make([]string, 0)
+	for _, page := range pages {
+		all = append(all, page...)
+	}
+	return all
+}
+
+func TestParseSort(t *testing.T) {
+	fields, err := ParseSort("price,-name")
+	if err != nil {
+		t.Fatalf("parse sort failed: %s", err.Error())
+	}
+	expected := []SortField{{Field: "price"}, {Field: "name", Desc: true}}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("expected %v, got %v", expected, fields)
+	}
+
+	for _, invalid := range []string{"", "price,", "version", "name;DROP TABLE products", "name,-name", "--id"} {
+		if _, err := ParseSort(invalid); err != ErrInvalidSort {
+			t.Errorf("expected ErrInvalidSort parsing %q, got %v", invalid, err)
+		}
+	}
+}
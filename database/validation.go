@@ -0,0 +1,109 @@
+package database
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/go-playground/validator/v10/non-standard/validators"
+	"github.com/shopspring/decimal"
+)
+
+const (
+	notBlankTag     = "notblank"
+	iso4217Tag      = "iso4217"
+	decimalGteTag   = "decimal_gte"
+	decimalLteTag   = "decimal_lte"
+	decimalScaleTag = "decimal_scale" // max number of decimal places
+	jsonTag         = "json"
+)
+
+var productValidator = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	_ = v.RegisterValidation(notBlankTag, validators.NotBlank)
+	_ = v.RegisterValidation(decimalGteTag, validateDecimal(func(value, param decimal.Decimal) bool {
+		return value.GreaterThanOrEqual(param)
+	}))
+	_ = v.RegisterValidation(decimalLteTag, validateDecimal(func(value, param decimal.Decimal) bool {
+		return value.LessThanOrEqual(param)
+	}))
+	_ = v.RegisterValidation(decimalScaleTag, validateDecimal(func(value, param decimal.Decimal) bool {
+		return value.Equal(value.Round(int32(param.IntPart())))
+	}))
+	// invalid fields are reported by their JSON name, as clients know them
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get(jsonTag), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return v
+}
+
+// Validate checks the product fields against the constraints declared in the validate tags,
+// returning a *ValidationError listing all the invalid ones
+func (p *Product) Validate() error {
+	err := productValidator.Struct(p)
+	if err == nil {
+		return nil
+	}
+
+	fieldErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+	validationErr := &ValidationError{InvalidParams: make([]*InvalidParam, 0, len(fieldErrs))}
+	for _, fieldErr := range fieldErrs {
+		validationErr.InvalidParams = append(validationErr.InvalidParams, &InvalidParam{
+			Name:   fieldErr.Field(),
+			Reason: reason(fieldErr),
+		})
+	}
+	return validationErr
+}
+
+// validateDecimal adapts a comparison of decimal.Decimal fields against the tag param to the validator
+func validateDecimal(compare func(value, param decimal.Decimal) bool) validator.Func {
+	return func(fl validator.FieldLevel) bool {
+		value, ok := fl.Field().Interface().(decimal.Decimal)
+		if !ok {
+			return false
+		}
+		param, paramErr := decimal.NewFromString(fl.Param())
+		if paramErr != nil {
+			panic(fmt.Sprintf("invalid %s param %s", fl.GetTag(), fl.Param()))
+		}
+		return compare(value, param)
+	}
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, 0, len(e.InvalidParams))
+	for _, param := range e.InvalidParams {
+		reasons = append(reasons, param.Name+" "+param.Reason)
+	}
+	return "invalid product: " + strings.Join(reasons, ", ")
+}
+
+func reason(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case notBlankTag, "required":
+		return "must not be blank"
+	case "max":
+		return fmt.Sprintf("must be at most %s characters long", fieldErr.Param())
+	case "gte", decimalGteTag:
+		return fmt.Sprintf("must be greater than or equal to %s", fieldErr.Param())
+	case "lte", decimalLteTag:
+		return fmt.Sprintf("must be less than or equal to %s", fieldErr.Param())
+	case decimalScaleTag:
+		return fmt.Sprintf("must have at most %s decimal places", fieldErr.Param())
+	case iso4217Tag:
+		return "must be an ISO-4217 currency code"
+	default:
+		return fmt.Sprintf("must satisfy %s %s", fieldErr.Tag(), fieldErr.Param())
+	}
+}
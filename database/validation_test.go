@@ -0,0 +1,56 @@
+package database
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProductValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		product  *Product
+		expected []*InvalidParam
+	}{
+		{"valid", &Product{Name: "lamp", Price: price("10"), Currency: "EUR"}, nil},
+		{"free", &Product{Name: "lamp", Currency: "EUR"}, nil},
+		{"blank name", &Product{Name: " \t", Price: price("1"), Currency: "EUR"},
+			[]*InvalidParam{{Name: "name", Reason: "must not be blank"}}},
+		{"long name", &Product{Name: strings.Repeat("x", 256), Price: price("1"), Currency: "EUR"},
+			[]*InvalidParam{{Name: "name", Reason: "must be at most 255 characters long"}}},
+		{"negative price and empty name", &Product{Price: price("-1"), Currency: "EUR"},
+			[]*InvalidParam{
+				{Name: "name", Reason: "must not be blank"},
+				{Name: "price", Reason: "must be greater than or equal to 0"},
+			}},
+		{"price overflow", &Product{Name: "lamp", Price: price("100000000"), Currency: "EUR"},
+			[]*InvalidParam{{Name: "price", Reason: "must be less than or equal to 99999999.99"}}},
+		{"price scale", &Product{Name: "lamp", Price: price("1.005"), Currency: "EUR"},
+			[]*InvalidParam{{Name: "price", Reason: "must have at most 2 decimal places"}}},
+		{"trailing zeros don't count as decimal places", &Product{Name: "lamp", Price: price("1.500"), Currency: "EUR"},
+			nil},
+		{"missing currency", &Product{Name: "lamp", Price: price("1")},
+			[]*InvalidParam{{Name: "currency", Reason: "must not be blank"}}},
+		{"unknown currency", &Product{Name: "lamp", Price: price("1"), Currency: "eur"},
+			[]*InvalidParam{{Name: "currency", Reason: "must be an ISO-4217 currency code"}}},
+	}
+
+	for _, test := range tests {
+		err := test.product.Validate()
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %s", test.name, err.Error())
+			}
+			continue
+		}
+
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("%s: expected ValidationError, got %v", test.name, err)
+		}
+		if !reflect.DeepEqual(validationErr.InvalidParams, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, validationErr.InvalidParams)
+		}
+	}
+}
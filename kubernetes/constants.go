@@ -6,8 +6,9 @@ const (
 	readinessEndpoint = "/ready"
 
 	// response status
-	ResponseStatusOk    Status = "OK"
-	ResponseStatusError Status = "ERROR"
+	ResponseStatusOk       Status = "OK"
+	ResponseStatusDegraded Status = "DEGRADED" // still able to serve, so it comes with ResponseCodeOk
+	ResponseStatusError    Status = "ERROR"
 
 	// response codes
 	ResponseCodeOk    Code = 200
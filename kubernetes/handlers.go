@@ -21,7 +21,10 @@ func (s *Server) livenessHandler(writer http.ResponseWriter, request *http.Reque
 func (s *Server) readinessHandler(writer http.ResponseWriter, request *http.Request) {
 	logging.Log.Debug("Readiness probe invoked")
 
-	err := json.NewEncoder(writer).Encode(s.buildProbes(writer))
+	probe := s.buildProbes(writer)
+	// Kubernetes only looks at the HTTP status code to decide whether the pod is ready
+	writer.WriteHeader(int(probe.Code))
+	err := json.NewEncoder(writer).Encode(probe)
 	if err != nil {
 		logging.SugaredLog.Errorf("JSON-Encoding readiness probe failed: %s", err.Error())
 	}
@@ -56,6 +59,9 @@ func computeGlobalStatus(components map[string]*ComponentProbe) (Status, Code) {
 			if compStatus.IsRequired && compStatus.Code != ResponseCodeOk {
 				globalStatus = compStatus.Status
 				globalCode = compStatus.Code
+			} else if compStatus.IsRequired && compStatus.Status == ResponseStatusDegraded &&
+				globalCode == ResponseCodeOk {
+				globalStatus = ResponseStatusDegraded
 			}
 		}
 	} else {
@@ -15,6 +15,11 @@ import (
 func main() {
 	initLogging()
 
+	if len(os.Args) > 1 && os.Args[1] == migrateCommand {
+		runMigrateCommand(os.Args[2:])
+		return
+	}
+
 	logging.SugaredLog.Infof("Load %s configurations", commons.ServiceName)
 	cfg := loadConfig()
 
@@ -53,7 +58,7 @@ func loadConfig() *config.Config {
 }
 
 func startSysCallChannel() {
-	syscallCh := make(chan os.Signal)
+	syscallCh := make(chan os.Signal, 1)
 	signal.Notify(syscallCh, syscall.SIGTERM, syscall.SIGINT, os.Interrupt)
 	<-syscallCh
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/commons"
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	migrateCommand       = "migrate"
+	migrateUpCommand     = "up"
+	migrateDownCommand   = "down"
+	migrateStatusCommand = "status"
+
+	migrateUsage = "usage: %s migrate up [steps] | down [steps] | status\n"
+
+	// exit statuses are truncated to 8 bits, keep them in 1-255
+	migrateUsageExitCode  = 2
+	migrateDbExitCode     = 3
+	migrateFailedExitCode = 4
+)
+
+// runMigrateCommand manages the DB schema on demand, e.g.
+//
+//	app migrate up      apply all pending migrations
+//	app migrate down 1  revert the last applied migration
+//	app migrate status  list migrations and their state
+func runMigrateCommand(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Printf(migrateUsage, os.Args[0])
+		os.Exit(migrateUsageExitCode)
+	}
+
+	// down reverts a single migration per default, to avoid wiping out the whole schema by mistake
+	steps := 0
+	if args[0] == migrateDownCommand {
+		steps = 1
+	}
+	if len(args) == 2 {
+		var stepsErr error
+		steps, stepsErr = strconv.Atoi(args[1])
+		if stepsErr != nil || steps < 1 {
+			fmt.Printf(migrateUsage, os.Args[0])
+			os.Exit(migrateUsageExitCode)
+		}
+	}
+
+	db, dbErr := database.Open()
+	if dbErr != nil {
+		logging.SugaredLog.Errorf("%s DB interface creation failed: %s", commons.ServiceName, dbErr.Error())
+		os.Exit(migrateDbExitCode)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var migrateErr error
+	switch args[0] {
+	case migrateUpCommand:
+		_, migrateErr = database.MigrateUp(db, steps, ctx)
+	case migrateDownCommand:
+		_, migrateErr = database.MigrateDown(db, steps, ctx)
+	case migrateStatusCommand:
+		migrateErr = printMigrationsStatus(db, ctx)
+	default:
+		fmt.Printf(migrateUsage, os.Args[0])
+		os.Exit(migrateUsageExitCode)
+	}
+	if migrateErr != nil {
+		logging.SugaredLog.Errorf("%s migrate %s failed: %s", commons.ServiceName, args[0], migrateErr.Error())
+		os.Exit(migrateFailedExitCode)
+	}
+}
+
+func printMigrationsStatus(db *sql.DB, ctx context.Context) error {
+	statuses, statusErr := database.GetMigrationsStatus(db, ctx)
+	if statusErr != nil {
+		return statusErr
+	}
+
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if status.Applied {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%04d %-40s %s\n", status.Version, status.Name, appliedAt)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+func TestMain(m *testing.M) {
+	err := logging.InitGlobalLogger()
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMigrateCommand(t *testing.T) {
+	t.Setenv("DB_DRIVER", "sqlite")
+	t.Setenv("DB_PATH", filepath.Join(t.TempDir(), "products.db"))
+
+	pending := strings.Count(migrateStatus(t), "pending")
+	if pending == 0 {
+		t.Fatal("expected pending migrations on an empty DB")
+	}
+
+	runMigrateCommand([]string{migrateUpCommand, "1"})
+	if remaining := strings.Count(migrateStatus(t), "pending"); remaining != pending-1 {
+		t.Fatalf("expected a single migration applied, got %d pending out of %d", remaining, pending)
+	}
+	runMigrateCommand([]string{migrateUpCommand})
+	if remaining := strings.Count(migrateStatus(t), "pending"); remaining != 0 {
+		t.Fatalf("expected all migrations applied, got %d pending", remaining)
+	}
+
+	// down reverts the latest migration only, unless told otherwise
+	runMigrateCommand([]string{migrateDownCommand})
+	lines := strings.Split(strings.TrimSpace(migrateStatus(t)), "\n")
+	if !strings.HasSuffix(lines[len(lines)-1], "pending") || strings.Count(strings.Join(lines, "\n"), "pending") != 1 {
+		t.Fatalf("expected the latest migration reverted, got\n%s", strings.Join(lines, "\n"))
+	}
+	runMigrateCommand([]string{migrateDownCommand, "100"})
+	if remaining := strings.Count(migrateStatus(t), "pending"); remaining != pending {
+		t.Fatalf("expected all migrations reverted, got %d pending out of %d", remaining, pending)
+	}
+}
+
+// migrateStatus returns the output of migrate status
+func migrateStatus(t *testing.T) string {
+	t.Helper()
+	reader, writer, pipeErr := os.Pipe()
+	if pipeErr != nil {
+		t.Fatal(pipeErr)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	runMigrateCommand([]string{migrateStatusCommand})
+	_ = writer.Close()
+	output, readErr := io.ReadAll(reader)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(output)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+
 	"github.com/bygui86/go-k8s-probes/logging"
 )
 
@@ -58,3 +60,16 @@ func (s *Server) Shutdown(timeout time.Duration) {
 
 	logging.Log.Error("Monitoring server shutdown failed: HTTP server not initialized or HTTP server not running")
 }
+
+// RegisterCollectors registers additional collectors, exposing their metrics together with the default ones
+func (s *Server) RegisterCollectors(collectors ...prometheus.Collector) error {
+	logging.SugaredLog.Debugf("Register %d collectors on monitoring server", len(collectors))
+
+	for _, collector := range collectors {
+		err := prometheus.Register(collector)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
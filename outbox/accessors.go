@@ -0,0 +1,10 @@
+package outbox
+
+import (
+	"time"
+)
+
+// GetMaxLag returns the lag above which the relay is reported as not healthy
+func (r *Relay) GetMaxLag() time.Duration {
+	return r.config.maxLag
+}
@@ -0,0 +1,96 @@
+package outbox
+
+import (
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/utils"
+)
+
+const (
+	sinkEnvVar           = "OUTBOX_SINK" // stdout, file or webhook, relay disabled if empty
+	webhookUrlEnvVar     = "OUTBOX_WEBHOOK_URL"
+	webhookTimeoutEnvVar = "OUTBOX_WEBHOOK_TIMEOUT" // in seconds
+	filePathEnvVar       = "OUTBOX_FILE_PATH"
+	pollIntervalEnvVar   = "OUTBOX_POLL_INTERVAL" // in seconds
+	batchSizeEnvVar      = "OUTBOX_BATCH_SIZE"
+	leaseEnvVar          = "OUTBOX_LEASE"       // in seconds
+	backoffMinEnvVar     = "OUTBOX_BACKOFF_MIN" // in seconds
+	backoffMaxEnvVar     = "OUTBOX_BACKOFF_MAX" // in seconds
+	maxLagEnvVar         = "OUTBOX_MAX_LAG"     // in seconds
+
+	sinkDefault           = ""
+	webhookUrlDefault     = ""
+	webhookTimeoutDefault = 5
+	filePathDefault       = ""
+	pollIntervalDefault   = 1
+	batchSizeDefault      = 100
+	leaseDefault          = 60
+	backoffMinDefault     = 1
+	backoffMaxDefault     = 300
+	maxLagDefault         = 300
+)
+
+func loadConfig() *config {
+	logging.Log.Debug("Load Outbox relay configurations")
+
+	webhookTimeout := utils.GetIntEnv(webhookTimeoutEnvVar, webhookTimeoutDefault)
+	if webhookTimeout < 1 {
+		logging.SugaredLog.Warnf("Outbox webhook timeout must be greater than 0, fallback to default %d",
+			webhookTimeoutDefault)
+		webhookTimeout = webhookTimeoutDefault
+	}
+
+	pollInterval := utils.GetIntEnv(pollIntervalEnvVar, pollIntervalDefault)
+	if pollInterval < 1 {
+		logging.SugaredLog.Warnf("Outbox poll interval must be greater than 0, fallback to default %d",
+			pollIntervalDefault)
+		pollInterval = pollIntervalDefault
+	}
+
+	batchSize := utils.GetIntEnv(batchSizeEnvVar, batchSizeDefault)
+	if batchSize < 1 {
+		logging.SugaredLog.Warnf("Outbox batch size must be greater than 0, fallback to default %d",
+			batchSizeDefault)
+		batchSize = batchSizeDefault
+	}
+
+	lease := utils.GetIntEnv(leaseEnvVar, leaseDefault)
+	if lease < 1 {
+		logging.SugaredLog.Warnf("Outbox lease must be greater than 0, fallback to default %d", leaseDefault)
+		lease = leaseDefault
+	}
+
+	backoffMin := utils.GetIntEnv(backoffMinEnvVar, backoffMinDefault)
+	if backoffMin < 1 {
+		logging.SugaredLog.Warnf("Outbox min backoff must be greater than 0, fallback to default %d",
+			backoffMinDefault)
+		backoffMin = backoffMinDefault
+	}
+
+	backoffMax := utils.GetIntEnv(backoffMaxEnvVar, backoffMaxDefault)
+	if backoffMax < backoffMin {
+		logging.SugaredLog.Warnf("Outbox max backoff must not be lower than min backoff %d, fallback to %d",
+			backoffMin, backoffMin)
+		backoffMax = backoffMin
+	}
+
+	maxLag := utils.GetIntEnv(maxLagEnvVar, maxLagDefault)
+	if maxLag < 1 {
+		logging.SugaredLog.Warnf("Outbox max lag must be greater than 0, fallback to default %d", maxLagDefault)
+		maxLag = maxLagDefault
+	}
+
+	return &config{
+		sink:           utils.GetStringEnv(sinkEnvVar, sinkDefault),
+		webhookUrl:     utils.GetStringEnv(webhookUrlEnvVar, webhookUrlDefault),
+		webhookTimeout: time.Duration(webhookTimeout) * time.Second,
+		filePath:       utils.GetStringEnv(filePathEnvVar, filePathDefault),
+		pollInterval:   time.Duration(pollInterval) * time.Second,
+		batchSize:      batchSize,
+		lease:          time.Duration(lease) * time.Second,
+		backoffMin:     time.Duration(backoffMin) * time.Second,
+		backoffMax:     time.Duration(backoffMax) * time.Second,
+		maxLag:         time.Duration(maxLag) * time.Second,
+	}
+}
@@ -0,0 +1,55 @@
+package outbox
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "products"
+	metricsSubsystem = "outbox"
+)
+
+var (
+	deliveredEvents = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "delivered_events_total",
+			Help:      "Number of product change events delivered, by type",
+		},
+		[]string{"type"},
+	)
+
+	failedDeliveries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "failed_deliveries_total",
+			Help:      "Number of product change event deliveries failed and rescheduled, by type",
+		},
+		[]string{"type"},
+	)
+)
+
+// GetCollectors returns the collectors of the Outbox relay metrics, to be registered on the monitoring server
+func (r *Relay) GetCollectors() []prometheus.Collector {
+	pending := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "pending_events",
+			Help:      "Number of product change events not delivered yet, as of the last poll",
+		},
+		func() float64 { return float64(r.GetStatus().Pending) },
+	)
+	lag := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "lag_seconds",
+			Help:      "Age of the oldest product change event not delivered yet in seconds",
+		},
+		func() float64 { return r.GetStatus().Lag.Seconds() },
+	)
+	return []prometheus.Collector{deliveredEvents, failedDeliveries, pending, lag}
+}
@@ -0,0 +1,55 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+// Relay delivers the product change events recorded in the outbox to a Sink, at least once.
+// Several relays may run against the same DB, each event is leased to one of them at a time.
+type Relay struct {
+	config  *config
+	store   database.OutboxStore
+	sink    Sink
+	running bool
+	stop    chan struct{}
+	stopped sync.WaitGroup
+
+	// outbox state as of the last poll
+	statusMutex sync.RWMutex
+	status      *database.OutboxStatus
+	statusErr   error
+	deliveryErr error
+}
+
+// Sink publishes the events to other systems. Deliver must return only once the event is safely stored,
+// events not delivered are retried with backoff.
+type Sink interface {
+	Deliver(event *database.OutboxEvent, ctx context.Context) error
+	Close() error
+}
+
+// Status reports how far behind the relay is
+type Status struct {
+	Pending int
+	// age of the oldest event pending, 0 if none
+	Lag time.Duration
+	// error of the last poll or of the last delivery, nil if both succeeded
+	Error error
+}
+
+type config struct {
+	sink           string
+	webhookUrl     string
+	webhookTimeout time.Duration
+	filePath       string
+	pollInterval   time.Duration
+	batchSize      int
+	lease          time.Duration
+	backoffMin     time.Duration
+	backoffMax     time.Duration
+	maxLag         time.Duration
+}
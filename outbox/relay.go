@@ -0,0 +1,209 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const releasedReason = "relay stopped"
+
+// New creates the Outbox relay delivering the events of store to the sink configured.
+// It returns nil if no sink is configured, events are kept pending in the outbox then.
+func New(store database.OutboxStore) (*Relay, error) {
+	logging.Log.Info("Create new Outbox relay")
+
+	cfg := loadConfig()
+	if cfg.sink == "" {
+		logging.SugaredLog.Infof("No Outbox sink configured in %s, events are kept pending", sinkEnvVar)
+		return nil, nil
+	}
+	sink, sinkErr := newSink(cfg)
+	if sinkErr != nil {
+		return nil, sinkErr
+	}
+	return newRelay(cfg, store, sink), nil
+}
+
+func newRelay(cfg *config, store database.OutboxStore, sink Sink) *Relay {
+	return &Relay{
+		config: cfg,
+		store:  store,
+		sink:   sink,
+		status: &database.OutboxStatus{},
+	}
+}
+
+func (r *Relay) Start() {
+	logging.SugaredLog.Infof("Start Outbox relay, delivering events to %s", r.config.sink)
+
+	if r.running {
+		logging.Log.Error("Outbox relay start failed: relay already running")
+		return
+	}
+	r.running = true
+	r.stop = make(chan struct{})
+	r.stopped.Add(1)
+	go func() {
+		defer r.stopped.Done()
+
+		r.poll()
+		ticker := time.NewTicker(r.config.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.poll()
+			}
+		}
+	}()
+}
+
+// Shutdown waits for the delivery in progress, if any, events left are delivered at next start
+func (r *Relay) Shutdown() {
+	logging.Log.Warn("Shutdown Outbox relay")
+
+	if !r.running {
+		logging.Log.Error("Outbox relay shutdown failed: relay not running")
+		return
+	}
+	close(r.stop)
+	r.stopped.Wait()
+	r.running = false
+
+	err := r.sink.Close()
+	if err != nil {
+		logging.SugaredLog.Errorf("Outbox sink closing failed: %s", err.Error())
+	}
+}
+
+// GetStatus returns the outbox state as of the last poll, the lag growing since then
+func (r *Relay) GetStatus() *Status {
+	r.statusMutex.RLock()
+	defer r.statusMutex.RUnlock()
+
+	status := &Status{Pending: r.status.Pending, Error: r.statusErr}
+	if status.Error == nil {
+		status.Error = r.deliveryErr
+	}
+	if r.status.Oldest != nil {
+		status.Lag = time.Since(*r.status.Oldest)
+	}
+	return status
+}
+
+// poll delivers all the events due, batch after batch, then refreshes the outbox status
+func (r *Relay) poll() {
+	span := opentracing.StartSpan("outbox-relay-poll")
+	defer span.Finish()
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+
+	for r.relayBatch(ctx) {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+	}
+
+	status, err := r.store.GetOutboxStatus(ctx)
+	if err != nil {
+		logging.SugaredLog.Errorf("Outbox status retrieval failed: %s", err.Error())
+		span.SetTag("error", err.Error())
+		span.LogKV("error", err.Error())
+	}
+
+	r.statusMutex.Lock()
+	defer r.statusMutex.Unlock()
+	r.statusErr = err
+	if status != nil {
+		r.status = status
+	}
+}
+
+// relayBatch delivers the events claimed one by one, returning true if more events may be due
+func (r *Relay) relayBatch(ctx context.Context) bool {
+	// deliveries must end before the lease expires, not to overlap with another relay
+	ctx, cancel := context.WithTimeout(ctx, r.config.lease)
+	defer cancel()
+
+	events, claimErr := r.store.ClaimOutboxEvents(r.config.batchSize, time.Now().Add(r.config.lease), ctx)
+	if claimErr != nil {
+		logging.SugaredLog.Errorf("Outbox events claim failed: %s", claimErr.Error())
+		return false
+	}
+
+	for i, event := range events {
+		select {
+		case <-r.stop:
+			r.release(events[i:])
+			return false
+		default:
+		}
+		if ctx.Err() != nil {
+			// lease expired, events left are delivered at next poll
+			return false
+		}
+		r.deliver(event, ctx)
+	}
+	return len(events) == r.config.batchSize
+}
+
+func (r *Relay) deliver(event *database.OutboxEvent, ctx context.Context) {
+	deliveryErr := r.sink.Deliver(event, ctx)
+	r.statusMutex.Lock()
+	r.deliveryErr = deliveryErr
+	r.statusMutex.Unlock()
+
+	if deliveryErr != nil {
+		failedDeliveries.WithLabelValues(event.Type).Inc()
+		retryAt := time.Now().Add(r.backoff(event.Attempts))
+		logging.SugaredLog.Warnf("Outbox event %d delivery attempt %d failed, retry at %s: %s",
+			event.ID, event.Attempts, retryAt.Format(time.RFC3339), deliveryErr.Error())
+		err := r.store.NackOutboxEvent(event.ID, retryAt, deliveryErr.Error(), ctx)
+		if err != nil {
+			// retried anyway once the lease expires
+			logging.SugaredLog.Errorf("Outbox event %d rescheduling failed: %s", event.ID, err.Error())
+		}
+		return
+	}
+
+	deliveredEvents.WithLabelValues(event.Type).Inc()
+	err := r.store.AckOutboxEvent(event.ID, ctx)
+	if err != nil {
+		// delivered again once the lease expires
+		logging.SugaredLog.Errorf("Outbox event %d acknowledgement failed: %s", event.ID, err.Error())
+	}
+}
+
+// release makes the events claimed but not delivered due again, not to wait for their lease to expire
+func (r *Relay) release(events []*database.OutboxEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.pollInterval)
+	defer cancel()
+
+	now := time.Now()
+	for _, event := range events {
+		err := r.store.NackOutboxEvent(event.ID, now, releasedReason, ctx)
+		if err != nil {
+			logging.SugaredLog.Errorf("Outbox event %d release failed: %s", event.ID, err.Error())
+		}
+	}
+}
+
+// backoff doubles the delay at every attempt, from min up to max
+func (r *Relay) backoff(attempts int) time.Duration {
+	delay := r.config.backoffMin
+	for i := 1; i < attempts && delay < r.config.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > r.config.backoffMax {
+		return r.config.backoffMax
+	}
+	return delay
+}
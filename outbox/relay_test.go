@@ -0,0 +1,130 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shopspring/decimal"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+func TestMain(m *testing.M) {
+	err := logging.InitGlobalLogger()
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRelayDeliversEventsInOrder(t *testing.T) {
+	repo := database.NewMemoryRepository()
+	product := createProduct(t, repo, "laptop")
+	if err := repo.DeleteProduct(product.ID, 0, testContext()); err != nil {
+		t.Fatalf("delete product failed: %s", err.Error())
+	}
+	createProduct(t, repo, "mouse")
+
+	sink := &recordingSink{}
+	relay := newRelay(testConfig(2), repo, sink)
+	relay.poll()
+
+	expected := []string{"product.created", "product.deleted", "product.created"}
+	if types := sink.types(); !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected events %v delivered, got %v", expected, types)
+	}
+	if status := relay.GetStatus(); status.Pending != 0 || status.Lag != 0 || status.Error != nil {
+		t.Fatalf("expected no event pending, got %+v", status)
+	}
+
+	relay.poll()
+	if delivered := len(sink.types()); delivered != 3 {
+		t.Fatalf("expected acknowledged events not delivered again, got %d deliveries", delivered)
+	}
+}
+
+func TestRelayReschedulesFailedDeliveries(t *testing.T) {
+	repo := database.NewMemoryRepository()
+	createProduct(t, repo, "laptop")
+
+	sink := &recordingSink{err: errors.New("unavailable")}
+	relay := newRelay(testConfig(10), repo, sink)
+	relay.poll()
+
+	status := relay.GetStatus()
+	if status.Pending != 1 || status.Lag <= 0 || status.Error == nil {
+		t.Fatalf("expected event pending with delivery error, got %+v", status)
+	}
+	relay.poll()
+	if attempts := len(sink.types()); attempts != 1 {
+		t.Fatalf("expected event not retried before backoff, got %d attempts", attempts)
+	}
+}
+
+func TestRelayBackoff(t *testing.T) {
+	relay := newRelay(testConfig(10), nil, nil)
+	delays := make([]time.Duration, 0)
+	for attempts := 1; attempts <= 5; attempts++ {
+		delays = append(delays, relay.backoff(attempts))
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !reflect.DeepEqual(delays, expected) {
+		t.Fatalf("expected backoff %v, got %v", expected, delays)
+	}
+}
+
+// recordingSink keeps the types of the events delivered, failing with err if set
+type recordingSink struct {
+	mutex     sync.Mutex
+	delivered []string
+	err       error
+}
+
+func (s *recordingSink) Deliver(event *database.OutboxEvent, ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.delivered = append(s.delivered, event.Type)
+	return s.err
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func (s *recordingSink) types() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.delivered...)
+}
+
+func testConfig(batchSize int) *config {
+	return &config{
+		pollInterval: time.Second,
+		batchSize:    batchSize,
+		lease:        time.Minute,
+		backoffMin:   time.Second,
+		backoffMax:   5 * time.Second,
+		maxLag:       time.Minute,
+	}
+}
+
+func createProduct(t *testing.T, repo database.ProductRepository, name string) *database.Product {
+	t.Helper()
+	product := &database.Product{Name: name, Price: decimal.RequireFromString("9.99"), Currency: "EUR"}
+	if err := repo.CreateProduct(product, testContext()); err != nil {
+		t.Fatalf("create product failed: %s", err.Error())
+	}
+	return product
+}
+
+// testContext mimics the rest handlers, which always pass a context holding a span
+func testContext() context.Context {
+	return opentracing.ContextWithSpan(context.Background(), opentracing.StartSpan("test"))
+}
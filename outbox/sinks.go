@@ -0,0 +1,116 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+const (
+	sinkStdout  = "stdout"
+	sinkFile    = "file"
+	sinkWebhook = "webhook"
+
+	contentTypeHeaderKey = "Content-Type"
+	eventIdHeaderKey     = "X-Event-Id"
+	eventTypeHeaderKey   = "X-Event-Type"
+	contentTypeJson      = "application/json"
+
+	fileSinkPermissions = 0644
+)
+
+func newSink(cfg *config) (Sink, error) {
+	switch cfg.sink {
+	case sinkStdout:
+		return &writerSink{writer: os.Stdout}, nil
+	case sinkFile:
+		if cfg.filePath == "" {
+			return nil, fmt.Errorf("%s required by %s outbox sink", filePathEnvVar, sinkFile)
+		}
+		file, openErr := os.OpenFile(cfg.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, fileSinkPermissions)
+		if openErr != nil {
+			return nil, fmt.Errorf("outbox file opening failed: %s", openErr.Error())
+		}
+		return &writerSink{writer: file, file: file}, nil
+	case sinkWebhook:
+		if cfg.webhookUrl == "" {
+			return nil, fmt.Errorf("%s required by %s outbox sink", webhookUrlEnvVar, sinkWebhook)
+		}
+		return &webhookSink{url: cfg.webhookUrl, client: &http.Client{Timeout: cfg.webhookTimeout}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported outbox sink %q, must be one of %s, %s, %s",
+			cfg.sink, sinkStdout, sinkFile, sinkWebhook)
+	}
+}
+
+// writerSink writes every event payload as a line of NDJSON
+type writerSink struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	// set to flush every event to disk before acknowledging it
+	file *os.File
+}
+
+func (s *writerSink) Deliver(event *database.OutboxEvent, ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := s.writer.Write(append(event.Payload, '\n'))
+	if err != nil {
+		return err
+	}
+	if s.file != nil {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *writerSink) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// webhookSink POSTs every event payload, any 2xx response acknowledges the event
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Deliver(event *database.OutboxEvent, ctx context.Context) error {
+	request, reqErr := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(event.Payload))
+	if reqErr != nil {
+		return reqErr
+	}
+	request.Header.Set(contentTypeHeaderKey, contentTypeJson)
+	// the same event may be delivered more than once, the ID lets the receiver deduplicate it
+	request.Header.Set(eventIdHeaderKey, strconv.FormatInt(event.ID, 10))
+	request.Header.Set(eventTypeHeaderKey, event.Type)
+
+	response, respErr := s.client.Do(request)
+	if respErr != nil {
+		return respErr
+	}
+	defer response.Body.Close()
+	// drained to reuse the connection
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return errors.New("webhook response code " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
@@ -19,3 +19,16 @@ func (s *Server) GetRestRouter() *mux.Router {
 func (s *Server) GetProductsEndpoint() string {
 	return productsEndpoint
 }
+
+// GetLoadSheddingStatus returns the status of load shedding, nil if disabled
+func (s *Server) GetLoadSheddingStatus() *LoadSheddingStatus {
+	if s.loadShedder == nil {
+		return nil
+	}
+	return s.loadShedder.getStatus()
+}
+
+// GetProbeApiKey returns the API key the readiness probe can read products with, empty if authentication is disabled
+func (s *Server) GetProbeApiKey() string {
+	return s.probeApiKey
+}
@@ -0,0 +1,44 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	adminEndpoint      = v1Endpoint + "/admin"
+	adminCacheEndpoint = adminEndpoint + "/cache"
+)
+
+// cacheFlush reports how many products were dropped from the cache
+type cacheFlush struct {
+	Flushed int `json:"flushed"`
+}
+
+// flushProductCache drops all the products cached, e.g. after changing them directly in the DB
+func (s *Server) flushProductCache(writer http.ResponseWriter, request *http.Request) {
+	span, _ := retrieveSpanAndCtx(request, "flush-product-cache-handler")
+	defer span.Finish()
+
+	if s.productCache == nil {
+		errMsg := "Flush product cache failed: cache not enabled"
+		sendErrorResponse(writer, span, http.StatusNotFound, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+
+	logging.SugaredLog.Infof("Flush product cache, requested by %q", subjectFromRequest(request))
+	flushed := s.productCache.FlushProducts()
+
+	span.SetTag("products-flushed", flushed)
+	span.LogKV("products-flushed", flushed)
+	sendJsonResponse(writer, http.StatusOK, &cacheFlush{Flushed: flushed})
+}
+
+func isAdminRoute(route string) bool {
+	return strings.HasPrefix(route, adminEndpoint+"/")
+}
@@ -0,0 +1,54 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+func TestFlushProductCache(t *testing.T) {
+	t.Setenv("DB_CACHE_ENABLED", "true")
+	memory := database.NewMemoryRepository()
+	server, serverErr := New(database.NewCachedRepository(memory), memory, nil)
+	if serverErr != nil {
+		t.Fatalf("server creation failed: %s", serverErr.Error())
+	}
+	serve(server, http.MethodPost, productsEndpoint, nil, `{"name":"lamp","price":"1","currency":"EUR"}`)
+	serve(server, http.MethodGet, productsEndpoint+"/1", nil, "")
+
+	response := serve(server, http.MethodDelete, adminCacheEndpoint, nil, "")
+	flush := &cacheFlush{}
+	if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), flush) != nil || flush.Flushed != 1 {
+		t.Fatalf("expected 1 product flushed, got %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestFlushProductCacheDisabled(t *testing.T) {
+	response := serve(newTestServer(t), http.MethodDelete, adminCacheEndpoint, nil, "")
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without cache, got %d", response.Code)
+	}
+}
+
+func TestFlushProductCacheRequiresAdminScope(t *testing.T) {
+	server := newAuthServer(t, writeJwks(t, newSigningKey(t)))
+	tests := []struct {
+		key          string
+		expectedCode int
+	}{
+		{"read-write", http.StatusForbidden},
+		// authorised, but the test server caches nothing
+		{"admin", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if response := serve(server, http.MethodDelete, adminCacheEndpoint, apiKey(test.key), ""); response.Code != test.expectedCode {
+			t.Errorf("%s: expected %d, got %d", test.key, test.expectedCode, response.Code)
+		}
+	}
+	// the admin scope alone grants no access to products
+	if response := serve(server, http.MethodGet, productsEndpoint, apiKey("admin"), ""); response.Code != http.StatusForbidden {
+		t.Errorf("expected admin key forbidden to read products, got %d", response.Code)
+	}
+}
@@ -0,0 +1,243 @@
+package rest
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	apiKeyHeaderKey          = "X-API-Key"
+	authorizationHeaderKey   = "Authorization"
+	wwwAuthenticateHeaderKey = "WWW-Authenticate"
+	bearerPrefix             = "Bearer "
+	authRealm                = "products"
+
+	scopeRead  = "products:read"
+	scopeWrite = "products:write"
+	scopeAdmin = "products:admin"
+
+	// subject of the API key generated for the readiness probe
+	probeSubject   = "readiness-probe"
+	probeKeyLength = 32
+
+	authFailureMissing   = "missing"
+	authFailureInvalid   = "invalid"
+	authFailureForbidden = "forbidden"
+)
+
+var (
+	// ErrNoCredentials is returned by authenticators, and AuthorizeHeaders, when the request carries no credentials
+	// of their kind
+	ErrNoCredentials = errors.New("no credentials")
+
+	// routes serving the documentation, open to anybody
+	publicRoutes = map[string]bool{
+		openApiEndpoint:   true,
+		swaggerUiEndpoint: true,
+	}
+)
+
+// authenticator verifies one kind of credentials, e.g. API keys
+type authenticator interface {
+	authenticate(request *http.Request) (*principal, error)
+}
+
+// principal is who made the request, along with the scopes granted
+type principal struct {
+	subject string
+	scopes  map[string]bool
+}
+
+func newPrincipal(subject string, scopes []string) *principal {
+	granted := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		granted[scope] = true
+	}
+	return &principal{subject: subject, scopes: granted}
+}
+
+// apiKeyEntry is an API key of the keys file, only its SHA-256 is stored
+type apiKeyEntry struct {
+	Subject string   `json:"subject"`
+	Sha256  string   `json:"sha256"`
+	Scopes  []string `json:"scopes"`
+}
+
+// apiKeyAuthenticator looks up the X-API-Key header among the static keys, by hash
+type apiKeyAuthenticator struct {
+	keys map[string]*principal
+}
+
+// newApiKeyAuthenticator loads the keys file, if any, and adds the probe key
+func newApiKeyAuthenticator(keysFile, probeKey string) (*apiKeyAuthenticator, error) {
+	auth := &apiKeyAuthenticator{keys: make(map[string]*principal)}
+	auth.keys[hashApiKey(probeKey)] = newPrincipal(probeSubject, []string{scopeRead})
+	if keysFile == "" {
+		return auth, nil
+	}
+
+	content, readErr := os.ReadFile(keysFile)
+	if readErr != nil {
+		return nil, readErr
+	}
+	var entries []*apiKeyEntry
+	unmarshalErr := json.Unmarshal(content, &entries)
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("invalid API keys file %s: %s", keysFile, unmarshalErr.Error())
+	}
+	for i, entry := range entries {
+		hash := strings.ToLower(entry.Sha256)
+		if entry.Subject == "" || len(hash) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid API key %d in %s: subject and SHA-256 hex digest required", i, keysFile)
+		}
+		auth.keys[hash] = newPrincipal(entry.Subject, entry.Scopes)
+	}
+	logging.SugaredLog.Infof("%d API keys loaded from %s", len(entries), keysFile)
+	return auth, nil
+}
+
+func (a *apiKeyAuthenticator) authenticate(request *http.Request) (*principal, error) {
+	key := request.Header.Get(apiKeyHeaderKey)
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	found, ok := a.keys[hashApiKey(key)]
+	if !ok {
+		return nil, errors.New("unknown API key")
+	}
+	return found, nil
+}
+
+func hashApiKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// newProbeKey generates the API key of the readiness probe, valid until the server stops
+func newProbeKey() (string, error) {
+	key := make([]byte, probeKeyLength)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// setupAuthenticators creates the authenticators configured, at least one besides the probe key is required
+func (s *Server) setupAuthenticators() error {
+	if s.config.authApiKeysFile == "" && s.config.authJwks == "" {
+		return errors.New("neither API keys file nor JWKS configured")
+	}
+
+	probeKey, keyErr := newProbeKey()
+	if keyErr != nil {
+		return keyErr
+	}
+	apiKeys, apiKeysErr := newApiKeyAuthenticator(s.config.authApiKeysFile, probeKey)
+	if apiKeysErr != nil {
+		return apiKeysErr
+	}
+	s.probeApiKey = probeKey
+	s.authenticators = []authenticator{apiKeys}
+
+	if s.config.authJwks != "" {
+		jwtAuth, jwtErr := newJwtAuthenticator(s.config)
+		if jwtErr != nil {
+			return jwtErr
+		}
+		s.jwtAuthenticator = jwtAuth
+		s.authenticators = append(s.authenticators, jwtAuth)
+	}
+	return nil
+}
+
+// withAuthentication replies 401 to the requests without valid credentials, 403 to those lacking the scope needed:
+// products:read to read, products:write to write, products:admin for the admin endpoints. The subject authenticated
+// is recorded in the request info.
+func (s *Server) withAuthentication(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		info := requestInfoFromContext(request.Context())
+		// browsers send CORS preflights without credentials, OPTIONS exposes nothing anyway
+		if publicRoutes[info.route] || request.Method == http.MethodOptions {
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		authenticated, authErr := s.authenticate(request)
+		if authErr != nil {
+			reason := authFailureInvalid
+			challenge := fmt.Sprintf(`Bearer realm="%s", error="invalid_token"`, authRealm)
+			detail := "Invalid credentials: " + authErr.Error()
+			if authErr == ErrNoCredentials {
+				reason = authFailureMissing
+				challenge = fmt.Sprintf(`Bearer realm="%s"`, authRealm)
+				detail = "Authentication required, with an API key or a bearer token"
+			}
+			authFailures.WithLabelValues(reason).Inc()
+			logging.SugaredLog.Debugf("Authentication failed: %s (request ID %s)", authErr.Error(), info.id)
+			sendAuthErrorResponse(writer, http.StatusUnauthorized, challenge, detail)
+			return
+		}
+
+		scope := requiredScope(info.route, request.Method)
+		if !authenticated.scopes[scope] {
+			authFailures.WithLabelValues(authFailureForbidden).Inc()
+			logging.SugaredLog.Debugf("Scope %s missing for %s (request ID %s)", scope, authenticated.subject, info.id)
+			sendAuthErrorResponse(writer, http.StatusForbidden,
+				fmt.Sprintf(`Bearer realm="%s", error="insufficient_scope", scope="%s"`, authRealm, scope),
+				"Scope "+scope+" required")
+			return
+		}
+
+		info.subject = authenticated.subject
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// authenticate returns the principal of the first authenticator finding credentials of its kind
+func (s *Server) authenticate(request *http.Request) (*principal, error) {
+	for _, auth := range s.authenticators {
+		authenticated, err := auth.authenticate(request)
+		if err != ErrNoCredentials {
+			return authenticated, err
+		}
+	}
+	return nil, ErrNoCredentials
+}
+
+// requiredScope returns the scope needed by the route and method, reading methods need products:read
+func requiredScope(route, method string) string {
+	if isAdminRoute(route) {
+		return scopeAdmin
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return scopeRead
+	default:
+		return scopeWrite
+	}
+}
+
+// subjectFromRequest returns the subject authenticated, empty if authentication is disabled
+func subjectFromRequest(request *http.Request) string {
+	return requestInfoFromContext(request.Context()).subject
+}
+
+func sendAuthErrorResponse(writer http.ResponseWriter, code int, challenge, detail string) {
+	writer.Header().Set(wwwAuthenticateHeaderKey, challenge)
+	sendProblem(writer, &problem{
+		Type:   problemTypeDefault,
+		Title:  http.StatusText(code),
+		Status: code,
+		Detail: detail,
+	})
+}
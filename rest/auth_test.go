@@ -0,0 +1,260 @@
+package rest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+const (
+	testIssuer   = "https://issuer.test"
+	testAudience = "products"
+	testKeyId    = "test-key"
+)
+
+func TestAuthentication(t *testing.T) {
+	signingKey := newSigningKey(t)
+	otherKey := newSigningKey(t)
+	server := newAuthServer(t, writeJwks(t, signingKey))
+
+	valid := jwt.Claims{
+		Issuer:   testIssuer,
+		Audience: jwt.Audience{testAudience},
+		Subject:  "alice",
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	expired, wrongAudience, wrongIssuer, noExpiry := valid, valid, valid, valid
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongAudience.Audience = jwt.Audience{"orders"}
+	wrongIssuer.Issuer = "https://other.test"
+	noExpiry.Expiry = nil
+
+	readToken := signToken(t, signingKey, valid, map[string]interface{}{"scope": "openid " + scopeRead})
+	writeToken := signToken(t, signingKey, valid, map[string]interface{}{"scp": []string{scopeWrite}})
+	product := `{"name":"lamp","price":"10.50","currency":"EUR"}`
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		headers      map[string]string
+		expectedCode int
+	}{
+		{"no credentials", http.MethodGet, productsEndpoint, nil, http.StatusUnauthorized},
+		{"unknown API key", http.MethodGet, productsEndpoint, apiKey("nope"), http.StatusUnauthorized},
+		{"API key read", http.MethodGet, productsEndpoint, apiKey("read-only"), http.StatusOK},
+		{"API key without write scope", http.MethodPost, productsEndpoint, apiKey("read-only"), http.StatusForbidden},
+		{"API key write", http.MethodPost, productsEndpoint, apiKey("read-write"), http.StatusCreated},
+		{"probe key read", http.MethodGet, productsEndpoint, apiKey(server.GetProbeApiKey()), http.StatusOK},
+		{"probe key write", http.MethodPost, productsEndpoint, apiKey(server.GetProbeApiKey()), http.StatusForbidden},
+		{"JWT read", http.MethodGet, productsEndpoint, bearer(readToken), http.StatusOK},
+		{"JWT without write scope", http.MethodPost, productsEndpoint, bearer(readToken), http.StatusForbidden},
+		{"JWT without read scope", http.MethodGet, productsEndpoint, bearer(writeToken), http.StatusForbidden},
+		{"JWT write", http.MethodPost, productsEndpoint, bearer(writeToken), http.StatusCreated},
+		{"JWT expired", http.MethodGet, productsEndpoint,
+			bearer(signToken(t, signingKey, expired, map[string]interface{}{"scope": scopeRead})), http.StatusUnauthorized},
+		{"JWT wrong audience", http.MethodGet, productsEndpoint,
+			bearer(signToken(t, signingKey, wrongAudience, map[string]interface{}{"scope": scopeRead})), http.StatusUnauthorized},
+		{"JWT wrong issuer", http.MethodGet, productsEndpoint,
+			bearer(signToken(t, signingKey, wrongIssuer, map[string]interface{}{"scope": scopeRead})), http.StatusUnauthorized},
+		{"JWT without expiry", http.MethodGet, productsEndpoint,
+			bearer(signToken(t, signingKey, noExpiry, map[string]interface{}{"scope": scopeRead})), http.StatusUnauthorized},
+		{"JWT signed by another key", http.MethodGet, productsEndpoint,
+			bearer(signToken(t, otherKey, valid, map[string]interface{}{"scope": scopeRead})), http.StatusUnauthorized},
+		{"malformed JWT", http.MethodGet, productsEndpoint, bearer("not.a.token"), http.StatusUnauthorized},
+		{"public OpenAPI document", http.MethodGet, openApiEndpoint, nil, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := ""
+			if test.method == http.MethodPost {
+				body = product
+			}
+			response := serve(server, test.method, test.path, test.headers, body)
+			if response.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d: %s", test.expectedCode, response.Code, response.Body.String())
+			}
+			if (response.Code == http.StatusUnauthorized || response.Code == http.StatusForbidden) &&
+				!strings.HasPrefix(response.Header().Get(wwwAuthenticateHeaderKey), "Bearer ") {
+				t.Fatalf("expected WWW-Authenticate challenge, got %v", response.Header())
+			}
+		})
+	}
+}
+
+func TestSubjectRecordedAsActor(t *testing.T) {
+	signingKey := newSigningKey(t)
+	server := newAuthServer(t, writeJwks(t, signingKey))
+	token := signToken(t, signingKey, jwt.Claims{
+		Issuer:   testIssuer,
+		Audience: jwt.Audience{testAudience},
+		Subject:  "alice",
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, map[string]interface{}{"scope": scopeWrite})
+
+	headers := bearer(token)
+	// ignored, the subject authenticated is trusted instead
+	headers[forwardedUserHeaderKey] = "mallory"
+	created := serve(server, http.MethodPost, productsEndpoint, headers, `{"name":"lamp","price":"1","currency":"EUR"}`)
+	if created.Code != http.StatusCreated {
+		t.Fatalf("expected product created, got %d: %s", created.Code, created.Body.String())
+	}
+
+	response := serve(server, http.MethodGet, productsEndpoint+"/1/history", apiKey("read-only"), "")
+	var history []*database.ProductChange
+	if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil || len(history) != 1 {
+		t.Fatalf("expected one change, got %s", response.Body.String())
+	}
+	if history[0].Actor != "alice" {
+		t.Fatalf("expected change made by alice, got %q", history[0].Actor)
+	}
+}
+
+func TestForwardedUserRecordedAsActor(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string
+		expectedActor  string
+	}{
+		{"no trusted proxy", "", "anonymous"},
+		{"trusted proxy", "192.0.2.1", "bob"},
+		{"trusted network", "192.0.2.0/24", "bob"},
+		{"other network", "10.0.0.0/8, not-a-proxy", "anonymous"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// requests served from 192.0.2.1
+			t.Setenv(trustedProxiesEnvVar, test.trustedProxies)
+			server := newTestServer(t)
+
+			headers := map[string]string{forwardedUserHeaderKey: "bob"}
+			created := serve(server, http.MethodPost, productsEndpoint, headers, `{"name":"lamp","price":"1","currency":"EUR"}`)
+			if created.Code != http.StatusCreated {
+				t.Fatalf("expected product created, got %d: %s", created.Code, created.Body.String())
+			}
+
+			response := serve(server, http.MethodGet, productsEndpoint+"/1/history", nil, "")
+			var history []*database.ProductChange
+			if err := json.Unmarshal(response.Body.Bytes(), &history); err != nil || len(history) != 1 {
+				t.Fatalf("expected one change, got %s", response.Body.String())
+			}
+			if history[0].Actor != test.expectedActor {
+				t.Fatalf("expected change made by %s, got %q", test.expectedActor, history[0].Actor)
+			}
+		})
+	}
+}
+
+func TestJwksUrl(t *testing.T) {
+	signingKey := newSigningKey(t)
+	jwks, _ := json.Marshal(publicJwks(signingKey))
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		_, _ = writer.Write(jwks)
+	}))
+	defer jwksServer.Close()
+
+	server := newAuthServer(t, jwksServer.URL)
+	token := signToken(t, signingKey, jwt.Claims{
+		Issuer:   testIssuer,
+		Audience: jwt.Audience{testAudience},
+		Subject:  "alice",
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, map[string]interface{}{"scope": scopeRead})
+
+	if response := serve(server, http.MethodGet, productsEndpoint, bearer(token), ""); response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", response.Code, response.Body.String())
+	}
+}
+
+func TestAuthenticationMisconfigured(t *testing.T) {
+	t.Setenv(authEnabledEnvVar, "true")
+	repository := database.NewMemoryRepository()
+	if _, err := New(repository, repository, nil); err == nil {
+		t.Fatal("expected server creation failing without API keys file nor JWKS")
+	}
+
+	t.Setenv(authJwksEnvVar, writeJwks(t, newSigningKey(t)))
+	if _, err := New(repository, repository, nil); err == nil {
+		t.Fatal("expected server creation failing without JWT issuer and audience")
+	}
+}
+
+// newAuthServer creates a server authenticating with the API keys read-only and read-write, and with JWTs
+func newAuthServer(t *testing.T, jwks string) *Server {
+	t.Helper()
+	keys, _ := json.Marshal([]*apiKeyEntry{
+		{Subject: "reader", Sha256: hashApiKey("read-only"), Scopes: []string{scopeRead}},
+		{Subject: "writer", Sha256: strings.ToUpper(hashApiKey("read-write")), Scopes: []string{scopeRead, scopeWrite}},
+		{Subject: "operator", Sha256: hashApiKey("admin"), Scopes: []string{scopeAdmin}},
+	})
+	keysFile := filepath.Join(t.TempDir(), "api-keys.json")
+	if err := os.WriteFile(keysFile, keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(authEnabledEnvVar, "true")
+	t.Setenv(authApiKeysFileEnvVar, keysFile)
+	t.Setenv(authJwksEnvVar, jwks)
+	t.Setenv(authJwtIssuerEnvVar, testIssuer)
+	t.Setenv(authJwtAudienceEnvVar, testAudience)
+	return newTestServer(t)
+}
+
+func newSigningKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func publicJwks(key *rsa.PrivateKey) *jose.JSONWebKeySet {
+	return &jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: testKeyId, Algorithm: string(jose.RS256), Use: "sig"},
+	}}
+}
+
+func writeJwks(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+	jwks, _ := json.Marshal(publicJwks(key))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signToken(t *testing.T, key *rsa.PrivateKey, claims jwt.Claims, extra map[string]interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", testKeyId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Claims(extra).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func apiKey(key string) map[string]string {
+	return map[string]string{apiKeyHeaderKey: key}
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{authorizationHeaderKey: bearerPrefix + token}
+}
@@ -0,0 +1,517 @@
+package rest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shopspring/decimal"
+
+	"github.com/bygui86/go-k8s-probes/commons"
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	contentTypeCsv    = "text/csv"
+	contentTypeNdjson = "application/x-ndjson"
+
+	contentDispositionHeaderKey = "Content-Disposition"
+	contentDispositionFormat    = `attachment; filename="products.%s"`
+
+	formatParam  = "format"
+	formatCsv    = "csv"
+	formatNdjson = "ndjson"
+
+	csvNameColumn     = "name"
+	csvPriceColumn    = "price"
+	csvCurrencyColumn = "currency"
+
+	maxNdjsonLineBytes       = 1 << 20
+	maxReportedImportErrors  = 1000
+	exportFlushInterval      = 100 // products
+	importBatchFailureDetail = "batch insertion failed, look for the trace ID in the logs"
+)
+
+var (
+	csvImportColumns = []string{csvNameColumn, csvPriceColumn, csvCurrencyColumn}
+	csvExportColumns = []string{"id", "name", "price", "currency", "version"}
+	// assigned on import, accepted to import exports back
+	csvIgnoredColumns = []string{"id", "version", "updatedat"}
+
+	// spreadsheets evaluate the cells starting with these characters as formulas
+	csvFormulaPrefixes = "=+-@"
+
+	errUnsupportedImport = fmt.Errorf("unsupported import media type, use %s or %s", contentTypeCsv, contentTypeNdjson)
+	errUnsupportedExport = fmt.Errorf("unsupported export format, use %s or %s", formatCsv, formatNdjson)
+)
+
+// importReader reads one product at a time from the import body, returning io.EOF at the end.
+// Errors of a single row are returned as *importRowError, any other error aborts the import.
+type importReader interface {
+	next() (*database.Product, int, error)
+}
+
+type importRowError struct {
+	line          int
+	err           error
+	invalidParams []*invalidParam
+}
+
+func (e *importRowError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.err.Error())
+}
+
+// importer inserts the rows read in batches, collecting the errors of the rows rejected
+type importer struct {
+	repository database.ProductRepository
+	events     *eventBroker
+	batchSize  int
+	controller *http.ResponseController
+	span       opentracing.Span
+	ctx        context.Context
+
+	batch      []*database.Product
+	batchLines []int
+	report     *importReport
+}
+
+func (s *Server) importProducts(writer http.ResponseWriter, request *http.Request) {
+	span, ctx := retrieveSpanAndCtx(request, "import-products-handler")
+	defer span.Finish()
+	ctx = s.withActor(request, ctx)
+
+	logging.Log.Info("Import products")
+
+	reader, readerErr := newImportReader(request)
+	if readerErr != nil {
+		errMsg := "Import products failed: " + readerErr.Error()
+		if readerErr == errUnsupportedImport {
+			sendErrorResponse(writer, span, http.StatusUnsupportedMediaType, errMsg)
+		} else {
+			sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+		}
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+	defer request.Body.Close()
+
+	imp := &importer{
+		repository: s.repository,
+		events:     s.events,
+		batchSize:  s.config.importBatchSize,
+		controller: http.NewResponseController(writer),
+		span:       span,
+		ctx:        ctx,
+		batch:      make([]*database.Product, 0, s.config.importBatchSize),
+		batchLines: make([]int, 0, s.config.importBatchSize),
+		report:     &importReport{Errors: make([]*importError, 0)},
+	}
+	importErr := imp.run(reader)
+	if importErr != nil {
+		// batches inserted so far are not rolled back
+		errMsg := fmt.Sprintf("Import products failed after importing %d products: %s",
+			imp.report.Imported, importErr.Error())
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("products-imported", imp.report.Imported)
+		span.SetTag("error", errMsg)
+		span.LogKV("products-imported", imp.report.Imported, "error", errMsg)
+		return
+	}
+
+	span.SetTag("products-imported", imp.report.Imported)
+	span.SetTag("products-failed", imp.report.Failed)
+	span.LogKV("products-imported", imp.report.Imported, "products-failed", imp.report.Failed)
+
+	sendJsonResponse(writer, http.StatusOK, imp.report)
+}
+
+func (s *Server) exportProducts(writer http.ResponseWriter, request *http.Request) {
+	span, ctx := retrieveSpanAndCtx(request, "export-products-handler")
+	defer span.Finish()
+	ctx = withReadConsistency(request, ctx)
+
+	logging.Log.Info("Export products")
+
+	format := request.URL.Query().Get(formatParam)
+	if format == "" {
+		format = formatCsv
+	}
+	var exporter interface {
+		write(product *database.Product) error
+		flush() error
+	}
+	switch format {
+	case formatCsv:
+		writer.Header().Set(contentTypeHeaderKey, contentTypeCsv)
+		exporter = newCsvExporter(writer)
+	case formatNdjson:
+		writer.Header().Set(contentTypeHeaderKey, contentTypeNdjson)
+		exporter = &ndjsonExporter{encoder: json.NewEncoder(writer)}
+	default:
+		errMsg := "Export products failed: " + errUnsupportedExport.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+	writer.Header().Set(contentDispositionHeaderKey, fmt.Sprintf(contentDispositionFormat, format))
+
+	controller := http.NewResponseController(writer)
+	exported := 0
+	exportErr := s.repository.ExportProducts(func(product *database.Product) error {
+		err := exporter.write(product)
+		if err != nil {
+			return err
+		}
+		exported++
+		// a slow DB must not keep the client waiting for the whole export
+		if exported%exportFlushInterval == 0 {
+			if err := exporter.flush(); err != nil {
+				return err
+			}
+			// the server write timeout applies to the whole response, it's extended at every flush instead
+			if err := extendWriteDeadline(controller); err != nil {
+				return err
+			}
+			return controller.Flush()
+		}
+		return nil
+	}, ctx)
+	if exportErr == nil {
+		exportErr = exporter.flush()
+	}
+	if exportErr != nil {
+		errMsg := "Export products failed: " + exportErr.Error()
+		span.SetTag("products-exported", exported)
+		span.SetTag("error", errMsg)
+		span.LogKV("products-exported", exported, "error", errMsg)
+
+		if exported == 0 {
+			writer.Header().Del(contentDispositionHeaderKey)
+			sendErrorResponse(writer, span, http.StatusInternalServerError, errMsg)
+			return
+		}
+		// the response may be streaming already, the client gets a truncated body
+		logging.SugaredLog.Errorf("%s (trace ID %s)", errMsg, traceIdFromSpan(span))
+		panic(http.ErrAbortHandler)
+	}
+
+	span.SetTag("products-exported", exported)
+	span.LogKV("products-exported", exported)
+}
+
+// IMPORT
+
+func newImportReader(request *http.Request) (importReader, error) {
+	mediaType, _, mediaErr := mime.ParseMediaType(request.Header.Get(contentTypeHeaderKey))
+	if mediaErr != nil {
+		return nil, errUnsupportedImport
+	}
+
+	switch mediaType {
+	case contentTypeCsv:
+		return newCsvImportReader(request.Body)
+	case contentTypeNdjson, "application/ndjson":
+		scanner := bufio.NewScanner(request.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxNdjsonLineBytes)
+		return &ndjsonImportReader{scanner: scanner}, nil
+	default:
+		return nil, errUnsupportedImport
+	}
+}
+
+func (i *importer) run(reader importReader) error {
+	for {
+		product, line, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		var rowErr *importRowError
+		if errors.As(err, &rowErr) {
+			i.reject(rowErr)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		validationErr := product.Validate()
+		if validationErr != nil {
+			i.reject(newValidationRowError(line, validationErr))
+			continue
+		}
+
+		i.batch = append(i.batch, product)
+		i.batchLines = append(i.batchLines, line)
+		if len(i.batch) >= i.batchSize {
+			i.flush()
+			// the server timeouts apply to the whole request, they're extended at every batch instead
+			if err := extendReadDeadline(i.controller); err != nil {
+				return err
+			}
+			if err := extendWriteDeadline(i.controller); err != nil {
+				return err
+			}
+		}
+	}
+	i.flush()
+	return nil
+}
+
+// flush inserts the current batch, a failure rejects all its rows as they are inserted in one transaction
+func (i *importer) flush() {
+	if len(i.batch) == 0 {
+		return
+	}
+
+	err := i.repository.ImportProducts(i.batch, i.ctx)
+	if err != nil {
+		logging.SugaredLog.Errorf("Import products batch of lines %d-%d failed: %s (trace ID %s)",
+			i.batchLines[0], i.batchLines[len(i.batchLines)-1], err.Error(), traceIdFromSpan(i.span))
+		for _, line := range i.batchLines {
+			i.reject(&importRowError{line: line, err: errors.New(importBatchFailureDetail)})
+		}
+	} else {
+		i.report.Imported += len(i.batch)
+		for _, product := range i.batch {
+			i.events.publish(EventCreated, product.ID, product)
+		}
+	}
+
+	i.batch = i.batch[:0]
+	i.batchLines = i.batchLines[:0]
+}
+
+func (i *importer) reject(rowErr *importRowError) {
+	i.report.Failed++
+	if len(i.report.Errors) < maxReportedImportErrors {
+		i.report.Errors = append(i.report.Errors, &importError{
+			Line:          rowErr.line,
+			Detail:        rowErr.err.Error(),
+			InvalidParams: rowErr.invalidParams,
+		})
+	}
+}
+
+func newValidationRowError(line int, err error) *importRowError {
+	rowErr := &importRowError{line: line, err: err}
+	var validationErr *database.ValidationError
+	if errors.As(err, &validationErr) {
+		for _, param := range validationErr.InvalidParams {
+			rowErr.invalidParams = append(rowErr.invalidParams, &invalidParam{Name: param.Name, Reason: param.Reason})
+		}
+	}
+	return rowErr
+}
+
+// csvImportReader reads products from CSV with a header row naming the columns, in any order
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns map[string]int
+}
+
+func newCsvImportReader(body io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(body)
+	reader.ReuseRecord = true
+
+	header, headerErr := reader.Read()
+	if headerErr == io.EOF {
+		return nil, errors.New("missing CSV header")
+	}
+	if headerErr != nil {
+		return nil, fmt.Errorf("invalid CSV header: %s", headerErr.Error())
+	}
+
+	columns := make(map[string]int, len(header))
+	for index, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if slices.Contains(csvIgnoredColumns, column) {
+			continue
+		}
+		if !slices.Contains(csvImportColumns, column) {
+			return nil, fmt.Errorf("unknown CSV column %q, expected %s", column, strings.Join(csvImportColumns, ", "))
+		}
+		if _, found := columns[column]; found {
+			return nil, fmt.Errorf("duplicated CSV column %q", column)
+		}
+		columns[column] = index
+	}
+	for _, column := range csvImportColumns {
+		if _, found := columns[column]; !found {
+			return nil, fmt.Errorf("missing CSV column %q", column)
+		}
+	}
+	// every row must have as many fields as the header
+	reader.FieldsPerRecord = len(header)
+
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvImportReader) next() (*database.Product, int, error) {
+	record, readErr := r.reader.Read()
+	if readErr == io.EOF {
+		return nil, 0, io.EOF
+	}
+	var parseErr *csv.ParseError
+	if errors.As(readErr, &parseErr) {
+		return nil, parseErr.Line, &importRowError{line: parseErr.Line, err: parseErr.Err}
+	}
+	if readErr != nil {
+		return nil, 0, readErr
+	}
+	line, _ := r.reader.FieldPos(0)
+
+	price, priceErr := decimal.NewFromString(strings.TrimSpace(record[r.columns[csvPriceColumn]]))
+	if priceErr != nil {
+		return nil, line, &importRowError{
+			line:          line,
+			err:           errors.New("invalid product: price must be a decimal number"),
+			invalidParams: []*invalidParam{{Name: csvPriceColumn, Reason: "must be a decimal number"}},
+		}
+	}
+	return &database.Product{
+		Name:     unescapeCsvFormula(record[r.columns[csvNameColumn]]),
+		Price:    price,
+		Currency: strings.TrimSpace(record[r.columns[csvCurrencyColumn]]),
+	}, line, nil
+}
+
+// ndjsonImportReader reads a product per line, blank lines are skipped
+type ndjsonImportReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonImportReader) next() (*database.Product, int, error) {
+	for r.scanner.Scan() {
+		r.line++
+		raw := bytes.TrimSpace(r.scanner.Bytes())
+		if len(raw) == 0 {
+			continue
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.DisallowUnknownFields()
+		var product *database.Product
+		decodeErr := decoder.Decode(&product)
+		switch {
+		case decodeErr != nil:
+			return nil, r.line, &importRowError{line: r.line, err: decodeErr}
+		case product == nil:
+			return nil, r.line, &importRowError{line: r.line, err: errors.New("a JSON object is expected")}
+		case decoder.More():
+			return nil, r.line, &importRowError{line: r.line, err: errors.New("a single JSON object per line is expected")}
+		}
+		// assigned on import, accepted to import exports back
+		product.ID = 0
+		product.Version = 0
+		product.UpdatedAt = time.Time{}
+		return product, r.line, nil
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return nil, r.line, fmt.Errorf("reading line %d failed: %s", r.line+1, err.Error())
+	}
+	return nil, r.line, io.EOF
+}
+
+// extendReadDeadline gives another server read timeout to read the rest of the request body.
+// Writers not supporting deadlines, e.g. recorders in tests, are left as they are.
+func extendReadDeadline(controller *http.ResponseController) error {
+	err := controller.SetReadDeadline(time.Now().Add(commons.HttpServerReadTimeoutDefault))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// extendWriteDeadline gives another server write timeout to write the rest of the response.
+// Writers not supporting deadlines, e.g. recorders in tests, are left as they are.
+func extendWriteDeadline(controller *http.ResponseController) error {
+	err := controller.SetWriteDeadline(time.Now().Add(commons.HttpServerWriteTimeoutDefault))
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
+
+// EXPORT
+
+type csvExporter struct {
+	writer *csv.Writer
+	record []string
+}
+
+func newCsvExporter(writer io.Writer) *csvExporter {
+	exporter := &csvExporter{writer: csv.NewWriter(writer), record: make([]string, len(csvExportColumns))}
+	// the header is written along with the first flush
+	_ = exporter.writer.Write(csvExportColumns)
+	return exporter
+}
+
+func (e *csvExporter) write(product *database.Product) error {
+	e.record[0] = strconv.Itoa(product.ID)
+	e.record[1] = escapeCsvFormula(product.Name)
+	e.record[2] = product.Price.String()
+	e.record[3] = product.Currency
+	e.record[4] = strconv.Itoa(product.Version)
+	return e.writer.Write(e.record)
+}
+
+func (e *csvExporter) flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// escapeCsvFormula prefixes the cells spreadsheets would evaluate as formulas by a single quote, to be shown as text
+func escapeCsvFormula(cell string) string {
+	if isCsvFormula(cell) {
+		return "'" + cell
+	}
+	return cell
+}
+
+// unescapeCsvFormula drops the single quote escapeCsvFormula prefixes formulas by, to import exports back as they were
+func unescapeCsvFormula(cell string) string {
+	if strings.HasPrefix(cell, "'") && isCsvFormula(cell[1:]) {
+		return cell[1:]
+	}
+	return cell
+}
+
+// isCsvFormula tells whether the cell starts with a formula prefix, or with quotes followed by one: those are escaped
+// too, not to lose a quote importing them back
+func isCsvFormula(cell string) bool {
+	trimmed := strings.TrimLeft(cell, "'")
+	return trimmed != "" && strings.ContainsRune(csvFormulaPrefixes, rune(trimmed[0]))
+}
+
+type ndjsonExporter struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonExporter) write(product *database.Product) error {
+	// the encoder terminates every value by a new line
+	return e.encoder.Encode(product)
+}
+
+func (e *ndjsonExporter) flush() error {
+	return nil
+}
@@ -0,0 +1,212 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+// bulkTimeout replaces the server timeouts, the bulk requests below take longer
+const bulkTimeout = 300 * time.Millisecond
+
+// slowExportRepository exports the products as a slow DB would
+type slowExportRepository struct {
+	*database.MemoryRepository
+	delay time.Duration
+}
+
+func (r *slowExportRepository) ExportProducts(fn func(product *database.Product) error, ctx context.Context) error {
+	return r.MemoryRepository.ExportProducts(func(product *database.Product) error {
+		time.Sleep(r.delay)
+		return fn(product)
+	}, ctx)
+}
+
+func TestExportStreamed(t *testing.T) {
+	repository := &slowExportRepository{MemoryRepository: database.NewMemoryRepository(), delay: time.Millisecond}
+	products := 3 * bulkTimeout / time.Millisecond
+	for index := 0; index < int(products); index++ {
+		product := &database.Product{Name: fmt.Sprintf("product %d", index), Price: decimal.RequireFromString("1.5"),
+			Currency: "EUR"}
+		if err := repository.CreateProduct(product, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	httpServer := newBulkTestServer(t, repository)
+
+	t.Run("csv", func(t *testing.T) {
+		response := mustGet(t, httpServer.URL+exportEndpoint)
+		defer response.Body.Close()
+		if contentType := response.Header.Get(contentTypeHeaderKey); contentType != contentTypeCsv {
+			t.Fatalf("expected %s, got %s", contentTypeCsv, contentType)
+		}
+
+		records, err := csv.NewReader(response.Body).ReadAll()
+		if err != nil {
+			t.Fatalf("expected the whole export read, got %s", err.Error())
+		}
+		if len(records) != int(products)+1 || strings.Join(records[0], ",") != "id,name,price,currency,version" {
+			t.Fatalf("expected header and %d products, got %d records", products, len(records))
+		}
+		for index, record := range records[1:] {
+			if record[0] != strconv.Itoa(index+1) || record[2] != "1.5" {
+				t.Fatalf("expected product %d in ID order, got %v", index+1, record)
+			}
+		}
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		response := mustGet(t, httpServer.URL+exportEndpoint+"?format=ndjson")
+		defer response.Body.Close()
+
+		exported := 0
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			var product *database.Product
+			if err := json.Unmarshal(scanner.Bytes(), &product); err != nil || product.ID != exported+1 {
+				t.Fatalf("expected product %d, got %s (%v)", exported+1, scanner.Text(), err)
+			}
+			exported++
+		}
+		if err := scanner.Err(); err != nil || exported != int(products) {
+			t.Fatalf("expected %d products exported, got %d (%v)", products, exported, err)
+		}
+	})
+}
+
+func TestImportBatched(t *testing.T) {
+	t.Setenv(importBatchSizeEnvVar, "2")
+	repository := database.NewMemoryRepository()
+	httpServer := newBulkTestServer(t, repository)
+
+	// the body is sent slowly, a batch at a time
+	rows := []string{"name,price,currency"}
+	for index := 0; index < 10; index++ {
+		rows = append(rows, fmt.Sprintf("product %d,%d,EUR", index, index))
+	}
+	rows = append(rows, "invalid,-1,EUR")
+	body, bodyWriter := io.Pipe()
+	go func() {
+		for _, row := range rows {
+			time.Sleep(bulkTimeout / 5)
+			if _, err := bodyWriter.Write([]byte(row + "\n")); err != nil {
+				return
+			}
+		}
+		_ = bodyWriter.Close()
+	}()
+
+	response, err := http.Post(httpServer.URL+importEndpoint, contentTypeCsv, body)
+	if err != nil {
+		t.Fatalf("import request failed: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	var report *importReport
+	decodeErr := json.NewDecoder(response.Body).Decode(&report)
+	if response.StatusCode != http.StatusOK || decodeErr != nil {
+		t.Fatalf("expected 200 with a report, got %d (%v)", response.StatusCode, decodeErr)
+	}
+	if report.Imported != 10 || report.Failed != 1 || len(report.Errors) != 1 || report.Errors[0].Line != 12 {
+		t.Fatalf("expected 10 products imported and line 12 rejected, got %+v", report)
+	}
+
+	page, getErr := repository.GetProducts(&database.ProductsQuery{Limit: 100}, context.Background())
+	if getErr != nil || len(page.Products) != 10 {
+		t.Fatalf("expected 10 products stored, got %v (%v)", page, getErr)
+	}
+}
+
+func TestExportImportedBack(t *testing.T) {
+	names := []string{"lamp", "=HYPERLINK(\"http://evil.example\")", "-5 degrees fridge", "+1 pack", "@home",
+		"'quoted", "'=kept quoted"}
+	source := database.NewMemoryRepository()
+	for _, name := range names {
+		product := &database.Product{Name: name, Price: decimal.RequireFromString("1.5"), Currency: "EUR"}
+		if err := source.CreateProduct(product, context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sourceServer := newBulkTestServer(t, source)
+
+	for _, format := range []string{formatCsv, formatNdjson} {
+		t.Run(format, func(t *testing.T) {
+			response := mustGet(t, sourceServer.URL+exportEndpoint+"?format="+format)
+			exported, readErr := io.ReadAll(response.Body)
+			_ = response.Body.Close()
+			if readErr != nil {
+				t.Fatal(readErr)
+			}
+			if format == formatCsv {
+				records, _ := csv.NewReader(strings.NewReader(string(exported))).ReadAll()
+				for _, record := range records[1:] {
+					if strings.IndexAny(record[1], "=+-@") == 0 {
+						t.Fatalf("expected formulas escaped, got %s", record[1])
+					}
+				}
+			}
+
+			target := database.NewMemoryRepository()
+			contentType := map[string]string{formatCsv: contentTypeCsv, formatNdjson: contentTypeNdjson}[format]
+			imported, importErr := http.Post(newBulkTestServer(t, target).URL+importEndpoint, contentType,
+				strings.NewReader(string(exported)))
+			if importErr != nil {
+				t.Fatalf("import request failed: %s", importErr.Error())
+			}
+			defer imported.Body.Close()
+			var report *importReport
+			if err := json.NewDecoder(imported.Body).Decode(&report); err != nil || report.Imported != len(names) {
+				t.Fatalf("expected %d products imported, got %+v (%v)", len(names), report, err)
+			}
+
+			page, _ := target.GetProducts(&database.ProductsQuery{Limit: 100}, context.Background())
+			for index, product := range page.Products {
+				if product.Name != names[index] || product.Version != 1 {
+					t.Fatalf("expected %q imported back as version 1, got %q version %d", names[index], product.Name,
+						product.Version)
+				}
+			}
+		})
+	}
+}
+
+// newBulkTestServer serves the products over HTTP, where deadlines apply, with timeouts shorter than the requests
+func newBulkTestServer(t *testing.T, repository database.ProductRepository) *httptest.Server {
+	t.Helper()
+	server, serverErr := New(repository, database.NewMemoryRepository(), nil)
+	if serverErr != nil {
+		t.Fatalf("server creation failed: %s", serverErr.Error())
+	}
+
+	httpServer := httptest.NewUnstartedServer(server.httpServer.Handler)
+	httpServer.Config.ReadTimeout = bulkTimeout
+	httpServer.Config.WriteTimeout = bulkTimeout
+	httpServer.Start()
+	t.Cleanup(httpServer.Close)
+	return httpServer
+}
+
+func mustGet(t *testing.T, url string) *http.Response {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("request failed: %s", err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", response.StatusCode)
+	}
+	return response
+}
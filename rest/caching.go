@@ -0,0 +1,108 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	lastModifiedHeaderKey    = "Last-Modified"
+	ifNoneMatchHeaderKey     = "If-None-Match"
+	ifModifiedSinceHeaderKey = "If-Modified-Since"
+
+	// responses may be stored, but must be revalidated every time. Private when authentication is enabled, not to
+	// be served by shared caches to clients without credentials.
+	cacheControlPublic  = "no-cache"
+	cacheControlPrivate = "private, no-cache"
+
+	// bytes of the SHA-256 of the body kept in content ETags
+	contentETagLength = 16
+)
+
+// sendCacheableJsonResponse sends the payload along with its validators, or 304 if the client has it already.
+// The ETag is computed from the body if empty; lastModified is left out if zero.
+func (s *Server) sendCacheableJsonResponse(writer http.ResponseWriter, request *http.Request, etag string,
+	lastModified time.Time, payload interface{}) {
+
+	response, _ := json.Marshal(payload)
+	if etag == "" {
+		etag = contentETag(response)
+	}
+	if s.setValidators(writer, request, etag, lastModified) {
+		return
+	}
+
+	writer.Header().Set(contentTypeHeaderKey, contentTypeApplicationJson)
+	writer.WriteHeader(http.StatusOK)
+	_, err := writer.Write(response)
+	if err != nil {
+		logging.SugaredLog.Errorf("Error sending JSON response: %s", err.Error())
+	}
+}
+
+// setValidators sets ETag, Last-Modified and Cache-Control, then replies 304 and returns true if the client
+// has the current representation already
+func (s *Server) setValidators(writer http.ResponseWriter, request *http.Request, etag string,
+	lastModified time.Time) bool {
+
+	writer.Header().Set(etagHeaderKey, etag)
+	if !lastModified.IsZero() {
+		writer.Header().Set(lastModifiedHeaderKey, lastModified.UTC().Format(http.TimeFormat))
+	}
+	if s.config.authEnabled {
+		writer.Header().Set(cacheControlHeaderKey, cacheControlPrivate)
+	} else {
+		writer.Header().Set(cacheControlHeaderKey, cacheControlPublic)
+	}
+
+	if !isNotModified(request, etag, lastModified) {
+		return false
+	}
+	writer.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// isNotModified evaluates If-None-Match or, only if missing, If-Modified-Since (RFC 9110, section 13.2.2)
+func isNotModified(request *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := request.Header.Values(ifNoneMatchHeaderKey); len(ifNoneMatch) > 0 {
+		return matchesETag(ifNoneMatch, etag)
+	}
+
+	ifModifiedSince := request.Header.Get(ifModifiedSinceHeaderKey)
+	if ifModifiedSince == "" || lastModified.IsZero() {
+		return false
+	}
+	since, parseErr := http.ParseTime(ifModifiedSince)
+	if parseErr != nil {
+		return false
+	}
+	// Last-Modified has a resolution of a second
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// matchesETag compares the ETags listed in the header values with the current one, weakly as required by
+// If-None-Match: compressed responses carry the weak version of the ETags
+func matchesETag(values []string, etag string) bool {
+	current := strings.TrimPrefix(etag, weakPrefix)
+	for _, value := range values {
+		for _, candidate := range strings.Split(value, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == etagWildcard || strings.TrimPrefix(candidate, weakPrefix) == current {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentETag identifies a representation by its content, for those without a version, e.g. lists
+func contentETag(content []byte) string {
+	hash := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(hash[:contentETagLength]) + `"`
+}
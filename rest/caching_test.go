@@ -0,0 +1,82 @@
+package rest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConditionalProductGet(t *testing.T) {
+	server := newTestServer(t)
+	serve(server, http.MethodPost, productsEndpoint, nil, `{"name":"lamp","price":"1","currency":"EUR"}`)
+
+	response := serve(server, http.MethodGet, productsEndpoint+"/1", nil, "")
+	etag, lastModified := response.Header().Get(etagHeaderKey), response.Header().Get(lastModifiedHeaderKey)
+	if etag != `"1"` || lastModified == "" || response.Header().Get(cacheControlHeaderKey) != cacheControlPublic {
+		t.Fatalf("expected validators, got %v", response.Header())
+	}
+	modifiedAt, _ := http.ParseTime(lastModified)
+	before := modifiedAt.Add(-time.Second).Format(http.TimeFormat)
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		expectedCode int
+	}{
+		{"same ETag", map[string]string{ifNoneMatchHeaderKey: etag}, http.StatusNotModified},
+		{"weak ETag", map[string]string{ifNoneMatchHeaderKey: weakPrefix + etag}, http.StatusNotModified},
+		{"ETag among others", map[string]string{ifNoneMatchHeaderKey: `"7", ` + etag}, http.StatusNotModified},
+		{"wildcard", map[string]string{ifNoneMatchHeaderKey: etagWildcard}, http.StatusNotModified},
+		{"other ETag", map[string]string{ifNoneMatchHeaderKey: `"2"`}, http.StatusOK},
+		{"not modified since", map[string]string{ifModifiedSinceHeaderKey: lastModified}, http.StatusNotModified},
+		{"modified since", map[string]string{ifModifiedSinceHeaderKey: before}, http.StatusOK},
+		{"invalid date", map[string]string{ifModifiedSinceHeaderKey: "yesterday"}, http.StatusOK},
+		{"ETag first", map[string]string{ifNoneMatchHeaderKey: `"2"`, ifModifiedSinceHeaderKey: lastModified},
+			http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(server, http.MethodGet, productsEndpoint+"/1", test.headers, "")
+			if response.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d", test.expectedCode, response.Code)
+			}
+			if response.Code == http.StatusNotModified && (response.Body.Len() > 0 || response.Header().Get(etagHeaderKey) != etag) {
+				t.Fatalf("expected empty 304 with ETag, got %v %q", response.Header(), response.Body.String())
+			}
+		})
+	}
+}
+
+func TestConditionalListGet(t *testing.T) {
+	server := newTestServer(t)
+	product := `{"name":"lamp","price":"1","currency":"EUR"}`
+	serve(server, http.MethodPost, productsEndpoint, nil, product)
+
+	first := serve(server, http.MethodGet, productsEndpoint, nil, "")
+	etag := first.Header().Get(etagHeaderKey)
+	if etag == "" || first.Header().Get(lastModifiedHeaderKey) == "" {
+		t.Fatalf("expected validators, got %v", first.Header())
+	}
+	if response := serve(server, http.MethodGet, productsEndpoint, map[string]string{ifNoneMatchHeaderKey: etag}, ""); response.Code != http.StatusNotModified {
+		t.Fatalf("expected unchanged list not modified, got %d", response.Code)
+	}
+
+	serve(server, http.MethodDelete, productsEndpoint+"/1", nil, "")
+	response := serve(server, http.MethodGet, productsEndpoint, map[string]string{ifNoneMatchHeaderKey: etag}, "")
+	if response.Code != http.StatusOK || response.Header().Get(etagHeaderKey) == etag {
+		t.Fatalf("expected list changed after deletion, got %d %v", response.Code, response.Header())
+	}
+
+	// the list is empty, but the deleted product still tells its last change
+	if response.Header().Get(lastModifiedHeaderKey) == "" {
+		t.Fatalf("expected Last-Modified of the deletion, got %v", response.Header())
+	}
+}
+
+func TestPrivateCacheControlWithAuthentication(t *testing.T) {
+	server := newAuthServer(t, writeJwks(t, newSigningKey(t)))
+	response := serve(server, http.MethodGet, productsEndpoint, apiKey("read-only"), "")
+	if cacheControl := response.Header().Get(cacheControlHeaderKey); cacheControl != cacheControlPrivate {
+		t.Fatalf("expected %q, got %q", cacheControlPrivate, cacheControl)
+	}
+}
@@ -0,0 +1,286 @@
+package rest
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	acceptEncodingHeaderKey  = "Accept-Encoding"
+	contentEncodingHeaderKey = "Content-Encoding"
+	contentLengthHeaderKey   = "Content-Length"
+	varyHeaderKey            = "Vary"
+
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+
+	// fast levels, responses are compressed on the fly
+	brotliLevel = 4
+	gzipLevel   = gzip.DefaultCompression
+)
+
+var (
+	// in order of preference, when the client accepts several equally
+	supportedEncodings = []string{encodingBrotli, encodingGzip}
+
+	// media types worth compressing, others are left as they are
+	compressibleMediaTypes = map[string]bool{
+		contentTypeApplicationJson: true,
+		contentTypeProblemJson:     true,
+		contentTypeNdjson:          true,
+		contentTypeCsv:             true,
+		"text/html":                true,
+	}
+
+	// compressors are reused, they allocate large buffers
+	brotliWriters = sync.Pool{New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}}
+	gzipWriters = sync.Pool{New: func() interface{} {
+		writer, _ := gzip.NewWriterLevel(nil, gzipLevel)
+		return writer
+	}}
+)
+
+// compressor is implemented by both brotli.Writer and gzip.Writer
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(writer io.Writer)
+}
+
+// withCompression compresses the responses with the encoding preferred by the client among br and gzip, if they
+// are of a compressible media type and at least minSize bytes long. Event streams are never compressed.
+func withCompression(minSize int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			encoding := negotiateEncoding(request.Header.Values(acceptEncodingHeaderKey))
+			if encoding == "" || request.Method == http.MethodHead {
+				next.ServeHTTP(writer, request)
+				return
+			}
+
+			compressWriter := &compressWriter{ResponseWriter: writer, encoding: encoding, minSize: minSize}
+			defer compressWriter.close()
+			next.ServeHTTP(compressWriter, request)
+		})
+	}
+}
+
+// negotiateEncoding returns the supported encoding with the highest quality in Accept-Encoding, empty if none
+func negotiateEncoding(acceptEncoding []string) string {
+	qualities := make(map[string]float64, len(supportedEncodings))
+	for _, value := range acceptEncoding {
+		for _, item := range strings.Split(value, ",") {
+			coding, quality := parseQualityItem(item)
+			if coding == "*" {
+				for _, encoding := range supportedEncodings {
+					if _, found := qualities[encoding]; !found {
+						qualities[encoding] = quality
+					}
+				}
+				continue
+			}
+			// explicit codings take precedence over the wildcard, wherever it is listed
+			qualities[coding] = quality
+		}
+	}
+
+	best, bestQuality := "", 0.0
+	for _, encoding := range supportedEncodings {
+		if quality := qualities[encoding]; quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// parseQualityItem splits an Accept-Encoding item, e.g. "gzip;q=0.8", defaulting to quality 1
+func parseQualityItem(item string) (string, float64) {
+	coding, params, _ := strings.Cut(item, ";")
+	coding = strings.ToLower(strings.TrimSpace(coding))
+	quality := 1.0
+	for _, param := range strings.Split(params, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found && strings.EqualFold(name, "q") {
+			parsed, parseErr := strconv.ParseFloat(value, 64)
+			if parseErr != nil {
+				return coding, 0
+			}
+			quality = parsed
+		}
+	}
+	return coding, quality
+}
+
+// compressWriter holds back the response until minSize bytes are written, or the handler is done or flushes,
+// to decide whether to compress it
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	statusCode int
+	buffer     []byte
+	decided    bool
+	compressor compressor // nil if the response is sent as it is
+}
+
+func (w *compressWriter) WriteHeader(statusCode int) {
+	if w.statusCode != 0 || w.decided {
+		return
+	}
+	if statusCode < http.StatusOK {
+		// informational, e.g. 101 switching to WebSocket
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	w.statusCode = statusCode
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if !w.decided {
+		w.buffer = append(w.buffer, data...)
+		if len(w.buffer) < w.minSize {
+			return len(data), nil
+		}
+		if err := w.decide(false); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// decide compresses the response if worth it, then sends the headers and the data buffered so far.
+// Responses streamed, flushing, are compressed whatever their size so far.
+func (w *compressWriter) decide(streamed bool) error {
+	w.decided = true
+	header := w.ResponseWriter.Header()
+	if isCompressible(header) || w.statusCode == http.StatusNotModified {
+		// the response depends on Accept-Encoding even when left uncompressed, e.g. too small
+		header.Add(varyHeaderKey, acceptEncodingHeaderKey)
+		if w.canCompress(header, streamed) {
+			w.startCompressor(header)
+		}
+	}
+
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	buffered := w.buffer
+	w.buffer = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	if w.compressor != nil {
+		_, err := w.compressor.Write(buffered)
+		return err
+	}
+	_, err := w.ResponseWriter.Write(buffered)
+	return err
+}
+
+func (w *compressWriter) canCompress(header http.Header, streamed bool) bool {
+	return (streamed || len(w.buffer) >= w.minSize) && header.Get(contentEncodingHeaderKey) == "" &&
+		w.statusCode != http.StatusNoContent && w.statusCode != http.StatusNotModified
+}
+
+func (w *compressWriter) startCompressor(header http.Header) {
+	header.Set(contentEncodingHeaderKey, w.encoding)
+	header.Del(contentLengthHeaderKey)
+	// the compressed bytes differ, strong ETags must not be shared with the uncompressed response
+	if etag := header.Get(etagHeaderKey); etag != "" && !strings.HasPrefix(etag, weakPrefix) {
+		header.Set(etagHeaderKey, weakPrefix+etag)
+	}
+
+	switch w.encoding {
+	case encodingBrotli:
+		w.compressor = brotliWriters.Get().(*brotli.Writer)
+	default:
+		w.compressor = gzipWriters.Get().(*gzip.Writer)
+	}
+	w.compressor.Reset(w.ResponseWriter)
+}
+
+// close sends what is left once the handler is done, the response is complete
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.statusCode == 0 {
+			// nothing sent by the handler, e.g. after hijacking the connection
+			return
+		}
+		if err := w.decide(false); err != nil {
+			logging.SugaredLog.Errorf("Error sending response: %s", err.Error())
+			return
+		}
+	}
+	if w.compressor == nil {
+		return
+	}
+
+	err := w.compressor.Close()
+	if err != nil {
+		logging.SugaredLog.Errorf("Error compressing response: %s", err.Error())
+	}
+	w.compressor.Reset(io.Discard)
+	switch compressor := w.compressor.(type) {
+	case *brotli.Writer:
+		brotliWriters.Put(compressor)
+	case *gzip.Writer:
+		gzipWriters.Put(compressor)
+	}
+	w.compressor = nil
+}
+
+// Flush sends the data written so far. Event streams flush right away, they are never compressed anyway.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.statusCode == 0 {
+			w.statusCode = http.StatusOK
+		}
+		if err := w.decide(true); err != nil {
+			return
+		}
+	}
+	if w.compressor != nil {
+		if err := w.compressor.Flush(); err != nil {
+			return
+		}
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack is used by WebSocket upgrades, which send their own response
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the original writer, e.g. to set deadlines
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isCompressible tells whether the media type of the response is worth compressing
+func isCompressible(header http.Header) bool {
+	mediaType, _, parseErr := mime.ParseMediaType(header.Get(contentTypeHeaderKey))
+	return parseErr == nil && compressibleMediaTypes[mediaType]
+}
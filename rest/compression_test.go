@@ -0,0 +1,131 @@
+package rest
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", encodingGzip},
+		{"gzip, deflate, br", encodingBrotli},
+		{"br;q=0.5, gzip", encodingGzip},
+		{"BR;Q=1, gzip;q=0.9", encodingBrotli},
+		{"*", encodingBrotli},
+		{"br;q=0, *", encodingGzip},
+		{"*;q=0.1, gzip;q=0.5", encodingGzip},
+		{"gzip;q=0", ""},
+		{"gzip;q=abc", ""},
+	}
+	for _, test := range tests {
+		if encoding := negotiateEncoding([]string{test.acceptEncoding}); encoding != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.acceptEncoding, test.expected, encoding)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	large := `["` + strings.Repeat("lamp ", 500) + `"]`
+	tests := []struct {
+		name             string
+		contentType      string
+		body             string
+		acceptEncoding   string
+		flush            bool
+		expectedEncoding string
+	}{
+		{"gzip", contentTypeApplicationJson, large, "gzip", false, encodingGzip},
+		{"brotli", contentTypeApplicationJson, large, "br, gzip", false, encodingBrotli},
+		{"not accepted", contentTypeApplicationJson, large, "", false, ""},
+		{"too small", contentTypeApplicationJson, `[]`, "gzip", false, ""},
+		{"small but streamed", contentTypeCsv, "id,name\n", "gzip", true, encodingGzip},
+		{"not compressible", "image/png", large, "gzip", false, ""},
+		{"event stream", contentTypeEventStream, large, "gzip", true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := withCompression(compressionMinSizeDefault)(http.HandlerFunc(
+				func(writer http.ResponseWriter, request *http.Request) {
+					writer.Header().Set(contentTypeHeaderKey, test.contentType)
+					writer.Header().Set(etagHeaderKey, `"1"`)
+					_, _ = writer.Write([]byte(test.body))
+					if test.flush {
+						_ = http.NewResponseController(writer).Flush()
+					}
+				}))
+			response := serveHandler(handler, http.MethodGet, productsEndpoint,
+				map[string]string{acceptEncodingHeaderKey: test.acceptEncoding})
+
+			if encoding := response.Header().Get(contentEncodingHeaderKey); encoding != test.expectedEncoding {
+				t.Fatalf("expected encoding %q, got %q", test.expectedEncoding, encoding)
+			}
+			var reader io.Reader = response.Body
+			switch test.expectedEncoding {
+			case encodingGzip:
+				gzipReader, gzipErr := gzip.NewReader(response.Body)
+				if gzipErr != nil {
+					t.Fatal(gzipErr)
+				}
+				reader = gzipReader
+			case encodingBrotli:
+				reader = brotli.NewReader(response.Body)
+			}
+			if body, readErr := io.ReadAll(reader); readErr != nil || string(body) != test.body {
+				t.Fatalf("expected body sent as written, got %d bytes (%v)", len(body), readErr)
+			}
+
+			expectedETag := `"1"`
+			if test.expectedEncoding != "" {
+				expectedETag = `W/"1"`
+			}
+			if etag := response.Header().Get(etagHeaderKey); etag != expectedETag {
+				t.Errorf("expected ETag %s, got %s", expectedETag, etag)
+			}
+		})
+	}
+}
+
+func TestCompressionKeepsStatus(t *testing.T) {
+	handler := withCompression(0)(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.WriteHeader(http.StatusNotModified)
+	}))
+	response := serveHandler(handler, http.MethodGet, productsEndpoint, map[string]string{acceptEncodingHeaderKey: "gzip"})
+	if response.Code != http.StatusNotModified || response.Body.Len() > 0 ||
+		response.Header().Get(contentEncodingHeaderKey) != "" {
+		t.Fatalf("expected empty 304 left uncompressed, got %d %v", response.Code, response.Header())
+	}
+}
+
+func TestCompressedProducts(t *testing.T) {
+	t.Setenv(compressionMinSizeEnvVar, "0")
+	server := newTestServer(t)
+	serve(server, http.MethodPost, productsEndpoint, nil, `{"name":"lamp","price":"1","currency":"EUR"}`)
+
+	response := serve(server, http.MethodGet, productsEndpoint+"/1", map[string]string{acceptEncodingHeaderKey: "gzip"}, "")
+	if response.Header().Get(contentEncodingHeaderKey) != encodingGzip ||
+		response.Header().Get(varyHeaderKey) != acceptEncodingHeaderKey {
+		t.Fatalf("expected product compressed, got %v", response.Header())
+	}
+
+	// the weak ETag received still matches, for reads and writes
+	etag := response.Header().Get(etagHeaderKey)
+	response = serve(server, http.MethodGet, productsEndpoint+"/1", map[string]string{ifNoneMatchHeaderKey: etag}, "")
+	if response.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for %s, got %d", etag, response.Code)
+	}
+	response = serve(server, http.MethodPut, productsEndpoint+"/1", map[string]string{ifMatchHeaderKey: etag},
+		`{"name":"desk","price":"1","currency":"EUR"}`)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected update with If-Match %s, got %d", etag, response.Code)
+	}
+}
@@ -1,22 +1,272 @@
 package rest
 
 import (
+	"net"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/bygui86/go-k8s-probes/logging"
 	"github.com/bygui86/go-k8s-probes/utils"
 )
 
 const (
-	restHostEnvVar = "PRODUCTS_REST_HOST"
-	restPortEnvVar = "PRODUCTS_REST_PORT"
+	restHostEnvVar                   = "PRODUCTS_REST_HOST"
+	restPortEnvVar                   = "PRODUCTS_REST_PORT"
+	defaultPageSizeEnvVar            = "PRODUCTS_DEFAULT_PAGE_SIZE"
+	maxPageSizeEnvVar                = "PRODUCTS_MAX_PAGE_SIZE"
+	importBatchSizeEnvVar            = "PRODUCTS_IMPORT_BATCH_SIZE"
+	idempotencyKeyTtlEnvVar          = "PRODUCTS_IDEMPOTENCY_KEY_TTL"          // in seconds
+	idempotencyKeyLeaseEnvVar        = "PRODUCTS_IDEMPOTENCY_KEY_LEASE"        // in seconds
+	idempotencyJanitorIntervalEnvVar = "PRODUCTS_IDEMPOTENCY_JANITOR_INTERVAL" // in seconds
+	eventsBacklogSizeEnvVar          = "PRODUCTS_EVENTS_BACKLOG_SIZE"
+	eventsHeartbeatIntervalEnvVar    = "PRODUCTS_EVENTS_HEARTBEAT_INTERVAL"   // in seconds
+	eventsWebSocketEnabledEnvVar     = "PRODUCTS_EVENTS_WEBSOCKET_ENABLED"    // bool
+	swaggerUiEnabledEnvVar           = "PRODUCTS_SWAGGER_UI_ENABLED"          // bool
+	responseValidationEnabledEnvVar  = "PRODUCTS_RESPONSE_VALIDATION_ENABLED" // bool, debug only as responses are buffered
+	accessLogEnabledEnvVar           = "PRODUCTS_ACCESS_LOG_ENABLED"          // bool
+	rateLimitEnabledEnvVar           = "PRODUCTS_RATE_LIMIT_ENABLED"          // bool
+	rateLimitRateEnvVar              = "PRODUCTS_RATE_LIMIT_RATE"             // requests per second, per client
+	rateLimitBurstEnvVar             = "PRODUCTS_RATE_LIMIT_BURST"
+	loadSheddingEnabledEnvVar        = "PRODUCTS_LOAD_SHEDDING_ENABLED" // bool
+	loadSheddingMaxInFlightEnvVar    = "PRODUCTS_LOAD_SHEDDING_MAX_IN_FLIGHT"
+	loadSheddingMaxDbWaitEnvVar      = "PRODUCTS_LOAD_SHEDDING_MAX_DB_WAIT" // in milliseconds
+	authEnabledEnvVar                = "PRODUCTS_AUTH_ENABLED"              // bool
+	authApiKeysFileEnvVar            = "PRODUCTS_AUTH_API_KEYS_FILE"
+	authJwksEnvVar                   = "PRODUCTS_AUTH_JWKS" // file path or URL
+	authJwtIssuerEnvVar              = "PRODUCTS_AUTH_JWT_ISSUER"
+	authJwtAudienceEnvVar            = "PRODUCTS_AUTH_JWT_AUDIENCE"
+	authJwtLeewayEnvVar              = "PRODUCTS_AUTH_JWT_LEEWAY"            // in seconds
+	authJwksRefreshIntervalEnvVar    = "PRODUCTS_AUTH_JWKS_REFRESH_INTERVAL" // in seconds
+	corsAllowedOriginsEnvVar         = "PRODUCTS_CORS_ALLOWED_ORIGINS"       // comma-separated, * for any, CORS disabled if empty
+	corsAllowCredentialsEnvVar       = "PRODUCTS_CORS_ALLOW_CREDENTIALS"     // bool
+	corsMaxAgeEnvVar                 = "PRODUCTS_CORS_MAX_AGE"               // in seconds
+	compressionEnabledEnvVar         = "PRODUCTS_COMPRESSION_ENABLED"        // bool
+	compressionMinSizeEnvVar         = "PRODUCTS_COMPRESSION_MIN_SIZE"       // in bytes
+	trustedProxiesEnvVar             = "PRODUCTS_TRUSTED_PROXIES"            // comma-separated IPs or CIDRs
 
-	restHostEnvVarDefault = "localhost"
-	restPortEnvVarDefault = 8080
+	restHostEnvVarDefault             = "localhost"
+	restPortEnvVarDefault             = 8080
+	defaultPageSizeDefault            = 10
+	maxPageSizeDefault                = 100
+	importBatchSizeDefault            = 500
+	idempotencyKeyTtlDefault          = 86400
+	idempotencyKeyLeaseDefault        = 60
+	idempotencyJanitorIntervalDefault = 600
+	eventsBacklogSizeDefault          = 1000
+	eventsHeartbeatIntervalDefault    = 15
+	eventsWebSocketEnabledDefault     = false
+	swaggerUiEnabledDefault           = false
+	responseValidationEnabledDefault  = false
+	accessLogEnabledDefault           = true
+	rateLimitEnabledDefault           = false
+	rateLimitRateDefault              = 10
+	rateLimitBurstDefault             = 20
+	loadSheddingEnabledDefault        = false
+	loadSheddingMaxInFlightDefault    = 100
+	loadSheddingMaxDbWaitDefault      = 200
+	authEnabledDefault                = false
+	authApiKeysFileDefault            = ""
+	authJwksDefault                   = ""
+	authJwtIssuerDefault              = ""
+	authJwtAudienceDefault            = ""
+	authJwtLeewayDefault              = 30
+	authJwksRefreshIntervalDefault    = 300
+	corsAllowCredentialsDefault       = false
+	corsMaxAgeDefault                 = 600
+	compressionEnabledDefault         = true
+	compressionMinSizeDefault         = 1024
 )
 
 func loadConfig() *config {
 	logging.Log.Debug("Load Products configurations")
+
+	maxPageSize := utils.GetIntEnv(maxPageSizeEnvVar, maxPageSizeDefault)
+	if maxPageSize < 1 {
+		logging.SugaredLog.Warnf("Max page size must be greater than 0, fallback to default %d",
+			maxPageSizeDefault)
+		maxPageSize = maxPageSizeDefault
+	}
+
+	defaultPageSize := utils.GetIntEnv(defaultPageSizeEnvVar, defaultPageSizeDefault)
+	if defaultPageSize < 1 || defaultPageSize > maxPageSize {
+		// the default may exceed a custom max page size
+		fallback := defaultPageSizeDefault
+		if fallback > maxPageSize {
+			fallback = maxPageSize
+		}
+		logging.SugaredLog.Warnf("Default page size must be between 1 and max page size %d, fallback to %d",
+			maxPageSize, fallback)
+		defaultPageSize = fallback
+	}
+
+	importBatchSize := utils.GetIntEnv(importBatchSizeEnvVar, importBatchSizeDefault)
+	if importBatchSize < 1 {
+		logging.SugaredLog.Warnf("Import batch size must be greater than 0, fallback to default %d",
+			importBatchSizeDefault)
+		importBatchSize = importBatchSizeDefault
+	}
+
+	idempotencyKeyTtl := utils.GetIntEnv(idempotencyKeyTtlEnvVar, idempotencyKeyTtlDefault)
+	if idempotencyKeyTtl < 1 {
+		logging.SugaredLog.Warnf("Idempotency key TTL must be greater than 0, fallback to default %d",
+			idempotencyKeyTtlDefault)
+		idempotencyKeyTtl = idempotencyKeyTtlDefault
+	}
+
+	idempotencyKeyLease := utils.GetIntEnv(idempotencyKeyLeaseEnvVar, idempotencyKeyLeaseDefault)
+	if idempotencyKeyLease < 1 {
+		logging.SugaredLog.Warnf("Idempotency key lease must be greater than 0, fallback to default %d",
+			idempotencyKeyLeaseDefault)
+		idempotencyKeyLease = idempotencyKeyLeaseDefault
+	}
+
+	idempotencyJanitorInterval := utils.GetIntEnv(idempotencyJanitorIntervalEnvVar, idempotencyJanitorIntervalDefault)
+	if idempotencyJanitorInterval < 1 {
+		logging.SugaredLog.Warnf("Idempotency janitor interval must be greater than 0, fallback to default %d",
+			idempotencyJanitorIntervalDefault)
+		idempotencyJanitorInterval = idempotencyJanitorIntervalDefault
+	}
+
+	eventsBacklogSize := utils.GetIntEnv(eventsBacklogSizeEnvVar, eventsBacklogSizeDefault)
+	if eventsBacklogSize < 1 {
+		logging.SugaredLog.Warnf("Events backlog size must be greater than 0, fallback to default %d",
+			eventsBacklogSizeDefault)
+		eventsBacklogSize = eventsBacklogSizeDefault
+	}
+
+	eventsHeartbeatInterval := utils.GetIntEnv(eventsHeartbeatIntervalEnvVar, eventsHeartbeatIntervalDefault)
+	if eventsHeartbeatInterval < 1 {
+		logging.SugaredLog.Warnf("Events heartbeat interval must be greater than 0, fallback to default %d",
+			eventsHeartbeatIntervalDefault)
+		eventsHeartbeatInterval = eventsHeartbeatIntervalDefault
+	}
+
+	rateLimitRate := utils.GetIntEnv(rateLimitRateEnvVar, rateLimitRateDefault)
+	if rateLimitRate < 1 {
+		logging.SugaredLog.Warnf("Rate limit rate must be greater than 0, fallback to default %d",
+			rateLimitRateDefault)
+		rateLimitRate = rateLimitRateDefault
+	}
+
+	rateLimitBurst := utils.GetIntEnv(rateLimitBurstEnvVar, rateLimitBurstDefault)
+	if rateLimitBurst < 1 {
+		logging.SugaredLog.Warnf("Rate limit burst must be greater than 0, fallback to default %d",
+			rateLimitBurstDefault)
+		rateLimitBurst = rateLimitBurstDefault
+	}
+
+	loadSheddingMaxInFlight := utils.GetIntEnv(loadSheddingMaxInFlightEnvVar, loadSheddingMaxInFlightDefault)
+	if loadSheddingMaxInFlight < 1 {
+		logging.SugaredLog.Warnf("Load shedding max in flight must be greater than 0, fallback to default %d",
+			loadSheddingMaxInFlightDefault)
+		loadSheddingMaxInFlight = loadSheddingMaxInFlightDefault
+	}
+
+	loadSheddingMaxDbWait := utils.GetIntEnv(loadSheddingMaxDbWaitEnvVar, loadSheddingMaxDbWaitDefault)
+	if loadSheddingMaxDbWait < 1 {
+		logging.SugaredLog.Warnf("Load shedding max DB wait must be greater than 0, fallback to default %d",
+			loadSheddingMaxDbWaitDefault)
+		loadSheddingMaxDbWait = loadSheddingMaxDbWaitDefault
+	}
+
+	authJwtLeeway := utils.GetIntEnv(authJwtLeewayEnvVar, authJwtLeewayDefault)
+	if authJwtLeeway < 0 {
+		logging.SugaredLog.Warnf("JWT leeway must not be negative, fallback to default %d",
+			authJwtLeewayDefault)
+		authJwtLeeway = authJwtLeewayDefault
+	}
+
+	authJwksRefreshInterval := utils.GetIntEnv(authJwksRefreshIntervalEnvVar, authJwksRefreshIntervalDefault)
+	if authJwksRefreshInterval < 1 {
+		logging.SugaredLog.Warnf("JWKS refresh interval must be greater than 0, fallback to default %d",
+			authJwksRefreshIntervalDefault)
+		authJwksRefreshInterval = authJwksRefreshIntervalDefault
+	}
+
+	corsAllowedOrigins := utils.GetStringSliceEnv(corsAllowedOriginsEnvVar, []string{})
+	corsAllowCredentials := utils.GetBoolEnv(corsAllowCredentialsEnvVar, corsAllowCredentialsDefault)
+	if corsAllowCredentials && slices.Contains(corsAllowedOrigins, anyOrigin) {
+		logging.SugaredLog.Warn("CORS credentials can't be allowed to any origin, fallback to credentials not allowed")
+		corsAllowCredentials = false
+	}
+
+	corsMaxAge := utils.GetIntEnv(corsMaxAgeEnvVar, corsMaxAgeDefault)
+	if corsMaxAge < 0 {
+		logging.SugaredLog.Warnf("CORS max age must not be negative, fallback to default %d",
+			corsMaxAgeDefault)
+		corsMaxAge = corsMaxAgeDefault
+	}
+
+	compressionMinSize := utils.GetIntEnv(compressionMinSizeEnvVar, compressionMinSizeDefault)
+	if compressionMinSize < 0 {
+		logging.SugaredLog.Warnf("Compression min size must not be negative, fallback to default %d",
+			compressionMinSizeDefault)
+		compressionMinSize = compressionMinSizeDefault
+	}
+
+	trustedProxies := make([]*net.IPNet, 0)
+	for _, proxy := range utils.GetStringSliceEnv(trustedProxiesEnvVar, []string{}) {
+		trustedProxy, proxyErr := parseTrustedProxy(proxy)
+		if proxyErr != nil {
+			logging.SugaredLog.Warnf("Trusted proxy %q must be an IP or a CIDR, ignored", proxy)
+			continue
+		}
+		trustedProxies = append(trustedProxies, trustedProxy)
+	}
+
 	return &config{
-		restHost: utils.GetStringEnv(restHostEnvVar, restHostEnvVarDefault),
-		restPort: utils.GetIntEnv(restPortEnvVar, restPortEnvVarDefault),
+		restHost:                   utils.GetStringEnv(restHostEnvVar, restHostEnvVarDefault),
+		restPort:                   utils.GetIntEnv(restPortEnvVar, restPortEnvVarDefault),
+		defaultPageSize:            defaultPageSize,
+		maxPageSize:                maxPageSize,
+		importBatchSize:            importBatchSize,
+		idempotencyKeyTtl:          time.Duration(idempotencyKeyTtl) * time.Second,
+		idempotencyKeyLease:        time.Duration(idempotencyKeyLease) * time.Second,
+		idempotencyJanitorInterval: time.Duration(idempotencyJanitorInterval) * time.Second,
+		eventsBacklogSize:          eventsBacklogSize,
+		eventsHeartbeatInterval:    time.Duration(eventsHeartbeatInterval) * time.Second,
+		eventsWebSocketEnabled:     utils.GetBoolEnv(eventsWebSocketEnabledEnvVar, eventsWebSocketEnabledDefault),
+		swaggerUiEnabled:           utils.GetBoolEnv(swaggerUiEnabledEnvVar, swaggerUiEnabledDefault),
+		responseValidationEnabled: utils.GetBoolEnv(responseValidationEnabledEnvVar,
+			responseValidationEnabledDefault),
+		accessLogEnabled:        utils.GetBoolEnv(accessLogEnabledEnvVar, accessLogEnabledDefault),
+		rateLimitEnabled:        utils.GetBoolEnv(rateLimitEnabledEnvVar, rateLimitEnabledDefault),
+		rateLimitRate:           rateLimitRate,
+		rateLimitBurst:          rateLimitBurst,
+		loadSheddingEnabled:     utils.GetBoolEnv(loadSheddingEnabledEnvVar, loadSheddingEnabledDefault),
+		loadSheddingMaxInFlight: loadSheddingMaxInFlight,
+		loadSheddingMaxDbWait:   time.Duration(loadSheddingMaxDbWait) * time.Millisecond,
+		authEnabled:             utils.GetBoolEnv(authEnabledEnvVar, authEnabledDefault),
+		authApiKeysFile:         utils.GetStringEnv(authApiKeysFileEnvVar, authApiKeysFileDefault),
+		authJwks:                utils.GetStringEnv(authJwksEnvVar, authJwksDefault),
+		authJwtIssuer:           utils.GetStringEnv(authJwtIssuerEnvVar, authJwtIssuerDefault),
+		authJwtAudience:         utils.GetStringEnv(authJwtAudienceEnvVar, authJwtAudienceDefault),
+		authJwtLeeway:           time.Duration(authJwtLeeway) * time.Second,
+		authJwksRefreshInterval: time.Duration(authJwksRefreshInterval) * time.Second,
+		corsAllowedOrigins:      corsAllowedOrigins,
+		corsAllowCredentials:    corsAllowCredentials,
+		corsMaxAge:              time.Duration(corsMaxAge) * time.Second,
+		compressionEnabled:      utils.GetBoolEnv(compressionEnabledEnvVar, compressionEnabledDefault),
+		compressionMinSize:      compressionMinSize,
+		trustedProxies:          trustedProxies,
+	}
+}
+
+// parseTrustedProxy parses a CIDR, or an IP as a network of its own
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if !strings.Contains(proxy, "/") {
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: proxy}
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
 	}
+	_, network, parseErr := net.ParseCIDR(proxy)
+	return network, parseErr
 }
@@ -0,0 +1,134 @@
+package rest
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	originHeaderKey                     = "Origin"
+	allowHeaderKey                      = "Allow"
+	accessControlAllowOriginKey         = "Access-Control-Allow-Origin"
+	accessControlAllowCredentialsKey    = "Access-Control-Allow-Credentials"
+	accessControlAllowMethodsKey        = "Access-Control-Allow-Methods"
+	accessControlAllowHeadersKey        = "Access-Control-Allow-Headers"
+	accessControlExposeHeadersKey       = "Access-Control-Expose-Headers"
+	accessControlMaxAgeKey              = "Access-Control-Max-Age"
+	accessControlRequestMethodHeaderKey = "Access-Control-Request-Method"
+
+	anyOrigin = "*"
+)
+
+var (
+	// request headers of the API, allowed to browsers
+	corsAllowedHeaders = strings.Join([]string{
+		authorizationHeaderKey, apiKeyHeaderKey, contentTypeHeaderKey, ifMatchHeaderKey, ifNoneMatchHeaderKey,
+		ifModifiedSinceHeaderKey, idempotencyKeyHeaderKey, readYourWritesHeaderKey, requestIdHeaderKey,
+		lastEventIdHeaderKey,
+	}, ", ")
+
+	// response headers of the API, browsers expose only a few safe ones to scripts otherwise
+	corsExposedHeaders = strings.Join([]string{
+		etagHeaderKey, lastModifiedHeaderKey, linkHeaderKey, locationHeaderKey, totalCountHeaderKey,
+		idempotentReplayedHeaderKey, requestIdHeaderKey, retryAfterHeaderKey, rateLimitLimitHeaderKey,
+		rateLimitRemainingHeaderKey, rateLimitResetHeaderKey, wwwAuthenticateHeaderKey, acceptPatchHeaderKey,
+	}, ", ")
+)
+
+// withCors lets the browsers of the origins allowed read the responses, errors included.
+// Preflight requests are answered by the router, see setupPreflightRoutes.
+func (s *Server) withCors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		origin := request.Header.Get(originHeaderKey)
+		if origin != "" && s.isAllowedOrigin(origin) {
+			header := writer.Header()
+			if slices.Contains(s.config.corsAllowedOrigins, anyOrigin) {
+				header.Set(accessControlAllowOriginKey, anyOrigin)
+			} else {
+				header.Set(accessControlAllowOriginKey, origin)
+				header.Add(varyHeaderKey, originHeaderKey)
+			}
+			if s.config.corsAllowCredentials {
+				header.Set(accessControlAllowCredentialsKey, "true")
+			}
+			header.Set(accessControlExposeHeadersKey, corsExposedHeaders)
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func (s *Server) isAllowedOrigin(origin string) bool {
+	for _, allowed := range s.config.corsAllowedOrigins {
+		if allowed == anyOrigin || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// setupPreflightRoutes routes OPTIONS on every path to the methods routed on it, for the preflight requests of
+// browsers. Routes must be registered already.
+func (s *Server) setupPreflightRoutes() {
+	paths := make([]string, 0)
+	methods := make(map[string][]string)
+	walkErr := s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, templateErr := route.GetPathTemplate()
+		if templateErr != nil {
+			return templateErr
+		}
+		routeMethods, methodsErr := route.GetMethods()
+		if methodsErr != nil {
+			return methodsErr
+		}
+		if _, found := methods[template]; !found {
+			paths = append(paths, template)
+		}
+		methods[template] = append(methods[template], routeMethods...)
+		return nil
+	})
+	if walkErr != nil {
+		logging.SugaredLog.Errorf("Preflight routes setup failed: %s", walkErr.Error())
+		return
+	}
+
+	for _, path := range paths {
+		s.router.HandleFunc(path, s.preflight(append(methods[path], http.MethodOptions))).Methods(http.MethodOptions)
+	}
+}
+
+// preflight answers OPTIONS with the methods allowed, to browsers only if the origin and the method are allowed
+func (s *Server) preflight(methods []string) http.HandlerFunc {
+	allowed := strings.Join(methods, ", ")
+	return func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set(allowHeaderKey, allowed)
+
+		origin := request.Header.Get(originHeaderKey)
+		method := request.Header.Get(accessControlRequestMethodHeaderKey)
+		if origin == "" || method == "" {
+			// not a preflight
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !s.isAllowedOrigin(origin) || !slices.Contains(methods, method) {
+			logging.SugaredLog.Debugf("CORS preflight of %s %s from %s rejected", method, request.URL.Path, origin)
+			sendProblem(writer, &problem{
+				Type:   problemTypeDefault,
+				Title:  http.StatusText(http.StatusForbidden),
+				Status: http.StatusForbidden,
+				Detail: "Cross-origin request not allowed",
+			})
+			return
+		}
+
+		writer.Header().Set(accessControlAllowMethodsKey, allowed)
+		writer.Header().Set(accessControlAllowHeadersKey, corsAllowedHeaders)
+		writer.Header().Set(accessControlMaxAgeKey, strconv.Itoa(int(s.config.corsMaxAge.Seconds())))
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,101 @@
+package rest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const allowedOrigin = "https://app.test"
+
+func TestCorsResponses(t *testing.T) {
+	t.Setenv(corsAllowedOriginsEnvVar, allowedOrigin)
+	server := newTestServer(t)
+
+	response := serve(server, http.MethodGet, productsEndpoint, map[string]string{originHeaderKey: allowedOrigin}, "")
+	if response.Header().Get(accessControlAllowOriginKey) != allowedOrigin ||
+		!strings.Contains(strings.Join(response.Header().Values(varyHeaderKey), ","), originHeaderKey) ||
+		!strings.Contains(response.Header().Get(accessControlExposeHeadersKey), etagHeaderKey) {
+		t.Fatalf("expected CORS headers for %s, got %v", allowedOrigin, response.Header())
+	}
+	if response.Header().Get(accessControlAllowCredentialsKey) != "" {
+		t.Fatalf("expected no credentials allowed, got %v", response.Header())
+	}
+
+	response = serve(server, http.MethodGet, productsEndpoint, map[string]string{originHeaderKey: "https://evil.test"}, "")
+	if response.Header().Get(accessControlAllowOriginKey) != "" {
+		t.Fatalf("expected no CORS headers for other origins, got %v", response.Header())
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	t.Setenv(corsAllowedOriginsEnvVar, allowedOrigin)
+	t.Setenv(corsMaxAgeEnvVar, "60")
+	server := newTestServer(t)
+
+	tests := []struct {
+		name         string
+		origin       string
+		method       string
+		expectedCode int
+	}{
+		{"allowed", allowedOrigin, http.MethodPut, http.StatusNoContent},
+		{"method not routed", allowedOrigin, http.MethodTrace, http.StatusForbidden},
+		{"origin not allowed", "https://evil.test", http.MethodPut, http.StatusForbidden},
+		{"not a preflight", "", "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if test.origin != "" {
+				headers[originHeaderKey] = test.origin
+				headers[accessControlRequestMethodHeaderKey] = test.method
+			}
+			response := serve(server, http.MethodOptions, productsEndpoint+"/1", headers, "")
+			if response.Code != test.expectedCode {
+				t.Fatalf("expected %d, got %d", test.expectedCode, response.Code)
+			}
+			if !strings.Contains(response.Header().Get(allowHeaderKey), http.MethodPut) {
+				t.Fatalf("expected methods of the path allowed, got %v", response.Header())
+			}
+			preflighted := test.origin != "" && response.Code == http.StatusNoContent
+			if preflighted != (response.Header().Get(accessControlMaxAgeKey) == "60") ||
+				preflighted != strings.Contains(response.Header().Get(accessControlAllowHeadersKey), ifMatchHeaderKey) {
+				t.Fatalf("unexpected preflight headers %v", response.Header())
+			}
+		})
+	}
+}
+
+func TestCorsWithAuthentication(t *testing.T) {
+	t.Setenv(corsAllowedOriginsEnvVar, allowedOrigin)
+	server := newAuthServer(t, writeJwks(t, newSigningKey(t)))
+
+	// preflights carry no credentials
+	response := serve(server, http.MethodOptions, productsEndpoint, map[string]string{
+		originHeaderKey: allowedOrigin, accessControlRequestMethodHeaderKey: http.MethodPost}, "")
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("expected preflight allowed, got %d", response.Code)
+	}
+
+	// errors must be readable by the browser too
+	response = serve(server, http.MethodGet, productsEndpoint, map[string]string{originHeaderKey: allowedOrigin}, "")
+	if response.Code != http.StatusUnauthorized || response.Header().Get(accessControlAllowOriginKey) != allowedOrigin {
+		t.Fatalf("expected 401 with CORS headers, got %d %v", response.Code, response.Header())
+	}
+}
+
+func TestCorsAnyOrigin(t *testing.T) {
+	t.Setenv(corsAllowedOriginsEnvVar, anyOrigin)
+	t.Setenv(corsAllowCredentialsEnvVar, "true")
+	server := newTestServer(t)
+	if server.config.corsAllowCredentials {
+		t.Fatal("expected credentials not allowed along with any origin")
+	}
+
+	response := serve(server, http.MethodGet, productsEndpoint, map[string]string{originHeaderKey: allowedOrigin}, "")
+	if response.Header().Get(accessControlAllowOriginKey) != anyOrigin ||
+		response.Header().Get(accessControlAllowCredentialsKey) != "" {
+		t.Fatalf("expected any origin allowed without credentials, got %v", response.Header())
+	}
+}
@@ -0,0 +1,397 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bygui86/go-k8s-probes/commons"
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	eventsEndpoint = productsEndpoint + "/events"
+
+	contentTypeEventStream = "text/event-stream"
+	cacheControlHeaderKey  = "Cache-Control"
+	lastEventIdHeaderKey   = "Last-Event-ID"
+	// for clients unable to set headers, e.g. browsers WebSocket
+	lastEventIdParam = "lastEventId"
+
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventDeleted  = "deleted"
+	EventRestored = "restored"
+	// the events since Last-Event-ID are not in the backlog anymore, products must be fetched again
+	EventReset = "reset"
+
+	eventIdSeparator = "-"
+	// events buffered per subscriber, a subscriber falling further behind is dropped
+	subscriberBufferSize = 64
+	// EventSource reconnection delay
+	sseRetryMillis = 3000
+
+	transportSse       = "sse"
+	transportWebSocket = "websocket"
+)
+
+var errEventsClosed = errors.New("events stream closed")
+
+// ProductEvent notifies a change of a product, deletions carry the product ID only
+type ProductEvent struct {
+	ID        string            `json:"id,omitempty"`
+	Type      string            `json:"type"`
+	ProductID int               `json:"productId,omitempty"`
+	Product   *database.Product `json:"product,omitempty"`
+
+	seq uint64
+}
+
+// eventBroker fans out product events to the subscribers, keeping the latest in a backlog for them to resume.
+// Event IDs are made of an epoch, changing at every start, and a sequence number.
+type eventBroker struct {
+	mutex       sync.Mutex
+	epoch       string
+	lastSeq     uint64
+	backlog     []*ProductEvent
+	backlogSize int
+	subscribers map[*eventSubscriber]struct{}
+	closed      bool
+}
+
+type eventSubscriber struct {
+	events chan *ProductEvent
+	// closed when the subscriber is dropped or the broker closed
+	done chan struct{}
+}
+
+func newEventBroker(backlogSize int) *eventBroker {
+	return &eventBroker{
+		epoch:       strconv.FormatInt(time.Now().UnixMilli(), 36),
+		backlog:     make([]*ProductEvent, 0, backlogSize),
+		backlogSize: backlogSize,
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+// publish never blocks, subscribers not keeping up are dropped and have to resume from the backlog
+func (b *eventBroker) publish(eventType string, productId int, product *database.Product) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.lastSeq++
+	event := &ProductEvent{
+		ID:        b.epoch + eventIdSeparator + strconv.FormatUint(b.lastSeq, 10),
+		Type:      eventType,
+		ProductID: productId,
+		seq:       b.lastSeq,
+	}
+	if product != nil {
+		productCopy := *product
+		event.Product = &productCopy
+	}
+
+	if len(b.backlog) == b.backlogSize {
+		b.backlog = b.backlog[1:]
+	}
+	b.backlog = append(b.backlog, event)
+
+	for sub := range b.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			logging.Log.Warn("Product events subscriber too slow, dropped")
+			b.drop(sub)
+		}
+	}
+}
+
+// subscribe registers a new subscriber, returning the events since lastEventId to replay first.
+// Resumable is false if those events are not available anymore.
+func (b *eventBroker) subscribe(lastEventId string) (sub *eventSubscriber, replay []*ProductEvent, resumable bool, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, nil, false, errEventsClosed
+	}
+
+	sub = &eventSubscriber{
+		events: make(chan *ProductEvent, subscriberBufferSize),
+		done:   make(chan struct{}),
+	}
+	b.subscribers[sub] = struct{}{}
+
+	if lastEventId == "" {
+		return sub, nil, true, nil
+	}
+	seq, ok := b.parseEventId(lastEventId)
+	oldestSeq := b.lastSeq + 1
+	if len(b.backlog) > 0 {
+		oldestSeq = b.backlog[0].seq
+	}
+	// resumable if the oldest event in the backlog is the one right after the last received, or an older one
+	if !ok || seq > b.lastSeq || seq+1 < oldestSeq {
+		return sub, nil, false, nil
+	}
+	for _, event := range b.backlog {
+		if event.seq > seq {
+			replay = append(replay, event)
+		}
+	}
+	return sub, replay, true, nil
+}
+
+// parseEventId returns the sequence number of an event ID issued since the last start
+func (b *eventBroker) parseEventId(eventId string) (uint64, bool) {
+	epoch, seqValue, found := strings.Cut(eventId, eventIdSeparator)
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(seqValue, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+func (b *eventBroker) unsubscribe(sub *eventSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.drop(sub)
+}
+
+// drop must be invoked holding the lock
+func (b *eventBroker) drop(sub *eventSubscriber) {
+	if _, found := b.subscribers[sub]; found {
+		delete(b.subscribers, sub)
+		close(sub.done)
+	}
+}
+
+// close ends all the subscriptions, to be invoked before shutting down the HTTP server not to wait for them
+func (b *eventBroker) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	for sub := range b.subscribers {
+		b.drop(sub)
+	}
+}
+
+// streamProductEvents sends the product events as Server-Sent Events, or over WebSocket if enabled and requested
+func (s *Server) streamProductEvents(writer http.ResponseWriter, request *http.Request) {
+	if s.config.eventsWebSocketEnabled && websocket.IsWebSocketUpgrade(request) {
+		s.streamProductEventsWebSocket(writer, request)
+		return
+	}
+
+	span, _ := retrieveSpanAndCtx(request, "stream-product-events-handler")
+	defer span.Finish()
+
+	span.SetTag("transport", transportSse)
+
+	sub, replay, resumable, subErr := s.events.subscribe(lastEventId(request))
+	if subErr != nil {
+		errMsg := "Stream product events failed: " + subErr.Error()
+		sendErrorResponse(writer, span, http.StatusServiceUnavailable, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+	defer s.events.unsubscribe(sub)
+
+	logging.Log.Info("Stream product events")
+	eventSubscribers.WithLabelValues(transportSse).Inc()
+	defer eventSubscribers.WithLabelValues(transportSse).Dec()
+
+	writer.Header().Set(contentTypeHeaderKey, contentTypeEventStream)
+	writer.Header().Set(cacheControlHeaderKey, "no-cache")
+	writer.WriteHeader(http.StatusOK)
+
+	stream := &sseStream{writer: writer, controller: http.NewResponseController(writer)}
+	stream.write(fmt.Sprintf("retry: %d\n\n", sseRetryMillis))
+	if !resumable {
+		stream.writeEvent(&ProductEvent{Type: EventReset})
+	}
+	for _, event := range replay {
+		stream.writeEvent(event)
+	}
+	stream.flush()
+
+	heartbeat := time.NewTicker(s.config.eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for stream.err == nil {
+		select {
+		case event := <-sub.events:
+			stream.writeEvent(event)
+		case <-heartbeat.C:
+			// comment line, ignored by clients but keeping proxies from closing the idle connection
+			stream.write(": heartbeat\n\n")
+		case <-sub.done:
+			return
+		case <-request.Context().Done():
+			return
+		}
+		stream.flush()
+	}
+
+	span.SetTag("error", stream.err.Error())
+	span.LogKV("error", stream.err.Error())
+}
+
+// sseStream writes events in the text/event-stream format, stopping at the first error
+type sseStream struct {
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	err        error
+}
+
+func (s *sseStream) writeEvent(event *ProductEvent) {
+	data, _ := json.Marshal(event)
+	if event.ID == "" {
+		s.write(fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, data))
+		return
+	}
+	s.write(fmt.Sprintf("id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data))
+}
+
+func (s *sseStream) write(message string) {
+	if s.err != nil {
+		return
+	}
+	// the server write timeout applies to the whole response, it's extended at every write instead
+	s.err = s.controller.SetWriteDeadline(time.Now().Add(commons.HttpServerWriteTimeoutDefault))
+	if s.err != nil {
+		return
+	}
+	_, s.err = s.writer.Write([]byte(message))
+}
+
+func (s *sseStream) flush() {
+	if s.err != nil {
+		return
+	}
+	s.err = s.controller.Flush()
+}
+
+// streamProductEventsWebSocket sends the product events as JSON text messages, pinging the client meanwhile
+func (s *Server) streamProductEventsWebSocket(writer http.ResponseWriter, request *http.Request) {
+	span, _ := retrieveSpanAndCtx(request, "stream-product-events-handler")
+	defer span.Finish()
+
+	span.SetTag("transport", transportWebSocket)
+
+	sub, replay, resumable, subErr := s.events.subscribe(lastEventId(request))
+	if subErr != nil {
+		errMsg := "Stream product events failed: " + subErr.Error()
+		sendErrorResponse(writer, span, http.StatusServiceUnavailable, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+	defer s.events.unsubscribe(sub)
+
+	// the upgrader replies on its own on failure
+	conn, upgradeErr := s.wsUpgrader.Upgrade(writer, request, nil)
+	if upgradeErr != nil {
+		span.SetTag("error", upgradeErr.Error())
+		span.LogKV("error", upgradeErr.Error())
+		return
+	}
+	defer conn.Close()
+
+	logging.Log.Info("Stream product events over WebSocket")
+	eventSubscribers.WithLabelValues(transportWebSocket).Inc()
+	defer eventSubscribers.WithLabelValues(transportWebSocket).Dec()
+
+	// messages from the client are not expected, reading is needed to process control frames though
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	var writeErr error
+	send := func(event *ProductEvent) {
+		if writeErr != nil {
+			return
+		}
+		writeErr = conn.SetWriteDeadline(time.Now().Add(commons.HttpServerWriteTimeoutDefault))
+		if writeErr == nil {
+			writeErr = conn.WriteJSON(event)
+		}
+	}
+	if !resumable {
+		send(&ProductEvent{Type: EventReset})
+	}
+	for _, event := range replay {
+		send(event)
+	}
+
+	heartbeat := time.NewTicker(s.config.eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for writeErr == nil {
+		select {
+		case event := <-sub.events:
+			send(event)
+		case <-heartbeat.C:
+			writeErr = conn.WriteControl(websocket.PingMessage, nil,
+				time.Now().Add(commons.HttpServerWriteTimeoutDefault))
+		case <-sub.done:
+			// shutting down or too slow, the client is expected to reconnect
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, ""),
+				time.Now().Add(commons.HttpServerWriteTimeoutDefault))
+			return
+		case <-closed:
+			return
+		}
+	}
+
+	span.SetTag("error", writeErr.Error())
+	span.LogKV("error", writeErr.Error())
+}
+
+// checkWebSocketOrigin accepts the upgrades of clients other than browsers, of pages served along with the API and
+// of the origins allowed by CORS. Browsers don't apply CORS to WebSocket, yet send their cookies along.
+func (s *Server) checkWebSocketOrigin(request *http.Request) bool {
+	origin := request.Header.Get(originHeaderKey)
+	if origin == "" {
+		return true
+	}
+	originUrl, parseErr := url.Parse(origin)
+	if parseErr == nil && strings.EqualFold(originUrl.Host, request.Host) {
+		return true
+	}
+	return s.isAllowedOrigin(origin)
+}
+
+func lastEventId(request *http.Request) string {
+	if value := request.Header.Get(lastEventIdHeaderKey); value != "" {
+		return value
+	}
+	return request.URL.Query().Get(lastEventIdParam)
+}
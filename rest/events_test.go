@@ -0,0 +1,209 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEventsReplay(t *testing.T) {
+	broker := newEventBroker(10)
+	for productId := 1; productId <= 3; productId++ {
+		broker.publish(EventCreated, productId, nil)
+	}
+	first := broker.backlog[0]
+
+	_, replay, resumable, err := broker.subscribe(first.ID)
+	if err != nil || !resumable {
+		t.Fatalf("expected subscription resumed, got resumable %v (%v)", resumable, err)
+	}
+	if len(replay) != 2 || replay[0].ProductID != 2 || replay[1].ProductID != 3 {
+		t.Fatalf("expected the events after %s replayed, got %v", first.ID, replay)
+	}
+}
+
+func TestEventsReset(t *testing.T) {
+	broker := newEventBroker(3)
+	for productId := 1; productId <= 5; productId++ {
+		broker.publish(EventCreated, productId, nil)
+	}
+	// events 3 to 5 kept in the backlog
+
+	tests := []struct {
+		name              string
+		lastEventId       string
+		expectedResumable bool
+		expectedReplay    int
+	}{
+		{"last event", broker.epoch + "-5", true, 0},
+		{"right before the backlog", broker.epoch + "-2", true, 3},
+		{"left the backlog", broker.epoch + "-1", false, 0},
+		{"unknown epoch", "previous-4", false, 0},
+		{"not issued yet", broker.epoch + "-6", false, 0},
+		{"malformed", "5", false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, replay, resumable, err := broker.subscribe(test.lastEventId)
+			if err != nil || resumable != test.expectedResumable || len(replay) != test.expectedReplay {
+				t.Fatalf("expected resumable %v with %d events, got %v with %d (%v)",
+					test.expectedResumable, test.expectedReplay, resumable, len(replay), err)
+			}
+		})
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	broker := newEventBroker(10)
+	slow, _, _, _ := broker.subscribe("")
+
+	for productId := 1; productId <= subscriberBufferSize; productId++ {
+		broker.publish(EventCreated, productId, nil)
+	}
+	select {
+	case <-slow.done:
+		t.Fatal("expected subscriber kept while its buffer is not full")
+	default:
+	}
+
+	broker.publish(EventCreated, subscriberBufferSize+1, nil)
+	select {
+	case <-slow.done:
+	default:
+		t.Fatal("expected subscriber dropped once its buffer is full")
+	}
+	if len(broker.subscribers) != 0 {
+		t.Fatalf("expected no subscribers left, got %d", len(broker.subscribers))
+	}
+}
+
+func TestEventStreamsClosed(t *testing.T) {
+	t.Setenv(eventsWebSocketEnabledEnvVar, "true")
+	server := newTestServer(t)
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	defer httpServer.Close()
+
+	sse := mustStreamEvents(t, httpServer.URL)
+	defer sse.Body.Close()
+	ws := mustDialEvents(t, httpServer.URL)
+	defer ws.Close()
+
+	server.events.close()
+
+	// the SSE stream ends after the lines sent so far
+	if _, err := io.ReadAll(sse.Body); err != nil {
+		t.Fatalf("expected SSE stream ended, got %s", err.Error())
+	}
+	_, _, readErr := ws.ReadMessage()
+	if !websocket.IsCloseError(readErr, websocket.CloseGoingAway) {
+		t.Fatalf("expected WebSocket closed going away, got %v", readErr)
+	}
+	if _, _, _, subErr := server.events.subscribe(""); !errors.Is(subErr, errEventsClosed) {
+		t.Fatalf("expected no more subscriptions, got %v", subErr)
+	}
+}
+
+func TestEventStreamsHeartbeat(t *testing.T) {
+	t.Setenv(eventsWebSocketEnabledEnvVar, "true")
+	server := newTestServer(t)
+	server.config.eventsHeartbeatInterval = 50 * time.Millisecond
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	defer httpServer.Close()
+
+	sse := mustStreamEvents(t, httpServer.URL)
+	defer sse.Body.Close()
+	reader := bufio.NewReader(sse.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected SSE heartbeat, got %s", err.Error())
+		}
+		if line == ": heartbeat\n" {
+			break
+		}
+	}
+
+	ws := mustDialEvents(t, httpServer.URL)
+	defer ws.Close()
+	pinged := make(chan struct{})
+	ws.SetPingHandler(func(string) error {
+		close(pinged)
+		return errors.New("pinged")
+	})
+	go func() { _, _, _ = ws.ReadMessage() }()
+	select {
+	case <-pinged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected WebSocket ping")
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	t.Setenv(eventsWebSocketEnabledEnvVar, "true")
+	t.Setenv(corsAllowedOriginsEnvVar, "https://shop.example")
+	httpServer := httptest.NewServer(newTestServer(t).httpServer.Handler)
+	defer httpServer.Close()
+
+	tests := []struct {
+		name         string
+		origin       string
+		expectedCode int
+	}{
+		{"not a browser", "", http.StatusSwitchingProtocols},
+		{"same host", httpServer.URL, http.StatusSwitchingProtocols},
+		{"allowed origin", "https://shop.example", http.StatusSwitchingProtocols},
+		{"other origin", "https://evil.example", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.origin != "" {
+				header.Set(originHeaderKey, test.origin)
+			}
+			conn, response, _ := websocket.DefaultDialer.Dial(wsUrl(httpServer.URL), header)
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if response == nil || response.StatusCode != test.expectedCode {
+				t.Fatalf("expected %d, got %v", test.expectedCode, response)
+			}
+		})
+	}
+}
+
+func mustStreamEvents(t *testing.T, serverUrl string) *http.Response {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, serverUrl+eventsEndpoint, nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("events request failed: %s", err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected events streamed, got %d", response.StatusCode)
+	}
+	return response
+}
+
+func mustDialEvents(t *testing.T, serverUrl string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(wsUrl(serverUrl), nil)
+	if err != nil {
+		t.Fatalf("WebSocket dial failed: %s", err.Error())
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func wsUrl(serverUrl string) string {
+	return "ws" + strings.TrimPrefix(serverUrl, "http") + eventsEndpoint
+}
@@ -1,14 +1,12 @@
 package rest
 
 import (
-	"database/sql"
-	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
-	_ "github.com/lib/pq"
 
 	"github.com/bygui86/go-k8s-probes/database"
 	"github.com/bygui86/go-k8s-probes/logging"
@@ -17,22 +15,25 @@ import (
 func (s *Server) getProducts(writer http.ResponseWriter, request *http.Request) {
 	span, ctx := retrieveSpanAndCtx(request, "get-products-handler")
 	defer span.Finish()
+	ctx = withReadConsistency(request, ctx)
 
-	startTimer := time.Now()
 	logging.Log.Info("Get products")
 
-	count, _ := strconv.Atoi(request.FormValue("count"))
-	start, _ := strconv.Atoi(request.FormValue("start"))
-	if count > 10 || count < 1 {
-		count = 10
-	}
-	if start < 0 {
-		start = 0
+	query, queryErr := s.parseProductsQuery(request)
+	if queryErr != nil {
+		errMsg := "Get products failed: " + queryErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("products-found", 0)
+		span.SetTag("error", errMsg)
+		span.LogKV("products-found", 0, "error", errMsg)
+		return
 	}
-	products, err := database.GetProducts(s.dbInterface, start, count, ctx)
+
+	page, err := s.repository.GetProducts(query, ctx)
 	if err != nil {
 		errMsg := "Get products failed: " + err.Error()
-		sendErrorResponse(writer, http.StatusInternalServerError, errMsg)
+		sendErrorResponse(writer, span, statusCodeFromError(err), errMsg)
 
 		span.SetTag("products-found", 0)
 		span.SetTag("error", errMsg)
@@ -40,26 +41,33 @@ func (s *Server) getProducts(writer http.ResponseWriter, request *http.Request)
 		return
 	}
 
-	span.SetTag("products-found", len(products))
-	span.LogKV("products-found", len(products))
+	span.SetTag("products-found", len(page.Products))
+	span.LogKV("products-found", len(page.Products))
 
-	sendJsonResponse(writer, http.StatusOK, products)
-
-	IncreaseRestRequests("getProducts")
-	ObserveRestRequestsTime("getProducts", float64(time.Now().Sub(startTimer).Milliseconds()))
+	setPageHeaders(writer, request, query, page)
+	s.sendCacheableJsonResponse(writer, request, "", page.LastModified, page.Products)
 }
 
 func (s *Server) getProduct(writer http.ResponseWriter, request *http.Request) {
 	span, ctx := retrieveSpanAndCtx(request, "get-product-handler")
 	defer span.Finish()
-
-	startTimer := time.Now()
+	ctx = withReadConsistency(request, ctx)
 
 	vars := mux.Vars(request)
 	id, idErr := strconv.Atoi(vars["id"])
 	if idErr != nil {
 		errMsg := "Get product failed: Invalid product ID"
-		sendErrorResponse(writer, http.StatusBadRequest, errMsg)
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+
+	includeDeleted, includeDeletedErr := parseIncludeDeleted(request)
+	if includeDeletedErr != nil {
+		errMsg := "Get product failed: " + includeDeletedErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
 
 		span.SetTag("error", errMsg)
 		span.LogKV("error", errMsg)
@@ -71,16 +79,16 @@ func (s *Server) getProduct(writer http.ResponseWriter, request *http.Request) {
 	span.SetTag("product-id", id)
 
 	product := &database.Product{ID: id}
-	getErr := database.GetProduct(s.dbInterface, product, ctx)
+	getErr := s.repository.GetProduct(product, includeDeleted, ctx)
 	if getErr != nil {
 		var errMsg string
 		switch getErr {
-		case sql.ErrNoRows:
+		case database.ErrProductNotFound:
 			errMsg = "Get product failed: product not found"
-			sendErrorResponse(writer, http.StatusNotFound, errMsg)
+			sendErrorResponse(writer, span, http.StatusNotFound, errMsg)
 		default:
 			errMsg = getErr.Error()
-			sendErrorResponse(writer, http.StatusInternalServerError, errMsg)
+			sendErrorResponse(writer, span, http.StatusInternalServerError, errMsg)
 		}
 
 		span.SetTag("product-found", false)
@@ -92,23 +100,18 @@ func (s *Server) getProduct(writer http.ResponseWriter, request *http.Request) {
 	span.SetTag("product-found", true)
 	span.LogKV("product-id", id, "product-found", true)
 
-	sendJsonResponse(writer, http.StatusOK, product)
-
-	IncreaseRestRequests("getProduct")
-	ObserveRestRequestsTime("getProduct", float64(time.Now().Sub(startTimer).Milliseconds()))
+	s.sendCacheableJsonResponse(writer, request, versionETag(product.Version), product.UpdatedAt, product)
 }
 
 func (s *Server) createProduct(writer http.ResponseWriter, request *http.Request) {
 	span, ctx := retrieveSpanAndCtx(request, "create-product-handler")
 	defer span.Finish()
+	ctx = s.withActor(request, ctx)
 
-	startTimer := time.Now()
-
-	var product *database.Product
-	unmarshErr := json.NewDecoder(request.Body).Decode(&product)
-	if unmarshErr != nil {
-		errMsg := "Create product failed: invalid request payload"
-		sendErrorResponse(writer, http.StatusBadRequest, errMsg)
+	product, decodeErr := decodeProduct(writer, request)
+	if decodeErr != nil {
+		errMsg := "Create product failed: invalid request payload: " + decodeErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
 
 		span.SetTag("product-created", false)
 		span.SetTag("error", errMsg)
@@ -117,12 +120,23 @@ func (s *Server) createProduct(writer http.ResponseWriter, request *http.Request
 	}
 	defer request.Body.Close()
 
+	validationErr := product.Validate()
+	if validationErr != nil {
+		errMsg := "Create product failed: " + validationErr.Error()
+		sendValidationErrorResponse(writer, span, errMsg, validationErr)
+
+		span.SetTag("product-created", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-created", false, "error", errMsg)
+		return
+	}
+
 	logging.SugaredLog.Infof("Create product %s", product.String())
 
-	createErr := database.CreateProduct(s.dbInterface, product, ctx)
+	createErr := s.repository.CreateProduct(product, ctx)
 	if createErr != nil {
 		errMsg := "Create product failed: " + createErr.Error()
-		sendErrorResponse(writer, http.StatusInternalServerError, errMsg)
+		sendErrorResponse(writer, span, http.StatusInternalServerError, errMsg)
 
 		span.SetTag("product-created", false)
 		span.SetTag("error", errMsg)
@@ -134,23 +148,32 @@ func (s *Server) createProduct(writer http.ResponseWriter, request *http.Request
 	span.SetTag("product-created", true)
 	span.LogKV("product", product.String(), "product-created", true)
 
+	s.events.publish(EventCreated, product.ID, product)
+	setETag(writer, product.Version)
 	sendJsonResponse(writer, http.StatusCreated, product)
-
-	IncreaseRestRequests("createProduct")
-	ObserveRestRequestsTime("createProduct", float64(time.Now().Sub(startTimer).Milliseconds()))
 }
 
 func (s *Server) updateProduct(writer http.ResponseWriter, request *http.Request) {
 	span, ctx := retrieveSpanAndCtx(request, "update-product-handler")
 	defer span.Finish()
-
-	startTimer := time.Now()
+	ctx = s.withActor(request, ctx)
 
 	vars := mux.Vars(request)
 	id, idErr := strconv.Atoi(vars["id"])
 	if idErr != nil {
 		errMsg := "Update product failed: invalid product ID"
-		sendErrorResponse(writer, http.StatusBadRequest, errMsg)
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("product-updated", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-updated", false, "error", errMsg)
+		return
+	}
+
+	version, versionErr := parseIfMatch(request)
+	if versionErr != nil {
+		errMsg := "Update product failed: " + versionErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
 
 		span.SetTag("product-updated", false)
 		span.SetTag("error", errMsg)
@@ -158,11 +181,10 @@ func (s *Server) updateProduct(writer http.ResponseWriter, request *http.Request
 		return
 	}
 
-	var product *database.Product
-	unmarshErr := json.NewDecoder(request.Body).Decode(&product)
-	if unmarshErr != nil {
-		errMsg := "Update product failed: invalid request payload"
-		sendErrorResponse(writer, http.StatusBadRequest, errMsg)
+	product, decodeErr := decodeProduct(writer, request)
+	if decodeErr != nil {
+		errMsg := "Update product failed: invalid request payload: " + decodeErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
 
 		span.SetTag("product-updated", false)
 		span.SetTag("error", errMsg)
@@ -171,14 +193,27 @@ func (s *Server) updateProduct(writer http.ResponseWriter, request *http.Request
 	}
 	defer request.Body.Close()
 
+	validationErr := product.Validate()
+	if validationErr != nil {
+		errMsg := "Update product failed: " + validationErr.Error()
+		sendValidationErrorResponse(writer, span, errMsg, validationErr)
+
+		span.SetTag("product-updated", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-updated", false, "error", errMsg)
+		return
+	}
+
 	product.ID = id
+	// the version in the payload is ignored, only If-Match drives optimistic concurrency
+	product.Version = version
 	logging.SugaredLog.Infof("Update product: %s", product.String())
 	span.SetTag("product-id", id)
 
-	updateErr := database.UpdateProduct(s.dbInterface, product, ctx)
+	updateErr := s.repository.UpdateProduct(product, ctx)
 	if updateErr != nil {
 		errMsg := "Update product failed: " + updateErr.Error()
-		sendErrorResponse(writer, http.StatusInternalServerError, errMsg)
+		sendErrorResponse(writer, span, statusCodeFromError(updateErr), errMsg)
 
 		span.SetTag("product-updated", false)
 		span.SetTag("error", errMsg)
@@ -190,23 +225,105 @@ func (s *Server) updateProduct(writer http.ResponseWriter, request *http.Request
 	span.SetTag("product-updated", true)
 	span.LogKV("product", product.String(), "product-updated", true)
 
+	s.events.publish(EventUpdated, product.ID, product)
+	setETag(writer, product.Version)
 	sendJsonResponse(writer, http.StatusOK, product)
+}
 
-	IncreaseRestRequests("updateProduct")
-	ObserveRestRequestsTime("updateProduct", float64(time.Now().Sub(startTimer).Milliseconds()))
+func (s *Server) patchProduct(writer http.ResponseWriter, request *http.Request) {
+	span, ctx := retrieveSpanAndCtx(request, "patch-product-handler")
+	defer span.Finish()
+	ctx = s.withActor(request, ctx)
+
+	vars := mux.Vars(request)
+	id, idErr := strconv.Atoi(vars["id"])
+	if idErr != nil {
+		errMsg := "Patch product failed: invalid product ID"
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("product-patched", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-patched", false, "error", errMsg)
+		return
+	}
+
+	version, versionErr := parseIfMatch(request)
+	if versionErr != nil {
+		errMsg := "Patch product failed: " + versionErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("product-patched", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-patched", false, "error", errMsg)
+		return
+	}
+
+	patch, patchErr := parsePatch(writer, request)
+	if patchErr != nil {
+		errMsg := "Patch product failed: " + patchErr.Error()
+		if patchErr == errUnsupportedPatch {
+			writer.Header().Set(acceptPatchHeaderKey, contentTypeMergePatch+", "+contentTypeJsonPatch)
+			sendErrorResponse(writer, span, http.StatusUnsupportedMediaType, errMsg)
+		} else {
+			sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+		}
+
+		span.SetTag("product-patched", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-patched", false, "error", errMsg)
+		return
+	}
+	defer request.Body.Close()
+
+	logging.SugaredLog.Infof("Patch product by ID: %d", id)
+	span.SetTag("product-id", id)
+
+	product := &database.Product{ID: id, Version: version}
+	updateErr := s.repository.PatchProduct(product, patch, ctx)
+	if updateErr != nil {
+		errMsg := "Patch product failed: " + updateErr.Error()
+		if errors.As(updateErr, new(*database.ValidationError)) {
+			sendValidationErrorResponse(writer, span, errMsg, updateErr)
+		} else {
+			sendErrorResponse(writer, span, patchErrorStatusCode(updateErr), errMsg)
+		}
+
+		span.SetTag("product-patched", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-patched", false, "error", errMsg)
+		return
+	}
+
+	span.SetTag("product", product.String())
+	span.SetTag("product-patched", true)
+	span.LogKV("product", product.String(), "product-patched", true)
+
+	s.events.publish(EventUpdated, product.ID, product)
+	setETag(writer, product.Version)
+	sendJsonResponse(writer, http.StatusOK, product)
 }
 
 func (s *Server) deleteProduct(writer http.ResponseWriter, request *http.Request) {
 	span, ctx := retrieveSpanAndCtx(request, "delete-product-handler")
 	defer span.Finish()
-
-	startTimer := time.Now()
+	ctx = s.withActor(request, ctx)
 
 	vars := mux.Vars(request)
 	id, idErr := strconv.Atoi(vars["id"])
 	if idErr != nil {
 		errMsg := "Delete product failed: invalid Product ID"
-		sendErrorResponse(writer, http.StatusBadRequest, errMsg)
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("product-deleted", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-deleted", false, "error", errMsg)
+		return
+	}
+
+	version, versionErr := parseIfMatch(request)
+	if versionErr != nil {
+		errMsg := "Delete product failed: " + versionErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
 
 		span.SetTag("product-deleted", false)
 		span.SetTag("error", errMsg)
@@ -217,10 +334,10 @@ func (s *Server) deleteProduct(writer http.ResponseWriter, request *http.Request
 	logging.SugaredLog.Infof("Delete product by ID: %d", id)
 	span.SetTag("product-id", id)
 
-	deleteErr := database.DeleteProduct(s.dbInterface, id, ctx)
+	deleteErr := s.repository.DeleteProduct(id, version, ctx)
 	if deleteErr != nil {
 		errMsg := "Delete product failed: " + deleteErr.Error()
-		sendErrorResponse(writer, http.StatusInternalServerError, errMsg)
+		sendErrorResponse(writer, span, statusCodeFromError(deleteErr), errMsg)
 
 		span.SetTag("product-deleted", false)
 		span.SetTag("error", errMsg)
@@ -231,8 +348,99 @@ func (s *Server) deleteProduct(writer http.ResponseWriter, request *http.Request
 	span.SetTag("product-deleted", true)
 	span.LogKV("product-deleted", true)
 
+	s.events.publish(EventDeleted, id, nil)
 	sendJsonResponse(writer, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func (s *Server) restoreProduct(writer http.ResponseWriter, request *http.Request) {
+	span, ctx := retrieveSpanAndCtx(request, "restore-product-handler")
+	defer span.Finish()
+	ctx = s.withActor(request, ctx)
+
+	vars := mux.Vars(request)
+	id, idErr := strconv.Atoi(vars["id"])
+	if idErr != nil {
+		errMsg := "Restore product failed: invalid product ID"
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("product-restored", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-restored", false, "error", errMsg)
+		return
+	}
+
+	version, versionErr := parseIfMatch(request)
+	if versionErr != nil {
+		errMsg := "Restore product failed: " + versionErr.Error()
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("product-restored", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-restored", false, "error", errMsg)
+		return
+	}
 
-	IncreaseRestRequests("deleteProduct")
-	ObserveRestRequestsTime("deleteProduct", float64(time.Now().Sub(startTimer).Milliseconds()))
+	logging.SugaredLog.Infof("Restore product by ID: %d", id)
+	span.SetTag("product-id", id)
+
+	product := &database.Product{ID: id, Version: version}
+	restoreErr := s.repository.RestoreProduct(product, ctx)
+	if restoreErr != nil {
+		errMsg := "Restore product failed: " + restoreErr.Error()
+		sendErrorResponse(writer, span, statusCodeFromError(restoreErr), errMsg)
+
+		span.SetTag("product-restored", false)
+		span.SetTag("error", errMsg)
+		span.LogKV("product-restored", false, "error", errMsg)
+		return
+	}
+
+	span.SetTag("product", product.String())
+	span.SetTag("product-restored", true)
+	span.LogKV("product", product.String(), "product-restored", true)
+
+	s.events.publish(EventRestored, product.ID, product)
+	setETag(writer, product.Version)
+	sendJsonResponse(writer, http.StatusOK, product)
+}
+
+func (s *Server) getProductHistory(writer http.ResponseWriter, request *http.Request) {
+	span, ctx := retrieveSpanAndCtx(request, "get-product-history-handler")
+	defer span.Finish()
+	ctx = withReadConsistency(request, ctx)
+
+	vars := mux.Vars(request)
+	id, idErr := strconv.Atoi(vars["id"])
+	if idErr != nil {
+		errMsg := "Get product history failed: invalid product ID"
+		sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+
+	logging.SugaredLog.Infof("Get product history by ID: %d", id)
+	span.SetTag("product-id", id)
+
+	history, err := s.repository.GetProductHistory(id, ctx)
+	if err != nil {
+		errMsg := "Get product history failed: " + err.Error()
+		sendErrorResponse(writer, span, statusCodeFromError(err), errMsg)
+
+		span.SetTag("changes-found", 0)
+		span.SetTag("error", errMsg)
+		span.LogKV("changes-found", 0, "error", errMsg)
+		return
+	}
+
+	span.SetTag("changes-found", len(history))
+	span.LogKV("changes-found", len(history))
+
+	// the history is append-only, it changes along with the last change
+	var lastModified time.Time
+	if len(history) > 0 {
+		lastModified = history[len(history)-1].ChangedAt
+	}
+	s.sendCacheableJsonResponse(writer, request, "", lastModified, history)
 }
@@ -0,0 +1,260 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	idempotencyKeyHeaderKey     = "Idempotency-Key"
+	idempotentReplayedHeaderKey = "Idempotent-Replayed" // bool
+	locationHeaderKey           = "Location"
+	maxIdempotencyKeyLength     = 255
+
+	idempotencyCompleteAttempts = 3
+	idempotencyCompleteBackoff  = 100 * time.Millisecond
+)
+
+// replayedHeaders are the response headers stored along with the body, to be replayed on retries
+var replayedHeaders = []string{contentTypeHeaderKey, etagHeaderKey, locationHeaderKey}
+
+// responseRecorder captures the response sent to the client, to store it for the retries
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	headers    map[string]string
+	body       bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if r.statusCode != 0 {
+		return
+	}
+	r.statusCode = statusCode
+	r.headers = make(map[string]string, len(replayedHeaders))
+	for _, name := range replayedHeaders {
+		if value := r.Header().Get(name); value != "" {
+			r.headers[name] = value
+		}
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// withIdempotency makes the handler safe to retry: requests carrying an Idempotency-Key header are executed once,
+// retries with the same key get the original response replayed until the key expires.
+// Keys are scoped by the subject authenticated, a client can't get the responses of another one.
+// Server errors are not stored, so that the request can be retried for real.
+func (s *Server) withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		key := request.Header.Get(idempotencyKeyHeaderKey)
+		if key == "" || s.idempotencyStore == nil {
+			next(writer, request)
+			return
+		}
+
+		span, ctx := retrieveSpanAndCtx(request, "idempotency-handler")
+		defer span.Finish()
+
+		span.SetTag("idempotency-key", key)
+
+		if len(key) > maxIdempotencyKeyLength {
+			errMsg := "Idempotent request failed: Idempotency-Key too long"
+			sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+			span.SetTag("error", errMsg)
+			span.LogKV("error", errMsg)
+			return
+		}
+
+		body, readErr := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxProductBodyBytes))
+		if readErr != nil {
+			errMsg := "Idempotent request failed: invalid request payload: " + readErr.Error()
+			sendErrorResponse(writer, span, http.StatusBadRequest, errMsg)
+
+			span.SetTag("error", errMsg)
+			span.LogKV("error", errMsg)
+			return
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+
+		storedKey := scopeIdempotencyKey(subjectFromRequest(request), key)
+		fingerprint := fingerprintRequest(request, body)
+		record, reserveErr := s.idempotencyStore.ReserveIdempotencyKey(
+			storedKey, fingerprint, time.Now().Add(s.config.idempotencyKeyLease), ctx)
+		if reserveErr != nil {
+			errMsg := "Idempotent request failed: " + reserveErr.Error()
+			sendErrorResponse(writer, span, http.StatusInternalServerError, errMsg)
+
+			span.SetTag("error", errMsg)
+			span.LogKV("error", errMsg)
+			return
+		}
+
+		if record != nil {
+			s.replayIdempotentRequest(writer, span, record, fingerprint)
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: writer}
+		handled := false
+		defer func() {
+			// the handler panicked or failed, the key is released for the client to retry
+			if !handled {
+				s.releaseIdempotencyKey(storedKey, ctx)
+			}
+		}()
+
+		next(recorder, request)
+
+		if recorder.statusCode == 0 || recorder.statusCode >= http.StatusInternalServerError {
+			return
+		}
+		handled = true
+		s.completeIdempotencyKey(&database.IdempotencyRecord{
+			Key:        storedKey,
+			StatusCode: recorder.statusCode,
+			Headers:    recorder.headers,
+			Body:       recorder.body.Bytes(),
+		}, ctx)
+	}
+}
+
+// completeIdempotencyKey stores the response, retrying as the request took effect already: releasing the key would
+// let a retry repeat it. If storing keeps failing, the key is left in progress until its lease expires.
+func (s *Server) completeIdempotencyKey(record *database.IdempotencyRecord, ctx context.Context) {
+	// stored even if the client went away, it's the one most likely to retry
+	ctx = context.WithoutCancel(ctx)
+
+	var err error
+	for attempt := 1; attempt <= idempotencyCompleteAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * idempotencyCompleteBackoff)
+		}
+		err = s.idempotencyStore.CompleteIdempotencyKey(record, time.Now().Add(s.config.idempotencyKeyTtl), ctx)
+		if err == nil {
+			return
+		}
+		logging.SugaredLog.Warnf("Idempotency key %q completion attempt %d failed: %s", record.Key, attempt, err.Error())
+	}
+	logging.SugaredLog.Errorf("Idempotency key %q completion failed, kept in progress: %s", record.Key, err.Error())
+}
+
+func (s *Server) replayIdempotentRequest(writer http.ResponseWriter, span opentracing.Span,
+	record *database.IdempotencyRecord, fingerprint string) {
+
+	switch {
+	case record.Fingerprint != fingerprint:
+		errMsg := "Idempotent request failed: Idempotency-Key already used for a different request"
+		sendErrorResponse(writer, span, http.StatusUnprocessableEntity, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+	case record.StatusCode == 0:
+		errMsg := "Idempotent request failed: a request with the same Idempotency-Key is still in progress"
+		sendErrorResponse(writer, span, http.StatusConflict, errMsg)
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+	default:
+		span.SetTag("replayed", true)
+		span.LogKV("replayed", true, "status-code", record.StatusCode)
+
+		for name, value := range record.Headers {
+			writer.Header().Set(name, value)
+		}
+		writer.Header().Set(idempotentReplayedHeaderKey, "true")
+		writer.WriteHeader(record.StatusCode)
+		_, err := writer.Write(record.Body)
+		if err != nil {
+			logging.SugaredLog.Errorf("Error sending replayed response: %s", err.Error())
+		}
+	}
+}
+
+func (s *Server) releaseIdempotencyKey(key string, ctx context.Context) {
+	err := s.idempotencyStore.ReleaseIdempotencyKey(key, ctx)
+	if err != nil {
+		logging.SugaredLog.Errorf("Idempotency key %q release failed: %s", key, err.Error())
+	}
+}
+
+// scopeIdempotencyKey prefixes the key by the subject quoted, unambiguously whatever characters both contain
+func scopeIdempotencyKey(subject, key string) string {
+	return strconv.Quote(subject) + " " + key
+}
+
+// fingerprintRequest identifies the request a key is used for, the same payload must be sent byte by byte on retries
+func fingerprintRequest(request *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(request.Method + " " + request.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// startIdempotencyJanitor deletes the expired idempotency keys periodically, until stopIdempotencyJanitor
+func (s *Server) startIdempotencyJanitor() {
+	if s.idempotencyStore == nil {
+		return
+	}
+
+	s.janitorStop = make(chan struct{})
+	s.janitorStopped.Add(1)
+	go func() {
+		defer s.janitorStopped.Done()
+
+		ticker := time.NewTicker(s.config.idempotencyJanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.janitorStop:
+				return
+			case <-ticker.C:
+				s.deleteExpiredIdempotencyKeys()
+			}
+		}
+	}()
+}
+
+func (s *Server) stopIdempotencyJanitor() {
+	if s.janitorStop == nil {
+		return
+	}
+	close(s.janitorStop)
+	s.janitorStopped.Wait()
+	s.janitorStop = nil
+}
+
+func (s *Server) deleteExpiredIdempotencyKeys() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.idempotencyJanitorInterval)
+	defer cancel()
+
+	deleted, err := s.idempotencyStore.DeleteExpiredIdempotencyKeys(time.Now(), ctx)
+	if err != nil {
+		logging.SugaredLog.Errorf("Expired idempotency keys deletion failed: %s", err.Error())
+		return
+	}
+	logging.SugaredLog.Debugf("Deleted %d expired idempotency keys", deleted)
+}
@@ -0,0 +1,105 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+const idempotentProduct = `{"name":"lamp","price":"10.50","currency":"EUR"}`
+
+// flakyIdempotencyStore fails to complete the keys as many times as failures
+type flakyIdempotencyStore struct {
+	*database.MemoryRepository
+	failures int
+	attempts int
+}
+
+func (s *flakyIdempotencyStore) CompleteIdempotencyKey(record *database.IdempotencyRecord, expiresAt time.Time,
+	ctx context.Context) error {
+
+	s.attempts++
+	if s.attempts <= s.failures {
+		return errors.New("connection reset")
+	}
+	return s.MemoryRepository.CompleteIdempotencyKey(record, expiresAt, ctx)
+}
+
+func TestIdempotencyKeyCompletionFailure(t *testing.T) {
+	tests := []struct {
+		name             string
+		failures         int
+		expectedAttempts int
+		expectedRetry    int
+	}{
+		{"completed on retry", 1, 2, http.StatusCreated},
+		{"kept in progress", idempotencyCompleteAttempts, idempotencyCompleteAttempts, http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repository := database.NewMemoryRepository()
+			store := &flakyIdempotencyStore{MemoryRepository: repository, failures: test.failures}
+			server, serverErr := New(repository, store, nil)
+			if serverErr != nil {
+				t.Fatalf("server creation failed: %s", serverErr.Error())
+			}
+
+			headers := map[string]string{idempotencyKeyHeaderKey: "key"}
+			if created := serve(server, http.MethodPost, productsEndpoint, headers, idempotentProduct); created.Code != http.StatusCreated {
+				t.Fatalf("expected product created, got %d: %s", created.Code, created.Body.String())
+			}
+			if store.attempts != test.expectedAttempts {
+				t.Fatalf("expected %d completion attempts, got %d", test.expectedAttempts, store.attempts)
+			}
+
+			// never executed twice, whether the response was stored or not
+			retried := serve(server, http.MethodPost, productsEndpoint, headers, idempotentProduct)
+			if retried.Code != test.expectedRetry {
+				t.Fatalf("expected retry answered %d, got %d: %s", test.expectedRetry, retried.Code, retried.Body.String())
+			}
+			page, _ := repository.GetProducts(&database.ProductsQuery{Limit: 10}, context.Background())
+			if len(page.Products) != 1 {
+				t.Fatalf("expected 1 product created, got %d", len(page.Products))
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeysScopedBySubject(t *testing.T) {
+	signingKey := newSigningKey(t)
+	server := newAuthServer(t, writeJwks(t, signingKey))
+	token := signToken(t, signingKey, jwt.Claims{
+		Issuer:   testIssuer,
+		Audience: jwt.Audience{testAudience},
+		Subject:  "alice",
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}, map[string]interface{}{"scope": scopeWrite})
+
+	writer := apiKey("read-write")
+	writer[idempotencyKeyHeaderKey] = "key"
+	alice := bearer(token)
+	alice[idempotencyKeyHeaderKey] = "key"
+
+	first := serve(server, http.MethodPost, productsEndpoint, writer, idempotentProduct)
+	second := serve(server, http.MethodPost, productsEndpoint, alice, idempotentProduct)
+	if first.Code != http.StatusCreated || second.Code != http.StatusCreated ||
+		second.Header().Get(idempotentReplayedHeaderKey) != "" {
+		t.Fatalf("expected a product created by each subject, got %d and %d %v", first.Code, second.Code,
+			second.Header())
+	}
+	if first.Body.String() == second.Body.String() {
+		t.Fatalf("expected different products, got %s twice", first.Body.String())
+	}
+
+	replayed := serve(server, http.MethodPost, productsEndpoint, writer, idempotentProduct)
+	if replayed.Header().Get(idempotentReplayedHeaderKey) != "true" || replayed.Body.String() != first.Body.String() {
+		t.Fatalf("expected the response of the first request replayed, got %d %s", replayed.Code,
+			replayed.Body.String())
+	}
+}
@@ -0,0 +1,186 @@
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	jwksFetchTimeout = 10 * time.Second
+	// JWKS documents larger than this are refused
+	maxJwksBytes = 1 << 20
+)
+
+// signature algorithms accepted, asymmetric only as keys come from a JWKS
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// jwtAuthenticator verifies bearer tokens against the keys of a JWKS, read from a file or fetched from a URL
+type jwtAuthenticator struct {
+	jwks     string
+	issuer   string
+	audience string
+	leeway   time.Duration
+	keys     atomic.Value // *jose.JSONWebKeySet
+	client   *http.Client
+	// JWKS refresher, for URLs only
+	refreshInterval time.Duration
+	refresherStop   chan struct{}
+	refresherDone   sync.WaitGroup
+}
+
+// scopeClaims are the scopes granted, as space-separated "scope" (RFC 8693) or as "scp" array
+type scopeClaims struct {
+	Scope string   `json:"scope"`
+	Scp   []string `json:"scp"`
+}
+
+func newJwtAuthenticator(cfg *config) (*jwtAuthenticator, error) {
+	if cfg.authJwtIssuer == "" || cfg.authJwtAudience == "" {
+		return nil, errors.New("JWT issuer and audience required along with the JWKS")
+	}
+
+	auth := &jwtAuthenticator{
+		jwks:            cfg.authJwks,
+		issuer:          cfg.authJwtIssuer,
+		audience:        cfg.authJwtAudience,
+		leeway:          cfg.authJwtLeeway,
+		client:          &http.Client{Timeout: jwksFetchTimeout},
+		refreshInterval: cfg.authJwksRefreshInterval,
+	}
+	loadErr := auth.loadKeys()
+	if loadErr != nil {
+		return nil, fmt.Errorf("JWKS loading failed: %s", loadErr.Error())
+	}
+	return auth, nil
+}
+
+func (a *jwtAuthenticator) isRemote() bool {
+	return strings.HasPrefix(a.jwks, "http://") || strings.HasPrefix(a.jwks, "https://")
+}
+
+// loadKeys reads the JWKS, keeping the current keys on failure
+func (a *jwtAuthenticator) loadKeys() error {
+	var content []byte
+	var err error
+	if a.isRemote() {
+		content, err = a.fetchJwks()
+	} else {
+		content, err = os.ReadFile(a.jwks)
+	}
+	if err != nil {
+		return err
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	err = json.Unmarshal(content, keys)
+	if err != nil {
+		return err
+	}
+	if len(keys.Keys) == 0 {
+		return errors.New("no keys found")
+	}
+	a.keys.Store(keys)
+	logging.SugaredLog.Infof("%d JWT verification keys loaded from %s", len(keys.Keys), a.jwks)
+	return nil
+}
+
+func (a *jwtAuthenticator) fetchJwks() ([]byte, error) {
+	response, err := a.client.Get(a.jwks)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS response code %d", response.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(response.Body, maxJwksBytes))
+}
+
+func (a *jwtAuthenticator) startRefresher() {
+	if !a.isRemote() {
+		return
+	}
+
+	a.refresherStop = make(chan struct{})
+	a.refresherDone.Add(1)
+	go func() {
+		defer a.refresherDone.Done()
+
+		ticker := time.NewTicker(a.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.refresherStop:
+				return
+			case <-ticker.C:
+				err := a.loadKeys()
+				if err != nil {
+					logging.SugaredLog.Errorf("JWKS refresh failed, keeping the keys loaded before: %s", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+func (a *jwtAuthenticator) stopRefresher() {
+	if a.refresherStop == nil {
+		return
+	}
+	close(a.refresherStop)
+	a.refresherDone.Wait()
+	a.refresherStop = nil
+}
+
+func (a *jwtAuthenticator) authenticate(request *http.Request) (*principal, error) {
+	authorization := request.Header.Get(authorizationHeaderKey)
+	if len(authorization) < len(bearerPrefix) || !strings.EqualFold(authorization[:len(bearerPrefix)], bearerPrefix) {
+		return nil, ErrNoCredentials
+	}
+
+	token, parseErr := jwt.ParseSigned(strings.TrimSpace(authorization[len(bearerPrefix):]), jwtAlgorithms)
+	if parseErr != nil {
+		return nil, fmt.Errorf("malformed token: %s", parseErr.Error())
+	}
+	keys := a.keys.Load().(*jose.JSONWebKeySet).Key(token.Headers[0].KeyID)
+	if len(keys) == 0 {
+		return nil, errors.New("unknown signing key")
+	}
+
+	var claims jwt.Claims
+	var scopes scopeClaims
+	claimsErr := token.Claims(keys[0].Key, &claims, &scopes)
+	if claimsErr != nil {
+		return nil, errors.New("invalid signature")
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("expiry missing")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("subject missing")
+	}
+	expected := jwt.Expected{Issuer: a.issuer, AnyAudience: jwt.Audience{a.audience}, Time: time.Now()}
+	validationErr := claims.ValidateWithLeeway(expected, a.leeway)
+	if validationErr != nil {
+		return nil, validationErr
+	}
+
+	return newPrincipal(claims.Subject, append(strings.Fields(scopes.Scope), scopes.Scp...)), nil
+}
@@ -2,48 +2,106 @@ package rest
 
 import (
 	"github.com/prometheus/client_golang/prometheus"
-
-	"github.com/bygui86/go-k8s-probes/commons"
 )
 
 const (
-	namespace = "rest-api"
+	productsNamespace = "products"
+	httpSubsystem     = "http"
+	eventsSubsystem   = "events"
 )
 
 var (
-	restRequests = prometheus.NewCounterVec(
+	httpRequests = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: commons.ServiceName,
-			Name:      "rest_requests_total",
-			Help:      "Number of rest requests managed",
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests served, by method, route template and status code",
 		},
-		[]string{"method"},
+		[]string{"method", "route", "code"},
 	)
 
-	restRequestsTiming = prometheus.NewHistogramVec(
+	httpRequestsDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: commons.ServiceName,
-			Name:      "rest_requests_execution_time_milliseconds",
-			Help:      "Execution time of rest requests in milliseconds",
-			Buckets:   []float64{1e-10, 1e-8, 1e-6, 1e-4, 1e-2, 0.025, 0.05, 0.075, 0.1, 0.125, 0.25, 0.5, 1, 1.5, 2, 2.5, 5, 7.5, 10, 25, 50, 100, 250, 500, 750, 1000, 2500, 5000, 10000},
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests in seconds, by method, route template and status code",
+			Buckets:   prometheus.DefBuckets,
 		},
-		[]string{"method"},
+		[]string{"method", "route", "code"},
 	)
-)
 
-func RegisterCustomMetrics() {
-	prometheus.MustRegister(
-		restRequests,
-		restRequestsTiming,
+	httpRequestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "requests_in_flight",
+			Help:      "Number of HTTP requests currently served",
+		},
 	)
-}
 
-func IncreaseRestRequests(method string) {
-	go restRequests.WithLabelValues(method).Inc()
-}
+	httpPanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "panics_total",
+			Help:      "Number of panics recovered while serving HTTP requests, by method and route template",
+		},
+		[]string{"method", "route"},
+	)
+
+	rateLimitedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "rate_limited_requests_total",
+			Help:      "Number of HTTP requests rejected for exceeding the client rate limit, by method and route template",
+		},
+		[]string{"method", "route"},
+	)
+
+	shedRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "shed_requests_total",
+			Help:      "Number of HTTP requests rejected while overloaded, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	authFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: productsNamespace,
+			Subsystem: httpSubsystem,
+			Name:      "auth_failures_total",
+			Help:      "Number of HTTP requests rejected by authentication, by reason: missing, invalid or forbidden",
+		},
+		[]string{"reason"},
+	)
+
+	eventSubscribers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: productsNamespace,
+			Subsystem: eventsSubsystem,
+			Name:      "subscribers",
+			Help:      "Number of clients currently streaming product events, by transport",
+		},
+		[]string{"transport"},
+	)
+)
 
-func ObserveRestRequestsTime(method string, timing float64) {
-	restRequestsTiming.WithLabelValues(method).Observe(timing)
+// GetCollectors returns the collectors of the Products server metrics, to be registered on the monitoring server
+func (s *Server) GetCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		httpRequests,
+		httpRequestsDuration,
+		httpRequestsInFlight,
+		httpPanics,
+		rateLimitedRequests,
+		shedRequests,
+		authFailures,
+		eventSubscribers,
+	}
 }
@@ -0,0 +1,232 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	requestIdHeaderKey = "X-Request-ID"
+	// request IDs received longer than this are replaced, not to flood logs and traces
+	maxRequestIdLength = 128
+
+	// route label of the requests not matching any route, not to label them by path
+	unmatchedRoute = "unmatched"
+
+	panicDetail = "Unexpected error, look for the request ID in the logs"
+)
+
+type requestInfoContextKey struct{}
+
+// requestInfo is shared along the middlewares chain, for the outer ones to report what the inner ones found out
+type requestInfo struct {
+	id      string
+	route   string
+	subject string
+}
+
+// withMiddlewares wraps the router with the middlewares applying to every request, matching a route or not.
+// From the outermost: request ID, CORS, access log, RED metrics, compression, panic recovery.
+func (s *Server) withMiddlewares(router http.Handler) http.Handler {
+	handler := withRecovery(router)
+	if s.config.compressionEnabled {
+		handler = withCompression(s.config.compressionMinSize)(handler)
+	}
+	handler = withMetrics(handler)
+	if s.config.accessLogEnabled {
+		handler = withAccessLog(handler)
+	}
+	if len(s.config.corsAllowedOrigins) > 0 {
+		handler = s.withCors(handler)
+	}
+	return withRequestId(handler)
+}
+
+// withRequestId propagates the X-Request-ID header received, or generates one, and sends it back
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(requestIdHeaderKey)
+		if !isValidRequestId(id) {
+			id = uuid.NewString()
+		}
+		writer.Header().Set(requestIdHeaderKey, id)
+
+		info := &requestInfo{id: id, route: unmatchedRoute}
+		ctx := context.WithValue(request.Context(), requestInfoContextKey{}, info)
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// isValidRequestId accepts printable ASCII only, as request IDs end up in logs and headers
+func isValidRequestId(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRouteTemplate records the template of the route matched, as route label of metrics and logs
+func withRouteTemplate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		info := requestInfoFromContext(request.Context())
+		if route := mux.CurrentRoute(request); info != nil && route != nil {
+			template, templateErr := route.GetPathTemplate()
+			if templateErr == nil {
+				info.route = openApiPath(template)
+			}
+		}
+		next.ServeHTTP(writer, request)
+	})
+}
+
+// withAccessLog logs every request served, once the response is sent
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := recordStatus(writer)
+		next.ServeHTTP(recorder, request)
+
+		info := requestInfoFromContext(request.Context())
+		logging.Log.Info("HTTP request served",
+			zap.String("request-id", info.id),
+			zap.String("method", request.Method),
+			zap.String("path", request.URL.RequestURI()),
+			zap.String("route", info.route),
+			zap.String("subject", info.subject),
+			zap.Int("status", recorder.status()),
+			zap.Int64("bytes", recorder.bytes),
+			zap.Duration("duration", time.Since(start)),
+			zap.String("remote-addr", request.RemoteAddr),
+			zap.String("user-agent", request.UserAgent()),
+		)
+	})
+}
+
+// withMetrics counts the requests and observes their duration, whatever the handler does
+func withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		start := time.Now()
+		recorder := recordStatus(writer)
+		next.ServeHTTP(recorder, request)
+
+		route := requestInfoFromContext(request.Context()).route
+		code := strconv.Itoa(recorder.status())
+		httpRequests.WithLabelValues(request.Method, route, code).Inc()
+		httpRequestsDuration.WithLabelValues(request.Method, route, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// withRecovery turns panics into 500 responses, if nothing was sent yet, instead of dropping the connection
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		recorder := recordStatus(writer)
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			if recovered == http.ErrAbortHandler {
+				// response aborted on purpose
+				panic(recovered)
+			}
+
+			info := requestInfoFromContext(request.Context())
+			httpPanics.WithLabelValues(request.Method, info.route).Inc()
+			logging.SugaredLog.Errorf("Panic serving %s %s (request ID %s): %v\n%s",
+				request.Method, request.URL.Path, info.id, recovered, debug.Stack())
+
+			if recorder.statusCode != 0 {
+				// too late to change the response, the client gets it truncated
+				return
+			}
+			sendProblem(recorder, &problem{
+				Type:   problemTypeDefault,
+				Title:  http.StatusText(http.StatusInternalServerError),
+				Status: http.StatusInternalServerError,
+				Detail: panicDetail,
+			})
+		}()
+		next.ServeHTTP(recorder, request)
+	})
+}
+
+// requestInfoFromContext returns the info of the request, an empty one outside the middlewares chain
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, ok := ctx.Value(requestInfoContextKey{}).(*requestInfo)
+	if !ok {
+		return &requestInfo{route: unmatchedRoute}
+	}
+	return info
+}
+
+// statusRecorder records the status and size of the response sent
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+// recordStatus wraps the writer to record the response, unless an outer middleware already did
+func recordStatus(writer http.ResponseWriter) *statusRecorder {
+	if recorder, ok := writer.(*statusRecorder); ok {
+		return recorder
+	}
+	return &statusRecorder{ResponseWriter: writer}
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	if r.statusCode == 0 {
+		r.statusCode = statusCode
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.statusCode == 0 {
+		r.statusCode = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Hijack is used by WebSocket upgrades, which send their own response
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buffer, err := http.NewResponseController(r.ResponseWriter).Hijack()
+	if err == nil && r.statusCode == 0 {
+		r.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, buffer, err
+}
+
+// Unwrap lets http.ResponseController reach the original writer, e.g. to flush event streams
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// status returns the status code sent, 200 if the handler sent nothing
+func (r *statusRecorder) status() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+	return r.statusCode
+}
@@ -0,0 +1,111 @@
+package rest
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+func TestRequestId(t *testing.T) {
+	handler := newTestServer(t).httpServer.Handler
+
+	response := serveHandler(handler, http.MethodGet, openApiEndpoint, map[string]string{requestIdHeaderKey: "abc-123"})
+	if id := response.Header().Get(requestIdHeaderKey); id != "abc-123" {
+		t.Fatalf("expected request ID propagated, got %q", id)
+	}
+
+	for _, received := range []string{"", "with spaces", strings.Repeat("a", maxRequestIdLength+1)} {
+		response = serveHandler(handler, http.MethodGet, openApiEndpoint, map[string]string{requestIdHeaderKey: received})
+		if id := response.Header().Get(requestIdHeaderKey); id == received || !isValidRequestId(id) {
+			t.Fatalf("expected request ID %q replaced, got %q", received, id)
+		}
+	}
+}
+
+func TestMetricsByRouteTemplate(t *testing.T) {
+	handler := newTestServer(t).httpServer.Handler
+
+	notFound := httpRequests.WithLabelValues(http.MethodGet, "/api/v1/products/{id}", "404")
+	unmatched := httpRequests.WithLabelValues(http.MethodGet, unmatchedRoute, "404")
+	notFoundBefore, unmatchedBefore := testutil.ToFloat64(notFound), testutil.ToFloat64(unmatched)
+
+	serveHandler(handler, http.MethodGet, productsEndpoint+"/41", nil)
+	serveHandler(handler, http.MethodGet, productsEndpoint+"/42", nil)
+	serveHandler(handler, http.MethodGet, "/unknown", nil)
+
+	if count := testutil.ToFloat64(notFound) - notFoundBefore; count != 2 {
+		t.Errorf("expected 2 requests of the route template, got %.0f", count)
+	}
+	if count := testutil.ToFloat64(unmatched) - unmatchedBefore; count != 1 {
+		t.Errorf("expected 1 unmatched request, got %.0f", count)
+	}
+	if inFlight := testutil.ToFloat64(httpRequestsInFlight); inFlight != 0 {
+		t.Errorf("expected no request in flight, got %.0f", inFlight)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	server := newTestServer(t)
+	server.router.HandleFunc("/panic", func(writer http.ResponseWriter, request *http.Request) {
+		panic("boom")
+	})
+	panics := httpPanics.WithLabelValues(http.MethodGet, "/panic")
+	before := testutil.ToFloat64(panics)
+
+	response := serveHandler(server.httpServer.Handler, http.MethodGet, "/panic", nil)
+	if response.Code != http.StatusInternalServerError ||
+		response.Header().Get(contentTypeHeaderKey) != contentTypeProblemJson {
+		t.Fatalf("expected 500 problem, got %d: %s", response.Code, response.Body.String())
+	}
+	if count := testutil.ToFloat64(panics) - before; count != 1 {
+		t.Fatalf("expected 1 panic counted, got %.0f", count)
+	}
+}
+
+// TestEventStreamFlushed makes sure events are still flushed through the response recorder of the middlewares
+func TestEventStreamFlushed(t *testing.T) {
+	httpServer := httptest.NewServer(newTestServer(t).httpServer.Handler)
+	defer httpServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	request, _ := http.NewRequestWithContext(ctx, http.MethodGet, httpServer.URL+eventsEndpoint, nil)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("events request failed: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	line, readErr := bufio.NewReader(response.Body).ReadString('\n')
+	if readErr != nil || !strings.HasPrefix(line, "retry:") {
+		t.Fatalf("expected retry line flushed, got %q (%v)", line, readErr)
+	}
+}
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	repository := database.NewMemoryRepository()
+	server, serverErr := New(repository, repository, nil)
+	if serverErr != nil {
+		t.Fatalf("server creation failed: %s", serverErr.Error())
+	}
+	return server
+}
+
+func serveHandler(handler http.Handler, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, nil)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
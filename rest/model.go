@@ -2,20 +2,114 @@ package rest
 
 import (
 	"database/sql"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 
+	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/bygui86/go-k8s-probes/database"
 )
 
 type Server struct {
-	config      *config
-	router      *mux.Router
-	httpServer  *http.Server
-	dbInterface *sql.DB
-	running     bool
+	config     *config
+	router     *mux.Router
+	httpServer *http.Server
+	openApi    *openapi3.T
+	repository database.ProductRepository
+	// nil unless the repository caches products
+	productCache database.ProductCache
+	running      bool
+	// idempotency keys janitor
+	idempotencyStore database.IdempotencyStore
+	janitorStop      chan struct{}
+	janitorStopped   sync.WaitGroup
+	events           *eventBroker
+	wsUpgrader       *websocket.Upgrader
+	rateLimiter      *rateLimiter
+	loadShedder      *loadShedder
+	authenticators   []authenticator
+	jwtAuthenticator *jwtAuthenticator
+	probeApiKey      string
+}
+
+// PoolStats reports the stats of a DB connection pool, e.g. *sql.DB
+type PoolStats interface {
+	Stats() sql.DBStats
+}
+
+// LoadSheddingStatus tells whether requests were shed lately, and why
+type LoadSheddingStatus struct {
+	Shedding bool
+	Reason   string
+	InFlight int
+	DbWait   time.Duration
 }
 
 type config struct {
-	restHost string
-	restPort int
+	restHost                   string
+	restPort                   int
+	defaultPageSize            int
+	maxPageSize                int
+	importBatchSize            int
+	idempotencyKeyTtl          time.Duration
+	idempotencyKeyLease        time.Duration
+	idempotencyJanitorInterval time.Duration
+	eventsBacklogSize          int
+	eventsHeartbeatInterval    time.Duration
+	eventsWebSocketEnabled     bool
+	swaggerUiEnabled           bool
+	responseValidationEnabled  bool
+	accessLogEnabled           bool
+	rateLimitEnabled           bool
+	rateLimitRate              int
+	rateLimitBurst             int
+	loadSheddingEnabled        bool
+	loadSheddingMaxInFlight    int
+	loadSheddingMaxDbWait      time.Duration
+	authEnabled                bool
+	authApiKeysFile            string
+	authJwks                   string
+	authJwtIssuer              string
+	authJwtAudience            string
+	authJwtLeeway              time.Duration
+	authJwksRefreshInterval    time.Duration
+	corsAllowedOrigins         []string
+	corsAllowCredentials       bool
+	corsMaxAge                 time.Duration
+	compressionEnabled         bool
+	compressionMinSize         int
+	// allowed to tell the user they authenticated and the client IP, with X-Forwarded-User and X-Forwarded-For
+	trustedProxies []*net.IPNet
+}
+
+// problem details for HTTP APIs (RFC 7807)
+type problem struct {
+	Type          string          `json:"type"`
+	Title         string          `json:"title"`
+	Status        int             `json:"status"`
+	Detail        string          `json:"detail,omitempty"`
+	InvalidParams []*invalidParam `json:"invalid-params,omitempty"`
+	TraceID       string          `json:"traceId,omitempty"`
+}
+
+type invalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// importReport lists the rows rejected by an import, up to maxReportedImportErrors
+type importReport struct {
+	Imported int            `json:"imported"`
+	Failed   int            `json:"failed"`
+	Errors   []*importError `json:"errors"`
+}
+
+type importError struct {
+	Line          int             `json:"line"`
+	Detail        string          `json:"detail"`
+	InvalidParams []*invalidParam `json:"invalid-params,omitempty"`
 }
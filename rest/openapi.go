@@ -0,0 +1,77 @@
+package rest
+
+import (
+	_ "embed"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	openApiEndpoint   = v1Endpoint + "/openapi.json"
+	swaggerUiEndpoint = v1Endpoint + "/docs"
+
+	contentTypeHtml = "text/html; charset=utf-8"
+	// swagger-ui-dist is loaded from a CDN, not to bundle it in the binary
+	swaggerUiVersion = "5"
+)
+
+// matches the regular expression of mux path variables, e.g. {id:[0-9]+}
+var pathVariableRegex = regexp.MustCompile(`\{(\w+):[^}]+\}`)
+
+// openApiSpec describes the Products API, it must list every route registered in setupRouter
+//
+//go:embed openapi.json
+var openApiSpec []byte
+
+var openApiSpecETag = contentETag(openApiSpec)
+
+var swaggerUiPage = []byte(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Products API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@` + swaggerUiVersion + `/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@` + swaggerUiVersion + `/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({url: "` + openApiEndpoint + `", dom_id: "#swagger-ui"});
+    };
+  </script>
+</body>
+</html>
+`)
+
+func (s *Server) getOpenApiSpec(writer http.ResponseWriter, request *http.Request) {
+	span, _ := retrieveSpanAndCtx(request, "get-openapi-spec-handler")
+	defer span.Finish()
+
+	logging.Log.Debug("Get OpenAPI spec")
+
+	if s.setValidators(writer, request, openApiSpecETag, time.Time{}) {
+		return
+	}
+	writer.Header().Set(contentTypeHeaderKey, contentTypeApplicationJson)
+	_, err := writer.Write(openApiSpec)
+	if err != nil {
+		logging.SugaredLog.Errorf("Error sending OpenAPI spec: %s", err.Error())
+	}
+}
+
+func (s *Server) getSwaggerUi(writer http.ResponseWriter, request *http.Request) {
+	span, _ := retrieveSpanAndCtx(request, "get-swagger-ui-handler")
+	defer span.Finish()
+
+	logging.Log.Debug("Get Swagger UI")
+
+	writer.Header().Set(contentTypeHeaderKey, contentTypeHtml)
+	_, err := writer.Write(swaggerUiPage)
+	if err != nil {
+		logging.SugaredLog.Errorf("Error sending Swagger UI: %s", err.Error())
+	}
+}
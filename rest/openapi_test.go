@@ -0,0 +1,98 @@
+package rest
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+// routes serving the documentation to humans, not part of the API described
+var undocumentedRoutes = map[string]bool{
+	http.MethodGet + " " + swaggerUiEndpoint: true,
+}
+
+func TestMain(m *testing.M) {
+	err := logging.InitGlobalLogger()
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestOpenApiSpecValid(t *testing.T) {
+	mustLoadOpenApiSpec(t)
+}
+
+func TestOpenApiSpecMatchesRoutes(t *testing.T) {
+	t.Setenv(swaggerUiEnabledEnvVar, "true")
+	repository := database.NewMemoryRepository()
+	server, serverErr := New(repository, repository, nil)
+	if serverErr != nil {
+		t.Fatalf("server creation failed: %s", serverErr.Error())
+	}
+
+	routes := make(map[string]bool)
+	walkErr := server.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, templateErr := route.GetPathTemplate()
+		if templateErr != nil {
+			return templateErr
+		}
+		methods, methodsErr := route.GetMethods()
+		if methodsErr != nil {
+			return methodsErr
+		}
+		path := openApiPath(template)
+		for _, method := range methods {
+			if key := method + " " + path; !undocumentedRoutes[key] {
+				routes[key] = true
+			}
+		}
+		return nil
+	})
+	if walkErr != nil {
+		t.Fatalf("routes walk failed: %s", walkErr.Error())
+	}
+
+	documented := make(map[string]bool)
+	for path, item := range mustLoadOpenApiSpec(t).Paths.Map() {
+		for method := range item.Operations() {
+			documented[method+" "+path] = true
+		}
+	}
+
+	if missing := difference(routes, documented); len(missing) > 0 {
+		t.Errorf("routes missing from the OpenAPI spec: %s", strings.Join(missing, ", "))
+	}
+	if unknown := difference(documented, routes); len(unknown) > 0 {
+		t.Errorf("OpenAPI spec paths not routed: %s", strings.Join(unknown, ", "))
+	}
+}
+
+func mustLoadOpenApiSpec(t *testing.T) *openapi3.T {
+	t.Helper()
+	spec, err := loadOpenApiSpec()
+	if err != nil {
+		t.Fatalf("OpenAPI spec loading failed: %s", err.Error())
+	}
+	return spec
+}
+
+// difference returns the keys of a missing from b, sorted
+func difference(a, b map[string]bool) []string {
+	keys := make([]string, 0)
+	for key := range a {
+		if !b[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
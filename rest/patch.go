@@ -0,0 +1,122 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+const (
+	acceptPatchHeaderKey = "Accept-Patch"
+
+	contentTypeMergePatch = "application/merge-patch+json" // RFC 7396
+	contentTypeJsonPatch  = "application/json-patch+json"  // RFC 6902
+)
+
+var (
+	errUnsupportedPatch = fmt.Errorf("unsupported patch media type, use %s or %s",
+		contentTypeMergePatch, contentTypeJsonPatch)
+	errMergePatchNotObject = errors.New("invalid merge patch, a JSON object is expected")
+)
+
+// patchApplyError reports a patch well-formed but not applicable to the product
+type patchApplyError struct {
+	err error
+}
+
+func (e *patchApplyError) Error() string {
+	return "patch not applicable: " + e.err.Error()
+}
+
+func (e *patchApplyError) Unwrap() error {
+	return e.err
+}
+
+// parsePatch decodes the patch in the request body, to be applied on the current product by the repository
+func parsePatch(writer http.ResponseWriter, request *http.Request) (database.ProductPatch, error) {
+	mediaType, _, mediaErr := mime.ParseMediaType(request.Header.Get(contentTypeHeaderKey))
+	if mediaErr != nil {
+		return nil, errUnsupportedPatch
+	}
+
+	body, readErr := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxProductBodyBytes))
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var apply func(doc []byte) ([]byte, error)
+	switch mediaType {
+	case contentTypeMergePatch:
+		// a patch other than an object would replace the whole product
+		if !json.Valid(body) || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+			return nil, errMergePatchNotObject
+		}
+		apply = func(doc []byte) ([]byte, error) {
+			return jsonpatch.MergePatch(doc, body)
+		}
+	case contentTypeJsonPatch:
+		patch, decodeErr := jsonpatch.DecodePatch(body)
+		if decodeErr != nil {
+			return nil, fmt.Errorf("invalid JSON patch: %s", decodeErr.Error())
+		}
+		apply = patch.Apply
+	default:
+		return nil, errUnsupportedPatch
+	}
+
+	return func(product *database.Product) error {
+		return applyPatch(product, apply)
+	}, nil
+}
+
+// applyPatch patches the JSON representation of the product, which must keep its ID, version and deletion
+func applyPatch(product *database.Product, apply func(doc []byte) ([]byte, error)) error {
+	doc, marshErr := json.Marshal(product)
+	if marshErr != nil {
+		return marshErr
+	}
+
+	patchedDoc, applyErr := apply(doc)
+	if applyErr != nil {
+		return &patchApplyError{err: applyErr}
+	}
+
+	patched := &database.Product{}
+	decoder := json.NewDecoder(bytes.NewReader(patchedDoc))
+	decoder.DisallowUnknownFields()
+	decodeErr := decoder.Decode(patched)
+	if decodeErr != nil {
+		return &patchApplyError{err: decodeErr}
+	}
+	if patched.ID != product.ID || patched.Version != product.Version || patched.DeletedAt != nil {
+		return &patchApplyError{err: errors.New("id, version and deletedAt are read-only")}
+	}
+	validationErr := patched.Validate()
+	if validationErr != nil {
+		return validationErr
+	}
+
+	*product = *patched
+	return nil
+}
+
+// patchErrorStatusCode maps the errors of a patch to HTTP status codes (RFC 5789)
+func patchErrorStatusCode(err error) int {
+	var applyErr *patchApplyError
+	switch {
+	case errors.Is(err, jsonpatch.ErrTestFailed):
+		return http.StatusConflict
+	case errors.As(err, &applyErr):
+		return http.StatusUnprocessableEntity
+	default:
+		return statusCodeFromError(err)
+	}
+}
@@ -0,0 +1,30 @@
+package rest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestParsePatchBodyLimit checks the patch body is limited as the product one, whatever the middlewares in front
+func TestParsePatchBodyLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		expectedErr bool
+	}{
+		{"within limit", `{"name":"` + strings.Repeat("a", maxProductBodyBytes-12) + `"}`, false},
+		{"beyond limit", `{"name":"` + strings.Repeat("a", maxProductBodyBytes) + `"}`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPatch, "/api/v1/products/1", strings.NewReader(test.body))
+			request.Header.Set(contentTypeHeaderKey, contentTypeMergePatch)
+			_, err := parsePatch(httptest.NewRecorder(), request)
+			if (err != nil) != test.expectedErr {
+				t.Fatalf("expected error %t, got %v", test.expectedErr, err)
+			}
+		})
+	}
+}
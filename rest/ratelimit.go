@@ -0,0 +1,217 @@
+package rest
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	forwardedForHeaderKey       = "X-Forwarded-For"
+	retryAfterHeaderKey         = "Retry-After"
+	rateLimitLimitHeaderKey     = "RateLimit-Limit"
+	rateLimitRemainingHeaderKey = "RateLimit-Remaining"
+	rateLimitResetHeaderKey     = "RateLimit-Reset"
+
+	// buckets refilled since are forgotten, as good as new ones
+	rateLimiterJanitorInterval = time.Minute
+)
+
+// rateLimiter keeps a token bucket per client: each request takes a token, refilled at rate per second up to burst
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	// idle buckets janitor
+	janitorStop    chan struct{}
+	janitorStopped sync.WaitGroup
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitDecision tells whether a request may go on, along with the state of the client bucket
+type rateLimitDecision struct {
+	allowed    bool
+	remaining  int
+	retryAfter time.Duration // until a token is available, if not allowed
+	reset      time.Duration // until the bucket is full again
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take consumes a token from the bucket of the client, if any is left
+func (l *rateLimiter) take(client string, now time.Time) *rateLimitDecision {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bucket, found := l.buckets[client]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[client] = bucket
+	}
+	l.refill(bucket, now)
+
+	decision := &rateLimitDecision{allowed: bucket.tokens >= 1}
+	if decision.allowed {
+		bucket.tokens--
+	} else {
+		decision.retryAfter = l.durationOf(1 - bucket.tokens)
+	}
+	decision.remaining = int(bucket.tokens)
+	decision.reset = l.durationOf(l.burst - bucket.tokens)
+	return decision
+}
+
+// giveBack returns a token taken from the bucket of the client, as if the request was not counted
+func (l *rateLimiter) giveBack(client string, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if bucket, found := l.buckets[client]; found {
+		l.refill(bucket, now)
+		bucket.tokens = math.Min(l.burst, bucket.tokens+1)
+	}
+}
+
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.updated = now
+	}
+}
+
+// durationOf returns the time needed to refill the tokens
+func (l *rateLimiter) durationOf(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// forgetIdleBuckets deletes the buckets full again, clients coming back start from a full bucket anyway
+func (l *rateLimiter) forgetIdleBuckets(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for client, bucket := range l.buckets {
+		l.refill(bucket, now)
+		if bucket.tokens >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+func (l *rateLimiter) startJanitor() {
+	l.janitorStop = make(chan struct{})
+	l.janitorStopped.Add(1)
+	go func() {
+		defer l.janitorStopped.Done()
+
+		ticker := time.NewTicker(rateLimiterJanitorInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.janitorStop:
+				return
+			case now := <-ticker.C:
+				l.forgetIdleBuckets(now)
+			}
+		}
+	}()
+}
+
+func (l *rateLimiter) stopJanitor() {
+	if l.janitorStop == nil {
+		return
+	}
+	close(l.janitorStop)
+	l.janitorStopped.Wait()
+	l.janitorStop = nil
+}
+
+// withIpRateLimit replies 429 to the IPs exceeding their rate limit, before authentication not to let clients guess
+// credentials at will. Subjects authenticated get their token back, to be limited on their own by withSubjectRateLimit.
+func (s *Server) withIpRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		s.limitRate(writer, request, s.ipRateLimitClient(request), next)
+	})
+}
+
+// withSubjectRateLimit replies 429 to the subjects authenticated exceeding their rate limit, whatever their IP
+func (s *Server) withSubjectRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		subject := subjectFromRequest(request)
+		if subject == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		s.rateLimiter.giveBack(s.ipRateLimitClient(request), time.Now())
+		s.limitRate(writer, request, "subject:"+subject, next)
+	})
+}
+
+// limitRate serves the request if the client bucket has a token left, replies 429 otherwise
+func (s *Server) limitRate(writer http.ResponseWriter, request *http.Request, client string, next http.Handler) {
+	decision := s.rateLimiter.take(client, time.Now())
+
+	writer.Header().Set(rateLimitLimitHeaderKey, strconv.Itoa(s.config.rateLimitBurst))
+	writer.Header().Set(rateLimitRemainingHeaderKey, strconv.Itoa(decision.remaining))
+	writer.Header().Set(rateLimitResetHeaderKey, strconv.Itoa(ceilSeconds(decision.reset)))
+	if decision.allowed {
+		next.ServeHTTP(writer, request)
+		return
+	}
+
+	info := requestInfoFromContext(request.Context())
+	rateLimitedRequests.WithLabelValues(request.Method, info.route).Inc()
+	logging.SugaredLog.Debugf("Rate limit exceeded by %s (request ID %s)", client, info.id)
+
+	writer.Header().Set(retryAfterHeaderKey, strconv.Itoa(ceilSeconds(decision.retryAfter)))
+	sendProblem(writer, &problem{
+		Type:   problemTypeDefault,
+		Title:  http.StatusText(http.StatusTooManyRequests),
+		Status: http.StatusTooManyRequests,
+		Detail: "Rate limit exceeded, retry later",
+	})
+}
+
+// ipRateLimitClient returns the key of the IP bucket of the client
+func (s *Server) ipRateLimitClient(request *http.Request) string {
+	return "ip:" + s.clientIp(request)
+}
+
+// clientIp returns the IP the request comes from. The last X-Forwarded-For entry, added by the proxy in front of the
+// service, is used only if the request comes from a trusted proxy, as clients can set the header to anything.
+func (s *Server) clientIp(request *http.Request) string {
+	forwardedFor := request.Header.Values(forwardedForHeaderKey)
+	if len(forwardedFor) > 0 && s.isTrustedProxy(request.RemoteAddr) {
+		hops := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, splitErr := net.SplitHostPort(request.RemoteAddr)
+	if splitErr != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds rounds the duration up to whole seconds, as expected by Retry-After and RateLimit-Reset
+func ceilSeconds(duration time.Duration) int {
+	return int(math.Ceil(duration.Seconds()))
+}
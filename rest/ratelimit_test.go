@@ -0,0 +1,140 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 2; i >= 0; i-- {
+		decision := limiter.take("client", now)
+		if !decision.allowed || decision.remaining != i {
+			t.Fatalf("expected request allowed with %d remaining, got %+v", i, decision)
+		}
+	}
+	decision := limiter.take("client", now)
+	if decision.allowed || decision.retryAfter != 500*time.Millisecond || decision.reset != 1500*time.Millisecond {
+		t.Fatalf("expected request limited for 500ms, reset in 1.5s, got %+v", decision)
+	}
+	if other := limiter.take("other", now); !other.allowed {
+		t.Fatalf("expected other clients not limited, got %+v", other)
+	}
+
+	if decision = limiter.take("client", now.Add(500*time.Millisecond)); !decision.allowed {
+		t.Fatalf("expected request allowed once a token is refilled, got %+v", decision)
+	}
+	limiter.giveBack("client", now.Add(500*time.Millisecond))
+	if decision = limiter.take("client", now.Add(500*time.Millisecond)); !decision.allowed {
+		t.Fatalf("expected request allowed with the token given back, got %+v", decision)
+	}
+
+	limiter.forgetIdleBuckets(now.Add(time.Second))
+	if _, found := limiter.buckets["other"]; found {
+		t.Fatal("expected bucket refilled forgotten")
+	}
+	if _, found := limiter.buckets["client"]; !found {
+		t.Fatal("expected bucket still refilling kept")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Setenv(rateLimitEnabledEnvVar, "true")
+	t.Setenv(rateLimitRateEnvVar, "1")
+	t.Setenv(rateLimitBurstEnvVar, "2")
+	handler := newTestServer(t).httpServer.Handler
+
+	for _, expectedCode := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		response := serveHandler(handler, http.MethodGet, productsEndpoint, nil)
+		if response.Code != expectedCode || response.Header().Get(rateLimitLimitHeaderKey) != "2" {
+			t.Fatalf("expected %d with rate limit headers, got %d %v", expectedCode, response.Code, response.Header())
+		}
+	}
+	response := serveHandler(handler, http.MethodGet, productsEndpoint, nil)
+	if retryAfter := response.Header().Get(retryAfterHeaderKey); retryAfter != "1" {
+		t.Fatalf("expected Retry-After 1, got %q", retryAfter)
+	}
+
+	// only subjects authenticated get their own buckets
+	response = serveHandler(handler, http.MethodGet, productsEndpoint, map[string]string{apiKeyHeaderKey: "key"})
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected unverified API key limited along with its IP, got %d", response.Code)
+	}
+}
+
+func TestRateLimitAuthenticated(t *testing.T) {
+	t.Setenv(rateLimitEnabledEnvVar, "true")
+	t.Setenv(rateLimitRateEnvVar, "1")
+	t.Setenv(rateLimitBurstEnvVar, "2")
+	// requests served from 192.0.2.1
+	t.Setenv(trustedProxiesEnvVar, "192.0.2.1")
+	handler := newAuthServer(t, writeJwks(t, newSigningKey(t))).httpServer.Handler
+
+	fromIp := func(ip string, headers map[string]string) map[string]string {
+		headers[forwardedForHeaderKey] = ip
+		return headers
+	}
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		expectedCode int
+	}{
+		// guessing credentials, limited by IP
+		{"unknown API key", fromIp("1.1.1.1", apiKey("nope")), http.StatusUnauthorized},
+		{"no credentials", fromIp("1.1.1.1", map[string]string{}), http.StatusUnauthorized},
+		{"IP over its limit", fromIp("1.1.1.1", apiKey("nope")), http.StatusTooManyRequests},
+		{"other IP", fromIp("2.2.2.2", apiKey("nope")), http.StatusUnauthorized},
+		// limited by subject, whatever the IP
+		{"subject", fromIp("3.3.3.3", apiKey("read-only")), http.StatusOK},
+		{"subject again", fromIp("3.3.3.3", apiKey("read-only")), http.StatusOK},
+		{"subject over its limit", fromIp("4.4.4.4", apiKey("read-only")), http.StatusTooManyRequests},
+		{"other subject, same IP", fromIp("3.3.3.3", apiKey("read-write")), http.StatusOK},
+	}
+	for _, test := range tests {
+		response := serveHandler(handler, http.MethodGet, productsEndpoint, test.headers)
+		if response.Code != test.expectedCode {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.expectedCode, response.Code)
+		}
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	t.Setenv(trustedProxiesEnvVar, "10.0.0.0/8")
+	server := newTestServer(t)
+	request, _ := http.NewRequest(http.MethodGet, productsEndpoint, nil)
+	request.Header.Add(forwardedForHeaderKey, "1.1.1.1, 2.2.2.2")
+	request.Header.Add(forwardedForHeaderKey, "3.3.3.3")
+
+	request.RemoteAddr = "192.0.2.1:4321"
+	if ip := server.clientIp(request); ip != "192.0.2.1" {
+		t.Errorf("expected remote address of an untrusted peer, got %s", ip)
+	}
+	request.RemoteAddr = "10.0.0.1:4321"
+	if ip := server.clientIp(request); ip != "3.3.3.3" {
+		t.Errorf("expected last forwarded address, got %s", ip)
+	}
+}
+
+func TestRateLimitSpoofedForwardedFor(t *testing.T) {
+	t.Setenv(rateLimitEnabledEnvVar, "true")
+	t.Setenv(rateLimitRateEnvVar, "1")
+	t.Setenv(rateLimitBurstEnvVar, "2")
+	t.Setenv(trustedProxiesEnvVar, "10.0.0.0/8")
+	server := newTestServer(t)
+
+	// requests served from 192.0.2.1, not a trusted proxy, claiming a new IP every time
+	for i, expectedCode := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		headers := map[string]string{forwardedForHeaderKey: fmt.Sprintf("1.1.1.%d", i)}
+		response := serveHandler(server.httpServer.Handler, http.MethodGet, productsEndpoint, headers)
+		if response.Code != expectedCode {
+			t.Fatalf("expected %d, got %d", expectedCode, response.Code)
+		}
+	}
+	if buckets := len(server.rateLimiter.buckets); buckets != 1 {
+		t.Fatalf("expected a single bucket for the peer, got %d", buckets)
+	}
+}
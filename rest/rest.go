@@ -2,21 +2,51 @@ package rest
 
 import (
 	"context"
-	"database/sql"
 	"fmt"
 	"time"
 
+	"github.com/gorilla/websocket"
+
+	"github.com/bygui86/go-k8s-probes/database"
 	"github.com/bygui86/go-k8s-probes/logging"
 )
 
-func New(dbInterface *sql.DB) (*Server, error) {
+// New creates the Products server, idempotencyStore may be nil to ignore Idempotency-Key headers, pool may be nil
+// not to shed load on DB connection waits. The products cache can be flushed if the repository is a
+// database.ProductCache, e.g. a database.CachedRepository.
+func New(repository database.ProductRepository, idempotencyStore database.IdempotencyStore,
+	pool PoolStats) (*Server, error) {
 	logging.Log.Info("Create new Products server")
 
 	cfg := loadConfig()
 
+	spec, specErr := loadOpenApiSpec()
+	if specErr != nil {
+		return nil, fmt.Errorf("OpenAPI spec loading failed: %s", specErr.Error())
+	}
+
 	server := &Server{
-		config:      cfg,
-		dbInterface: dbInterface,
+		config:           cfg,
+		openApi:          spec,
+		repository:       repository,
+		idempotencyStore: idempotencyStore,
+		events:           newEventBroker(cfg.eventsBacklogSize),
+	}
+	server.wsUpgrader = &websocket.Upgrader{CheckOrigin: server.checkWebSocketOrigin}
+	if cache, ok := repository.(database.ProductCache); ok {
+		server.productCache = cache
+	}
+	if cfg.rateLimitEnabled {
+		server.rateLimiter = newRateLimiter(cfg.rateLimitRate, cfg.rateLimitBurst)
+	}
+	if cfg.loadSheddingEnabled {
+		server.loadShedder = newLoadShedder(cfg.loadSheddingMaxInFlight, cfg.loadSheddingMaxDbWait, pool)
+	}
+	if cfg.authEnabled {
+		authErr := server.setupAuthenticators()
+		if authErr != nil {
+			return nil, fmt.Errorf("authentication setup failed: %s", authErr.Error())
+		}
 	}
 
 	server.setupRouter()
@@ -39,6 +69,16 @@ func (s *Server) Start() error {
 			return err
 		}
 		s.running = true
+		s.startIdempotencyJanitor()
+		if s.rateLimiter != nil {
+			s.rateLimiter.startJanitor()
+		}
+		if s.loadShedder != nil {
+			s.loadShedder.startSampler()
+		}
+		if s.jwtAuthenticator != nil {
+			s.jwtAuthenticator.startRefresher()
+		}
 		logging.SugaredLog.Infof("Products server listening on port %d", s.config.restPort)
 		return nil
 	}
@@ -50,6 +90,9 @@ func (s *Server) Shutdown(timeout time.Duration) {
 	logging.SugaredLog.Warnf("Shutdown Products server, timeout %.0f seconds", timeout.Seconds())
 
 	if s.httpServer != nil && s.running {
+		// event streams would otherwise keep the server waiting until the timeout
+		s.events.close()
+
 		// create a deadline to wait for.
 		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
@@ -59,6 +102,16 @@ func (s *Server) Shutdown(timeout time.Duration) {
 			logging.SugaredLog.Errorf("Products server shutdown failed: %s", err.Error())
 		}
 
+		s.stopIdempotencyJanitor()
+		if s.rateLimiter != nil {
+			s.rateLimiter.stopJanitor()
+		}
+		if s.loadShedder != nil {
+			s.loadShedder.stopSampler()
+		}
+		if s.jwtAuthenticator != nil {
+			s.jwtAuthenticator.stopRefresher()
+		}
 		s.running = false
 		return
 	}
@@ -0,0 +1,92 @@
+package rest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bygui86/go-k8s-probes/database"
+)
+
+// The credentials and the change feed of the products are shared with the other APIs serving them, e.g. gRPC,
+// for clients to see the same products whatever the API they use.
+
+var (
+	// ErrScopeMissing is wrapped by AuthorizeHeaders when the subject authenticated lacks the scope needed
+	ErrScopeMissing = errors.New("scope missing")
+
+	errSubscriberDropped = errors.New("events subscriber dropped")
+)
+
+// AuthorizeHeaders authenticates the credentials among the headers as the REST API does, i.e. X-API-Key or
+// Authorization, checking the scope granted: products:read to read, products:write to write.
+// It returns the subject authenticated, empty if authentication is disabled, or ErrNoCredentials if there are none.
+func (s *Server) AuthorizeHeaders(header http.Header, write bool) (string, error) {
+	if !s.config.authEnabled {
+		return "", nil
+	}
+
+	authenticated, authErr := s.authenticate(&http.Request{Header: header})
+	if authErr != nil {
+		return "", authErr
+	}
+	scope := scopeRead
+	if write {
+		scope = scopeWrite
+	}
+	if !authenticated.scopes[scope] {
+		return authenticated.subject, fmt.Errorf("%w: %s required", ErrScopeMissing, scope)
+	}
+	return authenticated.subject, nil
+}
+
+// ForwardedUser returns the user authenticated by the proxy in front of the service, from the X-Forwarded-User
+// header, if the request comes from a trusted proxy: clients could claim to be anybody otherwise.
+// It returns an empty string if the header is missing or not trusted.
+func (s *Server) ForwardedUser(header http.Header, remoteAddr string) string {
+	if !s.isTrustedProxy(remoteAddr) {
+		return ""
+	}
+	return header.Get(forwardedUserHeaderKey)
+}
+
+// PublishProductEvent notifies the subscribers of the product events of a change made through another API,
+// product is nil for deletions
+func (s *Server) PublishProductEvent(eventType string, productId int, product *database.Product) {
+	s.events.publish(eventType, productId, product)
+}
+
+// WatchProductEvents invokes send for every product event, replaying the ones since lastEventId first, until ctx is
+// done, send fails or the subscriber is dropped, e.g. for being too slow or shutting down.
+// The first event is a reset if the events since lastEventId are not available anymore.
+func (s *Server) WatchProductEvents(lastEventId string, send func(event *ProductEvent) error,
+	ctx context.Context) error {
+
+	sub, replay, resumable, subErr := s.events.subscribe(lastEventId)
+	if subErr != nil {
+		return subErr
+	}
+	defer s.events.unsubscribe(sub)
+
+	if !resumable {
+		replay = append([]*ProductEvent{{Type: EventReset}}, replay...)
+	}
+	for _, event := range replay {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case event := <-sub.events:
+			if err := send(event); err != nil {
+				return err
+			}
+		case <-sub.done:
+			return errSubscriberDropped
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package rest
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	shedReasonInFlight = "in-flight"
+	shedReasonDbWait   = "db-wait"
+
+	// how often the DB pool wait time is sampled
+	loadSheddingSampleInterval = time.Second
+	// the server is reported degraded for this long after shedding a request
+	loadSheddingDegradedPeriod = 30 * time.Second
+	// seconds clients are told to wait before retrying
+	loadSheddingRetryAfter = 1
+)
+
+// loadShedder rejects requests early while the server is overloaded, i.e. when too many requests are in flight or
+// getting a DB connection takes too long on average
+type loadShedder struct {
+	maxInFlight int64
+	maxDbWait   time.Duration
+	pool        PoolStats
+	inFlight    int64 // atomic
+	dbWait      int64 // atomic, average wait of the last sample in nanoseconds
+	lastShed    int64 // atomic, unix nanoseconds
+	lastReason  atomic.Value
+	lastStats   sql.DBStats
+	// DB pool sampler
+	samplerStop    chan struct{}
+	samplerStopped sync.WaitGroup
+}
+
+func newLoadShedder(maxInFlight int, maxDbWait time.Duration, pool PoolStats) *loadShedder {
+	shedder := &loadShedder{
+		maxInFlight: int64(maxInFlight),
+		maxDbWait:   maxDbWait,
+		pool:        pool,
+	}
+	shedder.lastReason.Store("")
+	return shedder
+}
+
+// overloaded returns the reason to shed a request, empty if it can be served
+func (l *loadShedder) overloaded() string {
+	if atomic.LoadInt64(&l.inFlight) >= l.maxInFlight {
+		return shedReasonInFlight
+	}
+	if time.Duration(atomic.LoadInt64(&l.dbWait)) > l.maxDbWait {
+		return shedReasonDbWait
+	}
+	return ""
+}
+
+// sampleDbWait computes the average time spent waiting for a DB connection since the previous sample
+func (l *loadShedder) sampleDbWait() {
+	stats := l.pool.Stats()
+	var wait time.Duration
+	if waits := stats.WaitCount - l.lastStats.WaitCount; waits > 0 {
+		wait = (stats.WaitDuration - l.lastStats.WaitDuration) / time.Duration(waits)
+	}
+	atomic.StoreInt64(&l.dbWait, int64(wait))
+	l.lastStats = stats
+}
+
+func (l *loadShedder) startSampler() {
+	if l.pool == nil {
+		return
+	}
+
+	l.lastStats = l.pool.Stats()
+	l.samplerStop = make(chan struct{})
+	l.samplerStopped.Add(1)
+	go func() {
+		defer l.samplerStopped.Done()
+
+		ticker := time.NewTicker(loadSheddingSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.samplerStop:
+				return
+			case <-ticker.C:
+				l.sampleDbWait()
+			}
+		}
+	}()
+}
+
+func (l *loadShedder) stopSampler() {
+	if l.samplerStop == nil {
+		return
+	}
+	close(l.samplerStop)
+	l.samplerStopped.Wait()
+	l.samplerStop = nil
+}
+
+func (l *loadShedder) getStatus() *LoadSheddingStatus {
+	lastShed := atomic.LoadInt64(&l.lastShed)
+	return &LoadSheddingStatus{
+		Shedding: lastShed > 0 && time.Since(time.Unix(0, lastShed)) < loadSheddingDegradedPeriod,
+		Reason:   l.lastReason.Load().(string),
+		InFlight: int(atomic.LoadInt64(&l.inFlight)),
+		DbWait:   time.Duration(atomic.LoadInt64(&l.dbWait)),
+	}
+}
+
+// withLoadShedding replies 503 while the server is overloaded, before doing any work.
+// Event streams are not counted in flight, as they last as long as the clients listen.
+func (s *Server) withLoadShedding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		info := requestInfoFromContext(request.Context())
+		reason := s.loadShedder.overloaded()
+		if reason == "" {
+			if info.route != eventsEndpoint {
+				atomic.AddInt64(&s.loadShedder.inFlight, 1)
+				defer atomic.AddInt64(&s.loadShedder.inFlight, -1)
+			}
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		atomic.StoreInt64(&s.loadShedder.lastShed, time.Now().UnixNano())
+		s.loadShedder.lastReason.Store(reason)
+		shedRequests.WithLabelValues(reason).Inc()
+		logging.SugaredLog.Debugf("Request shed, reason %s (request ID %s)", reason, info.id)
+
+		writer.Header().Set(retryAfterHeaderKey, strconv.Itoa(loadSheddingRetryAfter))
+		sendProblem(writer, &problem{
+			Type:   problemTypeDefault,
+			Title:  http.StatusText(http.StatusServiceUnavailable),
+			Status: http.StatusServiceUnavailable,
+			Detail: "Server overloaded, retry later",
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package rest
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakePool struct {
+	stats sql.DBStats
+}
+
+func (p *fakePool) Stats() sql.DBStats {
+	return p.stats
+}
+
+func TestLoadSheddingInFlight(t *testing.T) {
+	t.Setenv(loadSheddingEnabledEnvVar, "true")
+	t.Setenv(loadSheddingMaxInFlightEnvVar, "1")
+	server := newTestServer(t)
+
+	release := make(chan struct{})
+	served := make(chan struct{})
+	server.router.HandleFunc("/slow", func(writer http.ResponseWriter, request *http.Request) {
+		close(served)
+		<-release
+	})
+	go serveHandler(server.httpServer.Handler, http.MethodGet, "/slow", nil)
+	<-served
+
+	shed := shedRequests.WithLabelValues(shedReasonInFlight)
+	before := testutil.ToFloat64(shed)
+	response := serveHandler(server.httpServer.Handler, http.MethodGet, productsEndpoint, nil)
+	close(release)
+
+	if response.Code != http.StatusServiceUnavailable || response.Header().Get(retryAfterHeaderKey) == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %v", response.Code, response.Header())
+	}
+	if count := testutil.ToFloat64(shed) - before; count != 1 {
+		t.Fatalf("expected 1 request shed, got %.0f", count)
+	}
+	if status := server.GetLoadSheddingStatus(); !status.Shedding || status.Reason != shedReasonInFlight {
+		t.Fatalf("expected shedding status, got %+v", status)
+	}
+}
+
+func TestLoadSheddingDbWait(t *testing.T) {
+	pool := &fakePool{}
+	shedder := newLoadShedder(10, 100*time.Millisecond, pool)
+	shedder.lastStats = pool.Stats()
+
+	pool.stats = sql.DBStats{WaitCount: 4, WaitDuration: 200 * time.Millisecond}
+	shedder.sampleDbWait()
+	if reason := shedder.overloaded(); reason != "" {
+		t.Fatalf("expected 50ms average wait accepted, got %q", reason)
+	}
+
+	pool.stats = sql.DBStats{WaitCount: 6, WaitDuration: 600 * time.Millisecond}
+	shedder.sampleDbWait()
+	if reason := shedder.overloaded(); reason != shedReasonDbWait {
+		t.Fatalf("expected 200ms average wait shed, got %q", reason)
+	}
+
+	shedder.sampleDbWait()
+	if reason := shedder.overloaded(); reason != "" {
+		t.Fatalf("expected no wait since last sample accepted, got %q", reason)
+	}
+}
+
+// TestEventStreamsNotInFlight makes sure long lived streams don't count against the in flight limit
+func TestEventStreamsNotInFlight(t *testing.T) {
+	t.Setenv(loadSheddingEnabledEnvVar, "true")
+	t.Setenv(loadSheddingMaxInFlightEnvVar, "1")
+	server := newTestServer(t)
+	httpServer := httptest.NewServer(server.httpServer.Handler)
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + eventsEndpoint)
+	if err != nil {
+		t.Fatalf("events request failed: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	if products := serveHandler(server.httpServer.Handler, http.MethodGet, productsEndpoint, nil); products.Code != http.StatusOK {
+		t.Fatalf("expected products served while streaming, got %d", products.Code)
+	}
+}
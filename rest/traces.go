@@ -6,6 +6,7 @@ import (
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/ext"
+	"github.com/uber/jaeger-client-go"
 
 	"github.com/bygui86/go-k8s-probes/logging"
 )
@@ -21,7 +22,19 @@ func retrieveSpanAndCtx(request *http.Request, operationName string) (opentracin
 	// Create the span referring to the RPC client if available.
 	// If clientSpanContext == nil, a root span will be created.
 	span := opentracing.StartSpan(operationName, ext.RPCServerOption(clientSpanContext))
+	if info := requestInfoFromContext(request.Context()); info.id != "" {
+		span.SetTag("request-id", info.id)
+	}
 	ctx := opentracing.ContextWithSpan(context.Background(), span)
 
 	return span, ctx
 }
+
+// traceIdFromSpan returns the ID of the trace the span belongs to, empty if tracing is disabled
+func traceIdFromSpan(span opentracing.Span) string {
+	spanContext, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
@@ -1,13 +1,22 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/opentracing/opentracing-go"
+	"github.com/shopspring/decimal"
 
 	"github.com/bygui86/go-k8s-probes/commons"
+	"github.com/bygui86/go-k8s-probes/database"
 	"github.com/bygui86/go-k8s-probes/logging"
 )
 
@@ -16,9 +25,47 @@ const (
 	v1Endpoint         = "/api/v1"
 	productsEndpoint   = v1Endpoint + "/products"
 	productsIdEndpoint = productsEndpoint + "/{id:[0-9]+}"
+	importEndpoint     = productsEndpoint + ":import"
+	exportEndpoint     = productsEndpoint + ":export"
+	restoreEndpoint    = productsIdEndpoint + ":restore"
+	historyEndpoint    = productsIdEndpoint + "/history"
 
 	contentTypeHeaderKey       = "Content-Type"
 	contentTypeApplicationJson = "application/json"
+	contentTypeProblemJson     = "application/problem+json"
+	readYourWritesHeaderKey    = "X-Read-Your-Writes" // bool
+	etagHeaderKey              = "ETag"
+	ifMatchHeaderKey           = "If-Match"
+	linkHeaderKey              = "Link"
+	totalCountHeaderKey        = "X-Total-Count"
+	// set by the authenticating proxy in front of the service
+	forwardedUserHeaderKey = "X-Forwarded-User"
+
+	// products list query params
+	countParam     = "count"
+	startParam     = "start"
+	cursorParam    = "cursor"
+	withTotalParam = "withTotal" // bool
+	nameParam      = "name"
+	minPriceParam  = "minPrice"
+	maxPriceParam  = "maxPrice"
+	sortParam      = "sort"
+	searchParam    = "q"
+	// also for a single product
+	includeDeletedParam = "includeDeleted" // bool
+
+	linkFormat = `<%s>; rel="%s"`
+
+	// no further semantics than the HTTP status code (RFC 7807)
+	problemTypeDefault  = "about:blank"
+	internalErrorDetail = "Unexpected error, look for the trace ID in the logs"
+	maxProductBodyBytes = 1 << 20
+
+	etagFormat   = `"%d"`
+	etagWildcard = "*"
+	weakPrefix   = "W/"
+	// matches no product version, for ETags not issued by this server
+	unmatchableVersion = -1
 )
 
 // SERVER
@@ -28,10 +75,39 @@ func (s *Server) setupRouter() {
 
 	s.router = mux.NewRouter().StrictSlash(true)
 	s.router.HandleFunc(productsEndpoint, s.getProducts).Methods(http.MethodGet)
+	s.router.HandleFunc(eventsEndpoint, s.streamProductEvents).Methods(http.MethodGet)
 	s.router.HandleFunc(productsIdEndpoint, s.getProduct).Methods(http.MethodGet)
-	s.router.HandleFunc(productsEndpoint, s.createProduct).Methods(http.MethodPost)
+	s.router.HandleFunc(productsEndpoint, s.withIdempotency(s.createProduct)).Methods(http.MethodPost)
 	s.router.HandleFunc(productsIdEndpoint, s.updateProduct).Methods(http.MethodPut)
+	s.router.HandleFunc(productsIdEndpoint, s.patchProduct).Methods(http.MethodPatch)
 	s.router.HandleFunc(productsIdEndpoint, s.deleteProduct).Methods(http.MethodDelete)
+	s.router.HandleFunc(restoreEndpoint, s.restoreProduct).Methods(http.MethodPost)
+	s.router.HandleFunc(historyEndpoint, s.getProductHistory).Methods(http.MethodGet)
+	s.router.HandleFunc(importEndpoint, s.importProducts).Methods(http.MethodPost)
+	s.router.HandleFunc(exportEndpoint, s.exportProducts).Methods(http.MethodGet)
+	s.router.HandleFunc(openApiEndpoint, s.getOpenApiSpec).Methods(http.MethodGet)
+	s.router.HandleFunc(adminCacheEndpoint, s.flushProductCache).Methods(http.MethodDelete)
+	if s.config.swaggerUiEnabled {
+		s.router.HandleFunc(swaggerUiEndpoint, s.getSwaggerUi).Methods(http.MethodGet)
+	}
+	if len(s.config.corsAllowedOrigins) > 0 {
+		s.setupPreflightRoutes()
+	}
+	s.router.Use(withRouteTemplate)
+	if s.config.loadSheddingEnabled {
+		s.router.Use(s.withLoadShedding)
+	}
+	// clients failing authentication are limited by IP too
+	if s.config.rateLimitEnabled {
+		s.router.Use(s.withIpRateLimit)
+	}
+	if s.config.authEnabled {
+		s.router.Use(s.withAuthentication)
+	}
+	if s.config.rateLimitEnabled && s.config.authEnabled {
+		s.router.Use(s.withSubjectRateLimit)
+	}
+	s.router.Use(s.withValidation)
 }
 
 func (s *Server) setupHTTPServer() {
@@ -40,7 +116,7 @@ func (s *Server) setupHTTPServer() {
 	if s.config != nil {
 		s.httpServer = &http.Server{
 			Addr:    fmt.Sprintf(commons.HttpServerHostFormat, s.config.restHost, s.config.restPort),
-			Handler: s.router,
+			Handler: s.withMiddlewares(s.router),
 			// Good practice to set timeouts to avoid Slowloris attacks.
 			WriteTimeout: commons.HttpServerWriteTimeoutDefault,
 			ReadTimeout:  commons.HttpServerReadTimeoutDefault,
@@ -64,6 +140,264 @@ func sendJsonResponse(writer http.ResponseWriter, code int, payload interface{})
 	}
 }
 
-func sendErrorResponse(writer http.ResponseWriter, code int, message string) {
-	sendJsonResponse(writer, code, map[string]string{"error": message})
+// sendErrorResponse sends the message as problem detail, unless it's a server error whose details stay in logs
+func sendErrorResponse(writer http.ResponseWriter, span opentracing.Span, code int, message string) {
+	traceId := traceIdFromSpan(span)
+	if code >= http.StatusInternalServerError {
+		logging.SugaredLog.Errorf("%s (trace ID %s)", message, traceId)
+		message = internalErrorDetail
+	}
+	sendProblem(writer, &problem{
+		Type:    problemTypeDefault,
+		Title:   http.StatusText(code),
+		Status:  code,
+		Detail:  message,
+		TraceID: traceId,
+	})
+}
+
+// sendValidationErrorResponse lists the invalid product fields, err is expected to be a *database.ValidationError
+func sendValidationErrorResponse(writer http.ResponseWriter, span opentracing.Span, message string, err error) {
+	var validationErr *database.ValidationError
+	if !errors.As(err, &validationErr) {
+		sendErrorResponse(writer, span, http.StatusInternalServerError, message)
+		return
+	}
+
+	invalidParams := make([]*invalidParam, 0, len(validationErr.InvalidParams))
+	for _, param := range validationErr.InvalidParams {
+		invalidParams = append(invalidParams, &invalidParam{Name: param.Name, Reason: param.Reason})
+	}
+	sendProblem(writer, &problem{
+		Type:          problemTypeDefault,
+		Title:         http.StatusText(http.StatusUnprocessableEntity),
+		Status:        http.StatusUnprocessableEntity,
+		Detail:        message,
+		InvalidParams: invalidParams,
+		TraceID:       traceIdFromSpan(span),
+	})
+}
+
+func sendProblem(writer http.ResponseWriter, prob *problem) {
+	response, _ := json.Marshal(prob)
+	writer.Header().Set(contentTypeHeaderKey, contentTypeProblemJson)
+	writer.WriteHeader(prob.Status)
+	_, err := writer.Write(response)
+	if err != nil {
+		logging.SugaredLog.Errorf("Error sending problem response: %s", err.Error())
+	}
+}
+
+// decodeProduct reads the product in the request body, which must be a single JSON object with known fields only
+func decodeProduct(writer http.ResponseWriter, request *http.Request) (*database.Product, error) {
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, maxProductBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	var product *database.Product
+	err := decoder.Decode(&product)
+	if err != nil {
+		return nil, err
+	}
+	if product == nil {
+		return nil, errors.New("a JSON object is expected")
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON object")
+	}
+	return product, nil
+}
+
+// statusCodeFromError maps repository errors to HTTP status codes
+func statusCodeFromError(err error) int {
+	switch err {
+	case database.ErrProductNotFound:
+		return http.StatusNotFound
+	case database.ErrVersionMismatch:
+		return http.StatusPreconditionFailed
+	case database.ErrNotDeleted:
+		return http.StatusConflict
+	case database.ErrInvalidCursor, database.ErrInvalidSort:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// withReadConsistency routes reads to the primary DB when the client asks to read its own writes
+func withReadConsistency(request *http.Request, ctx context.Context) context.Context {
+	readYourWrites, _ := strconv.ParseBool(request.Header.Get(readYourWritesHeaderKey))
+	if readYourWrites {
+		return database.WithPrimary(ctx)
+	}
+	return ctx
+}
+
+// withActor records who makes the changes in the product history: the subject authenticated, or the user
+// authenticated by a trusted proxy in front of the service if authentication is disabled, anonymous otherwise
+func (s *Server) withActor(request *http.Request, ctx context.Context) context.Context {
+	if subject := subjectFromRequest(request); subject != "" {
+		return database.WithActor(ctx, subject)
+	}
+	return database.WithActor(ctx, s.ForwardedUser(request.Header, request.RemoteAddr))
+}
+
+// isTrustedProxy tells whether the request comes straight from a proxy trusted to set the forwarded headers
+func (s *Server) isTrustedProxy(remoteAddr string) bool {
+	host, _, splitErr := net.SplitHostPort(remoteAddr)
+	if splitErr != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range s.config.trustedProxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIncludeDeleted tells whether deleted products are requested too
+func parseIncludeDeleted(request *http.Request) (bool, error) {
+	value := request.URL.Query().Get(includeDeletedParam)
+	if value == "" {
+		return false, nil
+	}
+	includeDeleted, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("invalid includeDeleted, must be a boolean")
+	}
+	return includeDeleted, nil
+}
+
+func setETag(writer http.ResponseWriter, version int) {
+	writer.Header().Set(etagHeaderKey, versionETag(version))
+}
+
+func versionETag(version int) string {
+	return fmt.Sprintf(etagFormat, version)
+}
+
+// parseIfMatch returns the product version required by the If-Match header, 0 if any version is fine.
+// Only a single ETag is supported, as product versions are compared by the DB in one shot.
+func parseIfMatch(request *http.Request) (int, error) {
+	ifMatch := strings.TrimSpace(request.Header.Get(ifMatchHeaderKey))
+	if ifMatch == "" || ifMatch == etagWildcard {
+		return 0, nil
+	}
+
+	// versions are compared as strong validators anyway
+	etag := strings.TrimPrefix(ifMatch, weakPrefix)
+	unquoted, unquoteErr := strconv.Unquote(etag)
+	if unquoteErr != nil {
+		return 0, errors.New("invalid If-Match header, a single ETag is expected")
+	}
+	version, versionErr := strconv.Atoi(unquoted)
+	if versionErr != nil || version < 1 {
+		return unmatchableVersion, nil
+	}
+	return version, nil
+}
+
+// parseProductsQuery validates the products list query params, rejecting rather than defaulting invalid values
+func (s *Server) parseProductsQuery(request *http.Request) (*database.ProductsQuery, error) {
+	params := request.URL.Query()
+	query := &database.ProductsQuery{Limit: s.config.defaultPageSize}
+
+	if value := params.Get(countParam); value != "" {
+		count, countErr := strconv.Atoi(value)
+		if countErr != nil || count < 1 || count > s.config.maxPageSize {
+			return nil, fmt.Errorf("invalid count, must be between 1 and %d", s.config.maxPageSize)
+		}
+		query.Limit = count
+	}
+
+	if value := params.Get(startParam); value != "" {
+		start, startErr := strconv.Atoi(value)
+		if startErr != nil || start < 0 {
+			return nil, errors.New("invalid start, must be an offset greater than or equal to 0")
+		}
+		query.Offset = start
+	}
+
+	query.Cursor = params.Get(cursorParam)
+	if query.Cursor != "" && query.Offset != 0 {
+		return nil, errors.New("start and cursor are mutually exclusive")
+	}
+
+	if value := params.Get(withTotalParam); value != "" {
+		withTotal, withTotalErr := strconv.ParseBool(value)
+		if withTotalErr != nil {
+			return nil, errors.New("invalid withTotal, must be a boolean")
+		}
+		query.WithTotal = withTotal
+	}
+
+	includeDeleted, includeDeletedErr := parseIncludeDeleted(request)
+	if includeDeletedErr != nil {
+		return nil, includeDeletedErr
+	}
+	query.IncludeDeleted = includeDeleted
+
+	query.NamePrefix = params.Get(nameParam)
+	query.Search = params.Get(searchParam)
+
+	var priceErr error
+	query.MinPrice, priceErr = parsePriceParam(params, minPriceParam)
+	if priceErr != nil {
+		return nil, priceErr
+	}
+	query.MaxPrice, priceErr = parsePriceParam(params, maxPriceParam)
+	if priceErr != nil {
+		return nil, priceErr
+	}
+	if query.MinPrice != nil && query.MaxPrice != nil && query.MinPrice.GreaterThan(*query.MaxPrice) {
+		return nil, errors.New("invalid price range, minPrice greater than maxPrice")
+	}
+
+	if value := params.Get(sortParam); value != "" {
+		sortFields, sortErr := database.ParseSort(value)
+		if sortErr != nil {
+			return nil, errors.New("invalid sort, must be a comma-separated list of id, name, price, each optionally prefixed by -")
+		}
+		query.Sort = sortFields
+	}
+	return query, nil
+}
+
+func parsePriceParam(params url.Values, param string) (*decimal.Decimal, error) {
+	value := params.Get(param)
+	if value == "" {
+		return nil, nil
+	}
+	price, priceErr := decimal.NewFromString(value)
+	if priceErr != nil {
+		return nil, fmt.Errorf("invalid %s, must be a decimal number", param)
+	}
+	return &price, nil
+}
+
+// setPageHeaders links next and prev pages (RFC 8288), keeping the other query params of the request
+func setPageHeaders(writer http.ResponseWriter, request *http.Request, query *database.ProductsQuery, page *database.ProductsPage) {
+	links := make([]string, 0, 2)
+	for _, link := range []struct{ rel, cursor string }{{"next", page.NextCursor}, {"prev", page.PrevCursor}} {
+		if link.cursor == "" {
+			continue
+		}
+		params := request.URL.Query()
+		params.Del(startParam)
+		params.Set(countParam, strconv.Itoa(query.Limit))
+		params.Set(cursorParam, link.cursor)
+		linkUrl := url.URL{Path: request.URL.Path, RawQuery: params.Encode()}
+		links = append(links, fmt.Sprintf(linkFormat, linkUrl.String(), link.rel))
+	}
+	if len(links) > 0 {
+		writer.Header().Set(linkHeaderKey, strings.Join(links, ", "))
+	}
+
+	if query.WithTotal {
+		writer.Header().Set(totalCountHeaderKey, strconv.Itoa(page.Total))
+	}
 }
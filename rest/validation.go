@@ -0,0 +1,331 @@
+package rest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gorilla/mux"
+
+	"github.com/bygui86/go-k8s-probes/logging"
+)
+
+const (
+	// name of the invalid param reported for errors of the request body as a whole
+	bodyParamName = "body"
+	jsonSuffix    = "+json"
+
+	responseValidationFailureDetail = "Response not matching the OpenAPI spec, look for the trace ID in the logs"
+)
+
+// loadOpenApiSpec parses and validates openApiSpec
+func loadOpenApiSpec() (*openapi3.T, error) {
+	spec, loadErr := openapi3.NewLoader().LoadFromData(openApiSpec)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	validationErr := spec.Validate(context.Background())
+	if validationErr != nil {
+		return nil, validationErr
+	}
+	return spec, nil
+}
+
+// withValidation checks path and query params, headers and JSON bodies of the requests against the OpenAPI spec,
+// replying 400 listing the violations before the handler runs. Streamed bodies, e.g. imports, are left to the
+// handlers, as well as media types not supported, for them to reply 415.
+// If enabled, responses are validated too and replaced by a 500 when not matching the spec.
+func (s *Server) withValidation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		route := s.findOpenApiRoute(request)
+		if route == nil {
+			// not described by the spec, e.g. Swagger UI
+			next.ServeHTTP(writer, request)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    request,
+			PathParams: mux.Vars(request),
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError: true,
+				// ignored by the handlers, e.g. the id of a product to update
+				ExcludeReadOnlyValidations: true,
+				// the request is left as sent
+				SkipSettingDefaults: true,
+				AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		mediaType, validateBody := jsonBodyMediaType(route.Operation, request)
+		if validateBody {
+			// validated on a copy with the media type expected, the handlers don't look at Content-Type
+			request.Body = http.MaxBytesReader(writer, request.Body, maxProductBodyBytes)
+			input.Request = request.Clone(request.Context())
+			input.Request.Header.Set(contentTypeHeaderKey, mediaType)
+		} else {
+			input.Options.ExcludeRequestBody = true
+		}
+
+		validationErr := openapi3filter.ValidateRequest(request.Context(), input)
+		if validateBody {
+			// the body read is replaced by a copy
+			request.Body = input.Request.Body
+		}
+		if validationErr != nil {
+			sendRequestValidationErrorResponse(writer, request, validationErr)
+			return
+		}
+
+		if !s.config.responseValidationEnabled || !hasJsonResponses(route.Operation) {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		buffer := newResponseBuffer()
+		next.ServeHTTP(buffer, request)
+		s.validateResponse(writer, input, buffer)
+	})
+}
+
+// findOpenApiRoute returns the spec operation of the route matched by the router, nil if not described
+func (s *Server) findOpenApiRoute(request *http.Request) *routers.Route {
+	muxRoute := mux.CurrentRoute(request)
+	if muxRoute == nil {
+		return nil
+	}
+	template, templateErr := muxRoute.GetPathTemplate()
+	if templateErr != nil {
+		return nil
+	}
+	path := openApiPath(template)
+	pathItem := s.openApi.Paths.Value(path)
+	if pathItem == nil {
+		return nil
+	}
+	operation := pathItem.GetOperation(request.Method)
+	if operation == nil {
+		return nil
+	}
+	// credentials are checked by the authentication middleware, besides openapi3filter reads the whole body in
+	// memory to validate the security requirements, defeating streamed imports
+	withoutSecurity := *operation
+	withoutSecurity.Security = &openapi3.SecurityRequirements{}
+	return &routers.Route{
+		Spec:      s.openApi,
+		Path:      path,
+		PathItem:  pathItem,
+		Method:    request.Method,
+		Operation: &withoutSecurity,
+	}
+}
+
+// openApiPath turns a mux path template into an OpenAPI path, dropping the regular expressions of the variables
+func openApiPath(template string) string {
+	return pathVariableRegex.ReplaceAllString(template, "{$1}")
+}
+
+// jsonBodyMediaType returns the JSON media type to validate the request body as, if any.
+// Bodies described only as application/json are decoded as such whatever their Content-Type.
+func jsonBodyMediaType(operation *openapi3.Operation, request *http.Request) (string, bool) {
+	if operation.RequestBody == nil || operation.RequestBody.Value == nil {
+		return "", false
+	}
+	content := operation.RequestBody.Value.Content
+	if len(content) == 1 && content.Get(contentTypeApplicationJson) != nil {
+		return contentTypeApplicationJson, true
+	}
+	mediaType, _, mediaErr := mime.ParseMediaType(request.Header.Get(contentTypeHeaderKey))
+	if mediaErr != nil || content.Get(mediaType) == nil || !isJsonMediaType(mediaType) {
+		return "", false
+	}
+	return mediaType, true
+}
+
+func isJsonMediaType(mediaType string) bool {
+	return mediaType == contentTypeApplicationJson || strings.HasSuffix(mediaType, jsonSuffix)
+}
+
+// hasJsonResponses tells whether the operation answers with JSON on success, other responses are streamed
+func hasJsonResponses(operation *openapi3.Operation) bool {
+	for _, response := range operation.Responses.Map() {
+		if response.Value == nil {
+			continue
+		}
+		for mediaType := range response.Value.Content {
+			if !isJsonMediaType(mediaType) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func sendRequestValidationErrorResponse(writer http.ResponseWriter, request *http.Request, err error) {
+	span, _ := retrieveSpanAndCtx(request, "validate-request")
+	defer span.Finish()
+
+	invalidParams := invalidParamsFromError(err)
+	reasons := make([]string, 0, len(invalidParams))
+	for _, param := range invalidParams {
+		reasons = append(reasons, param.Name+" "+param.Reason)
+	}
+	errMsg := "Invalid request: " + strings.Join(reasons, ", ")
+	sendProblem(writer, &problem{
+		Type:          problemTypeDefault,
+		Title:         http.StatusText(http.StatusBadRequest),
+		Status:        http.StatusBadRequest,
+		Detail:        errMsg,
+		InvalidParams: invalidParams,
+		TraceID:       traceIdFromSpan(span),
+	})
+
+	span.SetTag("error", errMsg)
+	span.LogKV("error", errMsg)
+}
+
+// invalidParamsFromError lists the violations reported by openapi3filter.ValidateRequest, one per param.
+// Body fields are named after their JSON path, e.g. price.
+func invalidParamsFromError(err error) []*invalidParam {
+	invalidParams := make([]*invalidParam, 0)
+	byName := make(map[string]*invalidParam)
+	for _, param := range collectInvalidParams(err) {
+		if existing, found := byName[param.Name]; found {
+			existing.Reason += "; " + param.Reason
+			continue
+		}
+		byName[param.Name] = param
+		invalidParams = append(invalidParams, param)
+	}
+	return invalidParams
+}
+
+func collectInvalidParams(err error) []*invalidParam {
+	// not errors.As, a RequestError unwraps to the MultiError of its own violations
+	if multiErr, ok := err.(openapi3.MultiError); ok {
+		invalidParams := make([]*invalidParam, 0, len(multiErr))
+		for _, nested := range multiErr {
+			invalidParams = append(invalidParams, collectInvalidParams(nested)...)
+		}
+		return invalidParams
+	}
+
+	var requestErr *openapi3filter.RequestError
+	if !errors.As(err, &requestErr) {
+		return []*invalidParam{{Name: bodyParamName, Reason: err.Error()}}
+	}
+	name := bodyParamName
+	if requestErr.Parameter != nil {
+		name = requestErr.Parameter.Name
+	}
+
+	schemaErrs := schemaErrors(requestErr.Err)
+	if len(schemaErrs) == 0 {
+		reason := requestErr.Reason
+		if requestErr.Err != nil {
+			reason = requestErr.Err.Error()
+		}
+		return []*invalidParam{{Name: name, Reason: reason}}
+	}
+	invalidParams := make([]*invalidParam, 0, len(schemaErrs))
+	for _, schemaErr := range schemaErrs {
+		paramName := name
+		if pointer := schemaErr.JSONPointer(); requestErr.Parameter == nil && len(pointer) > 0 {
+			paramName = strings.Join(pointer, ".")
+		}
+		invalidParams = append(invalidParams, &invalidParam{Name: paramName, Reason: schemaErr.Reason})
+	}
+	return invalidParams
+}
+
+func schemaErrors(err error) []*openapi3.SchemaError {
+	var multiErr openapi3.MultiError
+	if errors.As(err, &multiErr) {
+		schemaErrs := make([]*openapi3.SchemaError, 0, len(multiErr))
+		for _, nested := range multiErr {
+			schemaErrs = append(schemaErrs, schemaErrors(nested)...)
+		}
+		return schemaErrs
+	}
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) {
+		return []*openapi3.SchemaError{schemaErr}
+	}
+	return nil
+}
+
+// validateResponse sends the response buffered if it matches the spec, a 500 otherwise
+func (s *Server) validateResponse(writer http.ResponseWriter, input *openapi3filter.RequestValidationInput,
+	buffer *responseBuffer) {
+
+	responseInput := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: input,
+		Status:                 buffer.statusCode,
+		Header:                 buffer.header,
+		Options:                &openapi3filter.Options{MultiError: true, IncludeResponseStatus: true},
+	}
+	responseInput.SetBodyBytes(buffer.body.Bytes())
+
+	validationErr := openapi3filter.ValidateResponse(input.Request.Context(), responseInput)
+	if validationErr != nil {
+		span, _ := retrieveSpanAndCtx(input.Request, "validate-response")
+		defer span.Finish()
+
+		errMsg := "Invalid " + input.Request.Method + " " + input.Route.Path + " response: " + validationErr.Error()
+		logging.SugaredLog.Errorf("%s (trace ID %s)", errMsg, traceIdFromSpan(span))
+		sendProblem(writer, &problem{
+			Type:    problemTypeDefault,
+			Title:   http.StatusText(http.StatusInternalServerError),
+			Status:  http.StatusInternalServerError,
+			Detail:  responseValidationFailureDetail,
+			TraceID: traceIdFromSpan(span),
+		})
+
+		span.SetTag("error", errMsg)
+		span.LogKV("error", errMsg)
+		return
+	}
+
+	for name, values := range buffer.header {
+		writer.Header()[name] = values
+	}
+	writer.WriteHeader(buffer.statusCode)
+	_, err := io.Copy(writer, &buffer.body)
+	if err != nil {
+		logging.SugaredLog.Errorf("Error sending validated response: %s", err.Error())
+	}
+}
+
+// responseBuffer holds the whole response, to validate it before sending it
+type responseBuffer struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(statusCode int) {
+	if b.statusCode == 0 {
+		b.statusCode = statusCode
+	}
+}
+
+func (b *responseBuffer) Write(data []byte) (int, error) {
+	if b.statusCode == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.body.Write(data)
+}
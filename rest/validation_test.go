@@ -0,0 +1,136 @@
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// TestResponsesMatchOpenApiSpec goes through every operation with response validation enabled,
+// responses not matching the spec are replaced by a 500
+func TestResponsesMatchOpenApiSpec(t *testing.T) {
+	server := newValidatingServer(t)
+
+	steps := []struct {
+		method       string
+		path         string
+		headers      map[string]string
+		body         string
+		expectedCode int
+	}{
+		{http.MethodPost, "/api/v1/products", nil, `{"name":"lamp","price":"10.50","currency":"EUR"}`, http.StatusCreated},
+		{http.MethodPost, "/api/v1/products", map[string]string{idempotencyKeyHeaderKey: "key"},
+			`{"name":"desk","price":120,"currency":"EUR"}`, http.StatusCreated},
+		{http.MethodPost, "/api/v1/products", map[string]string{idempotencyKeyHeaderKey: "key"},
+			`{"name":"desk","price":120,"currency":"EUR"}`, http.StatusCreated},
+		{http.MethodPost, "/api/v1/products", nil, `{"name":"lamp","price":"10.50","currency":"ABC"}`,
+			http.StatusUnprocessableEntity},
+		{http.MethodGet, "/api/v1/products?count=1&withTotal=true&sort=-price", nil, "", http.StatusOK},
+		{http.MethodGet, "/api/v1/products?sort=-price&start=1", nil, "", http.StatusOK},
+		{http.MethodGet, "/api/v1/products?start=1&cursor=abc", nil, "", http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/products/1", nil, "", http.StatusOK},
+		{http.MethodGet, "/api/v1/products/1", map[string]string{ifNoneMatchHeaderKey: `"1"`}, "", http.StatusNotModified},
+		{http.MethodGet, "/api/v1/products/99", nil, "", http.StatusNotFound},
+		{http.MethodPut, "/api/v1/products/1", map[string]string{ifMatchHeaderKey: `"1"`},
+			`{"id":1,"name":"lamp","price":"11.00","currency":"EUR","version":1}`, http.StatusOK},
+		{http.MethodPut, "/api/v1/products/1", map[string]string{ifMatchHeaderKey: `"1"`},
+			`{"name":"lamp","price":"12.00","currency":"EUR"}`, http.StatusPreconditionFailed},
+		{http.MethodPatch, "/api/v1/products/1", map[string]string{contentTypeHeaderKey: contentTypeMergePatch},
+			`{"price":"12.00"}`, http.StatusOK},
+		{http.MethodPatch, "/api/v1/products/1", map[string]string{contentTypeHeaderKey: contentTypeJsonPatch},
+			`[{"op":"test","path":"/price","value":"1"}]`, http.StatusConflict},
+		{http.MethodPatch, "/api/v1/products/1", map[string]string{contentTypeHeaderKey: "text/plain"},
+			`price=1`, http.StatusUnsupportedMediaType},
+		{http.MethodGet, "/api/v1/products/1/history", nil, "", http.StatusOK},
+		{http.MethodDelete, "/api/v1/products/1", nil, "", http.StatusOK},
+		{http.MethodGet, "/api/v1/products/1?includeDeleted=true", nil, "", http.StatusOK},
+		{http.MethodPost, "/api/v1/products/1:restore", nil, "", http.StatusOK},
+		{http.MethodPost, "/api/v1/products/1:restore", nil, "", http.StatusConflict},
+		{http.MethodPost, "/api/v1/products:import", map[string]string{contentTypeHeaderKey: contentTypeCsv},
+			"name,price,currency\nchair,45.00,EUR\nstool,-1,EUR\n", http.StatusOK},
+		{http.MethodGet, "/api/v1/products:export?format=ndjson", nil, "", http.StatusOK},
+		{http.MethodGet, "/api/v1/openapi.json", nil, "", http.StatusOK},
+		{http.MethodGet, "/api/v1/openapi.json", map[string]string{ifNoneMatchHeaderKey: openApiSpecETag}, "",
+			http.StatusNotModified},
+	}
+	for _, step := range steps {
+		response := serve(server, step.method, step.path, step.headers, step.body)
+		if response.Code != step.expectedCode {
+			t.Fatalf("%s %s: expected %d, got %d: %s",
+				step.method, step.path, step.expectedCode, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	server := newValidatingServer(t)
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		headers        map[string]string
+		body           string
+		expectedParams []string
+	}{
+		{"invalid query params", http.MethodGet, "/api/v1/products?count=0&withTotal=maybe", nil, "",
+			[]string{"count", "withTotal"}},
+		{"invalid header", http.MethodGet, "/api/v1/products/1", map[string]string{readYourWritesHeaderKey: "yes"}, "",
+			[]string{readYourWritesHeaderKey}},
+		{"invalid format", http.MethodGet, "/api/v1/products:export?format=xml", nil, "",
+			[]string{formatParam}},
+		{"invalid product", http.MethodPost, "/api/v1/products", nil,
+			`{"name":"","price":"-1","currency":"eur"}`, []string{"currency", "name", "price"}},
+		{"missing fields", http.MethodPut, "/api/v1/products/1", nil, `{"name":"lamp"}`,
+			[]string{"currency", "price"}},
+		{"unknown field", http.MethodPost, "/api/v1/products", nil,
+			`{"name":"lamp","price":"1","currency":"EUR","color":"red"}`, []string{bodyParamName}},
+		{"missing body", http.MethodPost, "/api/v1/products", nil, "", []string{bodyParamName}},
+		{"invalid JSON", http.MethodPost, "/api/v1/products", nil, `{"name":`, []string{bodyParamName}},
+		{"invalid JSON patch", http.MethodPatch, "/api/v1/products/1",
+			map[string]string{contentTypeHeaderKey: contentTypeJsonPatch}, `[{"op":"rename","path":"/name"}]`,
+			[]string{"0.op"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := serve(server, test.method, test.path, test.headers, test.body)
+			if response.Code != http.StatusBadRequest ||
+				response.Header().Get(contentTypeHeaderKey) != contentTypeProblemJson {
+				t.Fatalf("expected 400 problem, got %d: %s", response.Code, response.Body.String())
+			}
+
+			var prob problem
+			if err := json.Unmarshal(response.Body.Bytes(), &prob); err != nil {
+				t.Fatalf("problem unmarshalling failed: %s", err.Error())
+			}
+			names := make([]string, 0, len(prob.InvalidParams))
+			for _, param := range prob.InvalidParams {
+				names = append(names, param.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, test.expectedParams) {
+				t.Fatalf("expected invalid params %v, got %s", test.expectedParams, response.Body.String())
+			}
+		})
+	}
+}
+
+func newValidatingServer(t *testing.T) *Server {
+	t.Helper()
+	t.Setenv(responseValidationEnabledEnvVar, "true")
+	return newTestServer(t)
+}
+
+func serve(server *Server, method, path string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(response, request)
+	return response
+}
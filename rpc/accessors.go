@@ -0,0 +1,9 @@
+package rpc
+
+func (s *Server) GetGrpcHost() string {
+	return s.config.grpcHost
+}
+
+func (s *Server) GetGrpcPort() int {
+	return s.config.grpcPort
+}
@@ -0,0 +1,61 @@
+package rpc
+
+import (
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/utils"
+)
+
+const (
+	grpcEnabledEnvVar           = "PRODUCTS_GRPC_ENABLED" // bool
+	grpcHostEnvVar              = "PRODUCTS_GRPC_HOST"
+	grpcPortEnvVar              = "PRODUCTS_GRPC_PORT"
+	grpcReflectionEnabledEnvVar = "PRODUCTS_GRPC_REFLECTION_ENABLED" // bool
+	// shared with the REST API
+	defaultPageSizeEnvVar = "PRODUCTS_DEFAULT_PAGE_SIZE"
+	maxPageSizeEnvVar     = "PRODUCTS_MAX_PAGE_SIZE"
+
+	grpcEnabledDefault           = true
+	grpcHostDefault              = "localhost"
+	grpcPortDefault              = 50051
+	grpcReflectionEnabledDefault = true
+	defaultPageSizeDefault       = 10
+	maxPageSizeDefault           = 100
+)
+
+func loadConfig() *config {
+	logging.Log.Debug("Load Products gRPC configurations")
+
+	grpcPort := utils.GetIntEnv(grpcPortEnvVar, grpcPortDefault)
+	if grpcPort < 1 {
+		logging.SugaredLog.Warnf("gRPC port must be greater than 0, fallback to default %d", grpcPortDefault)
+		grpcPort = grpcPortDefault
+	}
+
+	maxPageSize := utils.GetIntEnv(maxPageSizeEnvVar, maxPageSizeDefault)
+	if maxPageSize < 1 {
+		logging.SugaredLog.Warnf("Max page size must be greater than 0, fallback to default %d",
+			maxPageSizeDefault)
+		maxPageSize = maxPageSizeDefault
+	}
+
+	defaultPageSize := utils.GetIntEnv(defaultPageSizeEnvVar, defaultPageSizeDefault)
+	if defaultPageSize < 1 || defaultPageSize > maxPageSize {
+		// the default may exceed a custom max page size
+		fallback := defaultPageSizeDefault
+		if fallback > maxPageSize {
+			fallback = maxPageSize
+		}
+		logging.SugaredLog.Warnf("Default page size must be between 1 and max page size %d, fallback to %d",
+			maxPageSize, fallback)
+		defaultPageSize = fallback
+	}
+
+	return &config{
+		grpcEnabled:           utils.GetBoolEnv(grpcEnabledEnvVar, grpcEnabledDefault),
+		grpcHost:              utils.GetStringEnv(grpcHostEnvVar, grpcHostDefault),
+		grpcPort:              grpcPort,
+		grpcReflectionEnabled: utils.GetBoolEnv(grpcReflectionEnabledEnvVar, grpcReflectionEnabledDefault),
+		defaultPageSize:       defaultPageSize,
+		maxPageSize:           maxPageSize,
+	}
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/opentracing/opentracing-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
+)
+
+func (s *Server) ListProducts(ctx context.Context,
+	request *productspb.ListProductsRequest) (*productspb.ListProductsResponse, error) {
+
+	span := opentracing.SpanFromContext(ctx)
+	ctx = withReadConsistency(ctx)
+
+	logging.Log.Info("Get products over gRPC")
+
+	query, queryErr := s.productsQueryFromProto(request)
+	if queryErr != nil {
+		span.SetTag("products-found", 0)
+		return nil, failed(span, codes.InvalidArgument, "Get products failed: "+queryErr.Error())
+	}
+
+	page, err := s.repository.GetProducts(query, ctx)
+	if err != nil {
+		span.SetTag("products-found", 0)
+		return nil, failed(span, codeFromError(err), "Get products failed: "+err.Error())
+	}
+
+	span.SetTag("products-found", len(page.Products))
+	span.LogKV("products-found", len(page.Products))
+
+	response := &productspb.ListProductsResponse{
+		Products:      make([]*productspb.Product, 0, len(page.Products)),
+		NextPageToken: page.NextCursor,
+		PrevPageToken: page.PrevCursor,
+		Total:         int64(page.Total),
+	}
+	for _, product := range page.Products {
+		response.Products = append(response.Products, productToProto(product))
+	}
+	return response, nil
+}
+
+func (s *Server) GetProduct(ctx context.Context, request *productspb.GetProductRequest) (*productspb.Product, error) {
+	span := opentracing.SpanFromContext(ctx)
+	ctx = withReadConsistency(ctx)
+
+	logging.SugaredLog.Infof("Get product by ID over gRPC: %d", request.GetId())
+
+	span.SetTag("product-id", request.GetId())
+
+	product := &database.Product{ID: int(request.GetId())}
+	getErr := s.repository.GetProduct(product, request.GetIncludeDeleted(), ctx)
+	if getErr != nil {
+		span.SetTag("product-found", false)
+		if getErr == database.ErrProductNotFound {
+			return nil, failed(span, codes.NotFound, "Get product failed: product not found")
+		}
+		return nil, failed(span, codeFromError(getErr), "Get product failed: "+getErr.Error())
+	}
+
+	span.SetTag("product-found", true)
+	span.LogKV("product-id", product.ID, "product-found", true)
+	return productToProto(product), nil
+}
+
+func (s *Server) CreateProduct(ctx context.Context,
+	request *productspb.CreateProductRequest) (*productspb.Product, error) {
+
+	span := opentracing.SpanFromContext(ctx)
+	ctx = s.withActor(ctx)
+
+	product, productErr := productFromProto(request.GetProduct())
+	if productErr == nil {
+		productErr = product.Validate()
+	}
+	if productErr != nil {
+		span.SetTag("product-created", false)
+		return nil, failed(span, codes.InvalidArgument, "Create product failed: "+productErr.Error())
+	}
+
+	logging.SugaredLog.Infof("Create product over gRPC %s", product.String())
+
+	createErr := s.repository.CreateProduct(product, ctx)
+	if createErr != nil {
+		span.SetTag("product-created", false)
+		return nil, failed(span, codeFromError(createErr), "Create product failed: "+createErr.Error())
+	}
+
+	span.SetTag("product", product.String())
+	span.SetTag("product-created", true)
+	span.LogKV("product", product.String(), "product-created", true)
+
+	s.products.PublishProductEvent(rest.EventCreated, product.ID, product)
+	return productToProto(product), nil
+}
+
+func (s *Server) UpdateProduct(ctx context.Context,
+	request *productspb.UpdateProductRequest) (*productspb.Product, error) {
+
+	span := opentracing.SpanFromContext(ctx)
+	ctx = s.withActor(ctx)
+
+	product, productErr := productFromProto(request.GetProduct())
+	if productErr == nil {
+		productErr = product.Validate()
+	}
+	if productErr != nil {
+		span.SetTag("product-updated", false)
+		return nil, failed(span, codes.InvalidArgument, "Update product failed: "+productErr.Error())
+	}
+
+	product.ID = int(request.GetId())
+	// the version of the product is ignored, only the one of the request drives optimistic concurrency
+	product.Version = int(request.GetVersion())
+	logging.SugaredLog.Infof("Update product over gRPC: %s", product.String())
+	span.SetTag("product-id", product.ID)
+
+	updateErr := s.repository.UpdateProduct(product, ctx)
+	if updateErr != nil {
+		span.SetTag("product-updated", false)
+		return nil, failed(span, codeFromError(updateErr), "Update product failed: "+updateErr.Error())
+	}
+
+	span.SetTag("product", product.String())
+	span.SetTag("product-updated", true)
+	span.LogKV("product", product.String(), "product-updated", true)
+
+	s.products.PublishProductEvent(rest.EventUpdated, product.ID, product)
+	return productToProto(product), nil
+}
+
+func (s *Server) DeleteProduct(ctx context.Context,
+	request *productspb.DeleteProductRequest) (*productspb.DeleteProductResponse, error) {
+
+	span := opentracing.SpanFromContext(ctx)
+	ctx = s.withActor(ctx)
+
+	id := int(request.GetId())
+	logging.SugaredLog.Infof("Delete product by ID over gRPC: %d", id)
+	span.SetTag("product-id", id)
+
+	deleteErr := s.repository.DeleteProduct(id, int(request.GetVersion()), ctx)
+	if deleteErr != nil {
+		span.SetTag("product-deleted", false)
+		return nil, failed(span, codeFromError(deleteErr), "Delete product failed: "+deleteErr.Error())
+	}
+
+	span.SetTag("product-deleted", true)
+	span.LogKV("product-deleted", true)
+
+	s.products.PublishProductEvent(rest.EventDeleted, id, nil)
+	return &productspb.DeleteProductResponse{}, nil
+}
+
+// WatchProducts streams the product events shared with the REST API, until the client cancels or the server
+// shuts down. Clients falling behind are dropped with UNAVAILABLE, to resume from the last event ID received.
+func (s *Server) WatchProducts(request *productspb.WatchProductsRequest,
+	stream productspb.ProductService_WatchProductsServer) error {
+
+	span := opentracing.SpanFromContext(stream.Context())
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	stopWatch := context.AfterFunc(s.watchCtx, cancel)
+	defer stopWatch()
+
+	logging.Log.Info("Watch product events over gRPC")
+
+	var sendErr error
+	watchErr := s.products.WatchProductEvents(request.GetLastEventId(), func(event *rest.ProductEvent) error {
+		sendErr = stream.Send(eventToProto(event))
+		return sendErr
+	}, ctx)
+	switch {
+	case sendErr != nil:
+		return failed(span, status.Code(sendErr), "Watch product events failed: "+sendErr.Error())
+	case stream.Context().Err() != nil:
+		// cancelled by the client
+		return status.FromContextError(stream.Context().Err()).Err()
+	case errors.Is(watchErr, context.Canceled):
+		return failed(span, codes.Unavailable, "Watch product events ended: server shutting down")
+	default:
+		return failed(span, codes.Unavailable, "Watch product events ended: "+watchErr.Error())
+	}
+}
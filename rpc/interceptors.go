@@ -0,0 +1,216 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
+)
+
+const (
+	// metadata keys, as the REST API headers
+	readYourWritesMetadataKey = "x-read-your-writes" // bool
+
+	authFailureMissing   = "missing"
+	authFailureInvalid   = "invalid"
+	authFailureForbidden = "forbidden"
+)
+
+// methods needing products:write, the others need products:read
+var writeMethods = map[string]bool{
+	productspb.ProductService_CreateProduct_FullMethodName: true,
+	productspb.ProductService_UpdateProduct_FullMethodName: true,
+	productspb.ProductService_DeleteProduct_FullMethodName: true,
+}
+
+var productsServicePrefix = "/" + productspb.ProductService_ServiceDesc.ServiceName + "/"
+
+type subjectContextKey struct{}
+
+// wrappedStream overrides the context of a server stream, for the inner interceptors and the handler
+type wrappedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (w *wrappedStream) Context() context.Context {
+	return w.ctx
+}
+
+// unaryMetrics records the RED metrics of the calls, by method and status code
+func unaryMetrics(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	start := time.Now()
+	grpcRequestsInFlight.Inc()
+	defer grpcRequestsInFlight.Dec()
+
+	response, err := handler(ctx, request)
+	observeCall(info.FullMethod, err, start)
+	return response, err
+}
+
+func streamMetrics(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	start := time.Now()
+	grpcRequestsInFlight.Inc()
+	defer grpcRequestsInFlight.Dec()
+
+	err := handler(srv, stream)
+	observeCall(info.FullMethod, err, start)
+	return err
+}
+
+func observeCall(fullMethod string, err error, start time.Time) {
+	method := path.Base(fullMethod)
+	code := status.Code(err).String()
+	grpcRequests.WithLabelValues(method, code).Inc()
+	grpcRequestsDuration.WithLabelValues(method, code).Observe(time.Since(start).Seconds())
+}
+
+// unaryTracing starts the span of the call, child of the client one if propagated through metadata.
+// Handlers tag it with the error, if any, as the REST ones do.
+func unaryTracing(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	span, spanCtx := startSpan(ctx, info.FullMethod)
+	defer span.Finish()
+
+	response, err := handler(spanCtx, request)
+	span.SetTag("grpc-code", status.Code(err).String())
+	return response, err
+}
+
+func streamTracing(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	span, spanCtx := startSpan(stream.Context(), info.FullMethod)
+	defer span.Finish()
+
+	err := handler(srv, &wrappedStream{ServerStream: stream, ctx: spanCtx})
+	span.SetTag("grpc-code", status.Code(err).String())
+	return err
+}
+
+func startSpan(ctx context.Context, fullMethod string) (opentracing.Span, context.Context) {
+	clientSpanContext, clientSpanErr := opentracing.GlobalTracer().Extract(
+		opentracing.HTTPHeaders,
+		opentracing.HTTPHeadersCarrier(headersFromContext(ctx)))
+	if clientSpanErr != nil {
+		logging.SugaredLog.Debugf("%s", clientSpanErr.Error())
+	}
+
+	// Create the span referring to the RPC client if available.
+	// If clientSpanContext == nil, a root span will be created.
+	span := opentracing.StartSpan(fullMethod, ext.RPCServerOption(clientSpanContext), ext.SpanKindRPCServer)
+	ext.Component.Set(span, "gRPC")
+	return span, opentracing.ContextWithSpan(ctx, span)
+}
+
+// unaryAuthentication rejects the calls without valid credentials with UNAUTHENTICATED, those lacking the scope
+// needed with PERMISSION_DENIED. Credentials are checked as the REST API does, sent as metadata instead of headers.
+// The health and reflection services are open to anybody, as the REST API documentation.
+func (s *Server) unaryAuthentication(ctx context.Context, request interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	authCtx, authErr := s.authorize(ctx, info.FullMethod)
+	if authErr != nil {
+		return nil, authErr
+	}
+	return handler(authCtx, request)
+}
+
+func (s *Server) streamAuthentication(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	authCtx, authErr := s.authorize(stream.Context(), info.FullMethod)
+	if authErr != nil {
+		return authErr
+	}
+	return handler(srv, &wrappedStream{ServerStream: stream, ctx: authCtx})
+}
+
+// authorize returns the context carrying the subject authenticated, empty if authentication is disabled
+func (s *Server) authorize(ctx context.Context, fullMethod string) (context.Context, error) {
+	if !strings.HasPrefix(fullMethod, productsServicePrefix) {
+		return ctx, nil
+	}
+
+	subject, authErr := s.products.AuthorizeHeaders(headersFromContext(ctx), writeMethods[fullMethod])
+	if authErr == nil {
+		return context.WithValue(ctx, subjectContextKey{}, subject), nil
+	}
+
+	switch {
+	case errors.Is(authErr, rest.ErrNoCredentials):
+		grpcAuthFailures.WithLabelValues(authFailureMissing).Inc()
+		return nil, status.Error(codes.Unauthenticated, "Authentication required, with an API key or a bearer token")
+	case errors.Is(authErr, rest.ErrScopeMissing):
+		grpcAuthFailures.WithLabelValues(authFailureForbidden).Inc()
+		logging.SugaredLog.Debugf("Scope missing for %s calling %s", subject, fullMethod)
+		return nil, status.Error(codes.PermissionDenied, authErr.Error())
+	default:
+		grpcAuthFailures.WithLabelValues(authFailureInvalid).Inc()
+		logging.SugaredLog.Debugf("Authentication failed calling %s: %s", fullMethod, authErr.Error())
+		return nil, status.Error(codes.Unauthenticated, "Invalid credentials: "+authErr.Error())
+	}
+}
+
+// headersFromContext returns the metadata received as HTTP headers, e.g. x-api-key as X-Api-Key
+func headersFromContext(ctx context.Context) http.Header {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := make(http.Header, len(md))
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return header
+}
+
+// withActor records who makes the changes in the product history: the subject authenticated, or the user
+// authenticated by a trusted proxy in front of the service if authentication is disabled, anonymous otherwise
+func (s *Server) withActor(ctx context.Context) context.Context {
+	if subject, _ := ctx.Value(subjectContextKey{}).(string); subject != "" {
+		return database.WithActor(ctx, subject)
+	}
+	remoteAddr := ""
+	if client, ok := peer.FromContext(ctx); ok {
+		remoteAddr = client.Addr.String()
+	}
+	return database.WithActor(ctx, s.products.ForwardedUser(headersFromContext(ctx), remoteAddr))
+}
+
+// withReadConsistency routes reads to the primary DB when the client asks to read its own writes
+func withReadConsistency(ctx context.Context) context.Context {
+	readYourWrites, _ := strconv.ParseBool(metadataValue(ctx, readYourWritesMetadataKey))
+	if readYourWrites {
+		return database.WithPrimary(ctx)
+	}
+	return ctx
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	values := metadata.ValueFromIncomingContext(ctx, key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
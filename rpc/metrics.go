@@ -0,0 +1,62 @@
+package rpc
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	productsNamespace = "products"
+	grpcSubsystem     = "grpc"
+)
+
+var (
+	grpcRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: productsNamespace,
+			Subsystem: grpcSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of gRPC calls served, by method and status code",
+		},
+		[]string{"method", "code"},
+	)
+
+	grpcRequestsDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: productsNamespace,
+			Subsystem: grpcSubsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Duration of gRPC calls in seconds, streams included, by method and status code",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method", "code"},
+	)
+
+	grpcRequestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: productsNamespace,
+			Subsystem: grpcSubsystem,
+			Name:      "requests_in_flight",
+			Help:      "Number of gRPC calls currently served, streams included",
+		},
+	)
+
+	grpcAuthFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: productsNamespace,
+			Subsystem: grpcSubsystem,
+			Name:      "auth_failures_total",
+			Help:      "Number of gRPC calls rejected by authentication, by reason: missing, invalid or forbidden",
+		},
+		[]string{"reason"},
+	)
+)
+
+// GetCollectors returns the collectors of the Products gRPC server metrics, to be registered on the monitoring server
+func (s *Server) GetCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		grpcRequests,
+		grpcRequestsDuration,
+		grpcRequestsInFlight,
+		grpcAuthFailures,
+	}
+}
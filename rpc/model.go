@@ -0,0 +1,45 @@
+package rpc
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
+)
+
+// Server serves the products over gRPC
+type Server struct {
+	productspb.UnimplementedProductServiceServer
+
+	config       *config
+	grpcServer   *grpc.Server
+	healthServer *health.Server
+	repository   database.ProductRepository
+	products     Products
+	running      bool
+	// done when shutting down, to end the watches not to wait for them
+	watchCtx    context.Context
+	stopWatches context.CancelFunc
+}
+
+// Products is the REST API sharing its credentials, trusted proxies and change feed, implemented by rest.Server
+type Products interface {
+	AuthorizeHeaders(header http.Header, write bool) (string, error)
+	ForwardedUser(header http.Header, remoteAddr string) string
+	PublishProductEvent(eventType string, productId int, product *database.Product)
+	WatchProductEvents(lastEventId string, send func(event *rest.ProductEvent) error, ctx context.Context) error
+}
+
+type config struct {
+	grpcEnabled           bool
+	grpcHost              string
+	grpcPort              int
+	grpcReflectionEnabled bool
+	defaultPageSize       int
+	maxPageSize           int
+}
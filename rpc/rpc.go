@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
+)
+
+// New creates the Products gRPC server if enabled, it returns nil otherwise. The products are read and written
+// through the same repository as the REST API, whose credentials and change feed are shared through products.
+func New(repository database.ProductRepository, products Products) *Server {
+	logging.Log.Info("Create new Products gRPC server")
+
+	cfg := loadConfig()
+	if !cfg.grpcEnabled {
+		logging.Log.Debug("Products gRPC server disabled, products served over REST only")
+		return nil
+	}
+
+	server := &Server{
+		config:       cfg,
+		repository:   repository,
+		products:     products,
+		healthServer: health.NewServer(),
+	}
+	server.watchCtx, server.stopWatches = context.WithCancel(context.Background())
+	server.setupGrpcServer()
+	return server
+}
+
+// setupGrpcServer registers the products service along with the health service and, if enabled, reflection.
+// From the outermost interceptor: RED metrics, tracing, authentication.
+func (s *Server) setupGrpcServer() {
+	logging.Log.Debug("Create gRPC server")
+	s.grpcServer = grpc.NewServer(
+		grpc.ChainUnaryInterceptor(unaryMetrics, unaryTracing, s.unaryAuthentication),
+		grpc.ChainStreamInterceptor(streamMetrics, streamTracing, s.streamAuthentication),
+	)
+	productspb.RegisterProductServiceServer(s.grpcServer, s)
+	healthpb.RegisterHealthServer(s.grpcServer, s.healthServer)
+	if s.config.grpcReflectionEnabled {
+		reflection.Register(s.grpcServer)
+	}
+}
+
+func (s *Server) Start() error {
+	logging.Log.Info("Start Products gRPC server")
+
+	if s.grpcServer != nil && !s.running {
+		listener, listenErr := net.Listen("tcp", fmt.Sprintf("%s:%d", s.config.grpcHost, s.config.grpcPort))
+		if listenErr != nil {
+			return fmt.Errorf("products gRPC server start failed: %s", listenErr.Error())
+		}
+		s.serve(listener)
+		logging.SugaredLog.Infof("Products gRPC server listening on port %d", s.config.grpcPort)
+		return nil
+	}
+
+	return fmt.Errorf("products gRPC server start failed: gRPC server not initialized or gRPC server already running")
+}
+
+// serve accepts the calls in background, reporting the products service as serving to health checks
+func (s *Server) serve(listener net.Listener) {
+	go func() {
+		err := s.grpcServer.Serve(listener)
+		if err != nil {
+			logging.SugaredLog.Errorf("Products gRPC server start failed: %s", err.Error())
+		}
+	}()
+	s.healthServer.SetServingStatus(productspb.ProductService_ServiceDesc.ServiceName,
+		healthpb.HealthCheckResponse_SERVING)
+	s.running = true
+}
+
+func (s *Server) Shutdown(timeout time.Duration) {
+	logging.SugaredLog.Warnf("Shutdown Products gRPC server, timeout %.0f seconds", timeout.Seconds())
+
+	if s.grpcServer != nil && s.running {
+		// clients checking health stop sending calls, watches would otherwise keep the server waiting until the timeout
+		s.healthServer.Shutdown()
+		s.stopWatches()
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.grpcServer.GracefulStop()
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(timeout):
+			logging.Log.Error("Products gRPC server graceful shutdown timed out, calls in progress cancelled")
+			s.grpcServer.Stop()
+		}
+		s.running = false
+		return
+	}
+
+	logging.Log.Error("Products gRPC server shutdown failed: gRPC server not initialized or gRPC server not running")
+}
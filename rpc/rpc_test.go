@@ -0,0 +1,290 @@
+package rpc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
+)
+
+func TestMain(m *testing.M) {
+	err := logging.InitGlobalLogger()
+	if err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestProductService(t *testing.T) {
+	client, _, _ := newTestClient(t)
+	ctx := context.Background()
+
+	created, createErr := client.CreateProduct(ctx, &productspb.CreateProductRequest{
+		Product: &productspb.Product{Name: "lamp", Price: "10.5", Currency: "EUR"},
+	})
+	if createErr != nil || created.GetId() != 1 || created.GetVersion() != 1 {
+		t.Fatalf("expected product 1 created, got %v (%v)", created, createErr)
+	}
+
+	_, invalidErr := client.CreateProduct(ctx, &productspb.CreateProductRequest{
+		Product: &productspb.Product{Name: "desk", Price: "-1", Currency: "EUR"},
+	})
+	expectCode(t, invalidErr, codes.InvalidArgument)
+
+	updated, updateErr := client.UpdateProduct(ctx, &productspb.UpdateProductRequest{
+		Id:      created.GetId(),
+		Product: &productspb.Product{Name: "desk lamp", Price: "12", Currency: "EUR"},
+		Version: created.GetVersion(),
+	})
+	if updateErr != nil || updated.GetName() != "desk lamp" || updated.GetVersion() != 2 {
+		t.Fatalf("expected product updated, got %v (%v)", updated, updateErr)
+	}
+	_, staleErr := client.UpdateProduct(ctx, &productspb.UpdateProductRequest{
+		Id:      created.GetId(),
+		Product: &productspb.Product{Name: "sofa", Price: "1", Currency: "EUR"},
+		Version: created.GetVersion(),
+	})
+	expectCode(t, staleErr, codes.FailedPrecondition)
+
+	page, listErr := client.ListProducts(ctx, &productspb.ListProductsRequest{WithTotal: true})
+	if listErr != nil || len(page.GetProducts()) != 1 || page.GetTotal() != 1 ||
+		page.GetProducts()[0].GetPrice() != "12" {
+		t.Fatalf("expected the product listed, got %v (%v)", page, listErr)
+	}
+	_, pageSizeErr := client.ListProducts(ctx, &productspb.ListProductsRequest{PageSize: 1000})
+	expectCode(t, pageSizeErr, codes.InvalidArgument)
+
+	if _, deleteErr := client.DeleteProduct(ctx, &productspb.DeleteProductRequest{Id: created.GetId()}); deleteErr != nil {
+		t.Fatal(deleteErr)
+	}
+	_, getErr := client.GetProduct(ctx, &productspb.GetProductRequest{Id: created.GetId()})
+	expectCode(t, getErr, codes.NotFound)
+	deleted, deletedErr := client.GetProduct(ctx, &productspb.GetProductRequest{Id: created.GetId(), IncludeDeleted: true})
+	if deletedErr != nil || deleted.GetDeletedAt() == nil {
+		t.Fatalf("expected deleted product found when included, got %v (%v)", deleted, deletedErr)
+	}
+}
+
+func TestWatchProducts(t *testing.T) {
+	client, server, products := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, watchErr := client.WatchProducts(ctx, &productspb.WatchProductsRequest{LastEventId: "unknown-1"})
+	if watchErr != nil {
+		t.Fatal(watchErr)
+	}
+	expectEvent(t, stream, productspb.ProductEvent_TYPE_RESET, 0)
+
+	// changes made through both APIs
+	created, createErr := client.CreateProduct(ctx, &productspb.CreateProductRequest{
+		Product: &productspb.Product{Name: "lamp", Price: "1", Currency: "EUR"},
+	})
+	if createErr != nil {
+		t.Fatal(createErr)
+	}
+	products.PublishProductEvent(rest.EventDeleted, int(created.GetId()), nil)
+	expectEvent(t, stream, productspb.ProductEvent_TYPE_CREATED, created.GetId())
+	last := expectEvent(t, stream, productspb.ProductEvent_TYPE_DELETED, created.GetId())
+
+	// resumed after the last event received
+	resumed, resumeErr := client.WatchProducts(ctx, &productspb.WatchProductsRequest{LastEventId: last.GetId()})
+	if resumeErr != nil {
+		t.Fatal(resumeErr)
+	}
+	products.PublishProductEvent(rest.EventRestored, int(created.GetId()), &database.Product{ID: int(created.GetId())})
+	expectEvent(t, resumed, productspb.ProductEvent_TYPE_RESTORED, created.GetId())
+
+	// ended by the shutdown instead of keeping the server waiting
+	server.Shutdown(5 * time.Second)
+	_, recvErr := resumed.Recv()
+	expectCode(t, recvErr, codes.Unavailable)
+}
+
+func TestAuthentication(t *testing.T) {
+	keys, _ := json.Marshal([]map[string]interface{}{
+		{"subject": "reader", "sha256": sha256Hex("read-only"), "scopes": []string{"products:read"}},
+		{"subject": "writer", "sha256": sha256Hex("read-write"), "scopes": []string{"products:read", "products:write"}},
+	})
+	keysFile := filepath.Join(t.TempDir(), "api-keys.json")
+	if err := os.WriteFile(keysFile, keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PRODUCTS_AUTH_ENABLED", "true")
+	t.Setenv("PRODUCTS_AUTH_API_KEYS_FILE", keysFile)
+	client, _, _ := newTestClient(t)
+
+	create := func(ctx context.Context) error {
+		_, err := client.CreateProduct(ctx, &productspb.CreateProductRequest{
+			Product: &productspb.Product{Name: "lamp", Price: "1", Currency: "EUR"},
+		})
+		return err
+	}
+	list := func(ctx context.Context) error {
+		_, err := client.ListProducts(ctx, &productspb.ListProductsRequest{})
+		return err
+	}
+	tests := []struct {
+		name         string
+		call         func(ctx context.Context) error
+		apiKey       string
+		expectedCode codes.Code
+	}{
+		{"no credentials", list, "", codes.Unauthenticated},
+		{"unknown API key", list, "nope", codes.Unauthenticated},
+		{"API key read", list, "read-only", codes.OK},
+		{"API key without write scope", create, "read-only", codes.PermissionDenied},
+		{"API key write", create, "read-write", codes.OK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.apiKey != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-api-key", test.apiKey)
+			}
+			expectCode(t, test.call(ctx), test.expectedCode)
+		})
+	}
+
+	t.Run("health open to anybody", func(t *testing.T) {
+		health := healthpb.NewHealthClient(client.(*testClient).conn)
+		response, err := health.Check(context.Background(),
+			&healthpb.HealthCheckRequest{Service: productspb.ProductService_ServiceDesc.ServiceName})
+		if err != nil || response.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+			t.Fatalf("expected serving, got %v (%v)", response, err)
+		}
+	})
+}
+
+func TestForwardedUserRecordedAsActor(t *testing.T) {
+	t.Setenv("PRODUCTS_TRUSTED_PROXIES", "10.0.0.0/8")
+	_, server, _ := newTestClient(t)
+
+	tests := []struct {
+		name          string
+		remoteIp      string
+		expectedActor string
+	}{
+		{"trusted proxy", "10.0.0.1", "bob"},
+		{"other client", "192.0.2.1", "anonymous"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-user", "bob"))
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(test.remoteIp), Port: 4321}})
+
+			product := &database.Product{Name: "lamp", Price: decimal.RequireFromString("1"), Currency: "EUR"}
+			if err := server.repository.CreateProduct(product, server.withActor(ctx)); err != nil {
+				t.Fatal(err)
+			}
+			history, historyErr := server.repository.GetProductHistory(product.ID, context.Background())
+			if historyErr != nil || len(history) != 1 || history[0].Actor != test.expectedActor {
+				t.Fatalf("expected change made by %s, got %v (%v)", test.expectedActor, history, historyErr)
+			}
+		})
+	}
+}
+
+// failingRepository fails to list the products as a broken DB would
+type failingRepository struct {
+	*database.MemoryRepository
+}
+
+func (r *failingRepository) GetProducts(query *database.ProductsQuery, ctx context.Context) (*database.ProductsPage, error) {
+	return nil, errors.New("dial tcp 10.0.0.5:5432: connect: connection refused")
+}
+
+func TestInternalErrorsHidden(t *testing.T) {
+	client, _, _ := newRepositoryTestClient(t, &failingRepository{MemoryRepository: database.NewMemoryRepository()})
+
+	_, err := client.ListProducts(context.Background(), &productspb.ListProductsRequest{})
+	expectCode(t, err, codes.Internal)
+	if message := status.Convert(err).Message(); strings.Contains(message, "10.0.0.5") ||
+		!strings.HasPrefix(message, internalErrorDetail) {
+		t.Fatalf("expected the DB error hidden, got %q", message)
+	}
+}
+
+// testClient keeps the connection at hand, for the other services
+type testClient struct {
+	productspb.ProductServiceClient
+	conn *grpc.ClientConn
+}
+
+// newTestClient serves the products of a memory repository in memory, sharing a REST server without routes served
+func newTestClient(t *testing.T) (productspb.ProductServiceClient, *Server, *rest.Server) {
+	t.Helper()
+	return newRepositoryTestClient(t, database.NewMemoryRepository())
+}
+
+// newRepositoryTestClient serves the products of the repository given in memory
+func newRepositoryTestClient(t *testing.T, repository database.ProductRepository) (productspb.ProductServiceClient,
+	*Server, *rest.Server) {
+
+	t.Helper()
+	products, productsErr := rest.New(repository, database.NewMemoryRepository(), nil)
+	if productsErr != nil {
+		t.Fatalf("REST server creation failed: %s", productsErr.Error())
+	}
+
+	server := New(repository, products)
+	listener := bufconn.Listen(1 << 20)
+	server.serve(listener)
+	t.Cleanup(func() { server.Shutdown(time.Second) })
+
+	conn, connErr := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if connErr != nil {
+		t.Fatal(connErr)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &testClient{ProductServiceClient: productspb.NewProductServiceClient(conn), conn: conn}, server, products
+}
+
+func expectCode(t *testing.T, err error, expected codes.Code) {
+	t.Helper()
+	if code := status.Code(err); code != expected {
+		t.Fatalf("expected %s, got %s (%v)", expected, code, err)
+	}
+}
+
+func expectEvent(t *testing.T, stream productspb.ProductService_WatchProductsClient,
+	expectedType productspb.ProductEvent_Type, expectedProductId int64) *productspb.ProductEvent {
+
+	t.Helper()
+	event, err := stream.Recv()
+	if err != nil || event.GetType() != expectedType || event.GetProductId() != expectedProductId {
+		t.Fatalf("expected %s of %d, got %v (%v)", expectedType, expectedProductId, event, err)
+	}
+	return event
+}
+
+func sha256Hex(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,161 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/shopspring/decimal"
+	"github.com/uber/jaeger-client-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/bygui86/go-k8s-probes/database"
+	"github.com/bygui86/go-k8s-probes/logging"
+	"github.com/bygui86/go-k8s-probes/rest"
+	"github.com/bygui86/go-k8s-probes/rpc/productspb"
+)
+
+const internalErrorDetail = "Unexpected error, look for the trace ID in the logs"
+
+var eventTypes = map[string]productspb.ProductEvent_Type{
+	rest.EventCreated:  productspb.ProductEvent_TYPE_CREATED,
+	rest.EventUpdated:  productspb.ProductEvent_TYPE_UPDATED,
+	rest.EventDeleted:  productspb.ProductEvent_TYPE_DELETED,
+	rest.EventRestored: productspb.ProductEvent_TYPE_RESTORED,
+	rest.EventReset:    productspb.ProductEvent_TYPE_RESET,
+}
+
+func productToProto(product *database.Product) *productspb.Product {
+	message := &productspb.Product{
+		Id:        int64(product.ID),
+		Name:      product.Name,
+		Price:     product.Price.String(),
+		Currency:  product.Currency,
+		Version:   int64(product.Version),
+		UpdatedAt: timestamppb.New(product.UpdatedAt),
+	}
+	if product.DeletedAt != nil {
+		message.DeletedAt = timestamppb.New(*product.DeletedAt)
+	}
+	return message
+}
+
+// productFromProto returns the name, price and currency of the product, the other fields are set by the server
+func productFromProto(message *productspb.Product) (*database.Product, error) {
+	if message == nil {
+		return nil, errors.New("product required")
+	}
+	price, priceErr := decimal.NewFromString(message.GetPrice())
+	if priceErr != nil {
+		return nil, errors.New("invalid price, must be a decimal number")
+	}
+	return &database.Product{
+		Name:     message.GetName(),
+		Price:    price,
+		Currency: message.GetCurrency(),
+	}, nil
+}
+
+func eventToProto(event *rest.ProductEvent) *productspb.ProductEvent {
+	message := &productspb.ProductEvent{
+		Id:        event.ID,
+		Type:      eventTypes[event.Type],
+		ProductId: int64(event.ProductID),
+	}
+	if event.Product != nil {
+		message.Product = productToProto(event.Product)
+	}
+	return message
+}
+
+func (s *Server) productsQueryFromProto(request *productspb.ListProductsRequest) (*database.ProductsQuery, error) {
+	query := &database.ProductsQuery{
+		Limit:          s.config.defaultPageSize,
+		Cursor:         request.GetPageToken(),
+		WithTotal:      request.GetWithTotal(),
+		NamePrefix:     request.GetNamePrefix(),
+		Search:         request.GetSearch(),
+		IncludeDeleted: request.GetIncludeDeleted(),
+	}
+
+	if pageSize := int(request.GetPageSize()); pageSize != 0 {
+		if pageSize < 1 || pageSize > s.config.maxPageSize {
+			return nil, fmt.Errorf("invalid page_size, must be between 1 and %d", s.config.maxPageSize)
+		}
+		query.Limit = pageSize
+	}
+
+	var priceErr error
+	query.MinPrice, priceErr = parsePrice(request.GetMinPrice(), "min_price")
+	if priceErr != nil {
+		return nil, priceErr
+	}
+	query.MaxPrice, priceErr = parsePrice(request.GetMaxPrice(), "max_price")
+	if priceErr != nil {
+		return nil, priceErr
+	}
+	if query.MinPrice != nil && query.MaxPrice != nil && query.MinPrice.GreaterThan(*query.MaxPrice) {
+		return nil, errors.New("invalid price range, min_price greater than max_price")
+	}
+
+	if request.GetSort() != "" {
+		sortFields, sortErr := database.ParseSort(request.GetSort())
+		if sortErr != nil {
+			return nil, errors.New("invalid sort, must be a comma-separated list of id, name, price, each optionally prefixed by -")
+		}
+		query.Sort = sortFields
+	}
+	return query, nil
+}
+
+func parsePrice(value, field string) (*decimal.Decimal, error) {
+	if value == "" {
+		return nil, nil
+	}
+	price, priceErr := decimal.NewFromString(value)
+	if priceErr != nil {
+		return nil, fmt.Errorf("invalid %s, must be a decimal number", field)
+	}
+	return &price, nil
+}
+
+// codeFromError maps repository errors to gRPC status codes
+func codeFromError(err error) codes.Code {
+	switch {
+	case err == database.ErrProductNotFound:
+		return codes.NotFound
+	case err == database.ErrVersionMismatch:
+		return codes.FailedPrecondition
+	case err == database.ErrInvalidCursor, err == database.ErrInvalidSort,
+		errors.As(err, new(*database.ValidationError)):
+		return codes.InvalidArgument
+	default:
+		return codes.Internal
+	}
+}
+
+// failed tags the span with the error, returned as gRPC status.
+// Internal errors are logged along with the trace ID instead, not to leak DB details to clients, as the REST API does.
+func failed(span opentracing.Span, code codes.Code, errMsg string) error {
+	span.SetTag("error", errMsg)
+	span.LogKV("error", errMsg)
+	if code == codes.Internal {
+		traceId := traceIdFromSpan(span)
+		logging.SugaredLog.Errorf("%s (trace ID %s)", errMsg, traceId)
+		if traceId == "" {
+			return status.Error(code, internalErrorDetail)
+		}
+		return status.Error(code, fmt.Sprintf("%s (trace ID %s)", internalErrorDetail, traceId))
+	}
+	return status.Error(code, errMsg)
+}
+
+func traceIdFromSpan(span opentracing.Span) string {
+	spanContext, ok := span.Context().(jaeger.SpanContext)
+	if !ok {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
@@ -3,6 +3,7 @@ package utils
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 func GetStringEnv(key, fallback string) string {
@@ -33,3 +34,18 @@ func GetBoolEnv(key string, fallback bool) bool {
 	}
 	return fallback
 }
+
+// GetStringSliceEnv splits a comma-separated value, ignoring blank items
+func GetStringSliceEnv(key string, fallback []string) []string {
+	if strValue, ok := os.LookupEnv(key); ok {
+		values := make([]string, 0)
+		for _, item := range strings.Split(strValue, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				values = append(values, item)
+			}
+		}
+		return values
+	}
+	return fallback
+}